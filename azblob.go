@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const azureStorageVersion = "2019-12-12"
+
+// AzureBlobClient is minimal Azure Blob Storage REST API client, supporting only operations needed by Gor
+//
+// Storage account is read from AZURE_STORAGE_ACCOUNT environment variable,
+// and requests are authorized using Shared Access Signature from AZURE_STORAGE_SAS_TOKEN.
+// Set AZURE_STORAGE_ENDPOINT to use custom endpoint, for example local emulator.
+type AzureBlobClient struct {
+	endpoint string
+	sasToken url.Values
+	client   *http.Client
+}
+
+// NewAzureBlobClient constructor for AzureBlobClient
+func NewAzureBlobClient() *AzureBlobClient {
+	endpoint := os.Getenv("AZURE_STORAGE_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://" + os.Getenv("AZURE_STORAGE_ACCOUNT") + ".blob.core.windows.net"
+	}
+
+	sas, _ := url.ParseQuery(strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?"))
+
+	return &AzureBlobClient{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		sasToken: sas,
+		client:   &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// parseAzureBlobPath splits `azblob://container/name` to container and blob name
+func parseAzureBlobPath(blobPath string) (container, name string) {
+	blobPath = strings.TrimPrefix(blobPath, "azblob://")
+
+	if idx := strings.IndexByte(blobPath, '/'); idx != -1 {
+		return blobPath[:idx], blobPath[idx+1:]
+	}
+
+	return blobPath, ""
+}
+
+// azureBlobResource returns escaped path of blob. Slashes in blob name are kept, since they separate virtual directories.
+func azureBlobResource(container, name string) string {
+	segments := strings.Split(name, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+
+	return "/" + url.PathEscape(container) + "/" + strings.Join(segments, "/")
+}
+
+func (c *AzureBlobClient) do(method, resource string, query url.Values, headers http.Header) (*http.Response, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+
+	for k, v := range c.sasToken {
+		query[k] = v
+	}
+
+	req, err := http.NewRequest(method, c.endpoint+resource+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("x-ms-version", azureStorageVersion)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("Azure Blob %s %s: %s %s", method, resource, resp.Status, msg)
+	}
+
+	return resp, nil
+}
+
+type azureBlob struct {
+	Name       string `xml:"Name"`
+	Properties struct {
+		ContentLength int64 `xml:"Content-Length"`
+	} `xml:"Properties"`
+}
+
+type azureListResult struct {
+	Blobs      []azureBlob `xml:"Blobs>Blob"`
+	NextMarker string      `xml:"NextMarker"`
+}
+
+// List returns all blobs in container with given prefix
+func (c *AzureBlobClient) List(container, prefix string) (blobs []azureBlob, err error) {
+	marker := ""
+
+	for {
+		q := url.Values{}
+		q.Set("restype", "container")
+		q.Set("comp", "list")
+		q.Set("prefix", prefix)
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+
+		resp, err := c.do("GET", "/"+url.PathEscape(container), q, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result azureListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		blobs = append(blobs, result.Blobs...)
+
+		if result.NextMarker == "" {
+			return blobs, nil
+		}
+
+		marker = result.NextMarker
+	}
+}
+
+// Glob returns blobs matching `azblob://container/pattern` path, where pattern uses path.Match syntax
+func (c *AzureBlobClient) Glob(blobPath string) (blobs []azureBlob, err error) {
+	container, pattern := parseAzureBlobPath(blobPath)
+
+	all, err := c.List(container, globPrefix(pattern))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, blob := range all {
+		if matched, _ := path.Match(pattern, blob.Name); matched {
+			blobs = append(blobs, blob)
+		}
+	}
+
+	return blobs, nil
+}
+
+// OpenRange returns body of blob bytes in [start, end] range
+func (c *AzureBlobClient) OpenRange(container, name string, start, end int64) (io.ReadCloser, error) {
+	headers := http.Header{}
+	headers.Set("x-ms-range", "bytes="+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(end, 10))
+
+	resp, err := c.do("GET", azureBlobResource(container, name), nil, headers)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// azureBlobStorage implements fileStorage for `azblob://container/name` paths
+type azureBlobStorage struct {
+	client *AzureBlobClient
+	sizes  map[string]int64
+}
+
+func newAzureBlobStorage() *azureBlobStorage {
+	return &azureBlobStorage{client: NewAzureBlobClient(), sizes: make(map[string]int64)}
+}
+
+func (s *azureBlobStorage) Glob(pattern string) (matches []string, err error) {
+	blobs, err := s.client.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	container, _ := parseAzureBlobPath(pattern)
+
+	for _, blob := range blobs {
+		name := "azblob://" + container + "/" + blob.Name
+		s.sizes[name] = blob.Properties.ContentLength
+		matches = append(matches, name)
+	}
+
+	return matches, nil
+}
+
+func (s *azureBlobStorage) Open(name string) (io.ReadCloser, error) {
+	container, blob := parseAzureBlobPath(name)
+
+	return newRangeReader(name, s.sizes[name], func(start, end int64) (io.ReadCloser, error) {
+		return s.client.OpenRange(container, blob, start, end)
+	}), nil
+}
+
+func (s *azureBlobStorage) Size(name string) int64 {
+	return s.sizes[name]
+}
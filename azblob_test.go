@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestInputFileAzureBlob(t *testing.T) {
+	var file1, file2 bytes.Buffer
+	file1.Write([]byte("1 1 1\ntest1"))
+	file1.Write([]byte(payloadSeparator))
+	file1.Write([]byte("1 1 3\ntest3"))
+	file1.Write([]byte(payloadSeparator))
+
+	file2.Write([]byte("1 1 2\ntest2"))
+	file2.Write([]byte(payloadSeparator))
+
+	blobs := map[string][]byte{
+		"2016/requests_0.gor": file1.Bytes(),
+		"2016/requests_1.gor": file2.Bytes(),
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sig") != "secret" {
+			w.WriteHeader(403)
+			return
+		}
+
+		if r.URL.Query().Get("comp") == "list" {
+			fmt.Fprint(w, "<EnumerationResults><Blobs>")
+			for k, v := range blobs {
+				if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+					fmt.Fprintf(w, "<Blob><Name>%s</Name><Properties><Content-Length>%d</Content-Length></Properties></Blob>", k, len(v))
+				}
+			}
+			fmt.Fprint(w, "</Blobs><NextMarker/></EnumerationResults>")
+			return
+		}
+
+		data, ok := blobs[strings.TrimPrefix(r.URL.Path, "/container/")]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+
+		var start, end int
+		fmt.Sscanf(r.Header.Get("x-ms-range"), "bytes=%d-%d", &start, &end)
+		w.WriteHeader(206)
+		w.Write(data[start : end+1])
+	}))
+	defer server.Close()
+
+	os.Setenv("AZURE_STORAGE_ENDPOINT", server.URL)
+	os.Setenv("AZURE_STORAGE_SAS_TOKEN", "?sv=2019-12-12&sig=secret")
+	defer os.Unsetenv("AZURE_STORAGE_ENDPOINT")
+	defer os.Unsetenv("AZURE_STORAGE_SAS_TOKEN")
+
+	input := NewFileInput("azblob://container/2016/*", &FileInputConfig{})
+	buf := make([]byte, 1000)
+
+	for i := '1'; i <= '3'; i++ {
+		n, _ := input.Read(buf)
+		if buf[n-1] != byte(i) {
+			t.Error("Should emit requests in right order", string(buf[:n]))
+		}
+	}
+}
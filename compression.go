@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	lz4Magic  = []byte{0x04, 0x22, 0x4d, 0x18}
+)
+
+// newDecompressor detects compression by content instead of extension, because remote objects not always have proper names.
+// Supports gzip, zstd and lz4 frame formats. Returns nil if data is not compressed.
+func newDecompressor(r *bufio.Reader) (io.ReadCloser, error) {
+	magic, _ := r.Peek(4)
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(r)
+	case bytes.HasPrefix(magic, zstdMagic):
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case bytes.HasPrefix(magic, lz4Magic):
+		return ioutil.NopCloser(&lz4FramesReader{src: r, zr: lz4.NewReader(r)}), nil
+	}
+
+	return nil, nil
+}
+
+// lz4FramesReader reads concatenated lz4 frames as a single stream, like gzip reader does with gzip members.
+// Frames are concatenated when output file is appended or indexed.
+type lz4FramesReader struct {
+	src *bufio.Reader
+	zr  *lz4.Reader
+}
+
+func (r *lz4FramesReader) Read(p []byte) (n int, err error) {
+	for {
+		// Previous frame is finished, check if the next one follows
+		if r.zr == nil {
+			if magic, _ := r.src.Peek(4); !bytes.Equal(magic, lz4Magic) {
+				return 0, io.EOF
+			}
+			r.zr = lz4.NewReader(r.src)
+		}
+
+		n, err = r.zr.Read(p)
+		if err != io.EOF {
+			return
+		}
+
+		r.zr = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// compressedFileExt checks if file should be compressed, based on its extension: .gz, .zst or .lz4
+func compressedFileExt(name string) bool {
+	_, ok := compressionExts[filepath.Ext(name)]
+	return ok
+}
+
+// Compression algorithms, set by --output-file-compression
+const (
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+	compressionLZ4  = "lz4"
+	compressionNone = "none"
+)
+
+var compressionExts = map[string]string{
+	".gz":  compressionGzip,
+	".zst": compressionZstd,
+	".lz4": compressionLZ4,
+}
+
+// validCompression checks value of --output-file-compression
+func validCompression(compression string) bool {
+	switch compression {
+	case "", compressionGzip, compressionZstd, compressionLZ4, compressionNone:
+		return true
+	}
+
+	return false
+}
+
+// fileCompression returns compression algorithm set explicitly, or picked by file extension.
+// Returns empty string if file should not be compressed.
+func fileCompression(name, compression string) string {
+	switch compression {
+	case compressionNone:
+		return ""
+	case "":
+		return compressionExts[filepath.Ext(name)]
+	}
+
+	return compression
+}
+
+// newCompressor returns writer which compresses data using given algorithm.
+// Level is algorithm specific: 1-9 for gzip and lz4, 1-22 for zstd. 0 means default level.
+func newCompressor(compression string, level int, w io.Writer) io.WriteCloser {
+	switch compression {
+	case compressionGzip:
+		if level != 0 {
+			if gz, err := gzip.NewWriterLevel(w, level); err == nil {
+				return gz
+			}
+		}
+		return gzip.NewWriter(w)
+	case compressionZstd:
+		var opts []zstd.EOption
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		e, _ := zstd.NewWriter(w, opts...)
+		return e
+	case compressionLZ4:
+		l := lz4.NewWriter(w)
+		if level > 0 && level <= 9 {
+			l.Apply(lz4.CompressionLevelOption(lz4.CompressionLevel(1 << uint(8+level))))
+		}
+		return l
+	}
+
+	return nil
+}
+
+// multiCloser closes decompressor together with underlying file
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	for _, c := range m {
+		c.Close()
+	}
+
+	return nil
+}
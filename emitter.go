@@ -3,11 +3,29 @@ package main
 import (
 	"bytes"
 	"io"
+	"log"
 	"time"
 )
 
 // Start initialize loop for sending data from inputs to outputs
 func Start(stop chan int) {
+	finished := make(chan bool, len(Plugins.Inputs))
+	activeInputs := 0
+
+	outputs := Plugins.Outputs
+	if Settings.splitOutputWeights != "" {
+		splitter, err := newOutputSplitter(Settings.splitOutputWeights, Settings.splitOutputHashHeader, Plugins.Outputs)
+		if err != nil {
+			log.Fatal("[EMITTER] ", err)
+		}
+
+		for i, out := range Plugins.Outputs {
+			log.Printf("[EMITTER] Output %v gets weight %d", out, splitter.weights[i])
+		}
+
+		outputs = []io.Writer{splitter}
+	}
+
 	if Settings.middleware != "" {
 		middleware := NewMiddleware(Settings.middleware)
 
@@ -17,15 +35,36 @@ func Start(stop chan int) {
 
 		// We are going only to read responses, so using same ReadFrom method
 		for _, out := range Plugins.Outputs {
-			if r, ok := out.(io.Reader); ok {
+			if r, ok := outputReader(out); ok {
 				middleware.ReadFrom(r)
 			}
 		}
 
-		go CopyMulty(middleware, Plugins.Outputs...)
+		go CopyMulty(middleware, outputs...)
 	} else {
 		for _, in := range Plugins.Inputs {
-			go CopyMulty(in, Plugins.Outputs...)
+			go func(in io.Reader) {
+				CopyMulty(in, outputs...)
+				finished <- true
+			}(in)
+		}
+
+		activeInputs = len(Plugins.Inputs)
+
+		// Replayed responses are passed to other outputs, like file or Kafka, linked to request by id
+		if Settings.outputHTTPTrackResponse {
+			for _, out := range Plugins.Outputs {
+				if r, ok := outputReader(out); ok {
+					var dst []io.Writer
+					for _, o := range Plugins.Outputs {
+						if o != out {
+							dst = append(dst, o)
+						}
+					}
+
+					go CopyMulty(r, dst...)
+				}
+			}
 		}
 	}
 
@@ -34,11 +73,32 @@ func Start(stop chan int) {
 		case <-stop:
 			finalize()
 			return
+		case <-finished:
+			// Inputs like file input with loop count can be finished
+			activeInputs--
+			if activeInputs == 0 {
+				log.Println("All inputs finished, stopping gor")
+				finalize()
+				return
+			}
 		case <-time.After(100 * time.Millisecond):
 		}
 	}
 }
 
+// outputReader returns reader of responses, if output emits them. Limiter is always io.Reader,
+// so limited output is readable only if plugin it wraps is.
+func outputReader(out io.Writer) (io.Reader, bool) {
+	if l, ok := out.(*Limiter); ok {
+		if _, ok := l.plugin.(io.Reader); !ok {
+			return nil, false
+		}
+	}
+
+	r, ok := out.(io.Reader)
+	return r, ok
+}
+
 // CopyMulty copies from 1 reader to multiple writers
 func CopyMulty(src io.Reader, writers ...io.Writer) (err error) {
 	buf := make([]byte, 5*1024*1024)
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/gor/proto"
+)
+
+// Routes of requests, which responses were not seen, are forgotten after this time
+const splitRouteExpire = 60 * time.Second
+
+// outputSplitter sends each request to one of outputs, in proportion to their weights, like 90% to production
+// replay and 10% to canary. Output is chosen by consistent hash of header, or of request id if header is not set
+// or missing, so requests with the same key always go to the same output. Responses follow their requests.
+//
+// Splitter is shared by copies from all inputs, so responses follow requests, even if they come from different input.
+type outputSplitter struct {
+	outputs []io.Writer
+	weights []int
+	// Cumulative weights, request with hash bucket below bounds[i] goes to output i
+	bounds []uint32
+	total  uint32
+	header []byte
+
+	// Outputs chosen by header, so responses which have no such header can follow requests
+	mu        sync.Mutex
+	routes    map[string]splitRoute
+	lastClean time.Time
+}
+
+type splitRoute struct {
+	output int
+	at     time.Time
+}
+
+// parseSplitWeights parses comma separated weights, like `90,10`
+func parseSplitWeights(s string) (weights []int, err error) {
+	for _, w := range strings.Split(s, ",") {
+		weight, err := strconv.Atoi(strings.TrimSpace(w))
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("Wrong output weight: %q", w)
+		}
+		weights = append(weights, weight)
+	}
+
+	return weights, nil
+}
+
+// newOutputSplitter constructor for outputSplitter, number of weights should match number of outputs
+func newOutputSplitter(weights string, header string, outputs []io.Writer) (*outputSplitter, error) {
+	ws, err := parseSplitWeights(weights)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ws) != len(outputs) {
+		return nil, fmt.Errorf("Expected %d output weights, got %d", len(outputs), len(ws))
+	}
+
+	s := &outputSplitter{outputs: outputs, weights: ws, header: []byte(header), routes: make(map[string]splitRoute), lastClean: time.Now()}
+
+	for _, w := range ws {
+		s.total += uint32(w)
+		s.bounds = append(s.bounds, s.total)
+	}
+
+	if s.total == 0 {
+		return nil, errors.New("At least one output weight should be positive")
+	}
+
+	return s, nil
+}
+
+// Write sends payload to output chosen for it
+func (s *outputSplitter) Write(data []byte) (int, error) {
+	return s.outputs[s.pick(data)].Write(data)
+}
+
+func (s *outputSplitter) String() string {
+	return fmt.Sprintf("Split of outputs %v by weights %v", s.outputs, s.weights)
+}
+
+// pick returns index of output for payload
+func (s *outputSplitter) pick(payload []byte) int {
+	id := string(payloadMeta(payload)[1])
+
+	if len(s.header) == 0 {
+		return s.bucket([]byte(id))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !isRequestPayload(payload) {
+		if route, ok := s.routes[id]; ok {
+			delete(s.routes, id)
+			return route.output
+		}
+		return s.bucket([]byte(id))
+	}
+
+	key := proto.Header(payloadBody(payload), s.header)
+	if len(key) == 0 {
+		return s.bucket([]byte(id))
+	}
+
+	output := s.bucket(key)
+	now := time.Now()
+	s.routes[id] = splitRoute{output, now}
+
+	if now.Sub(s.lastClean) > splitRouteExpire {
+		for k, v := range s.routes {
+			if now.Sub(v.at) > splitRouteExpire {
+				delete(s.routes, k)
+			}
+		}
+		s.lastClean = now
+	}
+
+	return output
+}
+
+func (s *outputSplitter) bucket(key []byte) int {
+	h := fnv.New32a()
+	h.Write(key)
+	b := h.Sum32() % s.total
+
+	for i, bound := range s.bounds {
+		if b < bound {
+			return i
+		}
+	}
+
+	return len(s.bounds) - 1
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -118,6 +120,138 @@ func TestEmitterRoundRobin(t *testing.T) {
 	Settings.splitOutput = false
 }
 
+func TestEmitterWeightedSplit(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	quit := make(chan int)
+
+	input := NewTestInput()
+	input.skipHeader = true
+
+	var mu sync.Mutex
+	// Outputs, which got requests and responses by user
+	users := make(map[string]map[int]bool)
+	var counts [2]int
+
+	var outputs []io.Writer
+	for i := range counts {
+		i := i
+		outputs = append(outputs, NewTestOutput(func(data []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			user := string(data[len(data)-1:])
+			if users[user] == nil {
+				users[user] = make(map[int]bool)
+			}
+			users[user][i] = true
+			counts[i]++
+
+			wg.Done()
+		}))
+	}
+
+	Plugins.Inputs = []io.Reader{input}
+	Plugins.Outputs = outputs
+
+	Settings.splitOutputWeights = "90,10"
+	Settings.splitOutputHashHeader = "X-User"
+	defer func() {
+		Settings.splitOutputWeights = ""
+		Settings.splitOutputHashHeader = ""
+	}()
+
+	go Start(quit)
+
+	for i := 0; i < 2000; i++ {
+		// Last byte of payload is user, responses don't have user header
+		user := string(rune('a' + i%20))
+		id := uuid()
+
+		wg.Add(2)
+		input.EmitBytes(append(payloadHeader(RequestPayload, id, time.Now().UnixNano(), -1), "GET / HTTP/1.1\r\nX-User: "+user+"\r\n\r\n"+user...))
+		input.EmitBytes(append(payloadHeader(ResponsePayload, id, time.Now().UnixNano(), 1), "HTTP/1.1 200 OK\r\n\r\n"+user...))
+	}
+
+	wg.Wait()
+	close(quit)
+
+	for user, got := range users {
+		if len(got) != 1 {
+			t.Error("Requests and responses of user should go to the same output", user, got)
+		}
+	}
+
+	// 20 users are split, so ratio is not exact
+	if counts[0] <= counts[1] || counts[1] == 0 {
+		t.Error("Traffic should be split by weights", counts)
+	}
+
+	// Without header requests are split by id
+	splitter, _ := newOutputSplitter("90,10", "", make([]io.Writer, 2))
+	var byID [2]int
+	for i := 0; i < 10000; i++ {
+		byID[splitter.pick(append(payloadHeader(RequestPayload, uuid(), 1, -1), "GET / HTTP/1.1\r\n\r\n"...))]++
+	}
+
+	if byID[1] < 800 || byID[1] > 1200 {
+		t.Error("Traffic should be split by weights", byID)
+	}
+}
+
+func TestNewOutputSplitter(t *testing.T) {
+	for _, weights := range []string{"90", "90,x", "90,-10", "0,0"} {
+		if _, err := newOutputSplitter(weights, "", make([]io.Writer, 2)); err == nil {
+			t.Error("Should reject weights", weights)
+		}
+	}
+}
+
+func TestEmitterReplayedResponses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	quit := make(chan int)
+	input := NewTestInput()
+
+	Settings.outputHTTPTrackResponse = true
+	defer func() { Settings.outputHTTPTrackResponse = false }()
+
+	received := make(chan []byte, 10)
+	output := NewTestOutput(func(data []byte) {
+		received <- append([]byte(nil), data...)
+	})
+
+	Plugins.Inputs = []io.Reader{input}
+	// Limited output which can't be read, like limited file output, only receives responses
+	Plugins.Outputs = []io.Writer{NewHTTPOutput(server.URL, &HTTPOutputConfig{Timeout: time.Second, TrackResponses: true}), NewLimiter(output, "100%")}
+
+	go Start(quit)
+	defer close(quit)
+
+	input.EmitGET()
+
+	var requestID []byte
+	for i := 0; i < 2; i++ {
+		select {
+		case data := <-received:
+			switch data[0] {
+			case RequestPayload:
+				requestID = payloadMeta(data)[1]
+			case ReplayedResponsePayload:
+				if requestID != nil && string(payloadMeta(data)[1]) != string(requestID) {
+					t.Error("Replayed response should have id of request")
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Replayed response should be passed to other outputs")
+		}
+	}
+
+	if !isStoredPayload([]byte("3 1 1 1\nHTTP/1.1 200 OK\r\n\r\n")) {
+		t.Error("Replayed response should be stored by file output")
+	}
+}
+
 func BenchmarkEmitter(b *testing.B) {
 	wg := new(sync.WaitGroup)
 	quit := make(chan int)
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// Encrypted file starts with magic header, followed by records:
+//
+//	length (4 bytes, big endian) | flags (1 byte) | nonce (12 bytes) | AES-GCM sealed data of given length
+//
+// Record number and flags are authenticated as additional data, so records can't be reordered,
+// and last record is marked as final, so truncated files are detected.
+// Files written in append mode may contain multiple such streams one after another.
+var encryptionMagic = []byte("GORENC\x00\x01")
+
+// Stream encrypted with data key from key management service starts with its own magic, followed by
+// envelope header (see envelopeHeader) with encrypted data key. Records are the same.
+var envelopeMagic = []byte("GORENC\x00\x02")
+
+const (
+	// Max size of plain data in a single record
+	encryptionRecordSize = 64 * 1024
+	// Size of record header: length, flags and nonce
+	encryptionHeaderSize = 4 + 1 + 12
+	encryptionFlagFinal  = 1
+)
+
+// encryptionKeyVar loads AES key from file set by flag. File should contain 16, 24 or 32 bytes key, raw or hex encoded.
+type encryptionKeyVar []byte
+
+func (k *encryptionKeyVar) String() string {
+	// Do not print the key
+	return ""
+}
+
+func (k *encryptionKeyVar) Set(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	key := data
+	if decoded, err := hex.DecodeString(string(bytes.TrimSpace(data))); err == nil {
+		key = decoded
+	}
+
+	if _, err := aes.NewCipher(key); err != nil {
+		return errors.New("Encryption key should be 16, 24 or 32 bytes: " + path)
+	}
+
+	*k = key
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// recordAdditionalData binds record to its position in stream
+func recordAdditionalData(counter uint64, flags byte) []byte {
+	ad := make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, counter)
+	ad[8] = flags
+
+	return ad
+}
+
+// encryptWriter encrypts data written to it. Data is sealed by records, on Flush or when record is full.
+type encryptWriter struct {
+	w io.Writer
+	// Written at the start of stream
+	header  []byte
+	gcm     cipher.AEAD
+	buf     []byte
+	counter uint64
+	started bool
+}
+
+func newEncryptWriter(w io.Writer, key []byte) (*encryptWriter, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{w: w, header: encryptionMagic, gcm: gcm, buf: make([]byte, 0, encryptionRecordSize)}, nil
+}
+
+// newEnvelopeEncryptWriter encrypts data with data key from key management service
+func newEnvelopeEncryptWriter(w io.Writer, key *envelopeKey) (*encryptWriter, error) {
+	plain, header, err := key.get()
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := newEncryptWriter(w, plain)
+	if err != nil {
+		return nil, err
+	}
+	e.header = header
+
+	return e, nil
+}
+
+func (e *encryptWriter) Write(data []byte) (n int, err error) {
+	for len(data) > 0 {
+		chunk := encryptionRecordSize - len(e.buf)
+		if chunk > len(data) {
+			chunk = len(data)
+		}
+
+		e.buf = append(e.buf, data[:chunk]...)
+		data = data[chunk:]
+		n += chunk
+
+		if len(e.buf) == encryptionRecordSize {
+			if err = e.seal(0); err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+func (e *encryptWriter) seal(flags byte) error {
+	if !e.started {
+		if _, err := e.w.Write(e.header); err != nil {
+			return err
+		}
+		e.started = true
+	}
+
+	record := make([]byte, encryptionHeaderSize, encryptionHeaderSize+len(e.buf)+e.gcm.Overhead())
+	record[4] = flags
+	nonce := record[5:encryptionHeaderSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	record = e.gcm.Seal(record, nonce, e.buf, recordAdditionalData(e.counter, flags))
+	binary.BigEndian.PutUint32(record, uint32(len(record)-encryptionHeaderSize))
+
+	e.counter++
+	e.buf = e.buf[:0]
+
+	_, err := e.w.Write(record)
+	return err
+}
+
+// Flush seals buffered data, so everything written so far can be decrypted
+func (e *encryptWriter) Flush() error {
+	if len(e.buf) == 0 {
+		return nil
+	}
+
+	return e.seal(0)
+}
+
+// Close seals buffered data as final record. Underlying writer is not closed.
+func (e *encryptWriter) Close() error {
+	return e.seal(encryptionFlagFinal)
+}
+
+// isEncrypted checks if data starts with encrypted stream header
+func isEncrypted(r *bufio.Reader) bool {
+	magic, _ := r.Peek(len(encryptionMagic))
+	return bytes.Equal(magic, encryptionMagic) || bytes.Equal(magic, envelopeMagic)
+}
+
+// isEnvelopeEncrypted checks if data is encrypted with key from key management service, so no key file is needed
+func isEnvelopeEncrypted(r *bufio.Reader) bool {
+	magic, _ := r.Peek(len(envelopeMagic))
+	return bytes.Equal(magic, envelopeMagic)
+}
+
+// decryptReader decrypts stream written by encryptWriter.
+// Records are read only when fully available, so file which is still written to can be read as it grows.
+type decryptReader struct {
+	r *bufio.Reader
+	// Key from key file, streams with envelope header use their own data keys
+	key     []byte
+	gcm     cipher.AEAD
+	plain   []byte
+	counter uint64
+	// Set after final record, next stream may follow in appended file
+	finished bool
+	// In watch mode file may grow, and unfinished record is not an error
+	watch bool
+}
+
+func newDecryptReader(r io.Reader, key []byte, watch bool) (*decryptReader, error) {
+	if len(key) > 0 {
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, err
+		}
+	}
+
+	// GCM tag is 16 bytes
+	size := encryptionHeaderSize + encryptionRecordSize + 16
+
+	return &decryptReader{r: bufio.NewReaderSize(r, size), key: key, finished: true, watch: watch}, nil
+}
+
+func (d *decryptReader) Read(data []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(data, d.plain)
+	d.plain = d.plain[n:]
+
+	return n, nil
+}
+
+// eof is returned when there is no complete record. Unless file can still grow, stream should end with final record.
+func (d *decryptReader) eof(err error) error {
+	if err != io.EOF {
+		return err
+	}
+
+	if d.watch || (d.finished && d.r.Buffered() == 0) {
+		return io.EOF
+	}
+
+	return errors.New("encrypted file is truncated")
+}
+
+// next decrypts next record
+func (d *decryptReader) next() error {
+	if d.finished {
+		magic, err := d.r.Peek(len(encryptionMagic))
+		if err != nil {
+			return d.eof(err)
+		}
+
+		switch {
+		case bytes.Equal(magic, encryptionMagic):
+			if len(d.key) == 0 {
+				return errors.New("file is encrypted, set --input-file-encryption-key")
+			}
+			d.r.Discard(len(magic))
+			d.gcm, _ = newGCM(d.key)
+		case bytes.Equal(magic, envelopeMagic):
+			if err = d.envelope(); err != nil {
+				return err
+			}
+		default:
+			return errors.New("wrong encrypted file header")
+		}
+
+		d.finished = false
+		d.counter = 0
+	}
+
+	header, err := d.r.Peek(encryptionHeaderSize)
+	if err != nil {
+		return d.eof(err)
+	}
+
+	size := int(binary.BigEndian.Uint32(header))
+	flags := header[4]
+
+	if size > encryptionRecordSize+d.gcm.Overhead() {
+		return errors.New("wrong encrypted record size")
+	}
+
+	record, err := d.r.Peek(encryptionHeaderSize + size)
+	if err != nil {
+		return d.eof(err)
+	}
+
+	nonce := record[5:encryptionHeaderSize]
+	plain, err := d.gcm.Open(nil, nonce, record[encryptionHeaderSize:], recordAdditionalData(d.counter, flags))
+	if err != nil {
+		return errors.New("can't decrypt file, wrong key or corrupted data")
+	}
+
+	d.r.Discard(len(record))
+	d.counter++
+	d.plain = plain
+	d.finished = flags&encryptionFlagFinal != 0
+
+	return nil
+}
+
+// envelope reads envelope header of stream, and decrypts its data key
+func (d *decryptReader) envelope() error {
+	size := len(envelopeMagic)
+	var fields [][]byte
+
+	for len(fields) < 3 {
+		header, err := d.r.Peek(size + 2)
+		if err != nil {
+			return d.eof(err)
+		}
+
+		length := int(binary.BigEndian.Uint16(header[size:]))
+		if header, err = d.r.Peek(size + 2 + length); err != nil {
+			return d.eof(err)
+		}
+
+		fields = append(fields, append([]byte(nil), header[size+2:]...))
+		size += 2 + length
+	}
+
+	key, err := decryptDataKey(string(fields[0]), string(fields[1]), fields[2])
+	if err != nil {
+		return err
+	}
+
+	if d.gcm, err = newGCM(key); err != nil {
+		return err
+	}
+	d.r.Discard(size)
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Index sidecar file, written next to chunk as `<chunk>.idx`, maps positions in chunk to file offsets.
+// Compressed stream is restarted at each index point, so reading can start right from the offset.
+const fileIndexExt = ".idx"
+
+const fileIndexHeader = "# gor index v1: requests timestamp file_offset stream_offset"
+
+// fileIndexEntry is a point in chunk, right before request
+type fileIndexEntry struct {
+	// Number of requests before this point
+	requests int
+	// Timestamp of the request at this point
+	timestamp int64
+	// Offset in file, where compressed stream restarts
+	fileOffset int64
+	// Offset in decompressed data, same as used by checkpoints
+	streamOffset int64
+}
+
+// writeFileIndex writes index of chunk. File is written under temporary name and renamed, so it is never read half-written.
+func writeFileIndex(name string, entries []fileIndexEntry) error {
+	tmp := filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	fmt.Fprintln(w, fileIndexHeader)
+	for _, e := range entries {
+		fmt.Fprintln(w, e.requests, e.timestamp, e.fileOffset, e.streamOffset)
+	}
+
+	if err = w.Flush(); err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
+
+// loadFileIndex reads index of chunk, returns nil if there is no index
+func loadFileIndex(name string) []fileIndexEntry {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var entries []fileIndexEntry
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		var e fileIndexEntry
+		if _, err := fmt.Sscan(line, &e.requests, &e.timestamp, &e.fileOffset, &e.streamOffset); err != nil {
+			Debug("[FILE-INPUT] Broken index", name, err)
+			return nil
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries
+}
+
+// findFileIndexEntry returns the last index point before checkpoint offset, given number of requests and timestamp.
+// Zero values mean no limit. Returns false if reading should start from the beginning.
+func findFileIndexEntry(entries []fileIndexEntry, offset int64, requests int, from int64) (found fileIndexEntry, ok bool) {
+	if offset == 0 && requests == 0 && from == 0 {
+		return
+	}
+
+	for _, e := range entries {
+		if (offset > 0 && e.streamOffset > offset) ||
+			(requests > 0 && e.requests > requests) ||
+			(from > 0 && e.timestamp > from) {
+			break
+		}
+
+		found, ok = e, true
+	}
+
+	return
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errFileLocked = errors.New("file is locked by another process")
+
+// lockFile is not supported on Windows
+func lockFile(file *os.File) error {
+	return nil
+}
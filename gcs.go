@@ -0,0 +1,506 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gcsEndpoint         = "https://storage.googleapis.com"
+	gcsScope            = "https://www.googleapis.com/auth/devstorage.read_write"
+	gcpMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// gcpTokenSource provides OAuth2 access tokens for Google Cloud APIs.
+//
+// Token is taken from first available source:
+//   - GOOGLE_OAUTH_ACCESS_TOKEN environment variable
+//   - service account key file pointed by GOOGLE_APPLICATION_CREDENTIALS
+//   - GCE metadata server
+//
+// If none of them available requests are made anonymously, which works for public buckets.
+type gcpTokenSource struct {
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+	// Set if metadata server is not reachable, to not wait for it on each request
+	anonymous bool
+	client    *http.Client
+}
+
+type gcpServiceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+type gcpTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func newGCPTokenSource() *gcpTokenSource {
+	return &gcpTokenSource{client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+// Token returns cached token or fetches new one if it is about to expire
+func (s *gcpTokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+
+	if s.anonymous {
+		return "", nil
+	}
+
+	if s.token != "" && time.Now().Add(time.Minute).Before(s.expiry) {
+		return s.token, nil
+	}
+
+	var resp *gcpTokenResponse
+	var err error
+
+	if keyFile := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); keyFile != "" {
+		resp, err = s.serviceAccountToken(keyFile)
+	} else {
+		resp, err = s.metadataToken()
+		if err != nil {
+			log.Println("[GCS] Can't get token from metadata server, using anonymous access:", err)
+			s.anonymous = true
+			return "", nil
+		}
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	s.token = resp.AccessToken
+	s.expiry = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+
+	return s.token, nil
+}
+
+func (s *gcpTokenSource) metadataToken() (*gcpTokenResponse, error) {
+	req, _ := http.NewRequest("GET", gcpMetadataTokenURL, nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	return s.fetchToken(req)
+}
+
+// serviceAccountToken exchanges self-signed JWT for access token
+// See: https://developers.google.com/identity/protocols/OAuth2ServiceAccount
+func (s *gcpTokenSource) serviceAccountToken(keyFile string) (*gcpTokenResponse, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var account gcpServiceAccount
+	if err = json.Unmarshal(data, &account); err != nil {
+		return nil, err
+	}
+
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, errors.New("Can't decode service account private key")
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("Service account private key should be RSA key")
+	}
+
+	now := time.Now().Unix()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   account.ClientEmail,
+		"scope": gcsScope,
+		"aud":   account.TokenURI,
+		"iat":   now,
+		"exp":   now + 3600,
+	})
+
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", unsigned+"."+base64.RawURLEncoding.EncodeToString(signature))
+
+	req, _ := http.NewRequest("POST", account.TokenURI, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return s.fetchToken(req)
+}
+
+func (s *gcpTokenSource) fetchToken(req *http.Request) (*gcpTokenResponse, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("Token request failed: %s %s", resp.Status, msg)
+	}
+
+	var token gcpTokenResponse
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// GCSClient is minimal Google Cloud Storage JSON API client, supporting only operations needed by Gor
+//
+// Set STORAGE_EMULATOR_HOST to use local emulator instead of real service.
+type GCSClient struct {
+	endpoint string
+	tokens   *gcpTokenSource
+	client   *http.Client
+}
+
+// NewGCSClient constructor for GCSClient
+func NewGCSClient() *GCSClient {
+	endpoint := gcsEndpoint
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		endpoint = host
+		if !strings.HasPrefix(endpoint, "http") {
+			endpoint = "http://" + endpoint
+		}
+	}
+
+	return &GCSClient{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		tokens:   newGCPTokenSource(),
+		client:   &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// parseGCSPath splits `gs://bucket/name` to bucket and object name
+func parseGCSPath(gspath string) (bucket, name string) {
+	gspath = strings.TrimPrefix(gspath, "gs://")
+
+	if idx := strings.IndexByte(gspath, '/'); idx != -1 {
+		return gspath[:idx], gspath[idx+1:]
+	}
+
+	return gspath, ""
+}
+
+func (c *GCSClient) do(req *http.Request) (*http.Response, error) {
+	token, err := c.tokens.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// 308 is returned by resumable upload for partially uploaded object
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusPermanentRedirect {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("GCS %s %s: %s %s", req.Method, req.URL.Path, resp.Status, msg)
+	}
+
+	return resp, nil
+}
+
+type gcsObject struct {
+	Name string `json:"name"`
+	Size int64  `json:"size,string"`
+}
+
+type gcsListResult struct {
+	Items         []gcsObject `json:"items"`
+	NextPageToken string      `json:"nextPageToken"`
+}
+
+// List returns all objects with given prefix
+func (c *GCSClient) List(bucket, prefix string) (objects []gcsObject, err error) {
+	token := ""
+
+	for {
+		q := url.Values{}
+		q.Set("prefix", prefix)
+		q.Set("fields", "items(name,size),nextPageToken")
+		if token != "" {
+			q.Set("pageToken", token)
+		}
+
+		req, err := http.NewRequest("GET", c.endpoint+"/storage/v1/b/"+url.PathEscape(bucket)+"/o?"+q.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var result gcsListResult
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, result.Items...)
+
+		if result.NextPageToken == "" {
+			return objects, nil
+		}
+
+		token = result.NextPageToken
+	}
+}
+
+// Glob returns objects matching `gs://bucket/pattern` path, where pattern uses path.Match syntax
+func (c *GCSClient) Glob(gspath string) (objects []gcsObject, err error) {
+	bucket, pattern := parseGCSPath(gspath)
+
+	all, err := c.List(bucket, globPrefix(pattern))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, obj := range all {
+		if matched, _ := path.Match(pattern, obj.Name); matched {
+			objects = append(objects, obj)
+		}
+	}
+
+	return objects, nil
+}
+
+// OpenRange returns body of object bytes in [start, end] range
+//
+// Objects are requested as they stored, without decompressive transcoding,
+// FileInput detects gzip itself.
+func (c *GCSClient) OpenRange(bucket, name string, start, end int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", c.endpoint+"/storage/v1/b/"+url.PathEscape(bucket)+"/o/"+url.PathEscape(name)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(end, 10))
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// Size of resumable upload chunk, should be multiple of 256KB
+var gcsUploadChunkSize int64 = 8 * 1024 * 1024
+
+// Upload writes object of given size, read from r, using resumable upload.
+// Object is sent by chunks, and if chunk fails, upload continues from the last byte persisted by GCS.
+func (c *GCSClient) Upload(bucket, name string, r io.ReaderAt, size int64) error {
+	q := url.Values{}
+	q.Set("uploadType", "resumable")
+	q.Set("name", name)
+
+	req, err := http.NewRequest("POST", c.endpoint+"/upload/storage/v1/b/"+url.PathEscape(bucket)+"/o?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return errors.New("GCS resumable upload: no session URL")
+	}
+
+	var offset int64
+	retries := 0
+
+	for {
+		end := offset + gcsUploadChunkSize
+		if end > size {
+			end = size
+		}
+
+		var done bool
+		var persisted int64
+		if done, persisted, err = c.uploadChunk(session, io.NewSectionReader(r, offset, end-offset), offset, end, size); err == nil {
+			if done {
+				return nil
+			}
+			// Server can persist only part of the chunk, rest is sent again
+			offset = persisted
+			retries = 0
+			continue
+		}
+
+		if retries++; retries > storageMaxRetries {
+			return err
+		}
+
+		log.Println("[GCS] Error while uploading", name, ", resuming:", err)
+		time.Sleep(time.Duration(retries) * time.Second)
+
+		// Ask how much data was persisted, and continue from there
+		if done, offset, err = c.uploadStatus(session, size); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// uploadChunk sends [start, end) bytes of object, and returns true if upload is finished,
+// or offset of the first byte not yet persisted
+func (c *GCSClient) uploadChunk(session string, body io.Reader, start, end, size int64) (done bool, offset int64, err error) {
+	req, err := http.NewRequest("PUT", session, body)
+	if err != nil {
+		return false, 0, err
+	}
+
+	req.ContentLength = end - start
+	if size == 0 {
+		req.Header.Set("Content-Range", "bytes */0")
+	} else {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, size))
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return false, 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPermanentRedirect {
+		return true, size, nil
+	}
+
+	return false, gcsPersistedOffset(resp), nil
+}
+
+// uploadStatus returns offset of the first byte not yet persisted in resumable upload
+func (c *GCSClient) uploadStatus(session string, size int64) (done bool, offset int64, err error) {
+	req, err := http.NewRequest("PUT", session, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	req.Header.Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+
+	resp, err := c.do(req)
+	if err != nil {
+		return false, 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPermanentRedirect {
+		return true, size, nil
+	}
+
+	return false, gcsPersistedOffset(resp), nil
+}
+
+// gcsPersistedOffset returns offset after last persisted byte, from `Range: bytes=0-N` header of 308 response.
+// Range header is missing if nothing was persisted yet.
+func gcsPersistedOffset(resp *http.Response) int64 {
+	var first, last int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Range"), "bytes=%d-%d", &first, &last); err == nil {
+		return last + 1
+	}
+
+	return 0
+}
+
+// gcsStorage implements fileStorage for `gs://bucket/name` paths
+type gcsStorage struct {
+	client *GCSClient
+	sizes  map[string]int64
+}
+
+func newGCSStorage() *gcsStorage {
+	return &gcsStorage{client: NewGCSClient(), sizes: make(map[string]int64)}
+}
+
+func (s *gcsStorage) Glob(pattern string) (matches []string, err error) {
+	objects, err := s.client.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket, _ := parseGCSPath(pattern)
+
+	for _, obj := range objects {
+		name := "gs://" + bucket + "/" + obj.Name
+		s.sizes[name] = obj.Size
+		matches = append(matches, name)
+	}
+
+	return matches, nil
+}
+
+func (s *gcsStorage) Open(name string) (io.ReadCloser, error) {
+	bucket, object := parseGCSPath(name)
+
+	return newRangeReader(name, s.sizes[name], func(start, end int64) (io.ReadCloser, error) {
+		return s.client.OpenRange(bucket, object, start, end)
+	}), nil
+}
+
+func (s *gcsStorage) Size(name string) int64 {
+	return s.sizes[name]
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInputFileGCS(t *testing.T) {
+	var plain, compressed bytes.Buffer
+	plain.Write([]byte("1 1 1\ntest1"))
+	plain.Write([]byte(payloadSeparator))
+	plain.Write([]byte("1 1 3\ntest3"))
+	plain.Write([]byte(payloadSeparator))
+
+	// Object without .gz suffix, compression should be detected from content
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("1 1 2\ntest2"))
+	gz.Write([]byte(payloadSeparator))
+	gz.Close()
+
+	objects := map[string][]byte{
+		"logs/requests_0": plain.Bytes(),
+		"logs/requests_1": compressed.Bytes(),
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(401)
+			return
+		}
+
+		if r.URL.Path == "/storage/v1/b/bucket/o" {
+			var items []string
+			for k, v := range objects {
+				if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+					items = append(items, fmt.Sprintf(`{"name":"%s","size":"%d"}`, k, len(v)))
+				}
+			}
+			fmt.Fprintf(w, `{"items":[%s]}`, strings.Join(items, ","))
+			return
+		}
+
+		name := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/bucket/o/")
+		data, ok := objects[name]
+		if !ok || r.URL.Query().Get("alt") != "media" {
+			w.WriteHeader(404)
+			return
+		}
+
+		var start, end int
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+		w.WriteHeader(206)
+		w.Write(data[start : end+1])
+	}))
+	defer server.Close()
+
+	os.Setenv("STORAGE_EMULATOR_HOST", server.URL)
+	os.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "token")
+	defer os.Unsetenv("STORAGE_EMULATOR_HOST")
+	defer os.Unsetenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+
+	input := NewFileInput("gs://bucket/logs/requests_*", &FileInputConfig{})
+	buf := make([]byte, 1000)
+
+	for i := '1'; i <= '3'; i++ {
+		n, _ := input.Read(buf)
+		if buf[n-1] != byte(i) {
+			t.Error("Should emit requests in right order", string(buf[:n]))
+		}
+	}
+}
+
+// newTestGCSUploadServer emulates GCS resumable uploads, failing the first chunk after given number of bytes
+// newTestGCSUploadServer emulates resumable uploads. With failAfter, first chunk bigger than it is persisted partially
+// and fails, with persistLimit server persists at most that many bytes of each chunk.
+func newTestGCSUploadServer(objects map[string][]byte, failAfter, persistLimit int) *httptest.Server {
+	sessions := make(map[string][]byte)
+	names := make(map[string]string)
+	var server *httptest.Server
+
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && r.URL.Path == "/upload/storage/v1/b/bucket/o" {
+			if r.URL.Query().Get("uploadType") != "resumable" {
+				w.WriteHeader(400)
+				return
+			}
+
+			id := fmt.Sprint(len(names))
+			names[id] = r.URL.Query().Get("name")
+			w.Header().Set("Location", server.URL+"/session/"+id)
+			return
+		}
+
+		id := strings.TrimPrefix(r.URL.Path, "/session/")
+		if _, ok := names[id]; !ok || r.Method != "PUT" {
+			w.WriteHeader(404)
+			return
+		}
+
+		var start, end, size int
+		if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size); err != nil {
+			// Status request: report persisted bytes
+			fmt.Sscanf(r.Header.Get("Content-Range"), "bytes */%d", &size)
+			if len(sessions[id]) == size {
+				objects[names[id]] = sessions[id]
+				return
+			}
+			if len(sessions[id]) > 0 {
+				w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(sessions[id])-1))
+			}
+			w.WriteHeader(308)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		if start != len(sessions[id]) {
+			w.WriteHeader(400)
+			return
+		}
+
+		if failAfter > 0 && len(body) > failAfter {
+			// Persist only part of chunk
+			sessions[id] = append(sessions[id], body[:failAfter]...)
+			failAfter = 0
+			w.WriteHeader(503)
+			return
+		}
+
+		if persistLimit > 0 && len(body) > persistLimit {
+			body = body[:persistLimit]
+		}
+
+		sessions[id] = append(sessions[id], body...)
+		if len(sessions[id]) < size {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(sessions[id])-1))
+			w.WriteHeader(308)
+			return
+		}
+
+		objects[names[id]] = sessions[id]
+	}))
+
+	return server
+}
+
+func TestGCSUploadResumable(t *testing.T) {
+	objects := make(map[string][]byte)
+	server := newTestGCSUploadServer(objects, 10, 0)
+	defer server.Close()
+
+	os.Setenv("STORAGE_EMULATOR_HOST", server.URL)
+	os.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "token")
+	defer os.Unsetenv("STORAGE_EMULATOR_HOST")
+	defer os.Unsetenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+
+	defer func(size int64) { gcsUploadChunkSize = size }(gcsUploadChunkSize)
+	gcsUploadChunkSize = 64
+
+	data := bytes.Repeat([]byte("0123456789"), 20)
+
+	client := NewGCSClient()
+	if err := client.Upload("bucket", "dir/object", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(objects["dir/object"], data) {
+		t.Errorf("Object should be uploaded: %q", objects["dir/object"])
+	}
+}
+
+func TestGCSUploadPartialChunk(t *testing.T) {
+	objects := make(map[string][]byte)
+	server := newTestGCSUploadServer(objects, 0, 50)
+	defer server.Close()
+
+	os.Setenv("STORAGE_EMULATOR_HOST", server.URL)
+	os.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "token")
+	defer os.Unsetenv("STORAGE_EMULATOR_HOST")
+	defer os.Unsetenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+
+	defer func(size int64) { gcsUploadChunkSize = size }(gcsUploadChunkSize)
+	gcsUploadChunkSize = 64
+
+	data := bytes.Repeat([]byte("0123456789"), 20)
+
+	// Rest of each chunk should be sent again, from the offset in Range header
+	client := NewGCSClient()
+	if err := client.Upload("bucket", "dir/object", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(objects["dir/object"], data) {
+		t.Errorf("Object should be uploaded: %q", objects["dir/object"])
+	}
+}
+
+func TestFileOutputUploadGCS(t *testing.T) {
+	objects := make(map[string][]byte)
+	server := newTestGCSUploadServer(objects, 0, 0)
+	defer server.Close()
+
+	os.Setenv("STORAGE_EMULATOR_HOST", server.URL)
+	os.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "token")
+	defer os.Unsetenv("STORAGE_EMULATOR_HOST")
+	defer os.Unsetenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+
+	rnd := rand.Int63()
+	output := NewFileOutput(fmt.Sprintf("/tmp/%d.gor", rnd), &FileOutputConfig{queueLimit: 2, uploadTarget: "gs://bucket/captures/", uploadName: "%Y/%{name}"})
+
+	for i := 0; i < 2; i++ {
+		output.Write([]byte("1 1 1\ntest"))
+	}
+	output.Close()
+
+	name := fmt.Sprintf("%d_0.gor", rnd)
+	if _, err := os.Stat("/tmp/" + name); !os.IsNotExist(err) {
+		t.Error("Local file should be removed", name)
+		os.Remove("/tmp/" + name)
+	}
+
+	object := "captures/" + time.Now().Format("2006") + "/" + name
+	expected := "1 1 1\ntest" + payloadSeparator + "1 1 1\ntest" + payloadSeparator
+	if string(objects[object]) != expected {
+		t.Errorf("Chunk should be uploaded as %s: %v", object, objects)
+	}
+}
@@ -55,6 +55,26 @@ func main() {
 		log.Println("Started example file server for current dirrectory on address ", args[1])
 
 		log.Fatal(http.ListenAndServe(args[1], loggingMiddleware(http.FileServer(http.Dir(dir)))))
+	} else if len(args) > 0 && args[0] == "file-validate" {
+		if len(args) < 2 {
+			log.Fatal("You should specify file pattern to validate. Example: `gor file-validate 'requests_*.gor'`")
+		}
+
+		valid := true
+		for _, pattern := range args[1:] {
+			report, err := validateFiles(pattern, "")
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			fmt.Printf("%s\n%s\n", pattern, report)
+			valid = valid && report.Valid()
+		}
+
+		if !valid {
+			os.Exit(1)
+		}
+		os.Exit(0)
 	} else {
 		flag.Parse()
 		InitPlugins()
@@ -79,7 +99,8 @@ func main() {
 	go func() {
 		<-c
 		finalize()
-		os.Exit(1)
+		exitOnFailedAssertions()
+		os.Exit(0)
 	}()
 
 	if Settings.exitAfter > 0 {
@@ -95,6 +116,16 @@ func main() {
 	} else {
 		Start(nil)
 	}
+
+	exitOnFailedAssertions()
+}
+
+// exitOnFailedAssertions exits with non-zero code, which lets CI fail the build, if some replayed responses failed assertions
+func exitOnFailedAssertions() {
+	if failed := failedAssertions(); failed > 0 {
+		log.Printf("%d replayed responses failed assertions", failed)
+		os.Exit(1)
+	}
 }
 
 func finalize() {
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTP Archive format, fields needed for replay, and required fields written by HAR output
+// See: http://www.softwareishard.com/blog/har-12-spec/
+type harFile struct {
+	Log struct {
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harRequest struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []harHeader  `json:"cookies"`
+	Headers     []harHeader  `json:"headers"`
+	QueryString []harHeader  `json:"queryString"`
+	PostData    *harPostData `json:"postData,omitempty"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harResponse struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []harHeader `json:"cookies"`
+	Headers     []harHeader `json:"headers"`
+	Content     harContent  `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+// buildHTTPMessage builds HTTP/1.1 message from headers and body of converted formats.
+// Browsers record HTTP/2 pseudo headers and already decoded bodies, so such headers are dropped,
+// and Content-Length is set according to the body.
+func buildHTTPMessage(firstLine string, headers []harHeader, host string, body []byte) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString(firstLine + "\r\n")
+
+	hasHost := false
+	for _, h := range headers {
+		switch strings.ToLower(h.Name) {
+		case "content-length", "content-encoding", "transfer-encoding", "connection":
+			continue
+		case "host":
+			hasHost = true
+		}
+
+		if strings.HasPrefix(h.Name, ":") {
+			continue
+		}
+
+		buf.WriteString(h.Name + ": " + h.Value + "\r\n")
+	}
+
+	if !hasHost && host != "" {
+		buf.WriteString("Host: " + host + "\r\n")
+	}
+
+	if len(body) > 0 {
+		buf.WriteString("Content-Length: " + strconv.Itoa(len(body)) + "\r\n")
+	}
+
+	buf.WriteString("\r\n")
+	buf.Write(body)
+
+	return buf.Bytes()
+}
+
+// newHARReader converts HAR file to Gor file format, so it can be read same way as files written by FileOutput.
+// Each entry produce request and response payloads, using startedDateTime as timestamp.
+func newHARReader(r io.Reader) (io.Reader, error) {
+	var har harFile
+
+	if err := json.NewDecoder(r).Decode(&har); err != nil {
+		return nil, err
+	}
+
+	entries := har.Log.Entries
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].StartedDateTime.Before(entries[j].StartedDateTime)
+	})
+
+	var buf bytes.Buffer
+
+	for _, e := range entries {
+		u, err := url.Parse(e.Request.URL)
+		if err != nil {
+			continue
+		}
+
+		var body []byte
+		if e.Request.PostData != nil {
+			body = []byte(e.Request.PostData.Text)
+		}
+
+		id := uuid()
+		start := e.StartedDateTime.UnixNano()
+
+		buf.Write(payloadHeader(RequestPayload, id, start, -1))
+		buf.Write(buildHTTPMessage(e.Request.Method+" "+u.RequestURI()+" HTTP/1.1", e.Request.Headers, u.Host, body))
+		buf.WriteString(payloadSeparator)
+
+		// Entries for failed or blocked requests do not have response
+		if e.Response.Status == 0 {
+			continue
+		}
+
+		body = []byte(e.Response.Content.Text)
+		if e.Response.Content.Encoding == "base64" {
+			if decoded, err := base64.StdEncoding.DecodeString(e.Response.Content.Text); err == nil {
+				body = decoded
+			}
+		}
+
+		status := strconv.Itoa(e.Response.Status) + " " + e.Response.StatusText
+
+		buf.Write(payloadHeader(ResponsePayload, id, start, int64(e.Time*float64(time.Millisecond))))
+		buf.Write(buildHTTPMessage("HTTP/1.1 "+strings.TrimSpace(status), e.Response.Headers, "", body))
+		buf.WriteString(payloadSeparator)
+	}
+
+	return &buf, nil
+}
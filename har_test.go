@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+const testHAR = `{"log": {"version": "1.2", "entries": [
+	{
+		"startedDateTime": "2017-01-10T10:00:01.000Z",
+		"time": 20,
+		"request": {
+			"method": "POST", "url": "https://example.org/upload?a=1", "httpVersion": "HTTP/2.0",
+			"headers": [{"name": ":authority", "value": "example.org"}, {"name": "Content-Type", "value": "application/x-www-form-urlencoded"}],
+			"postData": {"mimeType": "application/x-www-form-urlencoded", "text": "a=1&b=2"}
+		},
+		"response": {"status": 201, "statusText": "Created", "headers": [], "content": {"text": "b2s=", "encoding": "base64"}}
+	},
+	{
+		"startedDateTime": "2017-01-10T10:00:00.000Z",
+		"time": 10,
+		"request": {"method": "GET", "url": "https://example.org/", "headers": [{"name": "Host", "value": "example.org"}]},
+		"response": {"status": 200, "statusText": "OK", "headers": [{"name": "Content-Encoding", "value": "gzip"}], "content": {"text": "hello"}}
+	}
+]}}`
+
+func TestInputFileHAR(t *testing.T) {
+	name := fmt.Sprintf("/tmp/%d.har", rand.Int63())
+	ioutil.WriteFile(name, []byte(testHAR), 0660)
+	defer os.Remove(name)
+
+	input := NewFileInput(name, &FileInputConfig{})
+	buf := make([]byte, 1000)
+
+	expected := []string{
+		"GET / HTTP/1.1\r\nHost: example.org\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello",
+		"POST /upload?a=1 HTTP/1.1\r\nContent-Type: application/x-www-form-urlencoded\r\nHost: example.org\r\nContent-Length: 7\r\n\r\na=1&b=2",
+		"HTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok",
+	}
+
+	var reqID []byte
+	for i, e := range expected {
+		n, _ := input.Read(buf)
+		payload := buf[:n]
+
+		if !bytes.Equal(payloadBody(payload), []byte(e)) {
+			t.Errorf("Wrong payload %d: %q", i, payloadBody(payload))
+		}
+
+		meta := payloadMeta(payload)
+		if i%2 == 0 {
+			reqID = meta[1]
+		} else if !bytes.Equal(meta[1], reqID) {
+			t.Error("Response should have same id as request")
+		}
+	}
+
+	input.Close()
+}
+
+func TestFileOutputHAR(t *testing.T) {
+	name := fmt.Sprintf("/tmp/%d.har", rand.Int63())
+	defer os.Remove(setFileIndex(name, 0))
+
+	var gzBody bytes.Buffer
+	gz := gzip.NewWriter(&gzBody)
+	gz.Write([]byte("hello"))
+	gz.Close()
+
+	output := NewFileOutput(name, &FileOutputConfig{})
+	output.Write([]byte("1 a 1484042401000000000\nPOST /upload?a=1 HTTP/1.1\r\nHost: example.org\r\nCookie: s=1\r\nContent-Length: 3\r\n\r\na=1"))
+	output.Write([]byte("1 b 1484042402000000000\nGET / HTTP/1.1\r\nHost: example.org\r\n\r\n"))
+	output.Write([]byte(fmt.Sprintf("2 a 1484042401000000000 20000000\nHTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nContent-Length: %d\r\n\r\n%s", gzBody.Len(), gzBody.Bytes())))
+	output.Close()
+
+	data, _ := ioutil.ReadFile(setFileIndex(name, 0))
+
+	var har harFile
+	if err := json.Unmarshal(data, &har); err != nil {
+		t.Fatal("Should write valid JSON:", err, string(data))
+	}
+
+	entries := har.Log.Entries
+	if len(entries) != 2 {
+		t.Fatal("Should write entry for each request:", string(data))
+	}
+
+	e := entries[0]
+	if e.Request.URL != "http://example.org/upload?a=1" || e.Request.PostData.Text != "a=1" || e.Request.Cookies[0].Value != "1" || e.Request.QueryString[0].Name != "a" {
+		t.Errorf("Wrong request: %+v", e.Request)
+	}
+	if e.Response.Status != 200 || e.Response.StatusText != "OK" || e.Response.Content.Text != "hello" || e.Time != 20 {
+		t.Errorf("Wrong response: %+v", e.Response)
+	}
+
+	// Request without response is written with empty response
+	if entries[1].Request.Method != "GET" || entries[1].Response.Status != 0 {
+		t.Errorf("Wrong entry: %+v", entries[1])
+	}
+
+	// Written file can be replayed
+	input := NewFileInput(setFileIndex(name, 0), &FileInputConfig{})
+	buf := make([]byte, 1000)
+	n, _ := input.Read(buf)
+	if !bytes.Contains(buf[:n], []byte("POST /upload?a=1 HTTP/1.1")) {
+		t.Error("Should replay written HAR:", string(buf[:n]))
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// HTTP2Response holds decoded response stream
+type HTTP2Response struct {
+	Headers  []hpack.HeaderField
+	Trailers []hpack.HeaderField
+	Body     []byte
+}
+
+// newHTTP2Response converts response to header fields, so HTTP/2 and HTTP/3 responses are converted to HTTP/1.1 the same way
+func newHTTP2Response(resp *http.Response, body []byte) *HTTP2Response {
+	r := &HTTP2Response{Body: body}
+	r.Headers = append(r.Headers, hpack.HeaderField{Name: ":status", Value: strconv.Itoa(resp.StatusCode)})
+
+	for name, values := range resp.Header {
+		for _, value := range values {
+			r.Headers = append(r.Headers, hpack.HeaderField{Name: strings.ToLower(name), Value: value})
+		}
+	}
+
+	for name, values := range resp.Trailer {
+		for _, value := range values {
+			r.Trailers = append(r.Trailers, hpack.HeaderField{Name: strings.ToLower(name), Value: value})
+		}
+	}
+
+	return r
+}
+
+// HTTP1 converts response to HTTP/1.1, trailers are added as regular headers
+func (r *HTTP2Response) HTTP1() []byte {
+	var buf bytes.Buffer
+
+	status := ""
+	for _, h := range r.Headers {
+		if h.Name == ":status" {
+			status = h.Value
+		}
+	}
+
+	code, _ := strconv.Atoi(status)
+	buf.WriteString("HTTP/1.1 " + status + " " + http.StatusText(code) + "\r\n")
+
+	for _, fields := range [][]hpack.HeaderField{r.Headers, r.Trailers} {
+		for _, h := range fields {
+			if h.IsPseudo() || h.Name == "content-length" {
+				continue
+			}
+			buf.WriteString(http.CanonicalHeaderKey(h.Name) + ": " + h.Value + "\r\n")
+		}
+	}
+
+	buf.WriteString("Content-Length: " + strconv.Itoa(len(r.Body)) + "\r\n\r\n")
+	buf.Write(r.Body)
+
+	return buf.Bytes()
+}
+
+// newStreamRequest converts HTTP/2 header list to request sent to address. Connection goes to target address,
+// while ':authority' can be original host.
+func newStreamRequest(ctx context.Context, scheme, address string, headers []hpack.HeaderField, body []byte) (*http.Request, error) {
+	var method, path, authority string
+	header := make(http.Header)
+
+	for _, h := range headers {
+		switch h.Name {
+		case ":method":
+			method = h.Value
+		case ":path":
+			path = h.Value
+		case ":authority":
+			authority = h.Value
+		case ":scheme":
+		default:
+			header.Add(h.Name, h.Value)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, scheme+"://"+address+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Host = authority
+	req.Header = header
+	req.ContentLength = int64(len(body))
+
+	return req, nil
+}
+
+// HTTP2Client sends requests over HTTP/2 connection. Send is safe for concurrent use, and concurrent
+// requests are multiplexed as separate streams of the same connection.
+// Plain connections use prior knowledge (h2c), TLS connections negotiate 'h2' with ALPN.
+type HTTP2Client struct {
+	address string
+	useTLS  bool
+	timeout time.Duration
+	// Base TLS settings, like client certificate and verification. By default server certificate is not verified.
+	tlsConfig *tls.Config
+	// Connect through HTTP CONNECT or SOCKS5 proxy
+	proxy *url.URL
+	// Resolves host of address, by default resolved by OS
+	resolver *targetResolver
+
+	mu        sync.Mutex
+	transport *http2.Transport
+}
+
+var errHTTP2Timeout = errors.New("HTTP/2 request timeout")
+
+// NewHTTP2Client constructor for HTTP2Client, address should contain port
+func NewHTTP2Client(address string, useTLS bool, timeout time.Duration) *HTTP2Client {
+	return &HTTP2Client{address: address, useTLS: useTLS, timeout: timeout}
+}
+
+// Disconnect closes connection, next request opens new one. Requests in flight are finished on previous connection.
+func (c *HTTP2Client) Disconnect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.transport != nil {
+		c.transport.CloseIdleConnections()
+		c.transport = nil
+	}
+}
+
+// roundTripper returns current transport, it opens connection on first request and keeps it
+func (c *HTTP2Client) roundTripper() *http2.Transport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.transport != nil {
+		return c.transport
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if c.tlsConfig != nil {
+		tlsConfig = c.tlsConfig.Clone()
+	}
+
+	c.transport = &http2.Transport{
+		TLSClientConfig: tlsConfig,
+		// Plain connections use prior knowledge, without upgrade from HTTP/1.1
+		AllowHTTP:       true,
+		DialTLSContext:  c.dial,
+		IdleConnTimeout: 90 * time.Second,
+	}
+
+	return c.transport
+}
+
+// dial connects to target, directly or through proxy, and negotiates 'h2' if TLS is used
+func (c *HTTP2Client) dial(ctx context.Context, network, addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	conn, err := dialTarget(c.resolver, c.proxy, c.address, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.useTLS {
+		Debug("[HTTP2] Connected: ", c.address)
+		return conn, nil
+	}
+
+	tlsConfig = tlsConfig.Clone()
+	if host, _, err := net.SplitHostPort(c.address); err == nil && tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if tlsConn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		tlsConn.Close()
+		return nil, errors.New("server does not support HTTP/2: " + c.address)
+	}
+
+	Debug("[HTTP2] Connected: ", c.address)
+
+	return tlsConn, nil
+}
+
+// Send sends request and waits for the complete response. Headers should include pseudo headers.
+func (c *HTTP2Client) Send(headers []hpack.HeaderField, body []byte) (*HTTP2Response, error) {
+	scheme := "http"
+	if c.useTLS {
+		scheme = "https"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	req, err := newStreamRequest(ctx, scheme, c.address, headers, body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.roundTripper().RoundTrip(req)
+	if err == nil {
+		defer resp.Body.Close()
+
+		var data []byte
+		if data, err = ioutil.ReadAll(resp.Body); err == nil {
+			return newHTTP2Response(resp, data), nil
+		}
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, errHTTP2Timeout
+	}
+
+	return nil, err
+}
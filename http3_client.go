@@ -0,0 +1,146 @@
+//go:build http3
+// +build http3
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2/hpack"
+)
+
+var errHTTP3Timeout = errors.New("HTTP/3 request timeout")
+
+// initHTTP3 sets up HTTP/3 client of target. HTTP/3 support is built only with `http3` build tag.
+func (o *HTTPOutput) initHTTP3(t *httpTarget) {
+	if strings.HasPrefix(t.address, unixSocketPrefix) {
+		log.Fatal("[OUTPUT-HTTP] HTTP/3 is not supported for unix socket: ", t.address)
+	}
+
+	// QUIC always uses TLS, so addresses without scheme are https
+	hostPort := o.initStreamTarget(t, "https")
+	if t.http2Scheme != "https" {
+		log.Fatal("[OUTPUT-HTTP] HTTP/3 requires https:// address: ", t.address)
+	}
+
+	// QUIC goes over UDP, which can't be tunneled through HTTP CONNECT proxy
+	if o.config.proxy != "" {
+		log.Fatal("[OUTPUT-HTTP] HTTP/3 can't be sent through proxy: ", o.config.proxy)
+	}
+
+	t.http3 = NewHTTP3Client(hostPort, o.config.Timeout)
+	t.http3.tlsConfig = t.tlsConfig
+	t.http3.resolver = o.resolver
+}
+
+// HTTP3Client sends requests over HTTP/3 (QUIC). Send is safe for concurrent use, and concurrent
+// requests are multiplexed as separate streams of the same connection. HTTP/3 always uses TLS, 'h3' is negotiated with ALPN.
+// Experimental: QUIC runs over UDP, so proxies are not supported.
+type HTTP3Client struct {
+	address string
+	timeout time.Duration
+	// Base TLS settings, like client certificate and verification. By default server certificate is not verified.
+	tlsConfig *tls.Config
+	// Resolves host of address, by default resolved by OS
+	resolver *targetResolver
+
+	mu        sync.Mutex
+	transport *http3.Transport
+}
+
+// NewHTTP3Client constructor for HTTP3Client, address should contain port
+func NewHTTP3Client(address string, timeout time.Duration) *HTTP3Client {
+	return &HTTP3Client{address: address, timeout: timeout}
+}
+
+// Disconnect closes connection, next request opens new one
+func (c *HTTP3Client) Disconnect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.transport != nil {
+		c.transport.Close()
+		c.transport = nil
+	}
+}
+
+// roundTripper returns current transport, it opens connection on first request and keeps it
+func (c *HTTP3Client) roundTripper() *http3.Transport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.transport != nil {
+		return c.transport
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if c.tlsConfig != nil {
+		tlsConfig = c.tlsConfig.Clone()
+	}
+
+	c.transport = &http3.Transport{
+		TLSClientConfig: tlsConfig,
+		QUICConfig:      &quic.Config{HandshakeIdleTimeout: c.timeout},
+	}
+
+	if c.resolver != nil {
+		c.transport.Dial = c.dial
+	}
+
+	return c.transport
+}
+
+// dial tries addresses of host in turn until connection succeeds
+func (c *HTTP3Client) dial(ctx context.Context, address string, tlsConfig *tls.Config, config *quic.Config) (*quic.Conn, error) {
+	addrs, err := c.resolver.addresses(address)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		var conn *quic.Conn
+		if conn, err = quic.DialAddrEarly(ctx, addr, tlsConfig, config); err == nil {
+			Debug("[HTTP3] Connected: ", address, addr)
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+// Send sends request and waits for the complete response. Headers should include pseudo headers, response is
+// returned in the same form as HTTP/2 one.
+func (c *HTTP3Client) Send(headers []hpack.HeaderField, body []byte) (*HTTP2Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	req, err := newStreamRequest(ctx, "https", c.address, headers, body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.roundTripper().RoundTrip(req)
+	if err == nil {
+		defer resp.Body.Close()
+
+		var data []byte
+		if data, err = ioutil.ReadAll(resp.Body); err == nil {
+			return newHTTP2Response(resp, data), nil
+		}
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, errHTTP3Timeout
+	}
+
+	return nil, err
+}
@@ -0,0 +1,35 @@
+//go:build !http3
+// +build !http3
+
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+var errHTTP3Timeout = errors.New("HTTP/3 request timeout")
+
+// initHTTP3 fails, since HTTP/3 support is built only with `http3` build tag
+func (o *HTTPOutput) initHTTP3(t *httpTarget) {
+	log.Fatal("[OUTPUT-HTTP] HTTP/3 is not supported by this build, rebuild Gor with `-tags http3`")
+}
+
+// HTTP3Client is not available without `http3` build tag
+type HTTP3Client struct{}
+
+// NewHTTP3Client constructor for HTTP3Client, HTTP/3 is not available without `http3` build tag
+func NewHTTP3Client(address string, timeout time.Duration) *HTTP3Client {
+	return &HTTP3Client{}
+}
+
+// Disconnect does nothing, since there is no connection
+func (c *HTTP3Client) Disconnect() {}
+
+// Send always fails
+func (c *HTTP3Client) Send(headers []hpack.HeaderField, body []byte) (*HTTP2Response, error) {
+	return nil, errors.New("HTTP/3 is not supported by this build")
+}
@@ -0,0 +1,77 @@
+//go:build http3
+// +build http3
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buger/gor/proto"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestHTTPOutputHTTP3(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 3 {
+			t.Error("Should use HTTP/3", req.Proto)
+		}
+
+		if req.Host != "example.com" {
+			t.Error("Should send original host", req.Host)
+		}
+
+		body, _ := ioutil.ReadAll(req.Body)
+
+		w.Header().Set("X-Remote", req.RemoteAddr)
+		w.Write(append([]byte(req.Method+" "+req.URL.Path+" "), body...))
+	})
+
+	// Only used for its self-signed certificate
+	tlsServer := httptest.NewTLSServer(handler)
+	tlsServer.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http3.Server{Handler: handler, TLSConfig: http3.ConfigureTLSConfig(tlsServer.TLS)}
+	go server.Serve(conn)
+	defer server.Close()
+
+	output := NewHTTPOutput("https://"+conn.LocalAddr().String(), &HTTPOutputConfig{Timeout: time.Second, TrackResponses: true, OriginalHost: true, HTTP3: true})
+
+	output.Write([]byte("1 a 1\nPOST /chunked HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n"))
+	for i := 0; i < 5; i++ {
+		output.Write([]byte("1 b 1\nGET /get HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	}
+
+	remotes := make(map[string]bool)
+	data := make([]byte, 1024)
+
+	for i := 0; i < 6; i++ {
+		n, _ := output.(io.Reader).Read(data)
+		payload := payloadBody(data[:n])
+
+		if !strings.HasPrefix(string(payload), "HTTP/1.1 200 OK\r\n") {
+			t.Fatalf("Wrong response %q", payload)
+		}
+
+		if body := string(proto.Body(payload)); body != "POST /chunked abc" && body != "GET /get " {
+			t.Errorf("Wrong body %q", body)
+		}
+
+		remotes[string(proto.Header(payload, []byte("X-Remote")))] = true
+	}
+
+	if len(remotes) != 1 {
+		t.Error("Requests should be multiplexed over single connection", remotes)
+	}
+}
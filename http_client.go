@@ -12,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -25,34 +26,80 @@ const (
 	maxResponseSize = 1073741824
 )
 
-var chunkedSuffix = []byte("0\r\n\r\n")
-
 var defaultPorts = map[string]string{
 	"http":  "80",
 	"https": "443",
 }
 
+// RedirectStats counts redirects of clients which share it
+type RedirectStats struct {
+	Followed int64
+	// Redirects which were not followed: back to URL already visited by the same request, or above limit
+	Loops   int64
+	Limited int64
+}
+
+// Targets with this prefix are connected through unix socket, like `unix:///var/run/app.sock`
+const unixSocketPrefix = "unix://"
+
 type HTTPClientConfig struct {
-	FollowRedirects    int
+	FollowRedirects int
+	// Counters of redirects, can be shared by clients of the same output
+	Redirects          *RedirectStats
 	Debug              bool
 	OriginalHost       bool
 	ConnectionTimeout  time.Duration
 	Timeout            time.Duration
 	ResponseBufferSize int
+	// Connection unused for longer time is closed, 0 means no limit
+	IdleTimeout time.Duration
+	// Close connection after each request
+	DisableKeepAlive bool
+	// Base TLS settings, like client certificate and verification. By default server certificate is not verified.
+	TLSConfig *tls.Config
+	// Connect through HTTP CONNECT or SOCKS5 proxy
+	Proxy *url.URL
+	// Resolves host of target, by default resolved by OS on each connection
+	Resolver *targetResolver
+	// Limit of the whole request, including connecting and redirects, 0 means no limit
+	RequestTimeout time.Duration
+	// Bodies bigger than this are written after headers in chunks, each with own write deadline
+	StreamThreshold int
+	// How long to wait for 100 Continue before sending body of request with `Expect: 100-continue`
+	ContinueTimeout time.Duration
+	// By default equal to Timeout
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
 }
 
 type HTTPClient struct {
-	baseURL        string
-	scheme         string
-	host           string
+	baseURL string
+	scheme  string
+	host    string
+	// Path of unix socket, if target is like `unix:///var/run/app.sock`
+	socket         string
 	auth           string
 	conn           net.Conn
 	respBuf        []byte
 	config         *HTTPClientConfig
 	redirectsCount int
+	// URLs visited by current request and its redirects
+	redirectsVisited []string
+	// TLS server name of connection, original Host of request if it is preserved
+	serverName string
+	// Deadline of current request, set by RequestTimeout
+	deadline time.Time
+	lastUsed time.Time
 }
 
 func NewHTTPClient(baseURL string, config *HTTPClientConfig) *HTTPClient {
+	// Requests to unix socket are sent as to http://localhost
+	var socket string
+	if strings.HasPrefix(baseURL, unixSocketPrefix) {
+		socket = strings.TrimPrefix(baseURL, unixSocketPrefix)
+		baseURL = "http://localhost"
+	}
+
 	if !strings.HasPrefix(baseURL, "http") {
 		baseURL = "http://" + baseURL
 	}
@@ -65,14 +112,35 @@ func NewHTTPClient(baseURL string, config *HTTPClientConfig) *HTTPClient {
 
 	config.ConnectionTimeout = config.Timeout
 
+	if config.TLSHandshakeTimeout == 0 {
+		config.TLSHandshakeTimeout = config.Timeout
+	}
+
+	if config.ResponseHeaderTimeout == 0 {
+		config.ResponseHeaderTimeout = config.Timeout
+	}
+
 	if config.ResponseBufferSize == 0 {
 		config.ResponseBufferSize = 100 * 1024 // 100kb
 	}
 
+	if config.Redirects == nil {
+		config.Redirects = new(RedirectStats)
+	}
+
+	if config.StreamThreshold == 0 {
+		config.StreamThreshold = readChunkSize
+	}
+
+	if config.ContinueTimeout == 0 {
+		config.ContinueTimeout = time.Second
+	}
+
 	client := new(HTTPClient)
 	client.baseURL = u.String()
 	client.host = u.Host
 	client.scheme = u.Scheme
+	client.socket = socket
 	client.respBuf = make([]byte, config.ResponseBufferSize)
 	client.config = config
 
@@ -85,19 +153,54 @@ func NewHTTPClient(baseURL string, config *HTTPClientConfig) *HTTPClient {
 
 func (c *HTTPClient) Connect() (err error) {
 	c.Disconnect()
+	c.lastUsed = time.Now()
 
+	address := c.host
 	if !strings.Contains(c.host, ":") {
-		c.conn, err = net.DialTimeout("tcp", c.host + ":" + defaultPorts[c.scheme], c.config.ConnectionTimeout)
+		address = c.host + ":" + defaultPorts[c.scheme]
+	}
+
+	timeout := c.config.ConnectionTimeout
+	if !c.deadline.IsZero() && time.Until(c.deadline) < timeout {
+		timeout = time.Until(c.deadline)
+	}
+
+	if c.socket != "" {
+		c.conn, err = net.DialTimeout("unix", c.socket, timeout)
 	} else {
-		c.conn, err = net.DialTimeout("tcp", c.host, c.config.ConnectionTimeout)
+		c.conn, err = dialTarget(c.config.Resolver, c.config.Proxy, address, timeout)
+	}
+
+	if err != nil {
+		return
 	}
 
 	if c.scheme == "https" {
-		tlsConn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true, ServerName: c.host})
+		tlsConfig := &tls.Config{InsecureSkipVerify: true}
+		if c.config.TLSConfig != nil {
+			tlsConfig = c.config.TLSConfig.Clone()
+		}
+
+		// Server name should not include port
+		tlsConfig.ServerName = c.host
+		if host, _, err := net.SplitHostPort(c.host); err == nil {
+			tlsConfig.ServerName = host
+		}
 
+		if c.serverName != "" {
+			tlsConfig.ServerName = c.serverName
+		}
+
+		tlsConn := tls.Client(c.conn, tlsConfig)
+
+		// Otherwise server which accepts connection but never finishes handshake blocks worker forever
+		tlsConn.SetDeadline(c.limitDeadline(time.Now().Add(c.config.TLSHandshakeTimeout)))
 		if err = tlsConn.Handshake(); err != nil {
+			c.conn.Close()
+			c.conn = nil
 			return
 		}
+		tlsConn.SetDeadline(time.Time{})
 
 		c.conn = tlsConn
 	}
@@ -105,6 +208,28 @@ func (c *HTTPClient) Connect() (err error) {
 	return
 }
 
+// staleAddress checks if connection goes to address which host doesn't resolve to anymore, like after DNS failover
+func (c *HTTPClient) staleAddress() bool {
+	if c.config.Resolver == nil || c.config.Proxy != nil || c.socket != "" {
+		return false
+	}
+
+	address := c.host
+	if !strings.Contains(c.host, ":") {
+		address = c.host + ":" + defaultPorts[c.scheme]
+	}
+
+	return !c.config.Resolver.current(address, c.conn.RemoteAddr())
+}
+
+// limitDeadline returns given deadline, or deadline of request if it is earlier
+func (c *HTTPClient) limitDeadline(t time.Time) time.Time {
+	if !c.deadline.IsZero() && c.deadline.Before(t) {
+		return c.deadline
+	}
+	return t
+}
+
 func (c *HTTPClient) Disconnect() {
 	if c.conn != nil {
 		c.conn.Close()
@@ -113,6 +238,19 @@ func (c *HTTPClient) Disconnect() {
 	}
 }
 
+// isIdle checks if connection was unused longer than idle timeout
+func (c *HTTPClient) isIdle() bool {
+	return c.config.IdleTimeout > 0 && time.Since(c.lastUsed) > c.config.IdleTimeout
+}
+
+// CloseIdle closes connection if it was unused longer than idle timeout
+func (c *HTTPClient) CloseIdle() {
+	if c.conn != nil && c.isIdle() {
+		Debug("[HTTPClient] Closing idle connection:", c.baseURL)
+		c.Disconnect()
+	}
+}
+
 func (c *HTTPClient) isAlive() bool {
 	one := make([]byte, 1)
 
@@ -148,50 +286,119 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 		}
 	}()
 
-	if c.conn == nil || !c.isAlive() {
+	// Redirects are part of the same request
+	if c.redirectsCount == 0 {
+		c.redirectsVisited = c.redirectsVisited[:0]
+		c.deadline = time.Time{}
+		if c.config.RequestTimeout > 0 {
+			c.deadline = time.Now().Add(c.config.RequestTimeout)
+		}
+	}
+
+	// Ingress routing HTTPS requests by virtual host uses TLS server name, so with original Host
+	// connection is opened again, if request goes to another host
+	if c.config.OriginalHost && c.scheme == "https" {
+		host := string(proto.Header(data, []byte("Host")))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if host != "" && host != c.serverName {
+			c.serverName = host
+			c.Disconnect()
+		}
+	}
+
+	if c.conn == nil || c.isIdle() || !c.isAlive() || c.staleAddress() {
 		Debug("[HTTPClient] Connecting:", c.baseURL)
 		if err = c.Connect(); err != nil {
 			log.Println("[HTTPClient] Connection error:", err)
+			c.Disconnect()
 			response = errorPayload(HTTP_CONNECTION_ERROR)
 			return
 		}
 	}
 
-	timeout := time.Now().Add(c.config.Timeout)
+	c.conn.SetWriteDeadline(c.limitDeadline(time.Now().Add(c.config.Timeout)))
 
-	c.conn.SetWriteDeadline(timeout)
+	// Only headers are modified, body is written as captured, without copying
+	head, body := data, []byte(nil)
+	if end := proto.MIMEHeadersEndPos(data); end != -1 {
+		head = append([]byte(nil), data[:end+len(proto.EmptyLine)]...)
+		body = data[end+len(proto.EmptyLine):]
+	}
 
 	if !c.config.OriginalHost {
-		data = proto.SetHost(data, []byte(c.baseURL), []byte(c.host))
+		head = proto.SetHost(head, []byte(c.baseURL), []byte(c.host))
 	}
 
 	if c.auth != "" {
-		data = proto.SetHeader(data, []byte("Authorization"), []byte(c.auth))
+		head = proto.SetHeader(head, []byte("Authorization"), []byte(c.auth))
+	}
+
+	if c.config.DisableKeepAlive {
+		head = proto.SetHeader(head, []byte("Connection"), []byte("close"))
 	}
 
 	if c.config.Debug {
-		Debug("[HTTPClient] Sending:", string(data))
+		Debug("[HTTPClient] Sending:", string(head), len(body))
 	}
 
-	if _, err = c.conn.Write(data); err != nil {
+	// Bytes of response received while waiting for 100 Continue
+	var received int
+	// Server responded before body was sent, so connection can't be reused
+	bodySkipped := false
+
+	expectContinue := len(body) > 0 && bytes.EqualFold(proto.Header(head, []byte("Expect")), []byte("100-continue"))
+
+	if !expectContinue && len(body) <= c.config.StreamThreshold {
+		buffers := net.Buffers{head, body}
+		_, err = buffers.WriteTo(c.conn)
+	} else if _, err = c.conn.Write(head); err == nil {
+		send := true
+		if expectContinue {
+			received, send = c.waitContinue()
+		}
+
+		if send {
+			err = c.writeBody(body)
+		} else {
+			bodySkipped = true
+		}
+	}
+
+	// Late response to this request would be read as response to the next one, so connection is not reused
+	if err != nil {
 		Debug("[HTTPClient] Write error:", err, c.baseURL)
+		c.Disconnect()
 		response = errorPayload(HTTP_TIMEOUT)
 		return
 	}
 
 	var readBytes, n int
 	var currentChunk []byte
-	timeout = time.Now().Add(c.config.Timeout)
+	// Headers should be received in time, even if server sends them slowly
+	timeout := time.Now().Add(c.config.ResponseHeaderTimeout)
+	headersReceived := false
 	chunked := false
+	// Chunks are parsed as they arrive, to find the last one followed by trailers
+	var chunkedBody proto.ChunkedState
+	var chunkedDone bool
+	var chunkedErr error
 	contentLength := -1
 	currentContentLength := 0
 	chunks := 0
 
 	for {
-		c.conn.SetReadDeadline(timeout)
+		c.conn.SetReadDeadline(c.limitDeadline(timeout))
 
 		if readBytes < len(c.respBuf) {
-			n, err = c.conn.Read(c.respBuf[readBytes:])
+			if received > 0 {
+				n, err = received, nil
+				received = 0
+			} else {
+				n, err = c.conn.Read(c.respBuf[readBytes:])
+			}
 			readBytes += n
 			chunks++
 
@@ -205,11 +412,22 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 			// First chunk
 			if chunked || contentLength != -1 {
 				currentContentLength += n
+
+				if chunked {
+					_, chunkedDone, chunkedErr = chunkedBody.Feed(c.respBuf[readBytes-n : readBytes])
+				}
 			} else {
+				// Interim responses, like 100 Continue sent after body, are followed by final one
+				readBytes = c.skipInterimResponses(readBytes)
+
 				// If headers are finished
 				if bytes.Contains(c.respBuf[:readBytes], proto.EmptyLine) {
-					if bytes.Equal(proto.Header(c.respBuf, []byte("Transfer-Encoding")), []byte("chunked")) {
+					headersReceived = true
+
+					// Chunked is always the last encoding, like `gzip, chunked`
+					if bytes.HasSuffix(bytes.ToLower(proto.Header(c.respBuf, []byte("Transfer-Encoding"))), []byte("chunked")) {
 						chunked = true
+						_, chunkedDone, chunkedErr = chunkedBody.Feed(proto.Body(c.respBuf[:readBytes]))
 					} else {
 						status, _ := strconv.Atoi(string(proto.Status(c.respBuf)))
 						if (status >= 100 && status < 200) || status == 204 || status == 304 {
@@ -228,7 +446,13 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 
 			if chunked {
 				// Check if chunked message finished
-				if bytes.HasSuffix(c.respBuf[:readBytes], chunkedSuffix) {
+				if chunkedDone {
+					break
+				}
+
+				if chunkedErr != nil {
+					Debug("[HTTPClient] disconnected,", chunkedErr)
+					c.Disconnect()
 					break
 				}
 			} else if contentLength != -1 {
@@ -259,8 +483,16 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 			currentContentLength += n
 
 			if chunked {
+				_, chunkedDone, chunkedErr = chunkedBody.Feed(currentChunk[:n])
+
 				// Check if chunked message finished
-				if bytes.HasSuffix(currentChunk[:n], chunkedSuffix) {
+				if chunkedDone {
+					break
+				}
+
+				if chunkedErr != nil {
+					Debug("[HTTPClient] disconnected,", chunkedErr)
+					c.Disconnect()
 					break
 				}
 			} else if contentLength != -1 {
@@ -285,11 +517,14 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 		}
 
 		// For following chunks expect less timeout
-		timeout = time.Now().Add(c.config.Timeout / 5)
+		if headersReceived {
+			timeout = time.Now().Add(c.config.Timeout / 5)
+		}
 	}
 
 	if err != nil {
 		Debug("[HTTPClient] Response read error", err, c.conn, readBytes)
+		c.Disconnect()
 		response = errorPayload(HTTP_TIMEOUT)
 		return
 	}
@@ -304,21 +539,49 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 		Debug("[HTTPClient] Received:", string(payload))
 	}
 
-	if c.config.FollowRedirects > 0 && c.redirectsCount < c.config.FollowRedirects {
+	if bodySkipped {
+		c.Disconnect()
+		Debug("[HTTPClient] Closed connection, response received before body was sent")
+	}
+
+	if c.config.FollowRedirects > 0 {
 		status := payload[9:12]
 
 		// 3xx requests
-		if status[0] == '3' {
-			c.redirectsCount++
+		if location := proto.Header(payload, []byte("Location")); status[0] == '3' && len(location) > 0 {
+			if c.redirectsCount == 0 {
+				c.redirectsVisited = append(c.redirectsVisited, c.redirectURL(data, nil))
+			}
+			next := c.redirectURL(data, location)
+
+			switch {
+			case c.redirectsCount >= c.config.FollowRedirects:
+				atomic.AddInt64(&c.config.Redirects.Limited, 1)
+			case c.visited(next):
+				Debug("[HTTPClient] Redirect loop, not following:", next)
+				atomic.AddInt64(&c.config.Redirects.Loops, 1)
+			default:
+				c.redirectsCount++
+				c.redirectsVisited = append(c.redirectsVisited, next)
+				atomic.AddInt64(&c.config.Redirects.Followed, 1)
+
+				redirectPayload := []byte("GET " + string(location) + " HTTP/1.1\r\n\r\n")
+
+				// Host of target is set by Send, otherwise host from location or original request is kept
+				if c.config.OriginalHost {
+					host := proto.Header(data, []byte("Host"))
+					if u, err := url.Parse(string(location)); err == nil && u.Host != "" {
+						host = []byte(u.Host)
+					}
+					redirectPayload = proto.SetHeader(redirectPayload, []byte("Host"), host)
+				}
 
-			location := proto.Header(payload, []byte("Location"))
-			redirectPayload := []byte("GET " + string(location) + " HTTP/1.1\r\n\r\n")
+				if c.config.Debug {
+					Debug("[HTTPClient] Redirecting to: " + string(location))
+				}
 
-			if c.config.Debug {
-				Debug("[HTTPClient] Redirecting to: " + string(location))
+				return c.Send(redirectPayload)
 			}
-
-			return c.Send(redirectPayload)
 		}
 	}
 
@@ -328,10 +591,85 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 	}
 
 	c.redirectsCount = 0
+	c.lastUsed = time.Now()
+
+	if c.config.DisableKeepAlive {
+		c.Disconnect()
+	}
 
 	return payload, err
 }
 
+// waitContinue waits for response to request with `Expect: 100-continue`, after its headers are sent. Returns number of
+// bytes received into response buffer, and false if server sent final response, like 401 or 417, so body should not be
+// sent. Final response can follow 100 Continue in the same read. If server doesn't respond in time, body is sent anyway.
+func (c *HTTPClient) waitContinue() (received int, send bool) {
+	c.conn.SetReadDeadline(c.limitDeadline(time.Now().Add(c.config.ContinueTimeout)))
+
+	continued := false
+	for received < len(c.respBuf) {
+		n, err := c.conn.Read(c.respBuf[received:])
+		received += n
+
+		if bytes.Contains(c.respBuf[:received], proto.EmptyLine) {
+			rest := c.skipInterimResponses(received)
+			continued = continued || rest != received
+			received = rest
+
+			if bytes.Contains(c.respBuf[:received], proto.EmptyLine) {
+				return received, false
+			}
+			if continued && received == 0 {
+				return 0, true
+			}
+		}
+
+		if err != nil {
+			return received, true
+		}
+	}
+
+	return received, false
+}
+
+// skipInterimResponses removes 1xx responses, except 101 Switching Protocols, from start of response buffer,
+// and returns number of remaining bytes
+func (c *HTTPClient) skipInterimResponses(n int) int {
+	for {
+		end := bytes.Index(c.respBuf[:n], proto.EmptyLine)
+		if end < 12 || !bytes.HasPrefix(c.respBuf, []byte("HTTP/")) {
+			return n
+		}
+
+		if status := c.respBuf[9:12]; status[0] != '1' || string(status) == "101" {
+			return n
+		}
+
+		end += len(proto.EmptyLine)
+		copy(c.respBuf, c.respBuf[end:n])
+		n -= end
+	}
+}
+
+// writeBody writes body in chunks, each with own deadline, so upload is limited by its progress rather than size
+func (c *HTTPClient) writeBody(body []byte) error {
+	for len(body) > 0 {
+		n := readChunkSize
+		if n > len(body) {
+			n = len(body)
+		}
+
+		c.conn.SetWriteDeadline(c.limitDeadline(time.Now().Add(c.config.Timeout)))
+		if _, err := c.conn.Write(body[:n]); err != nil {
+			return err
+		}
+
+		body = body[n:]
+	}
+
+	return nil
+}
+
 func (c *HTTPClient) Get(path string) (response []byte, err error) {
 	payload := "GET " + path + " HTTP/1.1\r\n\r\n"
 
@@ -370,3 +708,34 @@ func errorPayload(errorCode string) []byte {
 
 	return payload
 }
+
+// redirectURL resolves location against URL of request, or returns URL of request if location is empty
+func (c *HTTPClient) redirectURL(request, location []byte) string {
+	host := c.host
+	if h := proto.Header(request, []byte("Host")); c.config.OriginalHost && len(h) > 0 {
+		host = string(h)
+	}
+
+	root := &url.URL{Scheme: c.scheme, Host: host}
+	base, err := root.Parse(string(proto.Path(request)))
+	if err != nil {
+		return string(location)
+	}
+
+	u, err := base.Parse(string(location))
+	if err != nil {
+		return string(location)
+	}
+
+	return u.String()
+}
+
+func (c *HTTPClient) visited(u string) bool {
+	for _, v := range c.redirectsVisited {
+		if v == u {
+			return true
+		}
+	}
+
+	return false
+}
@@ -10,9 +10,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
+	"os"
+	"path/filepath"
 	_ "reflect"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -88,6 +92,38 @@ func TestHTTPClientSend(t *testing.T) {
 	wg.Wait()
 }
 
+func TestHTTPClientChunked(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		// Trailers are available after body is read
+		if string(body) != "10\r\n\r\n0\r\n\r\n0123456789" || r.Trailer.Get("X-Checksum") != "1" {
+			t.Errorf("Wrong body: %q, trailers: %v", body, r.Trailer)
+		}
+
+		w.Header().Set("Trailer", "X-Checksum")
+		w.(http.Flusher).Flush()
+		w.Write(body)
+		w.(http.Flusher).Flush()
+		w.Header().Set("X-Checksum", "2")
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{Timeout: 2 * time.Second})
+
+	// Chunk content looks like the last chunk
+	start := time.Now()
+	resp, err := client.Send([]byte("POST / HTTP/1.1\r\nHost: www.w3.org\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n15\r\n10\r\n\r\n0\r\n\r\n0123456789\r\n0\r\nX-Checksum: 1\r\n\r\n"))
+
+	if err != nil || !bytes.HasSuffix(resp, []byte("15\r\n10\r\n\r\n0\r\n\r\n0123456789\r\n0\r\nX-Checksum: 2\r\n\r\n")) {
+		t.Errorf("Wrong response: %q %v", resp, err)
+	}
+
+	if time.Since(start) > time.Second {
+		t.Error("Response with trailers should be read without waiting for timeout")
+	}
+}
+
 func TestHTTPClientResonseByClose(t *testing.T) {
 	wg := new(sync.WaitGroup)
 
@@ -325,6 +361,32 @@ func TestHTTPClientRedirect(t *testing.T) {
 	wg.Wait()
 }
 
+func TestHTTPClientOriginalHost(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.Host+" "+r.TLS.ServerName)
+		mu.Unlock()
+
+		if r.URL.Path == "/" {
+			http.Redirect(w, r, "/new", 301)
+		}
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{FollowRedirects: 1, OriginalHost: true})
+
+	client.Send([]byte("GET / HTTP/1.1\r\nHost: a.example.com\r\n\r\n"))
+	client.Send([]byte("GET /b HTTP/1.1\r\nHost: b.example.com:443\r\n\r\n"))
+
+	expected := []string{"a.example.com a.example.com", "a.example.com a.example.com", "b.example.com:443 b.example.com"}
+	if strings.Join(seen, ",") != strings.Join(expected, ",") {
+		t.Error("Original host should be kept in header, server name and redirects", seen)
+	}
+}
+
 func TestHTTPClientRedirectLimit(t *testing.T) {
 	wg := new(sync.WaitGroup)
 
@@ -357,6 +419,173 @@ func TestHTTPClientRedirectLimit(t *testing.T) {
 	wg.Wait()
 }
 
+func TestHTTPClientRedirectLoop(t *testing.T) {
+	var requests int64
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+
+		switch r.URL.Path {
+		case "/":
+			http.Redirect(w, r, "/login", 302)
+		case "/login":
+			http.Redirect(w, r, "/", 302)
+		case "/a":
+			http.Redirect(w, r, "/b", 302)
+		case "/b":
+			http.Redirect(w, r, "/c", 302)
+		}
+	}))
+	defer server.Close()
+
+	stats := new(RedirectStats)
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{FollowRedirects: 5, Redirects: stats})
+
+	// Loop is stopped at first redirect back to visited URL
+	resp, _ := client.Send([]byte("GET / HTTP/1.1\r\n\r\n"))
+	if atomic.LoadInt64(&requests) != 2 || !bytes.Equal(proto.Status(resp), []byte("302")) || stats.Followed != 1 || stats.Loops != 1 {
+		t.Errorf("Redirect loop should not be followed: %d requests, %q, %+v", requests, proto.Status(resp), *stats)
+	}
+
+	// Visited URLs are tracked by request
+	client.config.FollowRedirects = 1
+	client.Send([]byte("GET /a HTTP/1.1\r\n\r\n"))
+	if atomic.LoadInt64(&requests) != 4 || stats.Followed != 2 || stats.Limited != 1 {
+		t.Errorf("Only 1 redirect should be followed: %d requests, %+v", requests, *stats)
+	}
+}
+
+func TestHTTPClientExpectContinue(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/denied" {
+			w.WriteHeader(417)
+			return
+		}
+
+		// 100 Continue is sent by server when handler reads body
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{})
+
+	resp, _ := client.Send([]byte("POST / HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\nhello"))
+	if !bytes.Equal(proto.Status(resp), []byte("200")) || !bytes.Equal(proto.Body(resp), []byte("hello")) {
+		t.Errorf("Body should be sent after 100 Continue: %q", resp)
+	}
+
+	resp, _ = client.Send([]byte("POST /denied HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\nhello"))
+	if !bytes.Equal(proto.Status(resp), []byte("417")) {
+		t.Errorf("Final response should be returned without sending body: %q", resp)
+	}
+
+	// Connection is opened again, as body was not sent
+	resp, _ = client.Send([]byte("POST / HTTP/1.1\r\nContent-Length: 2\r\n\r\nok"))
+	if !bytes.Equal(proto.Body(resp), []byte("ok")) {
+		t.Errorf("Next request should be sent on new connection: %q", resp)
+	}
+}
+
+func TestHTTPClientExpectContinueTimeout(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// Server which doesn't support Expect gets body after timeout, and responds with interim response first
+		buf := make([]byte, 4096)
+		n := 0
+		for !bytes.HasSuffix(buf[:n], []byte("hello")) {
+			m, err := conn.Read(buf[n:])
+			if err != nil {
+				return
+			}
+			n += m
+		}
+
+		conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	}()
+
+	client := NewHTTPClient(ln.Addr().String(), &HTTPClientConfig{ContinueTimeout: 50 * time.Millisecond})
+
+	resp, _ := client.Send([]byte("POST / HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\nhello"))
+	if !bytes.Equal(resp, []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")) {
+		t.Errorf("Interim response should be skipped: %q", resp)
+	}
+}
+
+func TestHTTPClientExpectContinueFinalResponse(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+
+	bodySent := make(chan bool, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 4096)
+		n := 0
+		for !bytes.Contains(buf[:n], proto.EmptyLine) {
+			m, err := conn.Read(buf[n:])
+			if err != nil {
+				return
+			}
+			n += m
+		}
+
+		// Final response follows 100 Continue in the same packet
+		conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 417 Expectation Failed\r\nContent-Length: 0\r\n\r\n"))
+
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		m, _ := conn.Read(buf[n:])
+		bodySent <- bytes.HasSuffix(buf[:n+m], []byte("hello"))
+	}()
+
+	client := NewHTTPClient(ln.Addr().String(), &HTTPClientConfig{})
+
+	resp, _ := client.Send([]byte("POST / HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\nhello"))
+	if !bytes.Equal(proto.Status(resp), []byte("417")) {
+		t.Errorf("Final response should be returned: %q", resp)
+	}
+
+	if <-bodySent {
+		t.Error("Body should not be sent after final response")
+	}
+}
+
+func TestHTTPClientStreamBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(strconv.Itoa(len(body)) + " " + r.Host))
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{StreamThreshold: 1024})
+
+	body := bytes.Repeat([]byte("a"), 200*1024)
+	payload := append([]byte("POST / HTTP/1.1\r\nHost: www.example.com\r\nContent-Length: 204800\r\n\r\n"), body...)
+	original := append([]byte(nil), payload...)
+
+	resp, _ := client.Send(payload)
+	if expected := "204800 " + client.host; string(proto.Body(resp)) != expected {
+		t.Errorf("Expected %q, got %q", expected, proto.Body(resp))
+	}
+
+	// Headers are modified in copy, so payload can be sent again
+	if !bytes.Equal(payload, original) {
+		t.Error("Payload should not be modified")
+	}
+}
+
 func TestHTTPClientBasicAuth(t *testing.T) {
 	wg := new(sync.WaitGroup)
 	wg.Add(2)
@@ -482,3 +711,147 @@ func TestHTTPClientErrors(t *testing.T) {
 		t.Error("Should throw error")
 	}
 }
+
+func TestHTTPClientKeepAlive(t *testing.T) {
+	var mu sync.Mutex
+	remotes := make(map[string]bool)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		remotes[r.RemoteAddr] = true
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	connections := func(config *HTTPClientConfig, pause time.Duration) int {
+		mu.Lock()
+		remotes = make(map[string]bool)
+		mu.Unlock()
+
+		client := NewHTTPClient(server.URL, config)
+		for i := 0; i < 3; i++ {
+			client.Send([]byte("GET / HTTP/1.1\r\n\r\n"))
+			time.Sleep(pause)
+			client.CloseIdle()
+		}
+		client.Disconnect()
+
+		mu.Lock()
+		defer mu.Unlock()
+		return len(remotes)
+	}
+
+	if n := connections(&HTTPClientConfig{}, 0); n != 1 {
+		t.Error("Should reuse connection", n)
+	}
+
+	if n := connections(&HTTPClientConfig{DisableKeepAlive: true}, 0); n != 3 {
+		t.Error("Should open connection for each request", n)
+	}
+
+	if n := connections(&HTTPClientConfig{IdleTimeout: 10 * time.Millisecond}, 20*time.Millisecond); n != 3 {
+		t.Error("Should close idle connection", n)
+	}
+}
+
+func TestHTTPClientUnixSocket(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor")
+	defer os.RemoveAll(dir)
+
+	ln, err := net.Listen("unix", filepath.Join(dir, "app.sock"))
+	if err != nil {
+		t.Skip("Unix sockets are not supported: ", err)
+	}
+
+	var conns int64
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Host))
+		}),
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt64(&conns, 1)
+			}
+		},
+	}
+	go server.Serve(ln)
+	defer server.Close()
+
+	request := []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+
+	client := NewHTTPClient("unix://"+ln.Addr().String(), &HTTPClientConfig{})
+	client.Send(request)
+	resp, _ := client.Send(request)
+	if !bytes.HasSuffix(resp, []byte("\r\n\r\nlocalhost")) || atomic.LoadInt64(&conns) != 1 {
+		t.Errorf("Request should be sent to localhost through the same connection: %q, %d", resp, conns)
+	}
+
+	client = NewHTTPClient("unix://"+ln.Addr().String(), &HTTPClientConfig{OriginalHost: true})
+	if resp, _ = client.Send(request); !bytes.HasSuffix(resp, []byte("www.example.com")) {
+		t.Errorf("Original host should be kept: %q", resp)
+	}
+}
+
+func TestHTTPClientTimeouts(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				break
+			}
+
+			go func() {
+				defer conn.Close()
+
+				buf := make([]byte, 1024)
+				n, _ := conn.Read(buf)
+
+				switch {
+				case bytes.HasPrefix(buf[:n], []byte("GET /drip")):
+					// Body is sent byte by byte, each in time of chunk timeout
+					conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n"))
+					for i := 0; i < 100; i++ {
+						time.Sleep(50 * time.Millisecond)
+						if _, err := conn.Write([]byte("a")); err != nil {
+							return
+						}
+					}
+				case bytes.HasPrefix(buf[:n], []byte("GET /slow")):
+					time.Sleep(300 * time.Millisecond)
+					conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+				default:
+					// TLS handshake is never answered
+					time.Sleep(time.Second)
+				}
+			}()
+		}
+	}()
+
+	for name, tc := range map[string]struct {
+		address string
+		request string
+		config  HTTPClientConfig
+		status  string
+	}{
+		"Request":         {ln.Addr().String(), "GET /drip HTTP/1.1\r\n\r\n", HTTPClientConfig{Timeout: time.Second, RequestTimeout: 200 * time.Millisecond}, HTTP_TIMEOUT},
+		"Response header": {ln.Addr().String(), "GET /slow HTTP/1.1\r\n\r\n", HTTPClientConfig{Timeout: time.Second, ResponseHeaderTimeout: 100 * time.Millisecond}, HTTP_TIMEOUT},
+		"TLS handshake":   {"https://" + ln.Addr().String(), "GET / HTTP/1.1\r\n\r\n", HTTPClientConfig{Timeout: time.Second, TLSHandshakeTimeout: 100 * time.Millisecond}, HTTP_CONNECTION_ERROR},
+	} {
+		config := tc.config
+		client := NewHTTPClient(tc.address, &config)
+
+		start := time.Now()
+		resp, _ := client.Send([]byte(tc.request))
+
+		if status := string(proto.Status(resp)); status != tc.status {
+			t.Error(name, "Wrong status", status)
+		}
+
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Error(name, "Should time out earlier", elapsed)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 
 type HTTPModifier struct {
 	config *HTTPModifierConfig
+	dedup  *requestDeduplicator
 }
 
 func NewHTTPModifier(config *HTTPModifierConfig) *HTTPModifier {
@@ -22,11 +23,17 @@ func NewHTTPModifier(config *HTTPModifierConfig) *HTTPModifier {
 		len(config.paramHashFilters) == 0 &&
 		len(config.params) == 0 &&
 		len(config.headers) == 0 &&
-		len(config.methods) == 0 {
+		len(config.methods) == 0 &&
+		config.dedupWindow == 0 {
 		return nil
 	}
 
-	return &HTTPModifier{config: config}
+	m := &HTTPModifier{config: config}
+	if config.dedupWindow > 0 {
+		m.dedup = newRequestDeduplicator(config.dedupWindow)
+	}
+
+	return m
 }
 
 func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
@@ -34,6 +41,58 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 		return payload
 	}
 
+	if !m.matchMethod(payload) {
+		return
+	}
+
+	if len(m.config.headers) > 0 {
+		for _, header := range m.config.headers {
+			payload = proto.SetHeader(payload, []byte(header.Name), []byte(header.Value))
+		}
+	}
+
+	if len(m.config.params) > 0 {
+		for _, param := range m.config.params {
+			payload = proto.SetPathParam(payload, param.Name, param.Value)
+		}
+	}
+
+	if !m.matchURL(payload) || !m.matchHeaders(payload) {
+		return
+	}
+
+	if len(m.config.urlRewrite) > 0 {
+		path := proto.Path(payload)
+
+		for _, f := range m.config.urlRewrite {
+			if f.src.Match(path) {
+				path = f.src.ReplaceAll(path, f.target)
+				payload = proto.SetPath(payload, path)
+
+				break
+			}
+		}
+	}
+
+	// Only requests which passed filters are remembered
+	if m.dedup != nil && m.dedup.duplicate(payload) {
+		return
+	}
+
+	return payload
+}
+
+// Filter checks if request passes method, URL and header filters, without modifying it.
+// Unlike Rewrite, filters are applied to original request, before headers and params are set.
+func (m *HTTPModifier) Filter(payload []byte) bool {
+	if !proto.IsHTTPPayload(payload) {
+		return true
+	}
+
+	return m.matchMethod(payload) && m.matchURL(payload) && m.matchHeaders(payload)
+}
+
+func (m *HTTPModifier) matchMethod(payload []byte) bool {
 	if len(m.config.methods) > 0 {
 		method := proto.Method(payload)
 
@@ -47,22 +106,14 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 		}
 
 		if !matched {
-			return
+			return false
 		}
 	}
 
-	if len(m.config.headers) > 0 {
-		for _, header := range m.config.headers {
-			payload = proto.SetHeader(payload, []byte(header.Name), []byte(header.Value))
-		}
-	}
-
-	if len(m.config.params) > 0 {
-		for _, param := range m.config.params {
-			payload = proto.SetPathParam(payload, param.Name, param.Value)
-		}
-	}
+	return true
+}
 
+func (m *HTTPModifier) matchURL(payload []byte) bool {
 	if len(m.config.urlRegexp) > 0 {
 		path := proto.Path(payload)
 
@@ -76,7 +127,7 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 		}
 
 		if !matched {
-			return
+			return false
 		}
 	}
 
@@ -85,17 +136,21 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 
 		for _, f := range m.config.urlNegativeRegexp {
 			if f.regexp.Match(path) {
-				return
+				return false
 			}
 		}
 	}
 
+	return true
+}
+
+func (m *HTTPModifier) matchHeaders(payload []byte) bool {
 	if len(m.config.headerFilters) > 0 {
 		for _, f := range m.config.headerFilters {
 			value := proto.Header(payload, f.name)
 
 			if len(value) > 0 && !f.regexp.Match(value) {
-				return
+				return false
 			}
 		}
 	}
@@ -105,7 +160,7 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 			value := proto.Header(payload, f.name)
 
 			if len(value) > 0 && f.regexp.Match(value) {
-				return
+				return false
 			}
 		}
 	}
@@ -119,7 +174,7 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 				hasher.Write(value)
 
 				if (hasher.Sum32() % 100) >= f.percent {
-					return
+					return false
 				}
 			}
 		}
@@ -134,24 +189,11 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 				hasher.Write(value)
 
 				if (hasher.Sum32() % 100) >= f.percent {
-					return
+					return false
 				}
 			}
 		}
 	}
 
-	if len(m.config.urlRewrite) > 0 {
-		path := proto.Path(payload)
-
-		for _, f := range m.config.urlRewrite {
-			if f.src.Match(path) {
-				path = f.src.ReplaceAll(path, f.target)
-				payload = proto.SetPath(payload, path)
-
-				break
-			}
-		}
-	}
-
-	return payload
+	return true
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"time"
+
+	"github.com/buger/gor/proto"
+)
+
+// requestDeduplicator drops requests identical to one seen within window: same method, host, URL, body and client.
+// Retries captured in production, like ones made by client after timeout, would repeat side effects on replay.
+//
+// Modifier is used by single emitter loop, so it is not safe for concurrent use.
+type requestDeduplicator struct {
+	window time.Duration
+	// Time of first request by hash, duplicates don't extend window
+	seen      map[uint64]time.Time
+	lastClean time.Time
+
+	checked    uint64
+	duplicates uint64
+	lastReport time.Time
+}
+
+func newRequestDeduplicator(window time.Duration) *requestDeduplicator {
+	now := time.Now()
+	return &requestDeduplicator{window: window, seen: make(map[uint64]time.Time), lastClean: now, lastReport: now}
+}
+
+// dedupKey hashes request by method, Host, URL, body, and client IP if it is known, so identical requests of
+// different clients, like polling, are not treated as retries
+func dedupKey(payload []byte) uint64 {
+	h := fnv.New64a()
+	for _, part := range [][]byte{proto.Method(payload), proto.Header(payload, []byte("Host")), proto.Path(payload), clientIP(payload), proto.Body(payload)} {
+		h.Write(part)
+		// Separator, so parts can't be shifted into each other
+		h.Write([]byte{0})
+	}
+
+	return h.Sum64()
+}
+
+// duplicate returns true if the same request was seen within window
+func (d *requestDeduplicator) duplicate(payload []byte) bool {
+	now := time.Now()
+	key := dedupKey(payload)
+
+	d.checked++
+
+	dup := false
+	if first, ok := d.seen[key]; ok && now.Sub(first) < d.window {
+		dup = true
+		d.duplicates++
+	} else {
+		d.seen[key] = now
+	}
+
+	if now.Sub(d.lastClean) > d.window {
+		for k, first := range d.seen {
+			if now.Sub(first) >= d.window {
+				delete(d.seen, k)
+			}
+		}
+		d.lastClean = now
+	}
+
+	if Settings.stats && now.Sub(d.lastReport) > rate*time.Second {
+		log.Printf("[HTTP-MODIFIER] Dedup: requests: %d, duplicates dropped: %d, tracked: %d\n", d.checked, d.duplicates, len(d.seen))
+		d.lastReport = now
+	}
+
+	return dup
+}
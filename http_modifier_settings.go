@@ -6,6 +6,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // HTTPModifierConfig holds configuration options for built-in traffic modifier
@@ -21,6 +22,9 @@ type HTTPModifierConfig struct {
 	params  HTTPParams
 	headers HTTPHeaders
 	methods HTTPMethods
+
+	// Identical requests within window are dropped
+	dedupWindow time.Duration
 }
 
 //
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"github.com/buger/gor/proto"
 	"testing"
+	"time"
 )
 
 func TestHTTPModifierWithoutConfig(t *testing.T) {
@@ -257,3 +258,40 @@ func TestHTTPModifierSetParam(t *testing.T) {
 		t.Error("Should override param", string(payload))
 	}
 }
+
+func TestHTTPModifierDedup(t *testing.T) {
+	modifier := NewHTTPModifier(&HTTPModifierConfig{
+		dedupWindow: 50 * time.Millisecond,
+	})
+
+	payload := []byte("POST /orders HTTP/1.1\r\nHost: www.w3.org\r\nX-Real-IP: 10.0.0.1\r\nContent-Length: 7\r\n\r\na=1&b=2")
+
+	if len(modifier.Rewrite(payload)) == 0 {
+		t.Error("First request should pass")
+	}
+
+	if len(modifier.Rewrite(payload)) != 0 {
+		t.Error("Duplicate within window should be dropped")
+	}
+
+	for _, other := range []string{
+		"POST /orders HTTP/1.1\r\nHost: www.w3.org\r\nX-Real-IP: 10.0.0.1\r\nContent-Length: 7\r\n\r\na=1&b=3",
+		"POST /orders HTTP/1.1\r\nHost: www.w3.org\r\nX-Real-IP: 10.0.0.2\r\nContent-Length: 7\r\n\r\na=1&b=2",
+		"PUT /orders HTTP/1.1\r\nHost: www.w3.org\r\nX-Real-IP: 10.0.0.1\r\nContent-Length: 7\r\n\r\na=1&b=2",
+		"POST /orders?id=1 HTTP/1.1\r\nHost: www.w3.org\r\nX-Real-IP: 10.0.0.1\r\nContent-Length: 7\r\n\r\na=1&b=2",
+	} {
+		if len(modifier.Rewrite([]byte(other))) == 0 {
+			t.Errorf("Different request should pass: %q", other)
+		}
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if len(modifier.Rewrite(payload)) == 0 {
+		t.Error("Request should pass after window")
+	}
+
+	if modifier.dedup.checked != 7 || modifier.dedup.duplicates != 1 {
+		t.Error("Wrong counters", modifier.dedup.checked, modifier.dedup.duplicates)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// httpStorage implements fileStorage for `http://` and `https://` URLs, for example recordings stored on artifact server.
+//
+// HTTP has no listing, so pattern is used as URL of single file. If server supports ranged requests,
+// file is streamed with a single open-ended request, and on transient failure download is resumed from the current offset.
+// Compressed files are detected by content, so both `.gz` files and responses with `Content-Encoding: gzip` are supported.
+type httpStorage struct {
+	client *http.Client
+	sizes  map[string]int64
+	ranges map[string]bool
+}
+
+func newHTTPStorage() *httpStorage {
+	return &httpStorage{
+		// No overall timeout, since download of large file can take long time
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ResponseHeaderTimeout: 30 * time.Second,
+		}},
+		sizes:  make(map[string]int64),
+		ranges: make(map[string]bool),
+	}
+}
+
+func (s *httpStorage) do(method, url string, headers http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	// Read file as is, compression is detected by content
+	req.Header.Set("Accept-Encoding", "identity")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("HTTP %s %s: %s %s", method, url, resp.Status, msg)
+	}
+
+	return resp, nil
+}
+
+func (s *httpStorage) Glob(pattern string) ([]string, error) {
+	resp, err := s.do("HEAD", pattern, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	s.sizes[pattern] = resp.ContentLength
+	s.ranges[pattern] = resp.Header.Get("Accept-Ranges") == "bytes" && resp.ContentLength > 0
+
+	return []string{pattern}, nil
+}
+
+func (s *httpStorage) Open(name string) (io.ReadCloser, error) {
+	if !s.ranges[name] {
+		resp, err := s.do("GET", name, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return resp.Body, nil
+	}
+
+	// End of range is ignored: rest of file is requested, and new request is made only after failure
+	return newRangeReader(name, s.sizes[name], func(start, end int64) (io.ReadCloser, error) {
+		headers := http.Header{}
+		headers.Set("Range", "bytes="+strconv.FormatInt(start, 10)+"-")
+
+		resp, err := s.do("GET", name, headers)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return nil, fmt.Errorf("HTTP GET %s: server ignored range request", name)
+		}
+
+		return resp.Body, nil
+	}), nil
+}
+
+func (s *httpStorage) Size(name string) int64 {
+	if size := s.sizes[name]; size > 0 {
+		return size
+	}
+
+	return 0
+}
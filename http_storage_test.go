@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestInputFileHTTP(t *testing.T) {
+	var file bytes.Buffer
+	gz := gzip.NewWriter(&file)
+	for i := 0; i < 100; i++ {
+		gz.Write([]byte(fmt.Sprintf("1 1 %d\ntest%d", i, i)))
+		gz.Write([]byte(payloadSeparator))
+	}
+	gz.Close()
+
+	data := file.Bytes()
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/capture_0.gz" {
+			w.WriteHeader(404)
+			return
+		}
+
+		w.Header().Set("Accept-Ranges", "bytes")
+
+		if r.Method == "HEAD" {
+			w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+			return
+		}
+
+		requests++
+
+		var start int
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)-start))
+		w.WriteHeader(206)
+
+		// First response is interrupted in the middle
+		if requests == 1 {
+			w.Write(data[start : len(data)/2])
+			return
+		}
+
+		w.Write(data[start:])
+	}))
+	defer server.Close()
+
+	input := NewFileInput(server.URL+"/capture_0.gz", &FileInputConfig{})
+	defer input.Close()
+	buf := make([]byte, 1000)
+
+	for i := 0; i < 100; i++ {
+		n, _ := input.Read(buf)
+		if expected := fmt.Sprintf("1 1 %d\ntest%d", i, i); string(buf[:n]) != expected {
+			t.Fatalf("Expected %q, got %q", expected, buf[:n])
+		}
+	}
+
+	if requests != 2 {
+		t.Error("Should resume download after failure", requests)
+	}
+}
@@ -3,58 +3,274 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"compress/gzip"
 	"errors"
+	"fmt"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
-	"strconv"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type fileInputReader struct {
+	name      string
 	reader    *bufio.Reader
 	data      []byte
-	file      *os.File
+	file      io.Closer
 	timestamp int64
+
+	// In watch mode reader is not closed on EOF, since file can still be written to
+	watch bool
+	// Skip malformed payloads instead of stopping reading the file
+	tolerant bool
+	// Discard responses already while reading
+	requestsOnly bool
+	// Payload counters, shared by readers of the same file in different loops
+	stats *fileInputStats
+	// Payloads bigger than maxPayloadSize are skipped, or truncated if truncateOversized set
+	maxPayloadSize    int
+	truncateOversized bool
+	oversized         bool
+	eof               bool
+	// Time of last successfully parsed payload, used to close inactive files in watch mode
+	lastRead time.Time
+	// Unfinished payload and line, read before reaching EOF
+	buffer  bytes.Buffer
+	partial []byte
+
+	// Count of bytes read from file, and position right after current payload. Offset is stored atomically,
+	// since Close saves checkpoint while reader can still be used
+	read   int64
+	offset int64
+	// Position right after last payload passed to FileInput consumer, accessed atomically
+	emittedOffset int64
+	// Set when file is fully read, accessed atomically
+	done int32
+	// Read error, file is skipped after it
+	err error
+	// Number of requests skipped by starting from index point
+	indexedRequests int
+	// Counts raw (possibly compressed) bytes read from file
+	counter *countingReader
+
+	// Payloads decoded in background, nil if read-ahead is disabled
+	prefetch chan parsedPayload
+	// Closed once to stop background reader, which gets it as argument
+	quit     chan struct{}
+	quitOnce sync.Once
+	// File is closed by emitter when it is finished, or by Close on exit
+	fileMu     sync.Mutex
+	fileClosed bool
 }
 
-func (f *fileInputReader) parseNext() error {
+// countingReader counts bytes read from underlying file, used for progress reporting
+type countingReader struct {
+	io.ReadCloser
+	read int64
+}
+
+func (c *countingReader) Read(data []byte) (n int, err error) {
+	n, err = c.ReadCloser.Read(data)
+	atomic.AddInt64(&c.read, int64(n))
+	return
+}
+
+func (f *fileInputReader) stopReadAhead() {
+	if f.quit != nil {
+		f.quitOnce.Do(func() { close(f.quit) })
+	}
+}
+
+// finish closes file, so reader won't be used anymore
+func (f *fileInputReader) finish() {
+	f.stopReadAhead()
+	f.closeFile()
+
+	f.fileMu.Lock()
+	f.file = nil
+	f.fileMu.Unlock()
+
+	atomic.StoreInt32(&f.done, 1)
+}
+
+// parsedPayload is result of reading single payload from file
+type parsedPayload struct {
+	data      []byte
+	timestamp int64
+	// Position in file right after payload
+	offset int64
+	err    error
+}
+
+// readPayload reads next payload from file. In watch mode unfinished payload is kept on EOF, to be continued on next call.
+func (f *fileInputReader) readPayload() parsedPayload {
 	payloadSeparatorAsBytes := []byte(payloadSeparator)
-	var buffer bytes.Buffer
 
 	for {
 		line, err := f.reader.ReadBytes('\n')
+		f.read += int64(len(line))
+		atomic.AddInt64(&f.stats.BytesRead, int64(len(line)))
+
+		if f.partial != nil {
+			line = append(f.partial, line...)
+			f.partial = nil
+		}
 
 		if err != nil {
-			if err != io.EOF {
-				log.Println(err)
-				return err
+			if err == io.EOF && f.watch {
+				f.partial = line
+				return parsedPayload{err: err}
 			}
 
-			if err == io.EOF {
-				f.file.Close()
-				f.file = nil
-				return err
+			// Writer crashed before finishing last payload
+			if err == io.EOF && len(bytes.TrimSpace(f.buffer.Bytes())) > 0 {
+				f.buffer.Reset()
+				f.oversized = false
+				atomic.AddInt64(&f.stats.Corrupted, 1)
+
+				if !f.tolerant {
+					return parsedPayload{err: errors.New("truncated payload at the end of file")}
+				}
+
+				log.Println("[FILE-INPUT] Skipping truncated payload at the end of file", f.name)
 			}
+
+			return parsedPayload{err: err}
 		}
 
 		if bytes.Equal(payloadSeparatorAsBytes[1:], line) {
-			asBytes := buffer.Bytes()
-			meta := payloadMeta(asBytes)
+			asBytes := make([]byte, f.buffer.Len())
+			copy(asBytes, f.buffer.Bytes())
+			f.buffer.Reset()
+
+			oversized := f.oversized
+			f.oversized = false
+
+			// Strip new line preceding separator, unless it was cut off
+			if len(asBytes) > 0 && !oversized {
+				asBytes = asBytes[:len(asBytes)-1]
+			}
+
+			timestamp, err := validatePayloadMeta(asBytes)
+			if err != nil {
+				err = fmt.Errorf("malformed payload before offset %d: %v", f.read, err)
+				atomic.AddInt64(&f.stats.Corrupted, 1)
+
+				if !f.tolerant {
+					return parsedPayload{err: err}
+				}
+
+				log.Println("[FILE-INPUT] Skipping", err, "in", f.name)
+				continue
+			}
+
+			if f.requestsOnly && isResponsePayload(asBytes) {
+				atomic.AddInt64(&f.stats.Skipped, 1)
+				continue
+			}
 
-			f.timestamp, _ = strconv.ParseInt(string(meta[2]), 10, 64)
-			f.data = asBytes[:len(asBytes)-1]
+			if oversized {
+				if !f.truncateOversized {
+					atomic.AddInt64(&f.stats.Skipped, 1)
+					log.Println("[FILE-INPUT] Skipping payload bigger than", formatDataUnit(int64(f.maxPayloadSize)), "in", f.name)
+					continue
+				}
+
+				Debug("[FILE-INPUT] Truncating payload bigger than", formatDataUnit(int64(f.maxPayloadSize)), "in", f.name)
+			}
+
+			return parsedPayload{data: asBytes, timestamp: timestamp, offset: f.read}
+		}
+
+		// Rest of too big payload is discarded, to not keep it in memory
+		if f.maxPayloadSize > 0 && f.buffer.Len()+len(line) > f.maxPayloadSize {
+			f.oversized = true
+			line = line[:f.maxPayloadSize-f.buffer.Len()]
+		}
+
+		f.buffer.Write(line)
+	}
+}
+
+// readAhead decodes payloads in background, so decompression of multiple files runs in parallel.
+// Number of files decoded at the same time is limited by workers semaphore.
+func (f *fileInputReader) readAhead(workers chan struct{}, quit chan struct{}) {
+	defer close(f.prefetch)
+
+	batchSize := cap(f.prefetch)
+	if batchSize > fileReadAheadBatch {
+		batchSize = fileReadAheadBatch
+	}
+
+	batch := make([]parsedPayload, 0, batchSize)
+
+	for {
+		workers <- struct{}{}
+		for len(batch) < batchSize {
+			p := f.readPayload()
+			batch = append(batch, p)
+
+			if p.err != nil {
+				break
+			}
+		}
+		<-workers
+
+		for _, p := range batch {
+			select {
+			case f.prefetch <- p:
+			case <-quit:
+				return
+			}
+
+			if p.err != nil {
+				return
+			}
+		}
+
+		batch = batch[:0]
+	}
+}
+
+func (f *fileInputReader) parseNext() error {
+	var p parsedPayload
+
+	if f.prefetch != nil {
+		var ok bool
+		if p, ok = <-f.prefetch; !ok {
+			p.err = io.EOF
+		}
+	} else {
+		p = f.readPayload()
+	}
+
+	if p.err != nil {
+		if p.err == io.EOF && f.watch {
+			f.eof = true
+			return p.err
+		}
 
-			return nil
+		if p.err != io.EOF {
+			f.err = fmt.Errorf("Error reading file %s: %v", f.name, p.err)
 		}
 
-		buffer.Write(line)
+		f.finish()
+		return p.err
 	}
 
+	f.data = p.data
+	f.timestamp = p.timestamp
+	atomic.StoreInt64(&f.offset, p.offset)
+	f.eof = false
+	f.lastRead = time.Now()
+
 	return nil
 }
 
@@ -64,31 +280,171 @@ func (f *fileInputReader) ReadPayload() []byte {
 	return f.data
 }
 func (f *fileInputReader) Close() error {
-	if f.file != nil {
+	f.stopReadAhead()
+	f.closeFile()
+
+	return nil
+}
+
+func (f *fileInputReader) closeFile() {
+	f.fileMu.Lock()
+	defer f.fileMu.Unlock()
+
+	if f.file != nil && !f.fileClosed {
 		f.file.Close()
+		f.fileClosed = true
 	}
+}
 
-	return nil
+// Supported input file formats
+const (
+	fileFormatGor   = "gor"
+	fileFormatHAR   = "har"
+	fileFormatJSONL = "jsonl"
+)
+
+// Policies for payloads bigger than --input-file-max-payload-size
+const (
+	oversizeSkip     = "skip"
+	oversizeTruncate = "truncate"
+)
+
+// fileInputFormat returns format set by --input-file-format, or detects it by file extension,
+// ignoring compression extension: `requests.har`, `requests.jsonl.gz`
+func fileInputFormat(name, format string) string {
+	if format != "" {
+		return format
+	}
+
+	if compressedFileExt(name) {
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".har":
+		return fileFormatHAR
+	case ".jsonl":
+		return fileFormatJSONL
+	default:
+		return fileFormatGor
+	}
 }
 
-func NewFileInputReader(path string) *fileInputReader {
-	file, err := os.Open(path)
+// convertFileFormat returns reader which converts data in given format to Gor format
+func convertFileFormat(r *bufio.Reader, format string) (*bufio.Reader, error) {
+	switch format {
+	case fileFormatHAR:
+		har, err := newHARReader(r)
+		if err != nil {
+			return nil, err
+		}
+
+		return bufio.NewReader(har), nil
+	case fileFormatJSONL:
+		return bufio.NewReader(newJSONLReader(r)), nil
+	default:
+		return r, nil
+	}
+}
+
+// newFileInputReader creates reader for given file, skipping first `offset` bytes of (decompressed) data
+// If read-ahead is enabled, payloads are decoded in background using one of `workers`.
+// If file has index, reading starts from the last index point before offset, `skipRequests` requests or --input-file-from time.
+func newFileInputReader(path string, file io.ReadCloser, config *FileInputConfig, offset int64, skipRequests int, workers chan struct{}, stats *fileInputStats) *fileInputReader {
+	r := &fileInputReader{name: path, watch: config.watch, tolerant: config.skipCorrupted, requestsOnly: config.requestsOnly, lastRead: time.Now()}
+	r.stats = stats
+	r.maxPayloadSize = int(config.maxPayloadSize)
+	r.truncateOversized = config.oversizePolicy == oversizeTruncate
+	r.counter = &countingReader{ReadCloser: file}
+	r.file = r.counter
+
+	// Position in decompressed data, where reading starts
+	var start int64
+	if f, ok := file.(*os.File); ok {
+		if e, found := findFileIndexEntry(loadFileIndex(path+fileIndexExt), offset, skipRequests, int64(config.from)); found {
+			if _, err := f.Seek(e.fileOffset, io.SeekStart); err != nil {
+				r.err = fmt.Errorf("Can't seek to index point of file %s: %v", path, err)
+				r.finish()
+				return r
+			}
+
+			Debug("[FILE-INPUT] Starting", path, "from index point at", e.requests, "requests")
+			r.counter.read = e.fileOffset
+			r.indexedRequests = e.requests
+			start = e.streamOffset
+		}
+	}
+
+	bufferSize := int(config.bufferSize)
+	if bufferSize <= 0 {
+		bufferSize = fileInputBufferSize
+	}
+	r.reader = bufio.NewReaderSize(r.counter, bufferSize)
+
+	encrypted := isEncrypted(r.reader)
+	if encrypted {
+		if len(config.encryptionKey) == 0 && !isEnvelopeEncrypted(r.reader) {
+			r.err = fmt.Errorf("File %s is encrypted, set --input-file-encryption-key", path)
+			r.finish()
+			return r
+		}
+
+		decryptor, err := newDecryptReader(r.reader, config.encryptionKey, config.watch)
+		if err != nil {
+			r.err = fmt.Errorf("Can't decrypt file %s: %v", path, err)
+			r.finish()
+			return r
+		}
+
+		r.reader = bufio.NewReaderSize(decryptor, bufferSize)
+	}
 
+	decompressor, err := newDecompressor(r.reader)
 	if err != nil {
-		log.Println(err)
-		return nil
+		r.err = fmt.Errorf("Can't read compressed file %s: %v", path, err)
+		r.finish()
+		return r
 	}
 
-	r := &fileInputReader{file: file}
-	if strings.HasSuffix(path, ".gz") {
-		gzReader, err := gzip.NewReader(file)
+	if decompressor != nil {
+		r.reader = bufio.NewReaderSize(decompressor, bufferSize)
+		r.file = multiCloser{decompressor, r.counter}
+	}
+
+	// Other formats are converted to Gor format
+	format := fileInputFormat(path, config.format)
+	if r.reader, err = convertFileFormat(r.reader, format); err != nil {
+		r.err = fmt.Errorf("Can't parse %s file %s: %v", format, path, err)
+		r.finish()
+		return r
+	}
+	converted := format != fileFormatGor
+
+	if offset > 0 {
+		if seeker, ok := file.(io.Seeker); ok && !encrypted && decompressor == nil && !converted {
+			_, err = seeker.Seek(offset, io.SeekStart)
+			r.counter.read = offset
+			r.reader.Reset(r.counter)
+		} else {
+			_, err = io.CopyN(ioutil.Discard, r.reader, offset-start)
+		}
+
 		if err != nil {
-			log.Println(err)
-			return nil
+			r.err = fmt.Errorf("Can't skip to checkpoint offset %d of file %s: %v", offset, path, err)
+			r.finish()
+			return r
 		}
-		r.reader = bufio.NewReader(gzReader)
-	} else {
-		r.reader = bufio.NewReader(file)
+
+		r.read, r.offset, r.emittedOffset = offset, offset, offset
+	} else if start > 0 {
+		r.read, r.offset, r.emittedOffset = start, start, start
+	}
+
+	// In watch mode files are read as they grow, so there is nothing to read ahead
+	if config.readAhead > 0 && !config.watch {
+		r.prefetch = make(chan parsedPayload, config.readAhead)
+		r.quit = make(chan struct{})
+		go r.readAhead(workers, r.quit)
 	}
 
 	r.parseNext()
@@ -96,32 +452,169 @@ func NewFileInputReader(path string) *fileInputReader {
 	return r
 }
 
+// FileInputConfig holds configuration options for FileInput
+type FileInputConfig struct {
+	loop bool
+	// Stop after replaying files given number of times, 0 means infinite loop
+	loopCount int
+	// Replay speed multiplier: 2 replays twice as fast, 0.5 twice as slow
+	speedFactor float64
+	// Keep scanning pattern for new files instead of exiting on EOF
+	watch bool
+	// Replay only payloads with timestamp in [from, to] window
+	from timestampVar
+	to   timestampVar
+	// File where replay position is saved, to resume after restart
+	checkpoint string
+	// How often to print replay progress, 0 disables it
+	progressInterval time.Duration
+	// File format: gor, har or jsonl. Detected by file extension if not set
+	format string
+	// Percent of requests (with their responses) to replay, 0 means all
+	sample percentVar
+	// Number of payloads decoded ahead for each file, 0 disables background decoding
+	readAhead int
+	// Replay requests at constant rate per second, ignoring recorded timing
+	rate rateVar
+	// Apply HTTP modifier filters (--http-allow-url, --http-allow-method, etc.) when reading files
+	filter bool
+	// Log and skip malformed payloads, instead of skipping the rest of file
+	skipCorrupted bool
+	// Maximum pause between replayed payloads, 0 means no limit
+	maxWait time.Duration
+	// Read only requests, and discard recorded responses
+	requestsOnly bool
+	// Skip given number of requests, or all requests before request with given ID, before starting replay
+	skip    int
+	startID string
+	// Size of read buffer, default 4kb
+	bufferSize unitSizeVar
+	// Payloads bigger than maxPayloadSize are handled according to oversizePolicy: skipped or truncated
+	maxPayloadSize unitSizeVar
+	oversizePolicy string
+	// AES key for decryption of files written with --output-file-encryption-key
+	encryptionKey encryptionKeyVar
+	// Report payload counters of each file every 5 seconds
+	stats bool
+}
+
+const (
+	// How often pattern is re-scanned in watch mode
+	fileWatchInterval = time.Second
+	// In watch mode file is closed if nothing was appended to it during this period
+	fileWatchInactiveTimeout = time.Minute
+	// How often replay position is saved to checkpoint file
+	fileCheckpointInterval = time.Second
+	// Max number of payloads decoded by read-ahead worker at once
+	fileReadAheadBatch = 100
+	// Default size of read buffer
+	fileInputBufferSize = 4096
+)
+
+// filePayload is payload read from file, along with its end position in that file
+type filePayload struct {
+	data   []byte
+	reader *fileInputReader
+	offset int64
+}
+
 // FileInput can read requests generated by FileOutput
 type FileInput struct {
-	mu          sync.Mutex
-	data        chan []byte
-	exit        chan bool
-	path        string
-	readers     []*fileInputReader
+	// Timestamps of first and last emitted payloads, used for progress reporting.
+	// Keep them first for 64bit alignment, required by atomic.
+	firstTimestamp int64
+	lastTimestamp  int64
+	// Set when replay is finished, accessed atomically
+	finished int32
+
+	mu      sync.Mutex
+	data    chan filePayload
+	exit    chan bool
+	errs    chan error
+	path    string
+	storage fileStorage
+	readers []*fileInputReader
+	// Limits number of files decoded at the same time in read-ahead mode
+	workers chan struct{}
+	rate    *constantRate
+	seen    map[string]bool
+	// Positions loaded from checkpoint file, used only until first loop restart
+	resume      map[string]fileCheckpoint
 	speedFactor float64
 	loop        bool
+
+	// Used to filter requests when reading files
+	modifier *HTTPModifier
+	// IDs of requests dropped by filter or fast-forward, to drop their responses too
+	dropped          map[string]time.Time
+	droppedCleanTime time.Time
+	// Payload counters of each file
+	stats map[string]*fileInputStats
+	// Number of requests skipped by --input-file-skip, and if --input-file-start-id was found
+	skippedRequests int
+	startFound      bool
+
+	config *FileInputConfig
 }
 
 // NewFileInput constructor for FileInput. Accepts file path as argument.
-func NewFileInput(path string, loop bool) (i *FileInput) {
+func NewFileInput(path string, config *FileInputConfig) (i *FileInput) {
 	i = new(FileInput)
-	i.data = make(chan []byte, 1000)
+	i.data = make(chan filePayload, 1000)
 	i.exit = make(chan bool, 1)
+	i.errs = make(chan error, 100)
 	i.path = path
+	i.storage = newFileStorage(path)
+	i.workers = make(chan struct{}, runtime.NumCPU())
+	i.config = config
 	i.speedFactor = 1
-	i.loop = loop
+	// Standard input can be read only once
+	i.loop = (config.loop || config.loopCount > 0) && path != stdinPath
+
+	if config.speedFactor > 0 {
+		i.speedFactor = config.speedFactor
+	}
+
+	switch config.oversizePolicy {
+	case "", oversizeSkip, oversizeTruncate:
+	default:
+		log.Fatal("[FILE-INPUT] --input-file-oversize-policy should be skip or truncate, got: ", config.oversizePolicy)
+	}
+
+	if config.rate > 0 {
+		i.rate = newConstantRate(float64(config.rate))
+	}
+
+	i.stats = make(map[string]*fileInputStats)
+	i.dropped = make(map[string]time.Time)
+	i.droppedCleanTime = time.Now()
+
+	if config.filter {
+		i.modifier = NewHTTPModifier(&Settings.modifierConfig)
+	}
+
+	if config.checkpoint != "" {
+		var err error
+		if i.resume, err = loadFileInputCheckpoint(config.checkpoint, path); err != nil {
+			log.Println("Can't load checkpoint", config.checkpoint, err)
+		}
+	}
 
-	if err := i.init(); err != nil {
+	// In watch mode files may appear later
+	if err := i.init(); err != nil && !config.watch {
 		return
 	}
 
 	go i.emit()
 
+	if config.progressInterval > 0 {
+		go i.reportProgress()
+	}
+
+	if config.stats {
+		go i.reportStats()
+	}
+
 	return
 }
 
@@ -135,31 +628,142 @@ func (i *FileInput) init() (err error) {
 	defer i.mu.Unlock()
 	i.mu.Lock()
 
-	var matches []string
+	// Restarting loop, replay files from the beginning
+	if i.readers != nil {
+		i.resume = nil
+	}
 
-	if matches, err = filepath.Glob(i.path); err != nil {
+	i.readers = nil
+	i.seen = make(map[string]bool)
+
+	matches, err := i.scan()
+	if err != nil {
 		log.Println("Wrong file pattern", i.path, err)
 		return
 	}
 
-	if len(matches) == 0 {
+	if matches == 0 {
 		log.Println("No files match pattern: ", i.path)
 		return errors.New("No matching files")
 	}
 
-	i.readers = make([]*fileInputReader, len(matches))
+	// Glob returns files in lexical order, which is wrong for chunks like `_9` and `_10`.
+	// Order by first payload, so payloads with equal timestamps from different files keep real chronology.
+	sort.SliceStable(i.readers, func(a, b int) bool {
+		return i.readers[a].timestamp < i.readers[b].timestamp
+	})
+
+	return nil
+}
+
+// scan opens files matching pattern which were not opened before
+func (i *FileInput) scan() (matches int, err error) {
+	paths, err := i.storage.Glob(i.path)
+	if err != nil {
+		return 0, err
+	}
 
-	for idx, p := range matches {
-		i.readers[idx] = NewFileInputReader(p)
+	// Output written with --output-file-shards: `requests.gor` replays all `requests_shardN_*.gor` files
+	if len(paths) == 0 && i.path != stdinPath {
+		if paths, err = i.storage.Glob(shardPath(i.path, "*")); err != nil {
+			return 0, err
+		}
 	}
 
-	return nil
+	for _, p := range paths {
+		if i.seen[p] {
+			continue
+		}
+		i.seen[p] = true
+
+		var offset int64
+		if cp, ok := i.resume[p]; ok {
+			if cp.Done {
+				continue
+			}
+			offset = cp.Offset
+		}
+
+		file, err := i.storage.Open(p)
+		if err != nil {
+			i.reportError(err)
+			continue
+		}
+
+		// Requests can be skipped by index only if they are counted same way as by fastForward
+		var skipRequests int
+		if len(paths) == 1 && offset == 0 && i.config.skip > i.skippedRequests && i.config.startID == "" &&
+			i.config.from == 0 && i.config.sample == 0 && i.modifier == nil {
+			skipRequests = i.config.skip - i.skippedRequests
+		}
+
+		r := newFileInputReader(p, file, i.config, offset, skipRequests, i.workers, i.fileStats(p))
+		i.checkError(r)
+		i.skippedRequests += r.indexedRequests
+		i.readers = append(i.readers, r)
+	}
+
+	return len(paths), nil
+}
+
+// watch checks if new data was appended to already opened files, and looks for new files
+func (i *FileInput) watch() {
+	defer i.mu.Unlock()
+	i.mu.Lock()
+
+	for _, r := range i.readers {
+		if r.file == nil || !r.eof {
+			continue
+		}
+
+		err := r.parseNext()
+		i.checkError(r)
+
+		if err == io.EOF && time.Since(r.lastRead) > fileWatchInactiveTimeout {
+			Debug("[FILE-INPUT] Closing inactive file")
+			r.finish()
+		}
+	}
+
+	if _, err := i.scan(); err != nil {
+		log.Println("Wrong file pattern", i.path, err)
+	}
+}
+
+// Errors returns channel with file read errors. Broken files are skipped, and replay continues with the rest of files.
+func (i *FileInput) Errors() <-chan error {
+	return i.errs
+}
+
+func (i *FileInput) reportError(err error) {
+	log.Println("[FILE-INPUT]", err)
+
+	// Do not block if nobody reads errors
+	select {
+	case i.errs <- err:
+	default:
+	}
+}
+
+// checkError reports reader error, if any
+func (i *FileInput) checkError(r *fileInputReader) {
+	if r.err != nil {
+		i.reportError(r.err)
+		r.err = nil
+	}
 }
 
 func (i *FileInput) Read(data []byte) (int, error) {
-	buf := <-i.data
+	p, ok := <-i.data
+	if !ok {
+		return 0, io.EOF
+	}
+	buf := p.data
 	copy(data, buf)
 
+	// Position is updated only when payload is actually consumed
+	atomic.StoreInt64(&p.reader.emittedOffset, p.offset)
+
 	return len(buf), nil
 }
 
@@ -170,7 +774,7 @@ func (i *FileInput) String() string {
 // Find reader with smallest timestamp e.g next payload in row
 func (i *FileInput) nextReader() (next *fileInputReader) {
 	for _, r := range i.readers {
-		if r == nil || r.file == nil {
+		if r == nil || r.file == nil || r.eof {
 			continue
 		}
 
@@ -183,8 +787,114 @@ func (i *FileInput) nextReader() (next *fileInputReader) {
 	return
 }
 
+// constantRate paces requests at fixed rate. Works as token bucket with capacity of single token,
+// so requests delayed by slow reading are not sent in burst later.
+type constantRate struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func newConstantRate(perSecond float64) *constantRate {
+	return &constantRate{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+func (r *constantRate) wait() {
+	now := time.Now()
+
+	if r.next.After(now) {
+		time.Sleep(r.next.Sub(now))
+		now = r.next
+	}
+
+	r.next = now.Add(r.interval)
+}
+
+// filter applies HTTP modifier filters to requests, and drops responses of filtered requests
+func (i *FileInput) filter(payload []byte) bool {
+	id := string(payloadMeta(payload)[1])
+
+	if isRequestPayload(payload) {
+		if i.modifier.Filter(payloadBody(payload)) {
+			return true
+		}
+
+		i.dropped[id] = time.Now()
+		return false
+	}
+
+	return !i.droppedResponse(id)
+}
+
+// fastForward skips requests before --input-file-start-id, and first --input-file-skip requests, along with their responses
+func (i *FileInput) fastForward(payload []byte) bool {
+	id := string(payloadMeta(payload)[1])
+
+	if !isRequestPayload(payload) {
+		return i.droppedResponse(id)
+	}
+
+	if i.config.startID != "" && !i.startFound {
+		if id != i.config.startID {
+			i.dropped[id] = time.Now()
+			return true
+		}
+
+		i.startFound = true
+	}
+
+	if i.skippedRequests < i.config.skip {
+		i.skippedRequests++
+		i.dropped[id] = time.Now()
+		return true
+	}
+
+	return false
+}
+
+// droppedResponse checks if payload with given id is response of dropped request
+func (i *FileInput) droppedResponse(id string) bool {
+	if _, ok := i.dropped[id]; ok {
+		delete(i.dropped, id)
+		return true
+	}
+
+	// Clean up dropped requests for which we didn't get a response
+	if now := time.Now(); now.Sub(i.droppedCleanTime) > time.Minute {
+		for k, v := range i.dropped {
+			if now.Sub(v) > time.Minute {
+				delete(i.dropped, k)
+			}
+		}
+		i.droppedCleanTime = now
+	}
+
+	return false
+}
+
+// skip drops current payload of reader without emitting it.
+// Checkpoint position is updated by next emitted payload.
+func (i *FileInput) skip(r *fileInputReader) {
+	atomic.AddInt64(&r.stats.Skipped, 1)
+	r.ReadPayload()
+	i.checkError(r)
+}
+
+// sampled decides if request should be replayed, based on hash of its ID.
+// This way responses are dropped together with their requests, without tracking dropped IDs.
+func sampled(id []byte, percent float64) bool {
+	h := fnv.New32a()
+	h.Write(id)
+
+	return float64(h.Sum32()%10000) < percent*100
+}
+
 func (i *FileInput) emit() {
 	var lastTime int64 = -1
+	var loops, emitted int
+	// Shift added to timestamps of emitted payloads, so they keep growing across loops
+	var rebase, lastEmitted int64
+	rebasePending := false
+	lastCheckpoint := time.Now()
 
 	for {
 		select {
@@ -197,7 +907,25 @@ func (i *FileInput) emit() {
 
 		if reader == nil {
 			if i.loop {
+				loops++
+				if i.config.loopCount > 0 && loops >= i.config.loopCount {
+					break
+				}
+
 				i.init()
+				atomic.StoreInt64(&i.firstTimestamp, 0)
+				lastTime = -1
+				rebasePending = emitted > 0
+				continue
+			} else if i.config.watch {
+				select {
+				case <-i.exit:
+					return
+				case <-time.After(fileWatchInterval):
+				}
+
+				i.watch()
+				// Do not wait for the time spent waiting for new data
 				lastTime = -1
 				continue
 			} else {
@@ -205,7 +933,40 @@ func (i *FileInput) emit() {
 			}
 		}
 
-		if lastTime != -1 {
+		// Payloads in file are ordered by time, so the rest of file is outside of window too
+		if i.config.to != 0 && reader.timestamp > int64(i.config.to) {
+			reader.finish()
+			continue
+		}
+
+		if reader.timestamp < int64(i.config.from) {
+			i.skip(reader)
+			continue
+		}
+
+		if i.config.sample > 0 && !sampled(payloadMeta(reader.data)[1], float64(i.config.sample)) {
+			i.skip(reader)
+			continue
+		}
+
+		if i.modifier != nil && !i.filter(reader.data) {
+			i.skip(reader)
+			continue
+		}
+
+		if (i.config.skip > 0 || i.config.startID != "") && i.fastForward(reader.data) {
+			i.skip(reader)
+			continue
+		}
+
+		offset := reader.offset
+
+		if i.rate != nil {
+			// Recorded timing is ignored, only requests are paced
+			if isRequestPayload(reader.data) {
+				i.rate.wait()
+			}
+		} else if lastTime != -1 {
 			diff := reader.timestamp - lastTime
 			lastTime = reader.timestamp
 
@@ -213,15 +974,68 @@ func (i *FileInput) emit() {
 				diff = int64(float64(diff) / i.speedFactor)
 			}
 
+			// Skip over long pauses in recording, like quiet night hours
+			if i.config.maxWait > 0 && diff > int64(i.config.maxWait) {
+				diff = int64(i.config.maxWait)
+			}
+
 			time.Sleep(time.Duration(diff))
 		} else {
 			lastTime = reader.timestamp
 		}
 
-		i.data <- reader.ReadPayload()
+		atomic.CompareAndSwapInt64(&i.firstTimestamp, 0, reader.timestamp)
+		atomic.StoreInt64(&i.lastTimestamp, reader.timestamp)
+
+		// Next loop continues right after last payload of previous one
+		if rebasePending {
+			rebase = lastEmitted - reader.timestamp
+			rebasePending = false
+		}
+		lastEmitted = reader.timestamp + rebase
+
+		payload := reader.ReadPayload()
+		if rebase != 0 {
+			payload = payloadWithTimestamp(payload, lastEmitted)
+		}
+
+		if isRequestPayload(payload) || payload[0] == UDPRequestPayload {
+			atomic.AddInt64(&reader.stats.Requests, 1)
+		} else {
+			atomic.AddInt64(&reader.stats.Responses, 1)
+		}
+
+		i.data <- filePayload{payload, reader, offset}
+		i.checkError(reader)
+		emitted++
+
+		if i.config.checkpoint != "" && time.Since(lastCheckpoint) > fileCheckpointInterval {
+			i.saveCheckpoint()
+			lastCheckpoint = time.Now()
+		}
 	}
 
 	log.Printf("FileInput: end of file '%s'\n", i.path)
+	atomic.StoreInt32(&i.finished, 1)
+
+	if i.config.progressInterval > 0 {
+		log.Println(i.progress())
+	}
+
+	if i.config.stats {
+		i.printStats()
+	}
+
+	if i.config.checkpoint != "" {
+		i.saveCheckpoint()
+	}
+
+	if i.config.loopCount > 0 {
+		log.Printf("FileInput: replayed '%s' %d times, %d payloads emitted\n", i.path, loops, emitted)
+	}
+
+	// Let emitter know that input is finished, so gor can exit and report assertions
+	close(i.data)
 }
 
 func (i *FileInput) Close() error {
@@ -229,6 +1043,11 @@ func (i *FileInput) Close() error {
 	i.mu.Lock()
 
 	i.exit <- true
+	atomic.StoreInt32(&i.finished, 1)
+
+	if i.config.checkpoint != "" {
+		i.writeCheckpoint()
+	}
 
 	for _, r := range i.readers {
 		r.Close()
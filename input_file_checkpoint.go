@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// fileCheckpoint is replay position inside single input file.
+// For compressed files offset is position in decompressed data.
+type fileCheckpoint struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Done   bool   `json:"done,omitempty"`
+}
+
+type fileInputCheckpoint struct {
+	Path  string           `json:"path"`
+	Files []fileCheckpoint `json:"files"`
+}
+
+// loadFileInputCheckpoint reads positions saved by FileInput with the same path pattern.
+// Missing checkpoint file is not an error, replay just starts from the beginning.
+func loadFileInputCheckpoint(name, path string) (map[string]fileCheckpoint, error) {
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cp fileInputCheckpoint
+	if err = json.Unmarshal(data, &cp); err != nil {
+		return nil, err
+	}
+
+	if cp.Path != path {
+		log.Println("Checkpoint", name, "was created for different input", cp.Path, "ignoring it")
+		return nil, nil
+	}
+
+	files := make(map[string]fileCheckpoint, len(cp.Files))
+	for _, f := range cp.Files {
+		files[f.Name] = f
+	}
+
+	return files, nil
+}
+
+func (i *FileInput) saveCheckpoint() {
+	defer i.mu.Unlock()
+	i.mu.Lock()
+
+	i.writeCheckpoint()
+}
+
+// writeCheckpoint saves position of all files, should be called with FileInput lock held.
+// File is replaced atomically, so it is never left half written.
+func (i *FileInput) writeCheckpoint() {
+	cp := fileInputCheckpoint{Path: i.path}
+	saved := make(map[string]bool)
+
+	for _, r := range i.readers {
+		offset := atomic.LoadInt64(&r.emittedOffset)
+		// Last payload of finished file can still wait to be consumed
+		done := atomic.LoadInt32(&r.done) == 1 && offset == atomic.LoadInt64(&r.offset)
+
+		cp.Files = append(cp.Files, fileCheckpoint{Name: r.name, Offset: offset, Done: done})
+		saved[r.name] = true
+	}
+
+	// Files finished before restart are not opened again
+	for name, f := range i.resume {
+		if !saved[name] && f.Done {
+			cp.Files = append(cp.Files, f)
+		}
+	}
+
+	data, _ := json.Marshal(cp)
+
+	tmp := i.config.checkpoint + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0660); err != nil {
+		log.Println("Can't save checkpoint", err)
+		return
+	}
+
+	if err := os.Rename(tmp, i.config.checkpoint); err != nil {
+		log.Println("Can't save checkpoint", err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+func (i *FileInput) reportProgress() {
+	ticker := time.NewTicker(i.config.progressInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if atomic.LoadInt32(&i.finished) == 1 {
+			return
+		}
+
+		log.Println(i.progress())
+	}
+}
+
+// progress returns human readable replay progress.
+// For compressed files progress is based on compressed size.
+// ETA is estimated from recorded time of already replayed payloads, adjusted by speed factor.
+func (i *FileInput) progress() string {
+	var read, total int64
+
+	i.mu.Lock()
+	for _, r := range i.readers {
+		read += atomic.LoadInt64(&r.counter.read)
+		total += i.storage.Size(r.name)
+	}
+	i.mu.Unlock()
+
+	msg := fmt.Sprintf("[FILE-INPUT] Progress '%s': %s / %s", i.path, formatDataUnit(read), formatDataUnit(total))
+
+	if total == 0 {
+		return msg
+	}
+
+	done := float64(read) / float64(total)
+	msg += fmt.Sprintf(" (%.1f%%)", done*100)
+
+	first := atomic.LoadInt64(&i.firstTimestamp)
+	last := atomic.LoadInt64(&i.lastTimestamp)
+
+	if done > 0 && done < 1 && last > first {
+		remaining := float64(last-first) * (1 - done) / done / i.speedFactor
+		msg += ", ETA " + time.Duration(remaining).Round(time.Second).String()
+	}
+
+	return msg
+}
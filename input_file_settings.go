@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseTimestamp accepts time in RFC3339 or "2006-01-02 15:04:05" format (local time zone is used if not specified),
+// or unix timestamp in seconds, and returns it in nanoseconds, same as used in payload meta.
+func parseTimestamp(s string) (int64, error) {
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ts * int64(time.Second), nil
+	}
+
+	for _, layout := range timestampLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t.UnixNano(), nil
+		}
+	}
+
+	return 0, errors.New("Unknown time format: " + s)
+}
+
+// timestampVar holds time in nanoseconds, 0 if not set
+type timestampVar int64
+
+func (t *timestampVar) String() string {
+	if *t == 0 {
+		return ""
+	}
+
+	return time.Unix(0, int64(*t)).Format(time.RFC3339)
+}
+
+func (t *timestampVar) Set(s string) error {
+	ts, err := parseTimestamp(s)
+	if err != nil {
+		return err
+	}
+
+	*t = timestampVar(ts)
+	return nil
+}
+
+// percentVar accepts percent value with optional "%" sign: `10%`, `0.5`
+type percentVar float64
+
+func (p *percentVar) String() string {
+	return strconv.FormatFloat(float64(*p), 'f', -1, 64) + "%"
+}
+
+func (p *percentVar) Set(s string) error {
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return err
+	}
+
+	if percent <= 0 || percent > 100 {
+		return errors.New("Percent should be in (0, 100] range: " + s)
+	}
+
+	*p = percentVar(percent)
+	return nil
+}
+
+var rateUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+}
+
+// rateVar holds rate per second, set as `500/s`, `30/m` or `100/h`. Rate without unit is per second.
+type rateVar float64
+
+func (r *rateVar) String() string {
+	if *r == 0 {
+		return ""
+	}
+
+	return strconv.FormatFloat(float64(*r), 'f', -1, 64) + "/s"
+}
+
+func (r *rateVar) Set(s string) error {
+	unit := time.Second
+	count := s
+
+	if idx := strings.IndexByte(s, '/'); idx != -1 {
+		var ok bool
+		if unit, ok = rateUnits[s[idx+1:]]; !ok {
+			return errors.New("Unknown rate unit: " + s)
+		}
+		count = s[:idx]
+	}
+
+	n, err := strconv.ParseFloat(count, 64)
+	if err != nil || n <= 0 {
+		return errors.New("Rate should be positive number: " + s)
+	}
+
+	*r = rateVar(n / unit.Seconds())
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// fileInputStats counts payloads of single input file, summed over all loops.
+// Updated atomically, since in read-ahead mode files are decoded in background.
+type fileInputStats struct {
+	Requests  int64
+	Responses int64
+	// Payloads dropped by time window, sampling, filters, --input-file-skip, etc.
+	Skipped int64
+	// Malformed or truncated payloads
+	Corrupted int64
+	// Size of decompressed data
+	BytesRead int64
+}
+
+func (s *fileInputStats) String() string {
+	return fmt.Sprintf("requests: %d, responses: %d, skipped: %d, corrupted: %d, read: %s",
+		atomic.LoadInt64(&s.Requests),
+		atomic.LoadInt64(&s.Responses),
+		atomic.LoadInt64(&s.Skipped),
+		atomic.LoadInt64(&s.Corrupted),
+		formatDataUnit(atomic.LoadInt64(&s.BytesRead)),
+	)
+}
+
+// fileStats returns counters of given file, creating them on first call
+func (i *FileInput) fileStats(name string) *fileInputStats {
+	s, ok := i.stats[name]
+	if !ok {
+		s = new(fileInputStats)
+		i.stats[name] = s
+	}
+
+	return s
+}
+
+// Stats returns copy of counters for each file read so far
+func (i *FileInput) Stats() map[string]fileInputStats {
+	defer i.mu.Unlock()
+	i.mu.Lock()
+
+	stats := make(map[string]fileInputStats, len(i.stats))
+	for name, s := range i.stats {
+		stats[name] = fileInputStats{
+			Requests:  atomic.LoadInt64(&s.Requests),
+			Responses: atomic.LoadInt64(&s.Responses),
+			Skipped:   atomic.LoadInt64(&s.Skipped),
+			Corrupted: atomic.LoadInt64(&s.Corrupted),
+			BytesRead: atomic.LoadInt64(&s.BytesRead),
+		}
+	}
+
+	return stats
+}
+
+func (i *FileInput) reportStats() {
+	ticker := time.NewTicker(rate * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if atomic.LoadInt32(&i.finished) == 1 {
+			return
+		}
+
+		i.printStats()
+	}
+}
+
+// printStats logs counters of each file, ordered by name
+func (i *FileInput) printStats() {
+	defer i.mu.Unlock()
+	i.mu.Lock()
+
+	names := make([]string, 0, len(i.stats))
+	for name := range i.stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		log.Printf("[FILE-INPUT] Stats '%s': %s\n", name, i.stats[name])
+	}
+}
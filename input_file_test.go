@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
@@ -9,6 +10,7 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"strings"
 	"sync"
 	"syscall"
 	"testing"
@@ -114,7 +116,7 @@ func TestInputFileMultipleFilesWithRequestsOnly(t *testing.T) {
 	file2.Write([]byte(payloadSeparator))
 	file2.Close()
 
-	input := NewFileInput(fmt.Sprintf("/tmp/%d*", rnd), false)
+	input := NewFileInput(fmt.Sprintf("/tmp/%d*", rnd), &FileInputConfig{})
 	buf := make([]byte, 1000)
 
 	for i := '1'; i <= '4'; i++ {
@@ -141,7 +143,7 @@ func TestInputFileRequestsWithLatency(t *testing.T) {
 	file.Write([]byte("1 3 250000000\nrequest3"))
 	file.Write([]byte(payloadSeparator))
 
-	input := NewFileInput(fmt.Sprintf("/tmp/%d", rnd), false)
+	input := NewFileInput(fmt.Sprintf("/tmp/%d", rnd), &FileInputConfig{})
 	buf := make([]byte, 1000)
 
 	start := time.Now().UnixNano()
@@ -162,6 +164,80 @@ func TestInputFileRequestsWithLatency(t *testing.T) {
 	}
 }
 
+func TestInputFileSpeedFactor(t *testing.T) {
+	rnd := rand.Int63()
+
+	file, _ := os.OpenFile(fmt.Sprintf("/tmp/%d", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	defer file.Close()
+
+	file.Write([]byte("1 1 100000000\nrequest1"))
+	file.Write([]byte(payloadSeparator))
+	file.Write([]byte("1 2 300000000\nrequest2"))
+	file.Write([]byte(payloadSeparator))
+
+	input := NewFileInput(fmt.Sprintf("/tmp/%d", rnd), &FileInputConfig{speedFactor: 2})
+	buf := make([]byte, 1000)
+
+	start := time.Now().UnixNano()
+	for i := 0; i < 2; i++ {
+		input.Read(buf)
+	}
+	end := time.Now().UnixNano()
+
+	var expectedLatency int64 = (300000000 - 100000000) / 2
+	realLatency := end - start
+	if realLatency < expectedLatency || realLatency > expectedLatency+10000000 {
+		t.Errorf("Should emit requests respecting speed factor. Expected: %v, real: %v", expectedLatency, realLatency)
+	}
+
+	os.Remove(file.Name())
+}
+
+func TestInputFileRate(t *testing.T) {
+	rnd := rand.Int63()
+
+	file, _ := os.OpenFile(fmt.Sprintf("/tmp/%d", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	for i := 0; i < 11; i++ {
+		// Recorded with 1 second interval
+		file.Write(payloadHeader(RequestPayload, uuid(), int64(i)*int64(time.Second), -1))
+		file.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		file.Write([]byte(payloadSeparator))
+	}
+	file.Close()
+
+	var rate rateVar
+	rate.Set("100/s")
+
+	input := NewFileInput(fmt.Sprintf("/tmp/%d", rnd), &FileInputConfig{rate: rate})
+	buf := make([]byte, 1000)
+
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		input.Read(buf)
+	}
+
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Error("Should replay requests at 100 rps", elapsed)
+	}
+
+	input.Close()
+	os.Remove(file.Name())
+}
+
+func TestRateVar(t *testing.T) {
+	for s, expected := range map[string]float64{"500/s": 500, "60/m": 1, "7200/h": 2, "10": 10} {
+		var r rateVar
+		if err := r.Set(s); err != nil || float64(r) != expected {
+			t.Error("Wrong rate", s, r, err)
+		}
+	}
+
+	var r rateVar
+	if r.Set("10/d") == nil || r.Set("-1/s") == nil {
+		t.Error("Should return error on wrong rate")
+	}
+}
+
 func TestInputFileMultipleFilesWithRequestsAndResponses(t *testing.T) {
 	rnd := rand.Int63()
 
@@ -187,7 +263,7 @@ func TestInputFileMultipleFilesWithRequestsAndResponses(t *testing.T) {
 	file2.Write([]byte(payloadSeparator))
 	file2.Close()
 
-	input := NewFileInput(fmt.Sprintf("/tmp/%d*", rnd), false)
+	input := NewFileInput(fmt.Sprintf("/tmp/%d*", rnd), &FileInputConfig{})
 	buf := make([]byte, 1000)
 
 	for i := '1'; i <= '4'; i++ {
@@ -216,7 +292,7 @@ func TestInputFileLoop(t *testing.T) {
 	file.Write([]byte(payloadSeparator))
 	file.Close()
 
-	input := NewFileInput(fmt.Sprintf("/tmp/%d", rnd), true)
+	input := NewFileInput(fmt.Sprintf("/tmp/%d", rnd), &FileInputConfig{loop: true})
 	buf := make([]byte, 1000)
 
 	// Even if we have just 2 requests in file, it should indifinitly loop
@@ -228,6 +304,740 @@ func TestInputFileLoop(t *testing.T) {
 	os.Remove(file.Name())
 }
 
+func TestInputFileTimeWindow(t *testing.T) {
+	rnd := rand.Int63()
+
+	file, _ := os.OpenFile(fmt.Sprintf("/tmp/%d", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	for i := 1; i <= 4; i++ {
+		file.Write(payloadHeader(RequestPayload, []byte("1"), int64(i)*int64(time.Millisecond), -1))
+		file.Write([]byte(fmt.Sprintf("test%d", i)))
+		file.Write([]byte(payloadSeparator))
+	}
+	file.Close()
+
+	config := &FileInputConfig{
+		from: timestampVar(2 * time.Millisecond),
+		to:   timestampVar(3 * time.Millisecond),
+	}
+	input := NewFileInput(fmt.Sprintf("/tmp/%d", rnd), config)
+	buf := make([]byte, 1000)
+
+	for i := '2'; i <= '3'; i++ {
+		n, _ := input.Read(buf)
+		if buf[n-1] != byte(i) {
+			t.Error("Should emit only requests inside time window", string(buf[:n]))
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if len(input.data) != 0 {
+		t.Error("Should skip requests after time window")
+	}
+
+	input.Close()
+	os.Remove(file.Name())
+}
+
+func TestParseTimestamp(t *testing.T) {
+	expected := time.Date(2016, 5, 10, 14, 0, 0, 0, time.UTC).UnixNano()
+
+	for _, s := range []string{"2016-05-10T14:00:00Z", "1462888800"} {
+		if ts, err := parseTimestamp(s); err != nil || ts != expected {
+			t.Error("Wrong timestamp", s, ts, err)
+		}
+	}
+
+	local := time.Date(2016, 5, 10, 14, 0, 0, 0, time.Local).UnixNano()
+	if ts, _ := parseTimestamp("2016-05-10 14:00"); ts != local {
+		t.Error("Should use local time zone", ts)
+	}
+
+	if _, err := parseTimestamp("yesterday"); err == nil {
+		t.Error("Should return error on unknown format")
+	}
+}
+
+func TestInputFileSample(t *testing.T) {
+	rnd := rand.Int63()
+
+	file, _ := os.OpenFile(fmt.Sprintf("/tmp/%d", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	for i := 0; i < 1000; i++ {
+		id := uuid()
+		file.Write(payloadHeader(RequestPayload, id, 1, -1))
+		file.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		file.Write([]byte(payloadSeparator))
+		file.Write(payloadHeader(ResponsePayload, id, 1, 1))
+		file.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+		file.Write([]byte(payloadSeparator))
+	}
+	file.Close()
+
+	input := NewFileInput(fmt.Sprintf("/tmp/%d", rnd), &FileInputConfig{sample: 10})
+	time.Sleep(100 * time.Millisecond)
+
+	buf := make([]byte, 1000)
+	requests := make(map[string]bool)
+	responses := 0
+
+	for len(input.data) > 0 {
+		n, _ := input.Read(buf)
+		id := string(payloadMeta(buf[:n])[1])
+
+		if isRequestPayload(buf[:n]) {
+			requests[id] = true
+		} else {
+			if !requests[id] {
+				t.Error("Should emit responses only for sampled requests")
+			}
+			responses++
+		}
+	}
+
+	if len(requests) < 50 || len(requests) > 150 {
+		t.Error("Should emit around 10% of requests", len(requests))
+	}
+
+	if responses != len(requests) {
+		t.Error("Should emit response for each sampled request", responses, len(requests))
+	}
+
+	input.Close()
+	os.Remove(file.Name())
+}
+
+func TestInputFileFilter(t *testing.T) {
+	rnd := rand.Int63()
+
+	file, _ := os.OpenFile(fmt.Sprintf("/tmp/%d", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	for _, req := range []string{"GET /api/orders HTTP/1.1", "POST /api/orders HTTP/1.1", "POST /api/users HTTP/1.1"} {
+		id := uuid()
+		file.Write(payloadHeader(RequestPayload, id, 1, -1))
+		file.Write([]byte(req + "\r\n\r\n"))
+		file.Write([]byte(payloadSeparator))
+		file.Write(payloadHeader(ResponsePayload, id, 1, 1))
+		file.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+		file.Write([]byte(payloadSeparator))
+	}
+	file.Close()
+
+	methods := HTTPMethods{}
+	methods.Set("POST")
+	urls := HTTPUrlRegexp{}
+	urls.Set("/api/orders")
+	Settings.modifierConfig = HTTPModifierConfig{methods: methods, urlRegexp: urls}
+	defer func() { Settings.modifierConfig = HTTPModifierConfig{} }()
+
+	input := NewFileInput(fmt.Sprintf("/tmp/%d", rnd), &FileInputConfig{filter: true})
+	time.Sleep(100 * time.Millisecond)
+
+	if len(input.data) != 2 {
+		t.Fatal("Should emit only matching request and its response", len(input.data))
+	}
+
+	buf := make([]byte, 1000)
+	n, _ := input.Read(buf)
+	if !bytes.HasPrefix(payloadBody(buf[:n]), []byte("POST /api/orders")) {
+		t.Error("Wrong request", string(buf[:n]))
+	}
+
+	n, _ = input.Read(buf)
+	if isRequestPayload(buf[:n]) {
+		t.Error("Should emit response", string(buf[:n]))
+	}
+
+	input.Close()
+	os.Remove(file.Name())
+}
+
+func TestInputFileWatch(t *testing.T) {
+	rnd := rand.Int63()
+	pattern := fmt.Sprintf("/tmp/%d_*", rnd)
+
+	file, _ := os.OpenFile(fmt.Sprintf("/tmp/%d_0", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	file.Write([]byte("1 1 1\ntest1"))
+	file.Write([]byte(payloadSeparator))
+	// Payload which is not fully written yet
+	file.Write([]byte("1 1 2\nte"))
+
+	input := NewFileInput(pattern, &FileInputConfig{watch: true})
+
+	read := func() string {
+		data := make(chan string)
+		go func() {
+			buf := make([]byte, 1000)
+			n, _ := input.Read(buf)
+			data <- string(buf[:n])
+		}()
+
+		select {
+		case d := <-data:
+			return d
+		case <-time.After(5 * time.Second):
+			return "timeout"
+		}
+	}
+
+	if d := read(); d != "1 1 1\ntest1" {
+		t.Error("Should read first payload", d)
+	}
+
+	file.Write([]byte("st2"))
+	file.Write([]byte(payloadSeparator))
+	file.Close()
+
+	if d := read(); d != "1 1 2\ntest2" {
+		t.Error("Should read payload appended to file", d)
+	}
+
+	file2, _ := os.OpenFile(fmt.Sprintf("/tmp/%d_1", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	file2.Write([]byte("1 1 3\ntest3"))
+	file2.Write([]byte(payloadSeparator))
+	file2.Close()
+
+	if d := read(); d != "1 1 3\ntest3" {
+		t.Error("Should read payload from new file", d)
+	}
+
+	input.Close()
+	os.Remove(file.Name())
+	os.Remove(file2.Name())
+}
+
+func TestInputFileLoopCount(t *testing.T) {
+	rnd := rand.Int63()
+
+	file, _ := os.OpenFile(fmt.Sprintf("/tmp/%d", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	file.Write([]byte("1 1 1\ntest1"))
+	file.Write([]byte(payloadSeparator))
+	file.Write([]byte("1 1 2\ntest2"))
+	file.Write([]byte(payloadSeparator))
+	file.Close()
+
+	input := NewFileInput(fmt.Sprintf("/tmp/%d", rnd), &FileInputConfig{loopCount: 3})
+	buf := make([]byte, 1000)
+
+	for i := 0; i < 6; i++ {
+		if _, err := input.Read(buf); err != nil {
+			t.Fatal("Should replay file 3 times", i, err)
+		}
+	}
+
+	if _, err := input.Read(buf); err != io.EOF {
+		t.Error("Should finish after 3 loops", err)
+	}
+
+	input.Close()
+	os.Remove(file.Name())
+}
+
+func TestInputFileOrderByTimestamp(t *testing.T) {
+	rnd := rand.Int63()
+
+	file1, _ := os.OpenFile(fmt.Sprintf("/tmp/%d_10", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	file1.Write([]byte("1 1 2\ntest2"))
+	file1.Write([]byte(payloadSeparator))
+	file1.Write([]byte("1 1 5\ntest5b"))
+	file1.Write([]byte(payloadSeparator))
+	file1.Close()
+	defer os.Remove(file1.Name())
+
+	file2, _ := os.OpenFile(fmt.Sprintf("/tmp/%d_9", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	file2.Write([]byte("1 1 1\ntest1"))
+	file2.Write([]byte(payloadSeparator))
+	file2.Write([]byte("1 1 5\ntest5a"))
+	file2.Write([]byte(payloadSeparator))
+	file2.Close()
+	defer os.Remove(file2.Name())
+
+	input := NewFileInput(fmt.Sprintf("/tmp/%d_*", rnd), &FileInputConfig{})
+	defer input.Close()
+	buf := make([]byte, 1000)
+
+	for _, expected := range []string{"test1", "test2", "test5a", "test5b"} {
+		n, _ := input.Read(buf)
+		if string(payloadBody(buf[:n])) != expected {
+			t.Errorf("Expected %q, got %q", expected, buf[:n])
+		}
+	}
+}
+
+func TestInputFileSkip(t *testing.T) {
+	rnd := rand.Int63()
+
+	file, _ := os.OpenFile(fmt.Sprintf("/tmp/%d", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	for i := 1; i <= 5; i++ {
+		file.Write([]byte(fmt.Sprintf("1 id%d %d\nrequest%d", i, i, i)))
+		file.Write([]byte(payloadSeparator))
+		file.Write([]byte(fmt.Sprintf("2 id%d %d 1\nresponse%d", i, i, i)))
+		file.Write([]byte(payloadSeparator))
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	tests := []struct {
+		skip     int
+		startID  string
+		expected string
+	}{
+		{2, "", "request3 response3 request4 response4 request5 response5"},
+		{0, "id4", "request4 response4 request5 response5"},
+		{1, "id2", "request3 response3 request4 response4 request5 response5"},
+		{0, "unknown", ""},
+	}
+
+	for _, tc := range tests {
+		input := NewFileInput(file.Name(), &FileInputConfig{skip: tc.skip, startID: tc.startID, loopCount: 1})
+		buf := make([]byte, 1000)
+
+		var bodies []string
+		for {
+			n, err := input.Read(buf)
+			if err != nil {
+				break
+			}
+			bodies = append(bodies, string(payloadBody(buf[:n])))
+		}
+		input.Close()
+
+		if strings.Join(bodies, " ") != tc.expected {
+			t.Errorf("Skip %d, start id %q: expected %q, got %q", tc.skip, tc.startID, tc.expected, bodies)
+		}
+	}
+}
+
+func TestInputFileStats(t *testing.T) {
+	rnd := rand.Int63()
+
+	file, _ := os.OpenFile(fmt.Sprintf("/tmp/%d", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	file.Write([]byte("1 1 1\nrequest1"))
+	file.Write([]byte(payloadSeparator))
+	file.Write([]byte("2 1 2 1\nresponse1"))
+	file.Write([]byte(payloadSeparator))
+	file.Write([]byte("1 broken\nrequest"))
+	file.Write([]byte(payloadSeparator))
+	file.Write([]byte("1 2 3\nrequest2"))
+	file.Write([]byte(payloadSeparator))
+	file.Write([]byte("2 2 4 1\nresponse2"))
+	file.Write([]byte(payloadSeparator))
+	file.Close()
+	defer os.Remove(file.Name())
+
+	input := NewFileInput(file.Name(), &FileInputConfig{skip: 1, skipCorrupted: true, loopCount: 2})
+	buf := make([]byte, 1000)
+	for {
+		if _, err := input.Read(buf); err != nil {
+			break
+		}
+	}
+	input.Close()
+
+	stat, _ := os.Stat(file.Name())
+	expected := fileInputStats{Requests: 3, Responses: 3, Skipped: 2, Corrupted: 2, BytesRead: 2 * stat.Size()}
+
+	if stats := input.Stats(); stats[file.Name()] != expected {
+		t.Errorf("Expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestInputFileMaxPayloadSize(t *testing.T) {
+	rnd := rand.Int63()
+
+	file, _ := os.OpenFile(fmt.Sprintf("/tmp/%d", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	file.Write([]byte("1 1 1\nsmall"))
+	file.Write([]byte(payloadSeparator))
+	file.Write([]byte("1 2 2\n" + strings.Repeat("big line\n", 1000)))
+	file.Write([]byte(payloadSeparator))
+	file.Write([]byte("1 3 3\nsmall"))
+	file.Write([]byte(payloadSeparator))
+	file.Close()
+	defer os.Remove(file.Name())
+
+	for _, policy := range []string{oversizeSkip, oversizeTruncate} {
+		input := NewFileInput(file.Name(), &FileInputConfig{maxPayloadSize: 100, oversizePolicy: policy, bufferSize: 64, loopCount: 1})
+		buf := make([]byte, 1000)
+
+		var payloads []string
+		for {
+			n, err := input.Read(buf)
+			if err != nil {
+				break
+			}
+			payloads = append(payloads, string(buf[:n]))
+		}
+		input.Close()
+
+		switch policy {
+		case oversizeSkip:
+			if len(payloads) != 2 || payloads[1] != "1 3 3\nsmall" {
+				t.Error("Should skip big payload", payloads)
+			}
+		case oversizeTruncate:
+			if len(payloads) != 3 || len(payloads[1]) != 100 || !strings.HasPrefix(payloads[1], "1 2 2\nbig line\n") {
+				t.Error("Should truncate big payload", payloads)
+			}
+		}
+	}
+}
+
+func TestInputFileRequestsOnly(t *testing.T) {
+	rnd := rand.Int63()
+
+	file, _ := os.OpenFile(fmt.Sprintf("/tmp/%d", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	file.Write([]byte("1 1 1\nrequest1"))
+	file.Write([]byte(payloadSeparator))
+	file.Write([]byte("2 1 2 1\nresponse1"))
+	file.Write([]byte(payloadSeparator))
+	file.Write([]byte("3 1 3 1\nreplayed1"))
+	file.Write([]byte(payloadSeparator))
+	file.Write([]byte("1 2 4\nrequest2"))
+	file.Write([]byte(payloadSeparator))
+	file.Close()
+	defer os.Remove(file.Name())
+
+	input := NewFileInput(file.Name(), &FileInputConfig{requestsOnly: true, loopCount: 1})
+	defer input.Close()
+	buf := make([]byte, 1000)
+
+	for _, expected := range []string{"1 1 1\nrequest1", "1 2 4\nrequest2"} {
+		n, _ := input.Read(buf)
+		if string(buf[:n]) != expected {
+			t.Errorf("Expected %q, got %q", expected, buf[:n])
+		}
+	}
+
+	if _, err := input.Read(buf); err != io.EOF {
+		t.Error("Responses should be discarded", err)
+	}
+}
+
+func TestInputFileMaxWait(t *testing.T) {
+	rnd := rand.Int63()
+
+	file, _ := os.OpenFile(fmt.Sprintf("/tmp/%d", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	file.Write([]byte(fmt.Sprintf("1 1 %d\ntest1", time.Hour)))
+	file.Write([]byte(payloadSeparator))
+	file.Write([]byte(fmt.Sprintf("1 2 %d\ntest2", 2*time.Hour)))
+	file.Write([]byte(payloadSeparator))
+	file.Close()
+	defer os.Remove(file.Name())
+
+	input := NewFileInput(file.Name(), &FileInputConfig{maxWait: 50 * time.Millisecond})
+	defer input.Close()
+	buf := make([]byte, 1000)
+
+	start := time.Now()
+	input.Read(buf)
+	input.Read(buf)
+
+	if took := time.Since(start); took < 50*time.Millisecond || took > time.Second {
+		t.Error("Pause should be limited by max wait", took)
+	}
+}
+
+func TestInputFileStdin(t *testing.T) {
+	r, w, _ := os.Pipe()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+
+	go func() {
+		gz := gzip.NewWriter(w)
+		for i := 0; i < 10; i++ {
+			gz.Write([]byte(fmt.Sprintf("1 1 %d\ntest%d", i, i)))
+			gz.Write([]byte(payloadSeparator))
+		}
+		gz.Close()
+		w.Close()
+	}()
+
+	input := NewFileInput(stdinPath, &FileInputConfig{loopCount: 2})
+	defer input.Close()
+	buf := make([]byte, 1000)
+
+	for i := 0; i < 10; i++ {
+		n, err := input.Read(buf)
+		if expected := fmt.Sprintf("1 1 %d\ntest%d", i, i); err != nil || string(buf[:n]) != expected {
+			t.Fatalf("Expected %q, got %q %v", expected, buf[:n], err)
+		}
+	}
+
+	if _, err := input.Read(buf); err != io.EOF {
+		t.Error("Standard input should not be looped", err)
+	}
+}
+
+func TestInputFileLoopRebase(t *testing.T) {
+	rnd := rand.Int63()
+
+	file, _ := os.OpenFile(fmt.Sprintf("/tmp/%d", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	file.Write([]byte("1 1 100\ntest1"))
+	file.Write([]byte(payloadSeparator))
+	file.Write([]byte("2 1 110 5\ntest2"))
+	file.Write([]byte(payloadSeparator))
+	file.Write([]byte("1 2 120\ntest3"))
+	file.Write([]byte(payloadSeparator))
+	file.Close()
+	defer os.Remove(file.Name())
+
+	input := NewFileInput(file.Name(), &FileInputConfig{loopCount: 3})
+	defer input.Close()
+	buf := make([]byte, 1000)
+
+	expected := []string{
+		"1 1 100\ntest1", "2 1 110 5\ntest2", "1 2 120\ntest3",
+		"1 1 120\ntest1", "2 1 130 5\ntest2", "1 2 140\ntest3",
+		"1 1 140\ntest1", "2 1 150 5\ntest2", "1 2 160\ntest3",
+	}
+
+	for _, e := range expected {
+		n, err := input.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(buf[:n]) != e {
+			t.Errorf("Expected %q, got %q", e, buf[:n])
+		}
+	}
+}
+
+func TestInputFileCheckpoint(t *testing.T) {
+	rnd := rand.Int63()
+	checkpoint := fmt.Sprintf("/tmp/%d.checkpoint", rnd)
+
+	file1, _ := os.OpenFile(fmt.Sprintf("/tmp/%d_0", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	file1.Write([]byte("1 1 1\ntest1"))
+	file1.Write([]byte(payloadSeparator))
+	file1.Write([]byte("1 1 3\ntest3"))
+	file1.Write([]byte(payloadSeparator))
+	file1.Close()
+
+	file2, _ := os.OpenFile(fmt.Sprintf("/tmp/%d_1", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	file2.Write([]byte("1 1 2\ntest2"))
+	file2.Write([]byte(payloadSeparator))
+	file2.Write([]byte("1 1 4\ntest4"))
+	file2.Write([]byte(payloadSeparator))
+	file2.Close()
+
+	pattern := fmt.Sprintf("/tmp/%d_*", rnd)
+	buf := make([]byte, 1000)
+
+	input := NewFileInput(pattern, &FileInputConfig{checkpoint: checkpoint})
+	for i := '1'; i <= '2'; i++ {
+		n, _ := input.Read(buf)
+		if buf[n-1] != byte(i) {
+			t.Error("Should emit requests in right order", string(buf[:n]))
+		}
+	}
+	input.Close()
+
+	// Should continue from the position where previous input stopped
+	input = NewFileInput(pattern, &FileInputConfig{checkpoint: checkpoint})
+	for i := '3'; i <= '4'; i++ {
+		n, _ := input.Read(buf)
+		if buf[n-1] != byte(i) {
+			t.Error("Should resume from checkpoint", string(buf[:n]))
+		}
+	}
+	input.Close()
+
+	os.Remove(file1.Name())
+	os.Remove(file2.Name())
+	os.Remove(checkpoint)
+}
+
+func TestInputFileBrokenFile(t *testing.T) {
+	rnd := rand.Int63()
+
+	file1, _ := os.OpenFile(fmt.Sprintf("/tmp/%d_0", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	file1.Write([]byte("1 1 1\ntest1"))
+	file1.Write([]byte(payloadSeparator))
+	file1.Write([]byte("1 1 3\ntest3"))
+	file1.Write([]byte(payloadSeparator))
+	file1.Close()
+
+	// Truncated gzip stream
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	for i := 0; i < 100; i++ {
+		gz.Write([]byte(fmt.Sprintf("1 1 2\nbroken%d", rand.Int63())))
+		gz.Write([]byte(payloadSeparator))
+	}
+	gz.Close()
+	ioutil.WriteFile(fmt.Sprintf("/tmp/%d_1.gz", rnd), compressed.Bytes()[:compressed.Len()/2], 0660)
+
+	input := NewFileInput(fmt.Sprintf("/tmp/%d_*", rnd), &FileInputConfig{})
+	buf := make([]byte, 1000)
+	seen := make(map[string]bool)
+
+	for {
+		data := make(chan string)
+		go func() {
+			n, _ := input.Read(buf)
+			data <- string(buf[:n])
+		}()
+
+		var payload string
+		select {
+		case payload = <-data:
+		case <-time.After(500 * time.Millisecond):
+		}
+
+		if payload == "" {
+			break
+		}
+
+		if seen[payload] {
+			t.Fatal("Should not emit payload twice", payload)
+		}
+		seen[payload] = true
+	}
+
+	if !seen["1 1 1\ntest1"] || !seen["1 1 3\ntest3"] {
+		t.Error("Should emit payloads from valid file", seen)
+	}
+
+	select {
+	case err := <-input.Errors():
+		if !strings.Contains(err.Error(), "_1.gz") {
+			t.Error("Error should contain file name", err)
+		}
+	default:
+		t.Error("Should report error")
+	}
+
+	os.Remove(file1.Name())
+	os.Remove(fmt.Sprintf("/tmp/%d_1.gz", rnd))
+}
+
+func TestInputFileCorruptedPayloads(t *testing.T) {
+	rnd := rand.Int63()
+
+	file, _ := os.OpenFile(fmt.Sprintf("/tmp/%d", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	file.Write([]byte("1 1 1\ntest1"))
+	file.Write([]byte(payloadSeparator))
+	file.Write([]byte("1 2\nno timestamp"))
+	file.Write([]byte(payloadSeparator))
+	file.Write([]byte("1 3 abc\nbad timestamp"))
+	file.Write([]byte(payloadSeparator))
+	file.Write([]byte(payloadSeparator))
+	file.Write([]byte("1 4 4\ntest4"))
+	file.Write([]byte(payloadSeparator))
+	file.Write([]byte("1 5 5\ntruncat"))
+	file.Close()
+	defer os.Remove(file.Name())
+
+	readAll := func(input *FileInput) (payloads []string) {
+		buf := make([]byte, 1000)
+		for {
+			data := make(chan string)
+			go func() {
+				n, err := input.Read(buf)
+				if err != nil {
+					close(data)
+					return
+				}
+				data <- string(buf[:n])
+			}()
+
+			select {
+			case payload, ok := <-data:
+				if !ok {
+					return
+				}
+				payloads = append(payloads, payload)
+			case <-time.After(500 * time.Millisecond):
+				return
+			}
+		}
+	}
+
+	input := NewFileInput(file.Name(), &FileInputConfig{})
+	if payloads := readAll(input); len(payloads) != 1 || payloads[0] != "1 1 1\ntest1" {
+		t.Error("Should stop reading file at first malformed payload", payloads)
+	}
+
+	select {
+	case err := <-input.Errors():
+		if !strings.Contains(err.Error(), "timestamp") {
+			t.Error("Error should describe malformed payload", err)
+		}
+	default:
+		t.Error("Should report error")
+	}
+	input.Close()
+
+	input = NewFileInput(file.Name(), &FileInputConfig{skipCorrupted: true})
+	if payloads := readAll(input); len(payloads) != 2 || payloads[0] != "1 1 1\ntest1" || payloads[1] != "1 4 4\ntest4" {
+		t.Error("Should skip malformed payloads", payloads)
+	}
+
+	select {
+	case err := <-input.Errors():
+		t.Error("Should not report error", err)
+	default:
+	}
+	input.Close()
+}
+
+func TestInputFileProgress(t *testing.T) {
+	rnd := rand.Int63()
+
+	file, _ := os.OpenFile(fmt.Sprintf("/tmp/%d", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	for i := 0; i < 4; i++ {
+		file.Write(payloadHeader(RequestPayload, []byte("1"), int64(i)*int64(time.Millisecond), -1))
+		file.Write([]byte("test"))
+		file.Write([]byte(payloadSeparator))
+	}
+	file.Close()
+
+	input := NewFileInput(fmt.Sprintf("/tmp/%d", rnd), &FileInputConfig{progressInterval: time.Hour})
+	buf := make([]byte, 1000)
+
+	for i := 0; i < 4; i++ {
+		input.Read(buf)
+	}
+
+	if progress := input.progress(); !strings.Contains(progress, "(100.0%)") {
+		t.Error("Should report progress", progress)
+	}
+
+	input.Close()
+	os.Remove(file.Name())
+}
+
+func TestInputFileReadAhead(t *testing.T) {
+	rnd := rand.Int63()
+
+	for f := 0; f < 5; f++ {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		for i := 0; i < 500; i++ {
+			gz.Write(payloadHeader(RequestPayload, uuid(), int64(i*5+f), -1))
+			gz.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+			gz.Write([]byte(payloadSeparator))
+		}
+		gz.Close()
+		ioutil.WriteFile(fmt.Sprintf("/tmp/%d_%d.gz", rnd, f), buf.Bytes(), 0660)
+	}
+
+	input := NewFileInput(fmt.Sprintf("/tmp/%d_*", rnd), &FileInputConfig{readAhead: 10})
+	buf := make([]byte, 1000)
+
+	for i := 0; i < 2500; i++ {
+		n, _ := input.Read(buf)
+		if ts := string(payloadMeta(buf[:n])[2]); ts != fmt.Sprint(i) {
+			t.Fatal("Should merge files by timestamp", i, ts)
+		}
+	}
+
+	input.Close()
+
+	for f := 0; f < 5; f++ {
+		os.Remove(fmt.Sprintf("/tmp/%d_%d.gz", rnd, f))
+	}
+}
+
 func TestInputFileCompressed(t *testing.T) {
 	rnd := rand.Int63()
 
@@ -245,7 +1055,7 @@ func TestInputFileCompressed(t *testing.T) {
 	name2 := output2.file.Name()
 	output2.Close()
 
-	input := NewFileInput(fmt.Sprintf("/tmp/%d*", rnd), false)
+	input := NewFileInput(fmt.Sprintf("/tmp/%d*", rnd), &FileInputConfig{})
 	buf := make([]byte, 1000)
 	for i := 0; i < 2000; i++ {
 		input.Read(buf)
@@ -255,6 +1065,31 @@ func TestInputFileCompressed(t *testing.T) {
 	os.Remove(name2)
 }
 
+func TestInputFileCompressedZstdAndLz4(t *testing.T) {
+	rnd := rand.Int63()
+
+	for _, ext := range []string{"zst", "lz4"} {
+		output := NewFileOutput(fmt.Sprintf("/tmp/%d_%s_0.%s", rnd, ext, ext), &FileOutputConfig{flushInterval: time.Minute, append: true})
+		for i := 0; i < 1000; i++ {
+			output.Write([]byte("1 1 1\r\ntest"))
+		}
+		name := output.file.Name()
+		output.Close()
+
+		input := NewFileInput(name, &FileInputConfig{})
+		buf := make([]byte, 1000)
+		for i := 0; i < 1000; i++ {
+			n, _ := input.Read(buf)
+			if string(buf[:n]) != "1 1 1\r\ntest" {
+				t.Error("Should decompress", ext, "payload:", string(buf[:n]))
+				break
+			}
+		}
+
+		os.Remove(name)
+	}
+}
+
 type CaptureFile struct {
 	data [][]byte
 	file *os.File
@@ -344,7 +1179,7 @@ func ReadFromCaptureFile(captureFile *os.File, count int, callback writeCallback
 	quit := make(chan int)
 	wg := new(sync.WaitGroup)
 
-	input := NewFileInput(captureFile.Name(), false)
+	input := NewFileInput(captureFile.Name(), &FileInputConfig{})
 	output := NewTestOutput(func(data []byte) {
 		callback(data)
 		wg.Done()
@@ -380,3 +1215,81 @@ func Duplicate(data []byte) (duplicate []byte) {
 
 	return
 }
+
+func TestInputFileEncrypted(t *testing.T) {
+	rnd := rand.Int63()
+
+	keyFile := fmt.Sprintf("/tmp/%d.key", rnd)
+	ioutil.WriteFile(keyFile, []byte("000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f\n"), 0600)
+	defer os.Remove(keyFile)
+
+	var key encryptionKeyVar
+	if err := key.Set(keyFile); err != nil || len(key) != 32 {
+		t.Fatal("Should load hex encoded key", err)
+	}
+
+	for _, ext := range []string{"gor", "gz"} {
+		output := NewFileOutput(fmt.Sprintf("/tmp/%d_%s_0.%s", rnd, ext, ext), &FileOutputConfig{flushInterval: time.Minute, append: true, encryptionKey: key})
+		for i := 0; i < 10000; i++ {
+			output.Write([]byte(fmt.Sprintf("1 %d 1\nsecret%d", i, i)))
+		}
+		name := output.file.Name()
+		output.Close()
+		defer os.Remove(name)
+
+		if data, _ := ioutil.ReadFile(name); bytes.Contains(data, []byte("secret")) {
+			t.Error("File should be encrypted", ext)
+		}
+
+		input := NewFileInput(name, &FileInputConfig{encryptionKey: key, loopCount: 1})
+		buf := make([]byte, 1000)
+		for i := 0; i < 10000; i++ {
+			n, err := input.Read(buf)
+			if expected := fmt.Sprintf("1 %d 1\nsecret%d", i, i); err != nil || string(buf[:n]) != expected {
+				t.Fatalf("Expected %q, got %q %v", expected, buf[:n], err)
+			}
+		}
+		input.Close()
+
+		// Without key file can't be read
+		input = NewFileInput(name, &FileInputConfig{loopCount: 1})
+		select {
+		case err := <-input.Errors():
+			if !strings.Contains(err.Error(), "encrypted") {
+				t.Error("Should report that file is encrypted", err)
+			}
+		case <-time.After(time.Second):
+			t.Error("Should report error")
+		}
+		input.Close()
+	}
+}
+
+func TestDecryptTruncated(t *testing.T) {
+	key := make([]byte, 16)
+
+	var buf bytes.Buffer
+	w, _ := newEncryptWriter(&buf, key)
+	w.Write(bytes.Repeat([]byte("a"), 100000))
+	w.Flush()
+	w.Write([]byte("b"))
+	w.Close()
+
+	data := buf.Bytes()
+
+	r, _ := newDecryptReader(bytes.NewReader(data), key, false)
+	if plain, err := ioutil.ReadAll(r); err != nil || len(plain) != 100001 {
+		t.Error("Should decrypt whole file", len(plain), err)
+	}
+
+	r, _ = newDecryptReader(bytes.NewReader(data[:len(data)-10]), key, false)
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("Should detect truncated file")
+	}
+
+	// Files which are still written to end without final record
+	r, _ = newDecryptReader(bytes.NewReader(data[:len(data)-10]), key, true)
+	if plain, err := ioutil.ReadAll(r); err != nil || len(plain) != 100000 {
+		t.Error("Should read all complete records in watch mode", len(plain), err)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/buger/gor/proto"
+)
+
+// Max number of error messages kept in report, to not flood output for completely broken files
+const maxValidationErrors = 20
+
+// fileValidationReport summarizes content of recorded files, produced by `gor file-validate`
+type fileValidationReport struct {
+	Files             int
+	Requests          int
+	Responses         int
+	ReplayedResponses int
+	BadPayloads       int
+	// Requests with timestamp smaller than previous request in the same file
+	OutOfOrder     int
+	FirstTimestamp int64
+	LastTimestamp  int64
+	Errors         []string
+}
+
+// Valid returns true if all files can be replayed without issues
+func (r *fileValidationReport) Valid() bool {
+	return r.BadPayloads == 0 && r.OutOfOrder == 0 && len(r.Errors) == 0
+}
+
+func (r *fileValidationReport) addError(format string, args ...interface{}) {
+	if len(r.Errors) < maxValidationErrors {
+		r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+	}
+}
+
+func (r *fileValidationReport) String() string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "Files: %d\n", r.Files)
+	fmt.Fprintf(&buf, "Requests: %d, responses: %d, replayed responses: %d\n", r.Requests, r.Responses, r.ReplayedResponses)
+	fmt.Fprintf(&buf, "Bad payloads: %d\n", r.BadPayloads)
+	fmt.Fprintf(&buf, "Out of order requests: %d\n", r.OutOfOrder)
+
+	if r.FirstTimestamp != 0 {
+		first := time.Unix(0, r.FirstTimestamp).UTC()
+		last := time.Unix(0, r.LastTimestamp).UTC()
+		fmt.Fprintf(&buf, "Time span: %s - %s (%s)\n", first.Format(time.RFC3339), last.Format(time.RFC3339), last.Sub(first))
+	}
+
+	if len(r.Errors) > 0 {
+		buf.WriteString("Errors:\n")
+		for _, e := range r.Errors {
+			buf.WriteString("  " + e + "\n")
+		}
+	}
+
+	return buf.String()
+}
+
+// validatePayload checks payload framing and meta, and that requests are valid HTTP. Returns payload timestamp.
+func validatePayload(payload []byte) (ts int64, err error) {
+	if ts, err = validatePayloadMeta(payload); err != nil {
+		return 0, err
+	}
+
+	if payload[0] == RequestPayload && !proto.IsHTTPPayload(payloadBody(payload)) {
+		return 0, errors.New("request is not valid HTTP")
+	}
+
+	return ts, nil
+}
+
+// validatePayloadMeta checks that payload has meta line with type, id and timestamp, and returns timestamp
+func validatePayloadMeta(payload []byte) (ts int64, err error) {
+	if bytes.IndexByte(payload, '\n') == -1 {
+		return 0, errors.New("no meta line")
+	}
+
+	meta := payloadMeta(payload)
+	if len(meta) < 3 {
+		return 0, errors.New("meta line should contain type, id and timestamp")
+	}
+
+	if len(meta[0]) != 1 || !isOriginPayload(meta[0]) && meta[0][0] != ReplayedResponsePayload {
+		return 0, fmt.Errorf("unknown payload type %q", meta[0])
+	}
+
+	if len(meta[1]) == 0 {
+		return 0, errors.New("empty id")
+	}
+
+	// Meta line may end with "\r" if payload uses CRLF line endings
+	if ts, err = strconv.ParseInt(string(bytes.TrimSpace(meta[2])), 10, 64); err != nil {
+		return 0, fmt.Errorf("wrong timestamp %q", meta[2])
+	}
+
+	// Labels go after positional fields
+	for i := 3; i < len(meta); i++ {
+		if isPayloadLabel(meta[i]) {
+			for _, label := range meta[i:] {
+				if !isPayloadLabel(label) {
+					return 0, fmt.Errorf("wrong label %q", label)
+				}
+			}
+
+			meta = meta[:i]
+			break
+		}
+	}
+
+	if len(meta) > 3 && len(bytes.TrimSpace(meta[3])) > 0 {
+		if _, err = strconv.ParseInt(string(bytes.TrimSpace(meta[3])), 10, 64); err != nil {
+			return 0, fmt.Errorf("wrong latency %q", meta[3])
+		}
+	}
+
+	if len(meta) > 4 && len(bytes.TrimSpace(meta[4])) > 0 {
+		if _, err = strconv.ParseInt(string(bytes.TrimSpace(meta[4])), 10, 64); err != nil {
+			return 0, fmt.Errorf("wrong original latency %q", meta[4])
+		}
+	}
+
+	return ts, nil
+}
+
+// validateFiles reads all files matching pattern, without replaying them, and reports issues which can break replay
+func validateFiles(pattern, format string) (*fileValidationReport, error) {
+	storage := newFileStorage(pattern)
+
+	names, err := storage.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(names) == 0 {
+		return nil, errors.New("No files match pattern: " + pattern)
+	}
+
+	report := &fileValidationReport{}
+	separator := []byte(payloadSeparator)
+
+	for _, name := range names {
+		report.Files++
+
+		file, err := storage.Open(name)
+		if err != nil {
+			report.addError("%s: %v", name, err)
+			continue
+		}
+
+		reader := bufio.NewReader(file)
+		decompressor, err := newDecompressor(reader)
+		if err != nil {
+			report.addError("%s: can't read compressed file: %v", name, err)
+			file.Close()
+			continue
+		}
+
+		if decompressor != nil {
+			reader = bufio.NewReader(decompressor)
+		}
+
+		if reader, err = convertFileFormat(reader, fileInputFormat(name, format)); err != nil {
+			report.addError("%s: %v", name, err)
+			file.Close()
+			continue
+		}
+
+		truncated := false
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024*1024)
+		scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+			if atEOF && len(bytes.TrimSpace(data)) > 0 && !bytes.Contains(data, separator) {
+				truncated = true
+			}
+			return payloadScanner(data, atEOF)
+		})
+
+		var lastRequest int64
+		for idx := 1; scanner.Scan(); idx++ {
+			payload := scanner.Bytes()
+			if len(bytes.TrimSpace(payload)) == 0 {
+				continue
+			}
+
+			if truncated {
+				report.BadPayloads++
+				report.addError("%s: payload %d: truncated", name, idx)
+				break
+			}
+
+			ts, err := validatePayload(payload)
+			if err != nil {
+				report.BadPayloads++
+				report.addError("%s: payload %d: %v", name, idx, err)
+				continue
+			}
+
+			switch payload[0] {
+			case RequestPayload, UDPRequestPayload:
+				report.Requests++
+				if ts < lastRequest {
+					report.OutOfOrder++
+					report.addError("%s: payload %d: timestamp %d is before previous request", name, idx, ts)
+				}
+				lastRequest = ts
+			case ResponsePayload, UDPResponsePayload:
+				report.Responses++
+			case ReplayedResponsePayload:
+				report.ReplayedResponses++
+			}
+
+			if report.FirstTimestamp == 0 || ts < report.FirstTimestamp {
+				report.FirstTimestamp = ts
+			}
+			if ts > report.LastTimestamp {
+				report.LastTimestamp = ts
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			report.addError("%s: %v", name, err)
+		}
+
+		if decompressor != nil {
+			decompressor.Close()
+		}
+		file.Close()
+	}
+
+	return report, nil
+}
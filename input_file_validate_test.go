@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestValidateFiles(t *testing.T) {
+	rnd := rand.Int63()
+
+	file, _ := os.OpenFile(fmt.Sprintf("/tmp/%d_0", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	file.Write([]byte("1 a 2000000000\nGET / HTTP/1.1\r\n\r\n"))
+	file.Write([]byte(payloadSeparator))
+	file.Write([]byte("2 a 2000000000 10\nHTTP/1.1 200 OK\r\n\r\n"))
+	file.Write([]byte(payloadSeparator))
+	// Out of order
+	file.Write([]byte("1 b 1000000000\nGET / HTTP/1.1\r\n\r\n"))
+	file.Write([]byte(payloadSeparator))
+	// Broken meta
+	file.Write([]byte("1 c\nGET / HTTP/1.1\r\n\r\n"))
+	file.Write([]byte(payloadSeparator))
+	file.Close()
+
+	file2, _ := os.OpenFile(fmt.Sprintf("/tmp/%d_1", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	file2.Write([]byte("1 d 3000000000\nPOST / HTTP/1.1\r\n\r\n"))
+	file2.Write([]byte(payloadSeparator))
+	// Not finished payload
+	file2.Write([]byte("1 e 3000000000\nGET / HT"))
+	file2.Close()
+
+	report, err := validateFiles(fmt.Sprintf("/tmp/%d_*", rnd), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Files != 2 || report.Requests != 3 || report.Responses != 1 {
+		t.Error("Wrong counters", report)
+	}
+
+	if report.BadPayloads != 2 || report.OutOfOrder != 1 || len(report.Errors) != 3 {
+		t.Error("Should find broken payloads", report)
+	}
+
+	if report.FirstTimestamp != 1000000000 || report.LastTimestamp != 3000000000 {
+		t.Error("Wrong time span", report)
+	}
+
+	if report.Valid() {
+		t.Error("Report should not be valid")
+	}
+
+	os.Remove(file.Name())
+	os.Remove(file2.Name())
+}
@@ -1,16 +1,24 @@
 package main
 
 import (
+	"errors"
 	"github.com/buger/gor/proto"
 	raw "github.com/buger/gor/raw_socket_listener"
 	"log"
 	"net"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // RAWInput used for intercepting traffic for given address
 type RAWInput struct {
 	data          chan *raw.TCPMessage
+	datagrams     chan *raw.UDPDatagram
+	frames        chan *raw.WebSocketFrame
 	address       string
 	expire        time.Duration
 	quit          chan bool
@@ -18,6 +26,7 @@ type RAWInput struct {
 	realIPHeader  []byte
 	trackResponse bool
 	listener      *raw.Listener
+	k8s           *K8sMetadata
 }
 
 // Available engines for intercepting traffic
@@ -25,8 +34,21 @@ const (
 	EngineRawSocket = 1 << iota
 	EnginePcap
 	EnginePcapFile
+	EngineAFPacket
+	EngineXDP
+	EnginePcapDir
 )
 
+// isPcapFile checks if file is tcpdump capture, based on its extension
+func isPcapFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".pcap", ".pcapng", ".cap":
+		return true
+	default:
+		return false
+	}
+}
+
 // NewRAWInput constructor for RAWInput. Accepts address with port as argument.
 func NewRAWInput(address string, engine int, trackResponse bool, expire time.Duration, realIPHeader string) (i *RAWInput) {
 	i = new(RAWInput)
@@ -38,25 +60,159 @@ func NewRAWInput(address string, engine int, trackResponse bool, expire time.Dur
 	i.quit = make(chan bool)
 	i.trackResponse = trackResponse
 
+	if Settings.inputRAWK8sMetadata {
+		i.k8s = NewK8sMetadata(Settings.inputRAWK8sAPI, Settings.inputRAWK8sRefresh)
+	}
+
 	i.listen(address)
 	i.listener.IsReady()
 
+	if Settings.inputRAWStats {
+		go i.reportStats()
+	}
+
 	return
 }
 
+// splitRAWAddress splits address with multiple ports, like ':8000,:8001,:9000-9010', to host and ports list.
+// Host can be given in any item, but should be the same for all of them.
+func splitRAWAddress(address string) (host, ports string, err error) {
+	var list []string
+
+	for _, item := range strings.Split(address, ",") {
+		item = strings.TrimSpace(item)
+
+		// Host part can be omitted, like "8000,8001"
+		if !strings.Contains(item, ":") {
+			item = ":" + item
+		}
+
+		h, p, err := net.SplitHostPort(item)
+		if err != nil {
+			return "", "", err
+		}
+
+		if h != "" {
+			if host != "" && host != h {
+				return "", "", errors.New("all ports should be on the same host: " + address)
+			}
+			host = h
+		}
+
+		list = append(list, p)
+	}
+
+	return host, strings.Join(list, ","), nil
+}
+
+// listenerConfig returns optional listener settings, based on input-raw flags
+func listenerConfig() (config raw.ListenerConfig) {
+	if Settings.inputRAWTLSKey != "" || Settings.inputRAWTLSKeyLog != "" {
+		keys, err := raw.NewTLSKeys(Settings.inputRAWTLSKey, Settings.inputRAWTLSKeyLog)
+		if err != nil {
+			log.Fatal("input-raw: can't load TLS keys: ", err)
+		}
+		config.TLSKeys = keys
+	}
+
+	config.BPFFilter = Settings.inputRAWBPFFilter
+	config.Decapsulate = Settings.inputRAWDecapsulate
+	config.AFPacketFanout = Settings.inputRAWAFPacketFanout
+	config.SnapLen = Settings.inputRAWSnapLen
+	config.NoPromiscuous = !Settings.inputRAWPromisc
+	config.ImmediateMode = Settings.inputRAWImmediateMode
+	config.BufferSize = int(Settings.inputRAWBufferSize)
+	config.ReassemblyLimit = int(Settings.inputRAWReassemblyLimit)
+	config.ConnExpire = Settings.inputRAWConnExpire
+	config.MaxFlows = Settings.inputRAWMaxFlows
+	config.MaxMessageSize = int(Settings.inputRAWMaxMessageSize)
+
+	switch Settings.inputRAWProtocol {
+	case "", "tcp":
+	case "udp":
+		config.UDP = true
+	default:
+		log.Fatal("input-raw: unknown protocol: ", Settings.inputRAWProtocol)
+	}
+
+	for _, pattern := range Settings.inputRAWTLSServerName {
+		pattern = strings.ToLower(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatal("input-raw: wrong TLS server name pattern: ", pattern)
+		}
+		config.TLSServerNames = append(config.TLSServerNames, pattern)
+	}
+	config.TLSALPN = Settings.inputRAWTLSALPN
+
+	var err error
+
+	if config.InterfaceInclude, err = interfacePattern(Settings.inputRAWIfaceInclude); err != nil {
+		log.Fatal("input-raw: wrong interface include pattern: ", err)
+	}
+
+	if config.InterfaceExclude, err = interfacePattern(Settings.inputRAWIfaceExclude); err != nil {
+		log.Fatal("input-raw: wrong interface exclude pattern: ", err)
+	}
+
+	if config.AllowIPs, err = raw.ParseIPNets(Settings.inputRAWAllowIP); err != nil {
+		log.Fatal("input-raw: ", err)
+	}
+
+	if config.DenyIPs, err = raw.ParseIPNets(Settings.inputRAWDenyIP); err != nil {
+		log.Fatal("input-raw: ", err)
+	}
+
+	for _, v := range Settings.inputRAWVLAN {
+		id, err := strconv.ParseUint(v, 10, 12)
+		if err != nil {
+			log.Fatal("input-raw: wrong VLAN ID: ", v)
+		}
+		config.VLANs = append(config.VLANs, uint16(id))
+	}
+
+	return
+}
+
+// interfacePattern compiles regular expression, which should match whole interface name
+func interfacePattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
 func (i *RAWInput) Read(data []byte) (int, error) {
-	msg := <-i.data
+	var msg *raw.TCPMessage
+
+	select {
+	case msg = <-i.data:
+	case d := <-i.datagrams:
+		return i.readDatagram(d, data), nil
+	case f := <-i.frames:
+		return i.readFrame(f, data), nil
+	}
+
 	buf := msg.Bytes()
 
 	var header []byte
 
 	if msg.IsIncoming {
 		header = payloadHeader(RequestPayload, msg.UUID(), msg.Start.UnixNano(), -1)
+		header = appendPayloadLabels(header, grpcPayloadLabels(buf, nil))
 		if len(i.realIPHeader) > 0 {
 			buf = proto.SetHeader(buf, i.realIPHeader, []byte(msg.IP().String()))
 		}
 	} else {
 		header = payloadHeader(ResponsePayload, msg.UUID(), msg.AssocMessage.Start.UnixNano(), msg.End.UnixNano()-msg.AssocMessage.Start.UnixNano())
+		// Request is copied only for gRPC responses
+		if proto.IsGRPCContentType(proto.Header(buf, []byte("Content-Type"))) {
+			header = appendPayloadLabels(header, grpcPayloadLabels(msg.AssocMessage.Bytes(), buf))
+		}
+	}
+
+	if i.k8s != nil {
+		header = appendPayloadLabels(header, i.k8s.Labels(msg.IP(), msg.DstIP()))
 	}
 
 	copy(data[0:len(header)], header)
@@ -65,12 +221,43 @@ func (i *RAWInput) Read(data []byte) (int, error) {
 	return len(buf) + len(header), nil
 }
 
+// readDatagram writes UDP datagram as separate payload
+func (i *RAWInput) readDatagram(d *raw.UDPDatagram, data []byte) int {
+	var header []byte
+
+	if d.IsIncoming {
+		header = payloadHeader(UDPRequestPayload, d.UUID(), d.Timestamp.UnixNano(), -1)
+	} else {
+		header = payloadHeader(UDPResponsePayload, d.UUID(), d.AssocDatagram.Timestamp.UnixNano(), d.Timestamp.UnixNano()-d.AssocDatagram.Timestamp.UnixNano())
+	}
+
+	copy(data[0:len(header)], header)
+	copy(data[len(header):], d.Data)
+
+	return len(d.Data) + len(header)
+}
+
+// readFrame writes WebSocket frame as separate payload, with id of connection handshake
+func (i *RAWInput) readFrame(f *raw.WebSocketFrame, data []byte) int {
+	payloadType := byte(WebSocketServerPayload)
+	if f.IsIncoming {
+		payloadType = WebSocketClientPayload
+	}
+
+	header := payloadHeader(payloadType, f.UUID(), f.Timestamp.UnixNano(), -1)
+
+	copy(data[0:len(header)], header)
+	copy(data[len(header):], f.Data)
+
+	return len(f.Data) + len(header)
+}
+
 func (i *RAWInput) listen(address string) {
 	Debug("Listening for traffic on: " + address)
 
-	host, port, err := net.SplitHostPort(address)
+	host, port, err := splitRAWAddress(address)
 
-	if i.engine == EnginePcapFile {
+	if i.engine == EnginePcapFile || i.engine == EnginePcapDir {
 		host = address
 		port = "1"
 		err = nil
@@ -80,9 +267,11 @@ func (i *RAWInput) listen(address string) {
 		log.Fatal("input-raw: error while parsing address", err)
 	}
 
-	i.listener = raw.NewListener(host, port, i.engine, i.trackResponse, i.expire)
+	i.listener = raw.NewListenerWithConfig(host, port, i.engine, i.trackResponse, i.expire, listenerConfig())
 
 	ch := i.listener.Receiver()
+	i.datagrams = i.listener.DatagramReceiver()
+	i.frames = i.listener.WebSocketReceiver()
 
 	go func() {
 		for {
@@ -106,6 +295,9 @@ func (i *RAWInput) String() string {
 
 func (i *RAWInput) Close() error {
 	i.listener.Close()
+	if i.k8s != nil {
+		i.k8s.Close()
+	}
 	close(i.quit)
 	return nil
 }
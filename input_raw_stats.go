@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	raw "github.com/buger/gor/raw_socket_listener"
+)
+
+// formatRAWStats returns counters of capture engine and TCP reassembly
+func formatRAWStats(s raw.Stats) string {
+	return fmt.Sprintf("received: %d, dropped by kernel: %d, dropped by interface: %d, incomplete messages: %d, oversized messages: %d, reassembly limit drops: %d, retransmitted packets: %d, expired connections: %d, evicted flows: %d, filtered packets: %d",
+		s.PacketsReceived,
+		s.PacketsDropped,
+		s.PacketsIfDropped,
+		s.IncompleteMessages,
+		s.OversizedMessages,
+		s.ReassemblyDropped,
+		s.RetransmittedPackets,
+		s.ExpiredConnections,
+		s.EvictedFlows,
+		s.FilteredPackets,
+	)
+}
+
+func (i *RAWInput) reportStats() {
+	ticker := time.NewTicker(rate * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-i.quit:
+			return
+		case <-ticker.C:
+			log.Printf("[INPUT-RAW] Stats '%s': %s\n", i.address, formatRAWStats(i.listener.Stats()))
+		}
+	}
+}
@@ -23,6 +23,64 @@ import (
 
 const testRawExpire = time.Millisecond * 200
 
+func TestIsPcapFile(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"./capture.pcap":     true,
+		"/tmp/dump.PCAPNG":   true,
+		"dump.cap":           true,
+		"requests.gor":       false,
+		"requests_*.gor.gz":  false,
+		"s3://bucket/prefix": false,
+	} {
+		if isPcapFile(path) != expected {
+			t.Error("Wrong pcap file detection", path)
+		}
+	}
+}
+
+func TestSplitRAWAddress(t *testing.T) {
+	for address, expected := range map[string][2]string{
+		":80":                     {"", "80"},
+		"127.0.0.1:8000,:8001":    {"127.0.0.1", "8000,8001"},
+		":8000,:8001,:9000-9010":  {"", "8000,8001,9000-9010"},
+		"[::1]:8000, 8001":        {"::1", "8000,8001"},
+		"10.0.0.1:80,10.0.0.2:81": {"", ""},
+	} {
+		host, ports, err := splitRAWAddress(address)
+		if expected[1] == "" {
+			if err == nil {
+				t.Error("Should return error for different hosts", address)
+			}
+			continue
+		}
+
+		if err != nil || host != expected[0] || ports != expected[1] {
+			t.Error("Wrong address split", address, host, ports, err)
+		}
+	}
+}
+
+func TestInterfacePattern(t *testing.T) {
+	re, err := interfacePattern("eth.*|lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]bool{"eth0": true, "lo": true, "veth1a2b": false, "lo0": false} {
+		if re.MatchString(name) != expected {
+			t.Error("Wrong interface match", name)
+		}
+	}
+
+	if re, _ := interfacePattern(""); re != nil {
+		t.Error("Empty pattern should match all interfaces")
+	}
+
+	if _, err := interfacePattern("eth["); err == nil {
+		t.Error("Should return error for wrong pattern")
+	}
+}
+
 func TestRAWInputIPv4(t *testing.T) {
 	wg := new(sync.WaitGroup)
 	quit := make(chan int)
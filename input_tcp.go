@@ -3,6 +3,8 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,24 +12,65 @@ import (
 	"os"
 )
 
+// TCPInputConfig struct for holding TCP input configuration
+type TCPInputConfig struct {
+	// Server certificate and its key in PEM format, connections are accepted over TLS if they are set
+	tlsCert string
+	tlsKey  string
+	// If set, clients should present certificate signed by one of these CAs
+	clientCACerts MultiOption
+}
+
 // TCPInput used for internal communication
 type TCPInput struct {
 	data     chan []byte
 	address  string
+	config   *TCPInputConfig
 	listener net.Listener
 }
 
 // NewTCPInput constructor for TCPInput, accepts address with port
-func NewTCPInput(address string) (i *TCPInput) {
+func NewTCPInput(address string, config *TCPInputConfig) (i *TCPInput) {
 	i = new(TCPInput)
 	i.data = make(chan []byte, 1000)
 	i.address = address
+	i.config = config
 
 	i.listen(address)
 
 	return
 }
 
+// tlsConfig returns TLS settings of listener, or nil if TLS is not enabled
+func (c *TCPInputConfig) tlsConfig() (*tls.Config, error) {
+	if c.tlsCert == "" && c.tlsKey == "" {
+		if len(c.clientCACerts) > 0 {
+			return nil, errors.New("client CA requires server certificate and key")
+		}
+		return nil, nil
+	}
+
+	if c.tlsCert == "" || c.tlsKey == "" {
+		return nil, errors.New("both server certificate and key should be set")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.tlsCert, c.tlsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if len(c.clientCACerts) > 0 {
+		if config.ClientCAs, err = loadCertPool(c.clientCACerts); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
 func (i *TCPInput) Read(data []byte) (int, error) {
 	buf := <-i.data
 	copy(data, buf)
@@ -36,13 +79,23 @@ func (i *TCPInput) Read(data []byte) (int, error) {
 }
 
 func (i *TCPInput) listen(address string) {
+	tlsConfig, err := i.config.tlsConfig()
+	if err != nil {
+		log.Fatal("[INPUT-TCP] TLS: ", err)
+	}
+
 	listener, err := net.Listen("tcp", address)
-	i.listener = listener
 
 	if err != nil {
 		log.Fatal("Can't start:", err)
 	}
 
+	// Handshake is done on first read from accepted connection
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	i.listener = listener
+
 	go func() {
 		for {
 			conn, err := listener.Accept()
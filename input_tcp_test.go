@@ -1,18 +1,22 @@
 package main
 
 import (
+	"crypto/tls"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"os"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestTCPInput(t *testing.T) {
 	wg := new(sync.WaitGroup)
 	quit := make(chan int)
 
-	input := NewTCPInput("127.0.0.1:0")
+	input := NewTCPInput("127.0.0.1:0", &TCPInputConfig{})
 	output := NewTestOutput(func(data []byte) {
 		wg.Done()
 	})
@@ -46,3 +50,50 @@ func TestTCPInput(t *testing.T) {
 
 	close(quit)
 }
+
+func TestTCPInputTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_tls")
+	defer os.RemoveAll(dir)
+
+	serverCert, serverKey := writeTestCert(t, dir, "server")
+	clientCert, clientKey := writeTestCert(t, dir, "client")
+
+	wg := new(sync.WaitGroup)
+	quit := make(chan int)
+
+	input := NewTCPInput("127.0.0.1:0", &TCPInputConfig{tlsCert: serverCert, tlsKey: serverKey, clientCACerts: MultiOption{clientCert}})
+	output := NewTestOutput(func(data []byte) {
+		wg.Done()
+	})
+
+	Plugins.Inputs = []io.Reader{input}
+	Plugins.Outputs = []io.Writer{output}
+
+	go Start(quit)
+
+	// Client without certificate is rejected
+	conn, err := tls.Dial("tcp", input.listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		conn.Write([]byte("1 1 1\nGET / HTTP/1.1\r\n\r\n" + payloadSeparator))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err = conn.Read(make([]byte, 1)); err == nil {
+			t.Error("Connection without client certificate should fail")
+		}
+		conn.Close()
+	}
+
+	tcpOutput := NewTCPOutput(input.listener.Addr().String(), &TCPOutputConfig{caCerts: MultiOption{serverCert}, tlsCert: clientCert, tlsKey: clientKey})
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		tcpOutput.Write([]byte("1 1 1\nGET / HTTP/1.1\r\n\r\n"))
+	}
+
+	wg.Wait()
+
+	close(quit)
+
+	if _, err := (&TCPInputConfig{tlsCert: serverCert}).tlsConfig(); err == nil {
+		t.Error("Should require both certificate and key")
+	}
+}
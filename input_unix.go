@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/gor/proto"
+)
+
+// Bigger messages are still proxied, but not emitted
+const unixMaxMessageSize = 64 * 1024 * 1024
+
+var errUnixMessageTooBig = errors.New("message is too big")
+
+// UnixInput proxies connections of unix domain socket, and emits HTTP requests and responses passing through it.
+// Gor listens on its own socket path, and forwards each connection to the application socket.
+type UnixInput struct {
+	data          chan []byte
+	address       string
+	upstream      string
+	trackResponse bool
+	listener      net.Listener
+	// Messages dropped because nobody reads emitted ones fast enough
+	dropped uint64
+	closed  chan struct{}
+}
+
+// unixRequest is emitted request, which response is expected
+type unixRequest struct {
+	uuid   []byte
+	method []byte
+	start  time.Time
+}
+
+// NewUnixInput constructor for UnixInput, address is '<listen path>:<application socket path>'
+func NewUnixInput(address string, trackResponse bool) (i *UnixInput) {
+	i = new(UnixInput)
+	i.data = make(chan []byte, 1000)
+	i.closed = make(chan struct{})
+	i.trackResponse = trackResponse
+
+	paths := strings.SplitN(address, ":", 2)
+	if len(paths) != 2 || paths[0] == "" || paths[1] == "" {
+		log.Fatal("[INPUT-UNIX] Address should be '<listen path>:<application socket path>', got: ", address)
+	}
+	i.address, i.upstream = paths[0], paths[1]
+
+	i.listen()
+	go i.reportDropped()
+
+	return
+}
+
+func (i *UnixInput) Read(data []byte) (int, error) {
+	buf := <-i.data
+	copy(data, buf)
+
+	return len(buf), nil
+}
+
+func (i *UnixInput) listen() {
+	// Socket file left by previous run prevents listening
+	if stat, err := os.Stat(i.address); err == nil && stat.Mode()&os.ModeSocket != 0 {
+		os.Remove(i.address)
+	}
+
+	listener, err := net.Listen("unix", i.address)
+	if err != nil {
+		log.Fatal("[INPUT-UNIX] Can't start:", err)
+	}
+	i.listener = listener
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					continue
+				}
+				return
+			}
+
+			go i.handleConnection(conn)
+		}
+	}()
+}
+
+func (i *UnixInput) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	upstream, err := net.DialTimeout("unix", i.upstream, 5*time.Second)
+	if err != nil {
+		log.Println("[INPUT-UNIX] Can't connect to application socket:", err)
+		return
+	}
+	defer upstream.Close()
+
+	requests := make(chan unixRequest, 100)
+	done := make(chan bool)
+
+	go func() {
+		i.proxyResponses(upstream, conn, requests)
+		closeWrite(conn)
+		done <- true
+	}()
+
+	i.proxyRequests(conn, upstream, requests)
+	closeWrite(upstream)
+
+	<-done
+}
+
+// closeWrite signals end of data to other side, while still allowing to read its reply
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(*net.UnixConn); ok {
+		c.CloseWrite()
+	}
+}
+
+// proxyRequests forwards client data to application, and emits requests parsed from it.
+// Data is forwarded as soon as it is read, so parsing does not delay it. Requests channel is closed when it returns.
+func (i *UnixInput) proxyRequests(src, dst net.Conn, requests chan unixRequest) {
+	defer func() {
+		if requests != nil {
+			close(requests)
+		}
+	}()
+
+	reader := bufio.NewReader(io.TeeReader(src, dst))
+
+	for {
+		msg, start, err := readHTTPMessage(reader, true, nil)
+		if err != nil {
+			if err != io.EOF {
+				Debug("[INPUT-UNIX] Can't parse request, rest of connection is not captured:", err)
+			}
+			io.Copy(ioutil.Discard, reader)
+			return
+		}
+
+		id := uuid()
+		i.emit(payloadHeader(RequestPayload, id, start.UnixNano(), -1), msg)
+
+		if i.trackResponse && requests != nil {
+			// Proxying should not block, if responses are not parsed anymore. Once request is skipped,
+			// following responses can't be matched by order, so responses of connection are not emitted anymore.
+			select {
+			case requests <- unixRequest{id, proto.Method(msg), start}:
+			default:
+				Debug("[INPUT-UNIX] Too many requests waiting for response, rest of responses is not captured")
+				close(requests)
+				requests = nil
+			}
+		}
+	}
+}
+
+// proxyResponses forwards application data to client. Responses are matched to requests in order.
+func (i *UnixInput) proxyResponses(src, dst net.Conn, requests chan unixRequest) {
+	reader := bufio.NewReader(io.TeeReader(src, dst))
+
+	if !i.trackResponse {
+		io.Copy(ioutil.Discard, reader)
+		return
+	}
+
+	for {
+		req, ok := <-requests
+		if !ok {
+			io.Copy(ioutil.Discard, reader)
+			return
+		}
+
+		var msg []byte
+		var err error
+
+		// Informational responses, like '100 Continue', are followed by final one
+		for {
+			if msg, _, err = readHTTPMessage(reader, false, req.method); err != nil || !bytes.HasPrefix(proto.Status(msg), []byte("1")) {
+				break
+			}
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				Debug("[INPUT-UNIX] Can't parse response, rest of connection is not captured:", err)
+			}
+			io.Copy(ioutil.Discard, reader)
+			return
+		}
+
+		i.emit(payloadHeader(ResponsePayload, req.uuid, req.start.UnixNano(), time.Since(req.start).Nanoseconds()), msg)
+	}
+}
+
+// emit passes message to emitter. Proxied connections should not wait for it, so message is dropped if emitter is behind.
+func (i *UnixInput) emit(header, msg []byte) {
+	buf := make([]byte, 0, len(header)+len(msg))
+	buf = append(buf, header...)
+	buf = append(buf, msg...)
+
+	select {
+	case i.data <- buf:
+	default:
+		atomic.AddUint64(&i.dropped, 1)
+	}
+}
+
+// reportDropped logs number of dropped messages every few seconds
+func (i *UnixInput) reportDropped() {
+	var reported uint64
+
+	for {
+		select {
+		case <-i.closed:
+			return
+		case <-time.After(rate * time.Second):
+		}
+
+		if dropped := atomic.LoadUint64(&i.dropped); dropped > reported {
+			log.Println("[INPUT-UNIX] Emitter is behind, dropped", dropped-reported, "messages, total:", dropped)
+			reported = dropped
+		}
+	}
+}
+
+// readHTTPMessage reads single HTTP/1.x request or response, and returns it with time when its first line was read.
+// For responses method of request is required, since responses to HEAD have no body.
+func readHTTPMessage(reader *bufio.Reader, isRequest bool, method []byte) (msg []byte, start time.Time, err error) {
+	var buf bytes.Buffer
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if buf.Len() == 0 {
+			start = time.Now()
+		}
+		buf.Write(line)
+
+		if err != nil {
+			if err == io.EOF && buf.Len() > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, start, err
+		}
+
+		if buf.Len() > unixMaxMessageSize {
+			return nil, start, errUnixMessageTooBig
+		}
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// Empty lines before request line are ignored
+			if buf.Len() == len(line) {
+				buf.Reset()
+				continue
+			}
+
+			// Empty line ends headers
+			break
+		}
+	}
+
+	headers := buf.Bytes()
+	length := -1
+
+	if !isRequest {
+		status := proto.Status(headers)
+		if bytes.Equal(method, []byte("HEAD")) || bytes.HasPrefix(status, []byte("1")) || bytes.Equal(status, []byte("204")) || bytes.Equal(status, []byte("304")) {
+			return buf.Bytes(), start, nil
+		}
+	}
+
+	if bytes.Contains(bytes.ToLower(proto.Header(headers, []byte("Transfer-Encoding"))), []byte("chunked")) {
+		err = readChunkedBody(reader, &buf)
+		return buf.Bytes(), start, err
+	}
+
+	if cl := proto.Header(headers, []byte("Content-Length")); len(cl) > 0 {
+		if length, err = strconv.Atoi(string(cl)); err != nil || length < 0 {
+			return nil, start, errors.New("wrong Content-Length: " + string(cl))
+		}
+	}
+
+	switch {
+	case length > unixMaxMessageSize:
+		return nil, start, errUnixMessageTooBig
+	case length > 0:
+		_, err = io.CopyN(&buf, reader, int64(length))
+	case length == -1 && !isRequest:
+		// Response without length ends with connection
+		_, err = io.Copy(&buf, io.LimitReader(reader, unixMaxMessageSize))
+	}
+
+	return buf.Bytes(), start, err
+}
+
+// readChunkedBody reads chunks including final one and trailers, in wire format
+func readChunkedBody(reader *bufio.Reader, buf *bytes.Buffer) error {
+	for {
+		line, err := reader.ReadBytes('\n')
+		buf.Write(line)
+		if err != nil {
+			return err
+		}
+
+		sizeStr := strings.TrimSpace(strings.SplitN(string(line), ";", 2)[0])
+		size, err := strconv.ParseInt(sizeStr, 16, 64)
+		if err != nil || size < 0 {
+			return errors.New("wrong chunk size: " + sizeStr)
+		}
+
+		if size == 0 {
+			break
+		}
+
+		if int64(buf.Len())+size > unixMaxMessageSize {
+			return errUnixMessageTooBig
+		}
+
+		// Chunk data is followed by CRLF
+		if _, err = io.CopyN(buf, reader, size+2); err != nil {
+			return err
+		}
+	}
+
+	// Trailers end with empty line
+	for {
+		line, err := reader.ReadBytes('\n')
+		buf.Write(line)
+		if err != nil {
+			return err
+		}
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return nil
+		}
+	}
+}
+
+func (i *UnixInput) String() string {
+	return "Unix socket input: " + i.address + " -> " + i.upstream
+}
+
+// Close stops listening, and removes socket file
+func (i *UnixInput) Close() error {
+	close(i.closed)
+	return i.listener.Close()
+}
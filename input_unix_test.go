@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUnixInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gor-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	appPath := filepath.Join(dir, "app.sock")
+	gorPath := filepath.Join(dir, "gor.sock")
+
+	app, err := net.Listen("unix", appPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+
+	go http.Serve(app, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/chunked" {
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte("echo " + string(body)))
+	}))
+
+	input := NewUnixInput(gorPath+":"+appPath, true)
+	defer input.Close()
+
+	conn, err := net.Dial("unix", gorPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	// Keep-alive connection with two requests, second response is chunked
+	for _, path := range []string{"/a", "/chunked"} {
+		conn.Write([]byte("POST " + path + " HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello"))
+
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal("Should proxy response:", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != "echo hello" {
+			t.Error("Wrong response body:", string(body))
+		}
+	}
+
+	data := make([]byte, 4096)
+	var payloads []string
+	for len(payloads) < 4 {
+		done := make(chan int)
+		go func() {
+			n, _ := input.Read(data)
+			done <- n
+		}()
+
+		select {
+		case n := <-done:
+			payloads = append(payloads, string(data[:n]))
+		case <-time.After(time.Second):
+			t.Fatal("Should emit request and response", payloads)
+		}
+	}
+
+	var requests, responses int
+	for _, p := range payloads {
+		body := string(payloadBody([]byte(p)))
+
+		switch p[0] {
+		case RequestPayload:
+			requests++
+			if !strings.HasPrefix(body, "POST /") || !strings.HasSuffix(body, "\r\n\r\nhello") {
+				t.Errorf("Wrong request: %q", body)
+			}
+		case ResponsePayload:
+			responses++
+			if !strings.HasPrefix(body, "HTTP/1.1 200 OK") || !strings.Contains(body, "echo hello") {
+				t.Errorf("Wrong response: %q", body)
+			}
+		}
+	}
+
+	if requests != 2 || responses != 2 {
+		t.Error("Should emit 2 requests and 2 responses", payloads)
+	}
+
+	if string(payloadMeta([]byte(payloads[0]))[1]) != string(payloadMeta([]byte(payloads[1]))[1]) {
+		t.Error("Response should have id of its request")
+	}
+}
+
+func TestUnixInputEmitterBehind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gor-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	appPath := filepath.Join(dir, "app.sock")
+	gorPath := filepath.Join(dir, "gor.sock")
+
+	app, err := net.Listen("unix", appPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+
+	go http.Serve(app, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	input := NewUnixInput(gorPath+":"+appPath, true)
+	defer input.Close()
+
+	// Nobody reads emitted messages
+	input.data = make(chan []byte)
+
+	conn, err := net.Dial("unix", gorPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+
+	if _, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil {
+		t.Fatal("Proxying should not wait for emitter:", err)
+	}
+
+	for start := time.Now(); atomic.LoadUint64(&input.dropped) < 2 && time.Since(start) < time.Second; {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if dropped := atomic.LoadUint64(&input.dropped); dropped != 2 {
+		t.Error("Request and response should be dropped:", dropped)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// jsonlRequest is single line of JSON-lines input:
+//
+//	{"method": "POST", "url": "/upload", "headers": {"Host": "example.org"}, "body": "a=1", "timestamp": "2017-01-10T10:00:00Z"}
+//
+// Timestamp is either string in one of formats accepted by --input-file-from, or number of seconds since epoch.
+// Requests without timestamp are emitted right after previous one.
+type jsonlRequest struct {
+	Method    string            `json:"method"`
+	URL       string            `json:"url"`
+	Headers   map[string]string `json:"headers"`
+	Body      string            `json:"body"`
+	Timestamp json.RawMessage   `json:"timestamp"`
+}
+
+// jsonlReader converts JSON-lines stream to Gor file format on the fly
+type jsonlReader struct {
+	reader   *bufio.Reader
+	buf      bytes.Buffer
+	partial  []byte
+	line     int
+	lastTime int64
+}
+
+func newJSONLReader(r *bufio.Reader) *jsonlReader {
+	return &jsonlReader{reader: r}
+}
+
+func (r *jsonlReader) Read(data []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		line, err := r.reader.ReadBytes('\n')
+
+		if r.partial != nil {
+			line = append(r.partial, line...)
+			r.partial = nil
+		}
+
+		if err != nil {
+			// Keep unfinished line, file can be still written to
+			if err == io.EOF && len(line) > 0 {
+				r.partial = line
+			}
+			return 0, err
+		}
+
+		r.line++
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		if err := r.convert(line); err != nil {
+			log.Println("[FILE-INPUT] Skipping invalid JSON line", r.line, err)
+		}
+	}
+
+	return r.buf.Read(data)
+}
+
+func (r *jsonlReader) convert(line []byte) error {
+	var req jsonlRequest
+	if err := json.Unmarshal(line, &req); err != nil {
+		return err
+	}
+
+	if req.Method == "" || req.URL == "" {
+		return errors.New("method and url are required")
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return err
+	}
+
+	if len(req.Timestamp) > 0 {
+		if r.lastTime, err = parseJSONLTimestamp(req.Timestamp); err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(req.Headers))
+	for name := range req.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	headers := make([]harHeader, len(names))
+	for i, name := range names {
+		headers[i] = harHeader{Name: name, Value: req.Headers[name]}
+	}
+
+	r.buf.Write(payloadHeader(RequestPayload, uuid(), r.lastTime, -1))
+	r.buf.Write(buildHTTPMessage(req.Method+" "+u.RequestURI()+" HTTP/1.1", headers, u.Host, []byte(req.Body)))
+	r.buf.WriteString(payloadSeparator)
+
+	return nil
+}
+
+func parseJSONLTimestamp(raw json.RawMessage) (int64, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return parseTimestamp(s)
+	}
+
+	seconds, err := strconv.ParseFloat(string(raw), 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(seconds * float64(time.Second)), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestInputFileJSONL(t *testing.T) {
+	name := fmt.Sprintf("/tmp/%d.log", rand.Int63())
+	ioutil.WriteFile(name, []byte(`{"method": "GET", "url": "http://example.org/?q=1", "timestamp": 1484042400}
+not a json
+{"method": "POST", "url": "/upload", "headers": {"Host": "example.org", "Content-Type": "text/plain"}, "body": "test", "timestamp": "2017-01-10T10:00:00.01Z"}
+`), 0660)
+	defer os.Remove(name)
+
+	input := NewFileInput(name, &FileInputConfig{format: "jsonl"})
+	buf := make([]byte, 1000)
+
+	expected := []struct {
+		body      string
+		timestamp int64
+	}{
+		{"GET /?q=1 HTTP/1.1\r\nHost: example.org\r\n\r\n", 1484042400 * int64(time.Second)},
+		{"POST /upload HTTP/1.1\r\nContent-Type: text/plain\r\nHost: example.org\r\nContent-Length: 4\r\n\r\ntest", 1484042400*int64(time.Second) + 10*int64(time.Millisecond)},
+	}
+
+	for _, e := range expected {
+		n, _ := input.Read(buf)
+		payload := buf[:n]
+
+		if !bytes.Equal(payloadBody(payload), []byte(e.body)) {
+			t.Errorf("Wrong payload: %q", payloadBody(payload))
+		}
+
+		if ts := string(payloadMeta(payload)[2]); ts != fmt.Sprint(e.timestamp) {
+			t.Error("Wrong timestamp", ts)
+		}
+	}
+
+	input.Close()
+}
+
+func TestFileInputFormat(t *testing.T) {
+	for name, expected := range map[string]string{
+		"requests.gor":       fileFormatGor,
+		"requests_0.gz":      fileFormatGor,
+		"session.har":        fileFormatHAR,
+		"session.har.gz":     fileFormatHAR,
+		"requests.jsonl.lz4": fileFormatJSONL,
+	} {
+		if format := fileInputFormat(name, ""); format != expected {
+			t.Error("Wrong format", name, format)
+		}
+	}
+
+	if format := fileInputFormat("requests.har", fileFormatJSONL); format != fileFormatJSONL {
+		t.Error("Format should be taken from config", format)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Service account credentials, mounted to every pod
+const (
+	k8sTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	k8sCAPath    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// k8sWorkload is pod or service, which owns IP address
+type k8sWorkload struct {
+	namespace string
+	pod       string
+	service   string
+}
+
+// K8sMetadata resolves captured IP addresses to Kubernetes pods, namespaces and services.
+// Pods, services and endpoints are periodically listed using API server.
+type K8sMetadata struct {
+	mu        sync.RWMutex
+	workloads map[string]k8sWorkload
+
+	api    string
+	token  string
+	client *http.Client
+	quit   chan bool
+}
+
+// Subset of Kubernetes API objects, needed to map IP addresses
+type k8sObjectMeta struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+type k8sPodList struct {
+	Items []struct {
+		Metadata k8sObjectMeta `json:"metadata"`
+		Spec     struct {
+			HostNetwork bool `json:"hostNetwork"`
+		} `json:"spec"`
+		Status struct {
+			PodIP  string `json:"podIP"`
+			PodIPs []struct {
+				IP string `json:"ip"`
+			} `json:"podIPs"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+type k8sServiceList struct {
+	Items []struct {
+		Metadata k8sObjectMeta `json:"metadata"`
+		Spec     struct {
+			ClusterIP  string   `json:"clusterIP"`
+			ClusterIPs []string `json:"clusterIPs"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+type k8sEndpointsList struct {
+	Items []struct {
+		Metadata k8sObjectMeta `json:"metadata"`
+		Subsets  []struct {
+			Addresses         []struct{ IP string } `json:"addresses"`
+			NotReadyAddresses []struct{ IP string } `json:"notReadyAddresses"`
+		} `json:"subsets"`
+	} `json:"items"`
+}
+
+// NewK8sMetadata constructor for K8sMetadata. If API address is empty, in-cluster API server and
+// service account of Gor pod are used.
+func NewK8sMetadata(api string, refresh time.Duration) *K8sMetadata {
+	m := &K8sMetadata{
+		workloads: make(map[string]k8sWorkload),
+		api:       strings.TrimRight(api, "/"),
+		quit:      make(chan bool),
+	}
+
+	if m.api == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" {
+			log.Fatal("[K8S] Not running in Kubernetes cluster, API server address should be set explicitly")
+		}
+		m.api = "https://" + net.JoinHostPort(host, port)
+	}
+
+	if token, err := ioutil.ReadFile(k8sTokenPath); err == nil {
+		m.token = strings.TrimSpace(string(token))
+	}
+
+	tlsConfig := &tls.Config{}
+	if ca, err := ioutil.ReadFile(k8sCAPath); err == nil {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AppendCertsFromPEM(ca)
+	}
+
+	m.client = &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+
+	if err := m.refresh(); err != nil {
+		log.Println("[K8S] Can't load metadata:", err)
+	}
+
+	if refresh <= 0 {
+		refresh = 30 * time.Second
+	}
+	go m.refreshLoop(refresh)
+
+	return m
+}
+
+func (m *K8sMetadata) refreshLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.quit:
+			return
+		case <-ticker.C:
+			if err := m.refresh(); err != nil {
+				log.Println("[K8S] Can't refresh metadata:", err)
+			}
+		}
+	}
+}
+
+func (m *K8sMetadata) get(path string, v interface{}) error {
+	req, err := http.NewRequest("GET", m.api+path, nil)
+	if err != nil {
+		return err
+	}
+
+	if m.token != "" {
+		req.Header.Set("Authorization", "Bearer "+m.token)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", path, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// refresh lists pods, services and endpoints, and replaces address mapping
+func (m *K8sMetadata) refresh() error {
+	var pods k8sPodList
+	var services k8sServiceList
+	var endpoints k8sEndpointsList
+
+	if err := m.get("/api/v1/pods", &pods); err != nil {
+		return err
+	}
+
+	if err := m.get("/api/v1/services", &services); err != nil {
+		return err
+	}
+
+	if err := m.get("/api/v1/endpoints", &endpoints); err != nil {
+		return err
+	}
+
+	workloads := make(map[string]k8sWorkload)
+
+	for _, pod := range pods.Items {
+		// Pods in host network share address of node
+		if pod.Spec.HostNetwork {
+			continue
+		}
+
+		ips := []string{pod.Status.PodIP}
+		for _, ip := range pod.Status.PodIPs {
+			ips = append(ips, ip.IP)
+		}
+
+		for _, ip := range ips {
+			if ip != "" {
+				workloads[ip] = k8sWorkload{namespace: pod.Metadata.Namespace, pod: pod.Metadata.Name}
+			}
+		}
+	}
+
+	// Pods get service of endpoints they belong to
+	for _, e := range endpoints.Items {
+		for _, subset := range e.Subsets {
+			for _, addr := range append(subset.Addresses, subset.NotReadyAddresses...) {
+				if w, ok := workloads[addr.IP]; ok && w.service == "" {
+					w.service = e.Metadata.Name
+					workloads[addr.IP] = w
+				}
+			}
+		}
+	}
+
+	for _, svc := range services.Items {
+		ips := append([]string{svc.Spec.ClusterIP}, svc.Spec.ClusterIPs...)
+
+		for _, ip := range ips {
+			// Headless services have no cluster IP
+			if ip != "" && ip != "None" {
+				workloads[ip] = k8sWorkload{namespace: svc.Metadata.Namespace, service: svc.Metadata.Name}
+			}
+		}
+	}
+
+	m.mu.Lock()
+	m.workloads = workloads
+	m.mu.Unlock()
+
+	return nil
+}
+
+// Labels returns key=value labels with pod, namespace and service of message source and destination
+func (m *K8sMetadata) Labels(src, dst net.IP) (labels []string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, side := range []struct {
+		prefix string
+		ip     net.IP
+	}{{"src", src}, {"dst", dst}} {
+		if side.ip == nil {
+			continue
+		}
+
+		w, ok := m.workloads[side.ip.String()]
+		if !ok {
+			continue
+		}
+
+		labels = append(labels, side.prefix+"-namespace="+w.namespace)
+		if w.pod != "" {
+			labels = append(labels, side.prefix+"-pod="+w.pod)
+		}
+		if w.service != "" {
+			labels = append(labels, side.prefix+"-service="+w.service)
+		}
+	}
+
+	return
+}
+
+// Close stops refreshing metadata
+func (m *K8sMetadata) Close() {
+	close(m.quit)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestK8sMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/pods":
+			w.Write([]byte(`{"items": [
+				{"metadata": {"name": "web-1", "namespace": "shop"}, "status": {"podIP": "10.0.0.1"}},
+				{"metadata": {"name": "node-exporter", "namespace": "monitoring"}, "spec": {"hostNetwork": true}, "status": {"podIP": "192.168.0.1"}},
+				{"metadata": {"name": "checker", "namespace": "monitoring"}, "status": {"podIP": "10.0.0.2", "podIPs": [{"ip": "10.0.0.2"}, {"ip": "fd00::2"}]}}
+			]}`))
+		case "/api/v1/services":
+			w.Write([]byte(`{"items": [
+				{"metadata": {"name": "web", "namespace": "shop"}, "spec": {"clusterIP": "10.96.0.10"}},
+				{"metadata": {"name": "headless", "namespace": "shop"}, "spec": {"clusterIP": "None"}}
+			]}`))
+		case "/api/v1/endpoints":
+			w.Write([]byte(`{"items": [
+				{"metadata": {"name": "web", "namespace": "shop"}, "subsets": [{"addresses": [{"ip": "10.0.0.1"}]}]}
+			]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	m := NewK8sMetadata(server.URL, time.Minute)
+	defer m.Close()
+
+	for name, tc := range map[string]struct {
+		src, dst net.IP
+		labels   []string
+	}{
+		"Pod with service": {net.ParseIP("fd00::2"), net.IP{10, 0, 0, 1}, []string{"src-namespace=monitoring", "src-pod=checker", "dst-namespace=shop", "dst-pod=web-1", "dst-service=web"}},
+		"Cluster IP":       {net.IP{10, 0, 0, 2}, net.ParseIP("10.96.0.10"), []string{"src-namespace=monitoring", "src-pod=checker", "dst-namespace=shop", "dst-service=web"}},
+		"Host network":     {net.IP{192, 168, 0, 1}, nil, nil},
+	} {
+		if labels := m.Labels(tc.src, tc.dst); !reflect.DeepEqual(labels, tc.labels) {
+			t.Error(name, "Wrong labels", labels)
+		}
+	}
+}
+
+func TestPayloadLabels(t *testing.T) {
+	header := appendPayloadLabels(payloadHeader(RequestPayload, []byte("a"), 1, -1), []string{"src-pod=web-1", "src-service=web"})
+	payload := append(header, []byte("GET / HTTP/1.1\r\n\r\n")...)
+
+	if string(header) != "1 a 1 src-pod=web-1 src-service=web\n" {
+		t.Error("Wrong header", string(header))
+	}
+
+	if labels := payloadLabels(payload); labels["src-pod"] != "web-1" || labels["src-service"] != "web" {
+		t.Error("Wrong labels", labels)
+	}
+
+	if _, err := validatePayloadMeta(payload); err != nil {
+		t.Error("Labels should be valid meta", err)
+	}
+
+	if _, err := validatePayloadMeta([]byte("2 a 1 10 src-pod=web-1\nHTTP/1.1 200 OK\r\n\r\n")); err != nil {
+		t.Error("Labels should follow latency", err)
+	}
+
+	if _, err := validatePayloadMeta([]byte("2 a 1 src-pod=web-1 10\nHTTP/1.1 200 OK\r\n\r\n")); err == nil {
+		t.Error("Positional fields should not follow labels")
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Envelope encryption: each output file is encrypted with data key, generated by external key management service.
+// Data key encrypted by the service is stored in file header, along with key id, and decrypted by FileInput
+// using the same service. Master key never leaves the service.
+
+// keyManager generates data keys and decrypts them, using master key with given id
+type keyManager interface {
+	// GenerateDataKey returns 32 bytes data key, its encrypted form, and full id of master key
+	GenerateDataKey(keyID string) (plain, encrypted []byte, fullKeyID string, err error)
+	Decrypt(keyID string, encrypted []byte) ([]byte, error)
+}
+
+// Supported key management services, as used in --output-file-encryption-kms
+const (
+	kmsProviderAWS   = "aws-kms"
+	kmsProviderVault = "vault"
+)
+
+// Data key is rotated after this time. Within lifetime all chunks are encrypted with the same key,
+// so service is not called on each rotation.
+const kmsDataKeyLifetime = time.Hour
+
+func newKeyManager(provider string) (keyManager, error) {
+	switch provider {
+	case kmsProviderAWS:
+		return NewAWSKMSClient(), nil
+	case kmsProviderVault:
+		return NewVaultClient(), nil
+	}
+
+	return nil, fmt.Errorf("Unknown key management service: %s", provider)
+}
+
+// kmsKeyVar is master key set by flag, like `aws-kms://alias/gor` or `vault://transit/gor`
+type kmsKeyVar struct {
+	provider string
+	keyID    string
+}
+
+func (k *kmsKeyVar) String() string {
+	if k.provider == "" {
+		return ""
+	}
+
+	return k.provider + "://" + k.keyID
+}
+
+func (k *kmsKeyVar) Set(value string) error {
+	idx := strings.Index(value, "://")
+	if idx == -1 || value[idx+3:] == "" {
+		return errors.New("Key should be set as aws-kms://<key id> or vault://<transit mount>/<key name>: " + value)
+	}
+
+	if _, err := newKeyManager(value[:idx]); err != nil {
+		return err
+	}
+
+	k.provider, k.keyID = value[:idx], value[idx+3:]
+	return nil
+}
+
+// envelopeKey holds data key used for encryption of output files, and its header written to each file
+type envelopeKey struct {
+	mu        sync.Mutex
+	master    kmsKeyVar
+	plain     []byte
+	header    []byte
+	generated time.Time
+}
+
+func newEnvelopeKey(master kmsKeyVar) *envelopeKey {
+	return &envelopeKey{master: master}
+}
+
+// get returns current data key and file header, generating new key when lifetime is over.
+// If service is not available, previous key is used until next attempt.
+func (k *envelopeKey) get() (plain, header []byte, err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.plain == nil || time.Since(k.generated) > kmsDataKeyLifetime {
+		var manager keyManager
+		if manager, err = newKeyManager(k.master.provider); err != nil {
+			return
+		}
+
+		plain, encrypted, keyID, genErr := manager.GenerateDataKey(k.master.keyID)
+		if genErr != nil {
+			if k.plain == nil {
+				return nil, nil, genErr
+			}
+			log.Println("[FILE-OUTPUT] Can't rotate encryption data key, using previous one:", genErr)
+		} else {
+			k.plain = plain
+			k.header = envelopeHeader(k.master.provider, keyID, encrypted)
+		}
+
+		// Failed attempts are not repeated on each chunk
+		k.generated = time.Now()
+	}
+
+	return k.plain, k.header, nil
+}
+
+// envelopeHeader is written after magic of envelope encrypted stream:
+//
+//	provider length (2 bytes) | provider | key id length (2 bytes) | key id | encrypted key length (2 bytes) | encrypted key
+func envelopeHeader(provider, keyID string, encrypted []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(envelopeMagic)
+
+	for _, field := range [][]byte{[]byte(provider), []byte(keyID), encrypted} {
+		buf.WriteByte(byte(len(field) >> 8))
+		buf.WriteByte(byte(len(field)))
+		buf.Write(field)
+	}
+
+	return buf.Bytes()
+}
+
+// Decrypted data keys, by provider, key id and encrypted key. Usually all files share just a few keys.
+var dataKeyCache = struct {
+	sync.Mutex
+	keys map[string][]byte
+}{keys: make(map[string][]byte)}
+
+// decryptDataKey decrypts data key from file header, using service which encrypted it
+func decryptDataKey(provider, keyID string, encrypted []byte) ([]byte, error) {
+	cacheKey := provider + "\x00" + keyID + "\x00" + string(encrypted)
+
+	dataKeyCache.Lock()
+	defer dataKeyCache.Unlock()
+
+	if key, ok := dataKeyCache.keys[cacheKey]; ok {
+		return key, nil
+	}
+
+	manager, err := newKeyManager(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := manager.Decrypt(keyID, encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt data key with %s key %s: %v", provider, keyID, err)
+	}
+
+	dataKeyCache.keys[cacheKey] = key
+	return key, nil
+}
+
+// AWSKMSClient is minimal AWS KMS API client, supporting only data key operations
+//
+// Credentials and region are read from the standard AWS_* environment variables, region is also taken from key ARN.
+// Set AWS_ENDPOINT_URL_KMS to use different endpoint.
+type AWSKMSClient struct {
+	region   string
+	endpoint string
+	creds    AWSCredentials
+	client   *http.Client
+}
+
+// NewAWSKMSClient constructor for AWSKMSClient
+func NewAWSKMSClient() *AWSKMSClient {
+	return &AWSKMSClient{
+		region:   awsRegionFromEnv(),
+		endpoint: strings.TrimSuffix(os.Getenv("AWS_ENDPOINT_URL_KMS"), "/"),
+		creds:    awsCredentialsFromEnv(),
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// call executes KMS API action, see https://docs.aws.amazon.com/kms/latest/APIReference/
+func (c *AWSKMSClient) call(action, keyID string, request, response interface{}) error {
+	region := c.region
+	// arn:aws:kms:<region>:<account>:key/<id>
+	if parts := strings.Split(keyID, ":"); len(parts) > 3 && parts[0] == "arn" {
+		region = parts[3]
+	}
+
+	endpoint := c.endpoint
+	if endpoint == "" {
+		endpoint = "https://kms." + region + ".amazonaws.com"
+	}
+
+	body, _ := json.Marshal(request)
+	req, err := http.NewRequest("POST", endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+
+	signAWSRequestV4(req, sha256Hex(body), c.creds, region, "kms", time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("KMS %s: %s %s", action, resp.Status, msg)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+type awsKMSDataKey struct {
+	KeyID          string `json:"KeyId"`
+	CiphertextBlob []byte `json:"CiphertextBlob"`
+	Plaintext      []byte `json:"Plaintext"`
+}
+
+// GenerateDataKey implements keyManager
+func (c *AWSKMSClient) GenerateDataKey(keyID string) (plain, encrypted []byte, fullKeyID string, err error) {
+	var resp awsKMSDataKey
+	err = c.call("GenerateDataKey", keyID, map[string]string{"KeyId": keyID, "KeySpec": "AES_256"}, &resp)
+
+	return resp.Plaintext, resp.CiphertextBlob, resp.KeyID, err
+}
+
+// Decrypt implements keyManager
+func (c *AWSKMSClient) Decrypt(keyID string, encrypted []byte) ([]byte, error) {
+	var resp awsKMSDataKey
+	err := c.call("Decrypt", keyID, map[string]interface{}{"KeyId": keyID, "CiphertextBlob": encrypted}, &resp)
+
+	return resp.Plaintext, err
+}
+
+// VaultClient is minimal client of HashiCorp Vault transit secrets engine
+//
+// Address and token are read from VAULT_ADDR, VAULT_TOKEN and VAULT_NAMESPACE environment variables.
+// Key id is `<transit mount>/<key name>`, or just key name for the default `transit` mount.
+type VaultClient struct {
+	addr      string
+	token     string
+	namespace string
+	client    *http.Client
+}
+
+// NewVaultClient constructor for VaultClient
+func NewVaultClient() *VaultClient {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		addr = "https://127.0.0.1:8200"
+	}
+
+	return &VaultClient{
+		addr:      strings.TrimSuffix(addr, "/"),
+		token:     os.Getenv("VAULT_TOKEN"),
+		namespace: os.Getenv("VAULT_NAMESPACE"),
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type vaultResponse struct {
+	Data struct {
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+	} `json:"data"`
+}
+
+// call executes transit engine operation, like `datakey/plaintext` or `decrypt`
+func (c *VaultClient) call(operation, keyID string, request interface{}) (*vaultResponse, error) {
+	mount, name := "transit", keyID
+	if idx := strings.LastIndexByte(keyID, '/'); idx != -1 {
+		mount, name = keyID[:idx], keyID[idx+1:]
+	}
+
+	body, _ := json.Marshal(request)
+	req, err := http.NewRequest("POST", c.addr+"/v1/"+mount+"/"+operation+"/"+name, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", c.token)
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("Vault %s %s: %s %s", operation, keyID, resp.Status, msg)
+	}
+
+	result := new(vaultResponse)
+	return result, json.NewDecoder(resp.Body).Decode(result)
+}
+
+// GenerateDataKey implements keyManager. Vault ciphertext is text like `vault:v1:...`, stored as is.
+func (c *VaultClient) GenerateDataKey(keyID string) (plain, encrypted []byte, fullKeyID string, err error) {
+	resp, err := c.call("datakey/plaintext", keyID, map[string]int{"bits": 256})
+	if err != nil {
+		return
+	}
+
+	if plain, err = base64.StdEncoding.DecodeString(resp.Data.Plaintext); err != nil {
+		return
+	}
+
+	return plain, []byte(resp.Data.Ciphertext), keyID, nil
+}
+
+// Decrypt implements keyManager
+func (c *VaultClient) Decrypt(keyID string, encrypted []byte) ([]byte, error) {
+	resp, err := c.call("decrypt", keyID, map[string]string{"ciphertext": string(encrypted)})
+	if err != nil {
+		return nil, err
+	}
+
+	return base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Fake services "encrypt" data key by prefixing it with key id
+func newTestKMSServer(t *testing.T, calls *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256") {
+			t.Error("KMS request should be signed")
+		}
+
+		var req awsKMSDataKey
+		json.NewDecoder(r.Body).Decode(&req)
+
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.GenerateDataKey":
+			key := bytes.Repeat([]byte{1}, 32)
+			json.NewEncoder(w).Encode(awsKMSDataKey{
+				KeyID:          "arn:aws:kms:eu-west-1:111122223333:key/" + req.KeyID,
+				CiphertextBlob: append([]byte(req.KeyID+":"), key...),
+				Plaintext:      key,
+			})
+		case "TrentService.Decrypt":
+			json.NewEncoder(w).Encode(awsKMSDataKey{Plaintext: bytes.TrimPrefix(req.CiphertextBlob, []byte("gor:"))})
+		default:
+			w.WriteHeader(400)
+		}
+	}))
+}
+
+func newTestVaultServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(403)
+			return
+		}
+
+		var resp vaultResponse
+		switch r.URL.Path {
+		case "/v1/transit/datakey/plaintext/gor":
+			resp.Data.Plaintext = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+			resp.Data.Ciphertext = "vault:v1:" + resp.Data.Plaintext
+		case "/v1/transit/decrypt/gor":
+			var req map[string]string
+			json.NewDecoder(r.Body).Decode(&req)
+			resp.Data.Plaintext = strings.TrimPrefix(req["ciphertext"], "vault:v1:")
+		default:
+			w.WriteHeader(404)
+			return
+		}
+
+		json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+func TestFileOutputEncryptionKMS(t *testing.T) {
+	var calls int
+	kms := newTestKMSServer(t, &calls)
+	defer kms.Close()
+	vault := newTestVaultServer(t)
+	defer vault.Close()
+
+	os.Setenv("AWS_ENDPOINT_URL_KMS", kms.URL)
+	os.Setenv("VAULT_ADDR", vault.URL)
+	os.Setenv("VAULT_TOKEN", "token")
+	defer os.Unsetenv("AWS_ENDPOINT_URL_KMS")
+	defer os.Unsetenv("VAULT_ADDR")
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	for _, master := range []string{"aws-kms://gor", "vault://transit/gor"} {
+		var key kmsKeyVar
+		if err := key.Set(master); err != nil {
+			t.Fatal(err)
+		}
+
+		name := fmt.Sprintf("/tmp/%d.gz", rand.Int63())
+		output := NewFileOutput(name, &FileOutputConfig{flushInterval: time.Minute, encryptionKMS: key})
+		for i := 0; i < 100; i++ {
+			output.Write([]byte(fmt.Sprintf("1 %d 1\nsecret%d", i, i)))
+		}
+		output.Close()
+
+		chunk := setFileIndex(name, 0)
+		defer os.Remove(chunk)
+
+		data, _ := ioutil.ReadFile(chunk)
+		if !bytes.HasPrefix(data, envelopeMagic) || bytes.Contains(data, []byte("secret")) {
+			t.Error("File should be encrypted with data key", master)
+		}
+
+		// Key id is recorded in header, so key file is not needed
+		input := NewFileInput(chunk, &FileInputConfig{loopCount: 1})
+		buf := make([]byte, 1000)
+		for i := 0; i < 100; i++ {
+			n, err := input.Read(buf)
+			if expected := fmt.Sprintf("1 %d 1\nsecret%d", i, i); err != nil || string(buf[:n]) != expected {
+				t.Fatalf("%s: expected %q, got %q %v", master, expected, buf[:n], err)
+			}
+		}
+		input.Close()
+	}
+
+	if calls != 2 {
+		t.Error("Data key should be generated and decrypted once", calls)
+	}
+
+	var key kmsKeyVar
+	if err := key.Set("local://key"); err == nil {
+		t.Error("Should accept only known services")
+	}
+}
+
+func TestFileOutputEncryptionKMSUnavailable(t *testing.T) {
+	name := fmt.Sprintf("/tmp/%d", rand.Int63())
+	output := NewFileOutput(name, &FileOutputConfig{flushInterval: time.Minute})
+	// Data key was never generated, and service is unknown
+	output.envelopeKey = newEnvelopeKey(kmsKeyVar{provider: "local", keyID: "key"})
+
+	output.Write([]byte("1 1 1\nsecret"))
+	output.Close()
+
+	chunk := setFileIndex(name, 0)
+	defer os.Remove(chunk)
+
+	if data, err := ioutil.ReadFile(chunk); err == nil && bytes.Contains(data, []byte("secret")) {
+		t.Error("Payload should not be written unencrypted")
+	}
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"fmt"
 	"io"
+	"log"
 	"math/rand"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,11 +16,55 @@ type Limiter struct {
 	plugin    interface{}
 	limit     int
 	isPercent bool
+	// Set if limit is rate, like `200/s`
+	bucket *tokenBucket
 
 	currentRPS  int
 	currentTime int64
 }
 
+// tokenBucket allows requests at given rate, with bursts up to 100ms worth of rate. Requests above the rate are dropped,
+// not delayed: bucket caps traffic, but doesn't pace it.
+// Unlike absolute limit, it does not allow bursts at the start of every second.
+type tokenBucket struct {
+	mu       sync.Mutex
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+	// Current time, replaced in tests
+	now func() time.Time
+}
+
+func newTokenBucket(perSecond float64) *tokenBucket {
+	capacity := perSecond / 10
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	return &tokenBucket{rate: perSecond, capacity: capacity, tokens: capacity, last: time.Now(), now: time.Now}
+}
+
+// take returns false if there is no token for request
+func (b *tokenBucket) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
 func parseLimitOptions(options string) (limit int, isPercent bool) {
 	if strings.Contains(options, "%") {
 		limit, _ = strconv.Atoi(strings.Split(options, "%")[0])
@@ -32,11 +78,22 @@ func parseLimitOptions(options string) (limit int, isPercent bool) {
 }
 
 // NewLimiter constructor for Limiter, accepts plugin and options
-// `options` allow to sprcify relatve or absolute limiting
+// `options` allow to sprcify relatve or absolute limiting, or rate like `200/s`, `1000/m` or `10000/h`
 func NewLimiter(plugin interface{}, options string) io.ReadWriter {
 	l := new(Limiter)
-	l.limit, l.isPercent = parseLimitOptions(options)
 	l.plugin = plugin
+
+	if strings.Contains(options, "/") {
+		var rate rateVar
+		if err := rate.Set(options); err != nil {
+			log.Fatal("[LIMITER] Wrong limit: ", err)
+		}
+		l.bucket = newTokenBucket(float64(rate))
+
+		return l
+	}
+
+	l.limit, l.isPercent = parseLimitOptions(options)
 	l.currentTime = time.Now().UnixNano()
 
 	// FileInput have its own rate limiting. Unlike other inputs we not just dropping requests, we can slow down or speed up request emittion.
@@ -48,6 +105,10 @@ func NewLimiter(plugin interface{}, options string) io.ReadWriter {
 }
 
 func (l *Limiter) isLimited() bool {
+	if l.bucket != nil {
+		return !l.bucket.take()
+	}
+
 	// File input have its own limiting algorithm
 	if _, ok := l.plugin.(*FileInput); ok && l.isPercent {
 		return false
@@ -84,6 +145,11 @@ func (l *Limiter) Write(data []byte) (n int, err error) {
 func (l *Limiter) Read(data []byte) (n int, err error) {
 	n, err = l.plugin.(io.Reader).Read(data)
 
+	// Responses of outputs belong to requests, which already passed rate limit
+	if _, isW := l.plugin.(io.Writer); isW && l.bucket != nil {
+		return
+	}
+
 	if l.isLimited() {
 		return 0, nil
 	}
@@ -92,5 +158,9 @@ func (l *Limiter) Read(data []byte) (n int, err error) {
 }
 
 func (l *Limiter) String() string {
-	return fmt.Sprintf("Limiting %s to: %d (isPercent: %b)", l.plugin, l.limit, l.isPercent)
+	if l.bucket != nil {
+		return fmt.Sprintf("Limiting %s to: %v/s", l.plugin, l.bucket.rate)
+	}
+
+	return fmt.Sprintf("Limiting %s to: %d (isPercent: %t)", l.plugin, l.limit, l.isPercent)
 }
@@ -5,7 +5,9 @@ package main
 import (
 	"io"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestOutputLimiter(t *testing.T) {
@@ -104,3 +106,49 @@ func TestPercentLimiter2(t *testing.T) {
 
 	close(quit)
 }
+
+func TestRateLimiter(t *testing.T) {
+	var count int32
+
+	output := NewLimiter(NewTestOutput(func(data []byte) {
+		atomic.AddInt32(&count, 1)
+	}), "100/s")
+
+	bucket := output.(*Limiter).bucket
+	now := bucket.last
+	bucket.now = func() time.Time { return now }
+
+	payload := []byte("1 a 1\nGET / HTTP/1.1\r\n\r\n")
+
+	// Burst is limited to 100ms of rate
+	for i := 0; i < 100; i++ {
+		output.Write(payload)
+	}
+
+	if n := atomic.LoadInt32(&count); n != 10 {
+		t.Error("Should allow burst of 10 requests", n)
+	}
+
+	now = now.Add(50 * time.Millisecond)
+	atomic.StoreInt32(&count, 0)
+
+	for i := 0; i < 100; i++ {
+		output.Write(payload)
+	}
+
+	if n := atomic.LoadInt32(&count); n != 5 {
+		t.Error("Should refill bucket at given rate", n)
+	}
+
+	// Bucket is not filled above burst size
+	now = now.Add(time.Minute)
+	atomic.StoreInt32(&count, 0)
+
+	for i := 0; i < 100; i++ {
+		output.Write(payload)
+	}
+
+	if n := atomic.LoadInt32(&count); n != 10 {
+		t.Error("Should limit burst after pause", n)
+	}
+}
@@ -67,7 +67,7 @@ func (m *Middleware) copy(to io.Writer, from io.Reader) {
 	dst := make([]byte, len(buf)*2)
 
 	for {
-		nr, _ := from.Read(buf)
+		nr, er := from.Read(buf)
 		if nr > 0 && len(buf) > nr {
 
 			hex.Encode(dst, buf[0:nr])
@@ -81,6 +81,11 @@ func (m *Middleware) copy(to io.Writer, from io.Reader) {
 				Debug("[MIDDLEWARE-MASTER] Sending:", string(buf[0:nr]), "From:", from)
 			}
 		}
+
+		// Finished inputs, like file input, are not read anymore
+		if er == io.EOF {
+			return
+		}
 	}
 }
 
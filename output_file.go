@@ -2,7 +2,7 @@ package main
 
 import (
 	"bufio"
-	"compress/gzip"
+	"bytes"
 	"fmt"
 	"io"
 	"log"
@@ -17,21 +17,57 @@ import (
 )
 
 var dateFileNameFuncs = map[string]func(*FileOutput) string{
-	"%Y":  func(o *FileOutput) string { return time.Now().Format("2006") },
-	"%m":  func(o *FileOutput) string { return time.Now().Format("01") },
-	"%d":  func(o *FileOutput) string { return time.Now().Format("02") },
-	"%H":  func(o *FileOutput) string { return time.Now().Format("15") },
-	"%M":  func(o *FileOutput) string { return time.Now().Format("04") },
-	"%S":  func(o *FileOutput) string { return time.Now().Format("05") },
+	"%Y":  func(o *FileOutput) string { return o.chunkTime().Format("2006") },
+	"%m":  func(o *FileOutput) string { return o.chunkTime().Format("01") },
+	"%d":  func(o *FileOutput) string { return o.chunkTime().Format("02") },
+	"%H":  func(o *FileOutput) string { return o.chunkTime().Format("15") },
+	"%M":  func(o *FileOutput) string { return o.chunkTime().Format("04") },
+	"%S":  func(o *FileOutput) string { return o.chunkTime().Format("05") },
 	"%NS": func(o *FileOutput) string { return fmt.Sprint(time.Now().Nanosecond()) },
 	"%r":  func(o *FileOutput) string { return o.currentID },
 }
 
 type FileOutputConfig struct {
 	flushInterval time.Duration
-	sizeLimit     unitSizeVar
-	queueLimit    int
-	append        bool
+	// Fsync chunk before it is closed, so rotated chunks survive machine crash
+	syncOnRotate bool
+	sizeLimit    unitSizeVar
+	queueLimit   int
+	append       bool
+	// AES key, if set chunks are encrypted
+	encryptionKey encryptionKeyVar
+	// Master key in key management service, if set chunks are encrypted with data keys generated by the service
+	encryptionKMS kmsKeyVar
+	// Start new chunk every interval, date variables in file name are rounded down to interval start
+	rotationInterval time.Duration
+	// Compression algorithm, by default picked by file extension
+	compression      string
+	compressionLevel int
+	// Upload closed chunks to object storage, like `s3://bucket/prefix/` or `gs://bucket/prefix/`
+	uploadTarget string
+	// Template of uploaded object name, chunk file name by default
+	uploadName string
+	// Retention of local chunks: oldest chunks are removed when they are older than max age,
+	// or when total size of chunks exceeds the limit
+	maxAge       time.Duration
+	maxTotalSize unitSizeVar
+	// Write payloads to given number of shard files in parallel
+	shards int
+	// Max number of payloads queued in memory, 0 to write synchronously
+	maxQueue int
+	// Behavior when queue is full: block or drop-oldest
+	queuePolicy string
+	// Report queue length to console
+	stats bool
+	// Output format: gor or har, by default picked by file extension
+	format string
+	// Write index sidecar file with entry every given number of requests, 0 disables index
+	indexInterval int
+}
+
+// Both buffered and compressed writers support flushing
+type flusher interface {
+	Flush() error
 }
 
 // FileOutput output plugin
@@ -45,6 +81,21 @@ type FileOutput struct {
 	writer       	io.Writer
 	requestPerFile 	bool
 	currentID    	string
+	encryptor      *encryptWriter
+	envelopeKey    *envelopeKey
+	counter        *countingWriter
+	// Start of rotation interval of current chunk
+	chunkStart time.Time
+	uploader   *chunkUploader
+	closed     bool
+	queue      *payloadQueue
+	queueDone  chan struct{}
+	queueStats *GorStat
+	har        *harWriter
+	// Index of current chunk, requests and decompressed bytes written to it
+	index         []fileIndexEntry
+	indexRequests int
+	streamOffset  int64
 
 	config *FileOutputConfig
 }
@@ -54,6 +105,48 @@ func NewFileOutput(pathTemplate string, config *FileOutputConfig) *FileOutput {
 	o := new(FileOutput)
 	o.pathTemplate = pathTemplate
 	o.config = config
+
+	if !validCompression(config.compression) {
+		log.Fatal("Unknown output file compression: ", config.compression)
+	}
+
+	switch config.format {
+	case "", fileFormatGor, fileFormatHAR:
+	default:
+		log.Fatal("Unknown output file format: ", config.format)
+	}
+
+	if config.encryptionKMS.provider != "" {
+		if len(config.encryptionKey) > 0 {
+			log.Fatal("Set either --output-file-encryption-key or --output-file-encryption-kms, not both")
+		}
+
+		// Key is fetched on start, so problems with access to the service are reported immediately
+		o.envelopeKey = newEnvelopeKey(config.encryptionKMS)
+		if _, _, err := o.envelopeKey.get(); err != nil {
+			log.Fatal("[FILE-OUTPUT] Can't get encryption data key: ", err)
+		}
+	}
+
+	if config.uploadTarget != "" {
+		var err error
+		if o.uploader, err = newChunkUploader(config.uploadTarget, config.uploadName); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if config.maxQueue > 0 {
+		var err error
+		if o.queue, err = newPayloadQueue("FILE-OUTPUT", config.maxQueue, config.queuePolicy); err != nil {
+			log.Fatal(err)
+		}
+		o.queueDone = make(chan struct{})
+
+		if config.stats {
+			o.queueStats = NewGorStat("output_file")
+		}
+
+		go o.writeQueue()
+	}
 	o.updateName()
 
 	if strings.Contains(pathTemplate, "%r") {
@@ -67,6 +160,26 @@ func NewFileOutput(pathTemplate string, config *FileOutputConfig) *FileOutput {
 		}
 	}()
 
+	if config.flushInterval > 0 {
+		go func() {
+			for {
+				time.Sleep(config.flushInterval)
+				if !o.flush() {
+					return
+				}
+			}
+		}()
+	}
+
+	if config.maxAge > 0 || config.maxTotalSize > 0 {
+		go func() {
+			for {
+				o.prune()
+				time.Sleep(retentionCheckInterval)
+			}
+		}()
+	}
+
 	return o
 }
 
@@ -138,7 +251,8 @@ func (o *FileOutput) filename() string {
 
 		if o.currentName == "" ||
 			((o.config.queueLimit > 0 && o.queueLength >= o.config.queueLimit) ||
-				(o.config.sizeLimit > 0 && o.chunkSize >= int(o.config.sizeLimit))) {
+				(o.config.sizeLimit > 0 && o.chunkSize >= int(o.config.sizeLimit)) ||
+				(o.config.rotationInterval > 0 && o.file != nil && !o.chunkStart.Equal(o.chunkTime()))) {
 			nextChunk = true
 		}
 
@@ -146,6 +260,15 @@ func (o *FileOutput) filename() string {
 		withoutExt := strings.TrimSuffix(path, ext)
 
 		if matches, err := filepath.Glob(withoutExt + "*" + ext); err == nil {
+			// Skip files of other outputs with the same prefix, like partitions `api` and `api2`
+			own := matches[:0]
+			for _, m := range matches {
+				if withoutIndex(strings.TrimSuffix(m, ext)) == withoutExt || m == path {
+					own = append(own, m)
+				}
+			}
+			matches = own
+
 			if len(matches) == 0 {
 				return setFileIndex(path, 0)
 			}
@@ -169,71 +292,189 @@ func (o *FileOutput) filename() string {
 	return path
 }
 
+// chunkTime returns current time, rounded down to start of rotation interval
+func (o *FileOutput) chunkTime() time.Time {
+	if o.config.rotationInterval > 0 {
+		return time.Now().Truncate(o.config.rotationInterval)
+	}
+
+	return time.Now()
+}
+
 func (o *FileOutput) updateName() {
 	o.currentName = filepath.Clean(o.filename())
 }
 
 func (o *FileOutput) Write(data []byte) (n int, err error) {
+	if o.queue == nil {
+		return o.write(data)
+	}
+
+	if isStoredPayload(data) {
+		o.queue.Push(data)
+
+		if o.queueStats != nil {
+			o.queueStats.Write(o.queue.Len())
+		}
+	}
+
+	return len(data), nil
+}
+
+// writeQueue writes queued payloads until queue is closed
+func (o *FileOutput) writeQueue() {
+	defer close(o.queueDone)
+
+	for data := range o.queue.ch {
+		o.write(data)
+	}
+}
+
+func (o *FileOutput) write(data []byte) (n int, err error) {
 	if o.requestPerFile {
 		o.currentID = string(payloadMeta(data)[1])
 		o.updateName()
 	}
 
-	if !isOriginPayload(data) {
+	if !isStoredPayload(data) {
 		return len(data), nil
 	}
 
 	if o.file == nil || o.currentName != o.file.Name() {
 		o.mu.Lock()
-		o.Close()
-
-		o.file, err = os.OpenFile(o.currentName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+		o.closeChunk()
+
+		// File is truncated only after lock is taken, to not damage file written by another process
+		o.file, err = os.OpenFile(o.currentName, os.O_WRONLY|os.O_CREATE, 0660)
+		if err == nil {
+			if lockErr := lockFile(o.file); lockErr == errFileLocked {
+				log.Fatalf("[FILE-OUTPUT] Output file %s is already written by another process, use different --output-file path", o.currentName)
+			} else if lockErr != nil {
+				Debug("[FILE-OUTPUT] Can't lock", o.currentName, lockErr)
+			}
+			o.file.Truncate(0)
+		}
 		o.file.Sync()
 
-		if strings.HasSuffix(o.currentName, ".gz") {
-			o.writer = gzip.NewWriter(o.file)
+		o.counter = &countingWriter{Writer: o.file}
+
+		// Data is compressed before encryption, since encrypted data can't be compressed
+		var w io.Writer = o.counter
+		if len(o.config.encryptionKey) > 0 {
+			var encErr error
+			if o.encryptor, encErr = newEncryptWriter(o.counter, o.config.encryptionKey); encErr != nil {
+				log.Fatal("[FILE-OUTPUT] Can't encrypt output file: ", encErr)
+			}
+			w = o.encryptor
+		} else if o.envelopeKey != nil {
+			var encErr error
+			if o.encryptor, encErr = newEnvelopeEncryptWriter(o.counter, o.envelopeKey); encErr != nil {
+				// Key management service may be unavailable for a while. Chunk is never written unencrypted,
+				// so it is removed, and opened again with next payload.
+				log.Println("[FILE-OUTPUT] Can't get encryption data key, dropping payload:", encErr)
+				if o.file != nil {
+					o.file.Close()
+					os.Remove(o.currentName)
+				}
+				o.file = nil
+				o.mu.Unlock()
+				return 0, encErr
+			}
+			w = o.encryptor
+		}
+
+		if compression := fileCompression(o.currentName, o.config.compression); compression != "" {
+			o.writer = newCompressor(compression, o.config.compressionLevel, w)
 		} else {
-			o.writer = bufio.NewWriter(o.file)
+			o.writer = bufio.NewWriter(w)
+		}
+
+		// Format is detected same way as for input files
+		o.har = nil
+		if fileInputFormat(o.currentName, o.config.format) == fileFormatHAR {
+			o.har = newHARWriter(o.writer)
 		}
 
+		o.index = nil
+		o.indexRequests = 0
+		o.streamOffset = 0
+
 		if err != nil {
 			log.Fatal(o, "Cannot open file %q. Error: %s", o.currentName, err)
 		}
 
 		o.queueLength = 0
+		o.chunkSize = 0
+		o.chunkStart = o.chunkTime()
 		o.mu.Unlock()
 	}
 
-	o.writer.Write(data)
-	o.writer.Write([]byte(payloadSeparator))
+	// Flush may happen in background
+	o.mu.Lock()
+	if o.har != nil {
+		o.har.Write(data)
+	} else {
+		if isRequestPayload(data) {
+			o.indexPoint(data)
+		}
+
+		o.writer.Write(data)
+		o.writer.Write([]byte(payloadSeparator))
+		o.streamOffset += int64(len(data) + len(payloadSeparator))
+	}
 
 	o.queueLength++
+	o.chunkSize = int(o.counter.written)
+	o.mu.Unlock()
+
+	// Switch to the next chunk right away, so chunks have nearly the same size
+	if o.config.sizeLimit > 0 && o.chunkSize >= int(o.config.sizeLimit) {
+		o.updateName()
+	}
 
 	return len(data), nil
 }
 
-func (o *FileOutput) flush() {
+// flush writes buffered data to the file, returns false if output is closed
+func (o *FileOutput) flush() (ok bool) {
 	// Don't exit on panic
 	defer func() {
 		if r := recover(); r != nil {
 			log.Println("PANIC while file flush: ", r, o, string(debug.Stack()))
+			ok = true
 		}
 	}()
 
 	defer o.mu.Unlock()
 	o.mu.Lock()
 
+	if o.closed {
+		return false
+	}
+
 	if o.file != nil {
-		if strings.HasSuffix(o.currentName, ".gz") {
-			o.writer.(*gzip.Writer).Flush()
-		} else {
-			o.writer.(*bufio.Writer).Flush()
-		}
+		o.writer.(flusher).Flush()
 
-		if stat, err := o.file.Stat(); err != nil {
-			o.chunkSize = int(stat.Size())
+		if o.encryptor != nil {
+			o.encryptor.Flush()
 		}
+
+		o.chunkSize = int(o.counter.written)
 	}
+
+	return true
+}
+
+// countingWriter counts bytes written to the chunk file, after compression
+type countingWriter struct {
+	io.Writer
+	written int64
+}
+
+func (w *countingWriter) Write(data []byte) (n int, err error) {
+	n, err = w.Writer.Write(data)
+	w.written += int64(n)
+	return
 }
 
 func (o *FileOutput) String() string {
@@ -241,13 +482,89 @@ func (o *FileOutput) String() string {
 }
 
 func (o *FileOutput) Close() error {
+	// Write payloads left in queue
+	if o.queue != nil {
+		o.queue.Close()
+		<-o.queueDone
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.closed = true
+	o.closeChunk()
+
+	// Wait for upload of the last chunks. Uploader is closed under the lock, so rotation can't add chunks to it.
+	if o.uploader != nil {
+		o.uploader.Close()
+		o.uploader = nil
+	}
+
+	return nil
+}
+
+// indexPoint adds index entry before every indexInterval request. Compressed stream is finished and new one
+// is started, so reader can decompress file from this point.
+func (o *FileOutput) indexPoint(request []byte) {
+	if o.config.indexInterval <= 0 || o.encryptor != nil {
+		return
+	}
+
+	o.indexRequests++
+	if o.indexRequests == 1 || (o.indexRequests-1)%o.config.indexInterval != 0 {
+		return
+	}
+
+	if w, ok := o.writer.(io.Closer); ok {
+		w.Close()
+		o.writer = newCompressor(fileCompression(o.currentName, o.config.compression), o.config.compressionLevel, o.counter)
+	} else {
+		o.writer.(flusher).Flush()
+	}
+
+	ts, _ := strconv.ParseInt(string(bytes.TrimSpace(payloadMeta(request)[2])), 10, 64)
+	o.index = append(o.index, fileIndexEntry{
+		requests:     o.indexRequests - 1,
+		timestamp:    ts,
+		fileOffset:   o.counter.written,
+		streamOffset: o.streamOffset,
+	})
+}
+
+func (o *FileOutput) closeChunk() {
 	if o.file != nil {
-		if strings.HasSuffix(o.currentName, ".gz") {
-			o.writer.(*gzip.Writer).Close()
+		if o.har != nil {
+			o.har.Close()
+		}
+
+		if w, ok := o.writer.(io.Closer); ok {
+			w.Close()
 		} else {
-			o.writer.(*bufio.Writer).Flush()
+			o.writer.(flusher).Flush()
+		}
+
+		if o.encryptor != nil {
+			o.encryptor.Close()
+		}
+
+		if o.config.syncOnRotate {
+			if err := o.file.Sync(); err != nil {
+				log.Println("[FILE-OUTPUT] Can't sync", o.file.Name(), err)
+			}
 		}
 		o.file.Close()
+
+		uploads := []string{o.file.Name()}
+		if len(o.index) > 0 {
+			if err := writeFileIndex(o.file.Name()+fileIndexExt, o.index); err != nil {
+				log.Println("[FILE-OUTPUT] Can't write index", err)
+			} else {
+				uploads = append(uploads, o.file.Name()+fileIndexExt)
+			}
+		}
+
+		if o.uploader != nil {
+			o.uploader.Add(uploads...)
+		}
 	}
-	return nil
 }
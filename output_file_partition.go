@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/gor/proto"
+)
+
+// Partition variables in output file name, taken from request
+var partitionFileNameFuncs = map[string]func(req []byte) string{
+	"%{Host}": func(req []byte) string { return string(proto.Header(req, []byte("Host"))) },
+	// First segment of request path
+	"%{Path}": func(req []byte) string {
+		path := bytes.TrimPrefix(proto.Path(req), []byte("/"))
+		if idx := bytes.IndexAny(path, "/?#"); idx != -1 {
+			path = path[:idx]
+		}
+		return string(path)
+	},
+}
+
+const (
+	// Host header is set by client, so number of files is limited. Requests above limit go to `other` partition.
+	maxPartitions = 1000
+	// Requests whose response did not arrive in this time are forgotten
+	partitionResponseTimeout = time.Minute
+)
+
+// isPartitionedPath checks if file name contains partition variables
+func isPartitionedPath(path string) bool {
+	for name := range partitionFileNameFuncs {
+		if strings.Contains(path, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// partitionName makes value safe to use in file name
+func partitionName(value string) string {
+	if value == "" {
+		return "none"
+	}
+
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, value)
+}
+
+type partitionRequest struct {
+	path    string
+	arrived time.Time
+}
+
+// PartitionedFileOutput writes requests to separate files by host or path, like `requests-%{Host}.gz`.
+// Each partition is a separate output with its own chunks. Responses are written to partition of their request.
+type PartitionedFileOutput struct {
+	mu           sync.Mutex
+	pathTemplate string
+	config       *FileOutputConfig
+	outputs      map[string]io.WriteCloser
+	// Partition of requests which wait for response
+	requests  map[string]partitionRequest
+	lastClean time.Time
+}
+
+// NewPartitionedFileOutput constructor for PartitionedFileOutput, accepts path with partition variables
+func NewPartitionedFileOutput(pathTemplate string, config *FileOutputConfig) *PartitionedFileOutput {
+	return &PartitionedFileOutput{
+		pathTemplate: pathTemplate,
+		config:       config,
+		outputs:      make(map[string]io.WriteCloser),
+		requests:     make(map[string]partitionRequest),
+		lastClean:    time.Now(),
+	}
+}
+
+// partitionPath returns file name of partition where request should be written
+func (o *PartitionedFileOutput) partitionPath(req []byte) string {
+	path := o.pathTemplate
+	for name, fn := range partitionFileNameFuncs {
+		if strings.Contains(path, name) {
+			path = strings.Replace(path, name, partitionName(fn(req)), -1)
+		}
+	}
+
+	if _, ok := o.outputs[path]; !ok && len(o.outputs) >= maxPartitions {
+		path = o.pathTemplate
+		for name := range partitionFileNameFuncs {
+			path = strings.Replace(path, name, "other", -1)
+		}
+	}
+
+	return path
+}
+
+func (o *PartitionedFileOutput) Write(data []byte) (n int, err error) {
+	if !isStoredPayload(data) {
+		return len(data), nil
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	id := string(payloadMeta(data)[1])
+
+	var path string
+	if isRequestPayload(data) {
+		path = o.partitionPath(payloadBody(data))
+		o.requests[id] = partitionRequest{path: path, arrived: time.Now()}
+	} else {
+		req, ok := o.requests[id]
+		if !ok {
+			return len(data), nil
+		}
+		delete(o.requests, id)
+		path = req.path
+	}
+
+	if time.Since(o.lastClean) > partitionResponseTimeout {
+		for id, req := range o.requests {
+			if time.Since(req.arrived) > partitionResponseTimeout {
+				delete(o.requests, id)
+			}
+		}
+		o.lastClean = time.Now()
+	}
+
+	output, ok := o.outputs[path]
+	if !ok {
+		if o.config.shards > 1 {
+			output = NewShardedFileOutput(path, o.config)
+		} else {
+			output = NewFileOutput(path, o.config)
+		}
+		o.outputs[path] = output
+	}
+
+	return output.Write(data)
+}
+
+func (o *PartitionedFileOutput) String() string {
+	return "Partitioned file output: " + o.pathTemplate
+}
+
+// Close closes output of each partition
+func (o *PartitionedFileOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, output := range o.outputs {
+		output.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Queue policies, applied when queue is full
+const (
+	queueBlock      = "block"
+	queueDropOldest = "drop-oldest"
+	queueDropNewest = "drop-newest"
+)
+
+// payloadQueue is a bounded queue of payloads between emitter and output writer, like file writer or HTTP workers.
+// When writer can't keep up, for example because of disk stall, it either blocks the caller,
+// or drops the oldest or the newest payloads, so memory usage stays bounded and capture goes on.
+type payloadQueue struct {
+	ch      chan []byte
+	policy  string
+	dropped uint64
+	closed  chan struct{}
+	// Held for reading by Push, so Close doesn't close channel while payload is sent to it
+	mu      sync.RWMutex
+	stopped bool
+	// Prefix of log messages, like `FILE-OUTPUT`
+	name string
+}
+
+func newPayloadQueue(name string, size int, policy string) (*payloadQueue, error) {
+	switch policy {
+	case "", queueBlock, queueDropOldest, queueDropNewest:
+	default:
+		return nil, errors.New("Unknown queue policy: " + policy)
+	}
+
+	q := &payloadQueue{ch: make(chan []byte, size), policy: policy, closed: make(chan struct{}), name: name}
+	if policy == queueDropOldest || policy == queueDropNewest {
+		go q.reportDropped()
+	}
+
+	return q, nil
+}
+
+// reportDropped logs number of dropped payloads every few seconds
+func (q *payloadQueue) reportDropped() {
+	var reported uint64
+
+	for {
+		select {
+		case <-q.closed:
+		case <-time.After(rate * time.Second):
+		}
+
+		if dropped := q.Dropped(); dropped > reported {
+			log.Println("["+q.name+"] Queue is full, dropped", dropped-reported, "payloads, total:", dropped)
+			reported = dropped
+		}
+
+		select {
+		case <-q.closed:
+			return
+		default:
+		}
+	}
+}
+
+// Push adds copy of payload to the queue. Payloads pushed after Close are ignored.
+func (q *payloadQueue) Push(data []byte) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.stopped {
+		return
+	}
+
+	// Buffer is reused by caller
+	payload := make([]byte, len(data))
+	copy(payload, data)
+
+	switch q.policy {
+	case queueDropOldest:
+	case queueDropNewest:
+		select {
+		case q.ch <- payload:
+		default:
+			atomic.AddUint64(&q.dropped, 1)
+		}
+		return
+	default:
+		q.ch <- payload
+		return
+	}
+
+	for {
+		select {
+		case q.ch <- payload:
+			return
+		default:
+		}
+
+		select {
+		case <-q.ch:
+			atomic.AddUint64(&q.dropped, 1)
+		default:
+		}
+	}
+}
+
+// Len returns number of queued payloads
+func (q *payloadQueue) Len() int {
+	return len(q.ch)
+}
+
+// Dropped returns number of payloads dropped because queue was full
+func (q *payloadQueue) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+// Close stops the queue, consumer receives remaining payloads. It waits for Push calls in progress,
+// so with block policy consumer should keep reading until channel is closed.
+func (q *payloadQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.stopped {
+		return
+	}
+	q.stopped = true
+
+	close(q.ch)
+	close(q.closed)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How often old chunks are checked, total size limit can be exceeded for this time
+var retentionCheckInterval = 10 * time.Second
+
+// chunkPattern returns glob matching all chunks written by output: variables in path template replaced with wildcards
+func (o *FileOutput) chunkPattern() string {
+	path := o.pathTemplate
+	for name := range dateFileNameFuncs {
+		path = strings.Replace(path, name, "*", -1)
+	}
+
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "*" + ext
+}
+
+type sortByModTime []os.FileInfo
+
+func (s sortByModTime) Len() int           { return len(s) }
+func (s sortByModTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sortByModTime) Less(i, j int) bool { return s[i].ModTime().Before(s[j].ModTime()) }
+
+// prune removes chunks older than max age, and then oldest chunks until total size fits the limit.
+// Chunk which is currently written is never removed.
+func (o *FileOutput) prune() {
+	o.mu.Lock()
+	current := o.currentName
+	if o.file != nil {
+		current = o.file.Name()
+	}
+	o.mu.Unlock()
+
+	matches, err := filepath.Glob(o.chunkPattern())
+	if err != nil {
+		return
+	}
+
+	var files []os.FileInfo
+	var paths = make(map[os.FileInfo]string)
+	var total int64
+
+	for _, name := range matches {
+		stat, err := os.Stat(name)
+		if err != nil || stat.IsDir() {
+			continue
+		}
+
+		total += stat.Size()
+
+		if filepath.Clean(name) == filepath.Clean(current) {
+			continue
+		}
+
+		files = append(files, stat)
+		paths[stat] = name
+	}
+
+	sort.Sort(sortByModTime(files))
+
+	for _, stat := range files {
+		expired := o.config.maxAge > 0 && time.Since(stat.ModTime()) > o.config.maxAge
+		oversized := o.config.maxTotalSize > 0 && total > int64(o.config.maxTotalSize)
+
+		if !expired && !oversized {
+			break
+		}
+
+		if err := os.Remove(paths[stat]); err != nil {
+			log.Println("[FILE-OUTPUT] Can't remove old chunk", paths[stat], err)
+			continue
+		}
+
+		os.Remove(paths[stat] + fileIndexExt)
+
+		Debug("[FILE-OUTPUT] Removed old chunk", paths[stat])
+		total -= stat.Size()
+	}
+}
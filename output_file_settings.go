@@ -27,13 +27,27 @@ func parseDataUnit(s string) int64 {
 	}
 }
 
+// formatDataUnit is reverse of parseDataUnit, used for human readable output
+func formatDataUnit(size int64) string {
+	switch {
+	case size >= dataUnitMap['g']:
+		return strconv.FormatFloat(float64(size)/float64(dataUnitMap['g']), 'f', 1, 64) + "gb"
+	case size >= dataUnitMap['m']:
+		return strconv.FormatFloat(float64(size)/float64(dataUnitMap['m']), 'f', 1, 64) + "mb"
+	case size >= dataUnitMap['k']:
+		return strconv.FormatFloat(float64(size)/float64(dataUnitMap['k']), 'f', 1, 64) + "kb"
+	default:
+		return strconv.FormatInt(size, 10) + "b"
+	}
+}
+
 type unitSizeVar int64
 
-func (u unitSizeVar) String() string {
-	return strconv.Itoa(int(u))
+func (u *unitSizeVar) String() string {
+	return strconv.Itoa(int(*u))
 }
 
-func (u unitSizeVar) Set(s string) error {
-	u = unitSizeVar(parseDataUnit(s))
+func (u *unitSizeVar) Set(s string) error {
+	*u = unitSizeVar(parseDataUnit(s))
 	return nil
 }
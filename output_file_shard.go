@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Number of payloads buffered for each shard, if queue size is not set
+const shardQueueSize = 1000
+
+// shardPath inserts shard suffix before file extension: `requests.gor` -> `requests_shard1.gor`
+func shardPath(path string, shard string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "_shard" + shard + ext
+}
+
+// ShardedFileOutput writes payloads to several FileOutputs in parallel, each in its own goroutine.
+// Payloads are distributed by id, so request and its response are written to the same shard.
+// FileInput merges shards back by timestamp.
+type ShardedFileOutput struct {
+	shards []*FileOutput
+	queues []*payloadQueue
+	wg     sync.WaitGroup
+}
+
+// NewShardedFileOutput constructor for ShardedFileOutput, accepts path and number of shards set in config
+func NewShardedFileOutput(pathTemplate string, config *FileOutputConfig) *ShardedFileOutput {
+	o := new(ShardedFileOutput)
+
+	// Shards are written from own queues, with the same size and policy as queue of single file output
+	queueSize := shardQueueSize
+	if config.maxQueue > 0 {
+		queueSize = config.maxQueue
+	}
+	shardConfig := *config
+	shardConfig.maxQueue = 0
+
+	for i := 0; i < config.shards; i++ {
+		shard := NewFileOutput(shardPath(pathTemplate, fmt.Sprint(i)), &shardConfig)
+		queue, err := newPayloadQueue("FILE-OUTPUT", queueSize, config.queuePolicy)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		o.shards = append(o.shards, shard)
+		o.queues = append(o.queues, queue)
+
+		o.wg.Add(1)
+		go func() {
+			defer o.wg.Done()
+			for data := range queue.ch {
+				shard.Write(data)
+			}
+		}()
+	}
+
+	return o
+}
+
+func (o *ShardedFileOutput) Write(data []byte) (n int, err error) {
+	if !isStoredPayload(data) {
+		return len(data), nil
+	}
+
+	hasher := fnv.New32a()
+	hasher.Write(payloadMeta(data)[1])
+
+	o.queues[hasher.Sum32()%uint32(len(o.queues))].Push(data)
+
+	return len(data), nil
+}
+
+func (o *ShardedFileOutput) String() string {
+	return fmt.Sprintf("Sharded file output: %d shards", len(o.shards))
+}
+
+// Close writes queued payloads and closes all shards
+func (o *ShardedFileOutput) Close() error {
+	for _, queue := range o.queues {
+		queue.Close()
+	}
+	o.wg.Wait()
+
+	for _, shard := range o.shards {
+		shard.Close()
+	}
+
+	return nil
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -38,7 +43,7 @@ func TestFileOutput(t *testing.T) {
 	quit = make(chan int)
 
 	var counter int64
-	input2 := NewFileInput("/tmp/test_requests.gor", false)
+	input2 := NewFileInput("/tmp/test_requests.gor", &FileInputConfig{})
 	output2 := NewTestOutput(func(data []byte) {
 		atomic.AddInt64(&counter, 1)
 		wg.Done()
@@ -156,6 +161,35 @@ func TestFileOutputCompression(t *testing.T) {
 	os.Remove(name)
 }
 
+func TestFileOutputCompressionOption(t *testing.T) {
+	for _, compression := range []string{compressionGzip, compressionZstd, compressionLZ4} {
+		name := fmt.Sprintf("/tmp/%d.gor", rand.Int63())
+		output := NewFileOutput(name, &FileOutputConfig{append: true, flushInterval: time.Minute, compression: compression, compressionLevel: 3})
+
+		for i := 0; i < 1000; i++ {
+			output.Write([]byte("1 1 1\r\ntest"))
+		}
+		output.Close()
+
+		if s, _ := os.Stat(name); s.Size() >= 12*1000 {
+			t.Error("Should be compressed file:", compression, s.Size())
+		}
+
+		input := NewFileInput(name, &FileInputConfig{})
+		buf := make([]byte, 1000)
+		if n, _ := input.Read(buf); string(buf[:n]) != "1 1 1\r\ntest" {
+			t.Error("Should read compressed file:", compression, string(buf[:n]))
+		}
+		input.Close()
+
+		os.Remove(name)
+	}
+
+	if fileCompression("requests.gz", compressionNone) != "" || fileCompression("requests.zst", "") != compressionZstd {
+		t.Error("Explicit compression should override file extension")
+	}
+}
+
 func TestParseDataUnit(t *testing.T) {
 	var tests = []struct {
 		value string
@@ -176,6 +210,23 @@ func TestParseDataUnit(t *testing.T) {
 	}
 }
 
+func TestUnitSizeVarFlag(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+
+	var limit unitSizeVar
+	limit.Set("32mb")
+	fs.Var(&limit, "size-limit", "")
+
+	if limit != unitSizeVar(32*dataUnitMap['m']) {
+		t.Error("Default should be set", limit)
+	}
+
+	fs.Parse([]string{"-size-limit", "1k"})
+	if limit != unitSizeVar(dataUnitMap['k']) {
+		t.Error("Flag value should be set", limit)
+	}
+}
+
 func TestGetFileIndex(t *testing.T) {
 	var tests = []struct {
 		path  string
@@ -302,6 +353,233 @@ func TestFileOutputAppendQueueLimitGzips(t *testing.T) {
 	os.Remove(name3)
 }
 
+func TestFileOutputSizeLimit(t *testing.T) {
+	rnd := rand.Int63()
+
+	for _, ext := range []string{"", ".gz"} {
+		name := fmt.Sprintf("/tmp/%d%s", rnd, ext)
+		output := NewFileOutput(name, &FileOutputConfig{flushInterval: time.Minute, sizeLimit: 64 * 1024})
+
+		body := make([]byte, 50)
+		for i := 0; i < 5000; i++ {
+			rand.Read(body)
+			output.Write([]byte(fmt.Sprintf("1 %d 1\n%x", i, body)))
+		}
+		output.Close()
+
+		files, _ := filepath.Glob(fmt.Sprintf("/tmp/%d_*%s", rnd, ext))
+		if len(files) < 3 {
+			t.Error("Should rotate files by size", ext, files)
+		}
+
+		for _, f := range files {
+			stat, _ := os.Stat(f)
+			// Compressor keeps part of data in its buffer
+			if stat.Size() > 2*64*1024 {
+				t.Error("Chunk is too big", f, stat.Size())
+			}
+			os.Remove(f)
+		}
+	}
+}
+
+func TestFileOutputRotationInterval(t *testing.T) {
+	rnd := rand.Int63()
+	name := fmt.Sprintf("/tmp/%d", rnd)
+
+	output := NewFileOutput(name, &FileOutputConfig{flushInterval: time.Minute, rotationInterval: time.Second})
+
+	output.Write([]byte("1 1 1\r\ntest"))
+	name1 := output.file.Name()
+
+	time.Sleep(1100 * time.Millisecond)
+	output.updateName()
+
+	output.Write([]byte("1 1 1\r\ntest"))
+	name2 := output.file.Name()
+	output.Close()
+
+	if name1 != name+"_0" || name2 != name+"_1" {
+		t.Error("Should start new chunk after interval:", name1, name2)
+	}
+
+	os.Remove(name1)
+	os.Remove(name2)
+
+	before := time.Now().Truncate(5 * time.Minute).Format("/tmp/log-2006-01-02-15-04.gor")
+	output = NewFileOutput("/tmp/log-%Y-%m-%d-%H-%M.gor", &FileOutputConfig{append: true, rotationInterval: 5 * time.Minute})
+	after := time.Now().Truncate(5 * time.Minute).Format("/tmp/log-2006-01-02-15-04.gor")
+
+	if output.currentName != before && output.currentName != after {
+		t.Error("Date variables should be rounded to interval start:", output.currentName, before)
+	}
+}
+
+func TestFileOutputRetention(t *testing.T) {
+	rnd := rand.Int63()
+	name := fmt.Sprintf("/tmp/%d-%%Y.gor", rnd)
+
+	var chunks []string
+	for i := 0; i < 4; i++ {
+		chunk := fmt.Sprintf("/tmp/%d-2016_%d.gor", rnd, i)
+		ioutil.WriteFile(chunk, make([]byte, 100), 0660)
+		// Oldest chunk is written first
+		modTime := time.Now().Add(-time.Duration(4-i) * time.Hour)
+		os.Chtimes(chunk, modTime, modTime)
+		chunks = append(chunks, chunk)
+		defer os.Remove(chunk)
+	}
+
+	output := &FileOutput{pathTemplate: name, currentName: chunks[0], config: &FileOutputConfig{maxAge: 150 * time.Minute, maxTotalSize: 250}}
+	output.prune()
+
+	for i, chunk := range chunks {
+		_, err := os.Stat(chunk)
+		// Chunk 0 is current and kept, chunk 1 is too old, chunk 2 is removed to fit size limit
+		if removed := os.IsNotExist(err); removed != (i == 1 || i == 2) {
+			t.Error("Wrong chunk is removed:", chunk, removed)
+		}
+	}
+}
+
+func TestFileOutputShards(t *testing.T) {
+	name := fmt.Sprintf("/tmp/%d.gor", rand.Int63())
+	output := NewShardedFileOutput(name, &FileOutputConfig{shards: 3})
+
+	for i := 0; i < 30; i++ {
+		output.Write([]byte(fmt.Sprintf("1 %d %d\ntest%d", i, 1000+i, i)))
+	}
+	output.Close()
+
+	files, _ := filepath.Glob(shardPath(name, "*"))
+	for _, f := range files {
+		defer os.Remove(f)
+	}
+
+	if len(files) != 3 {
+		t.Fatal("Should write 3 shards:", files)
+	}
+
+	// Shards are merged by timestamp
+	input := NewFileInput(name, &FileInputConfig{})
+	buf := make([]byte, 1000)
+
+	for i := 0; i < 30; i++ {
+		n, _ := input.Read(buf)
+		if !bytes.HasSuffix(buf[:n], []byte(fmt.Sprintf("\ntest%d", i))) {
+			t.Fatal("Should replay payloads in order:", i, string(buf[:n]))
+		}
+	}
+}
+
+func TestFileOutputQueue(t *testing.T) {
+	name := fmt.Sprintf("/tmp/%d", rand.Int63())
+	output := NewFileOutput(name, &FileOutputConfig{maxQueue: 10, queuePolicy: queueBlock})
+	defer os.Remove(name + "_0")
+
+	for i := 0; i < 100; i++ {
+		output.Write([]byte("1 1 1\ntest"))
+	}
+	output.Close()
+
+	data, _ := ioutil.ReadFile(name + "_0")
+	if count := bytes.Count(data, []byte(payloadSeparator)); count != 100 {
+		t.Error("All queued payloads should be written on close:", count)
+	}
+}
+
+func TestPayloadQueueDropOldest(t *testing.T) {
+	queue, _ := newPayloadQueue("FILE-OUTPUT", 2, queueDropOldest)
+
+	for i := 0; i < 5; i++ {
+		queue.Push([]byte{byte(i)})
+	}
+	queue.Close()
+
+	var left []byte
+	for data := range queue.ch {
+		left = append(left, data...)
+	}
+
+	if !bytes.Equal(left, []byte{3, 4}) || queue.Dropped() != 3 {
+		t.Error("Should drop oldest payloads:", left, queue.Dropped())
+	}
+
+	if _, err := newPayloadQueue("FILE-OUTPUT", 2, "wrong"); err == nil {
+		t.Error("Should not accept unknown policy")
+	}
+}
+
+func TestPayloadQueueDropNewest(t *testing.T) {
+	queue, _ := newPayloadQueue("FILE-OUTPUT", 2, queueDropNewest)
+
+	for i := 0; i < 5; i++ {
+		queue.Push([]byte{byte(i)})
+	}
+	queue.Close()
+
+	var left []byte
+	for data := range queue.ch {
+		left = append(left, data...)
+	}
+
+	if !bytes.Equal(left, []byte{0, 1}) || queue.Dropped() != 3 {
+		t.Error("Should drop newest payloads:", left, queue.Dropped())
+	}
+}
+
+func TestPayloadQueuePushAfterClose(t *testing.T) {
+	queue, _ := newPayloadQueue("FILE-OUTPUT", 2, queueBlock)
+	queue.Push([]byte{1})
+	queue.Close()
+	queue.Close()
+
+	// Emitter can still write, while outputs are closed on exit
+	queue.Push([]byte{2})
+
+	var left []byte
+	for data := range queue.ch {
+		left = append(left, data...)
+	}
+
+	if !bytes.Equal(left, []byte{1}) {
+		t.Error("Payloads pushed after close should be ignored:", left)
+	}
+}
+
+func TestFileOutputPartition(t *testing.T) {
+	rnd := rand.Int63()
+	output := NewPartitionedFileOutput(fmt.Sprintf("/tmp/%d-%%{Host}-%%{Path}.gor", rnd), &FileOutputConfig{})
+
+	output.Write([]byte("1 1 1\nGET /api/users HTTP/1.1\r\nHost: a.com\r\n\r\n"))
+	output.Write([]byte("1 2 1\nGET /api2 HTTP/1.1\r\nHost: a.com\r\n\r\n"))
+	output.Write([]byte("1 3 1\nGET / HTTP/1.1\r\nHost: b.com:8080\r\n\r\n"))
+	output.Write([]byte("2 1 1 1\nHTTP/1.1 200 OK\r\n\r\n"))
+	output.Close()
+
+	expected := map[string]int{
+		"a.com-api_0.gor":       2,
+		"a.com-api2_0.gor":      1,
+		"b.com_8080-none_0.gor": 1,
+	}
+
+	files, _ := filepath.Glob(fmt.Sprintf("/tmp/%d-*", rnd))
+	for _, f := range files {
+		defer os.Remove(f)
+	}
+
+	if len(files) != len(expected) {
+		t.Error("Wrong partitions:", files)
+	}
+
+	for name, count := range expected {
+		data, _ := ioutil.ReadFile(fmt.Sprintf("/tmp/%d-%s", rnd, name))
+		if c := bytes.Count(data, []byte(payloadSeparator)); c != count {
+			t.Error("Wrong number of payloads in", name, c)
+		}
+	}
+}
+
 func TestFileOutputSort(t *testing.T) {
 	var files = []string{"2016_0", "2014_10", "2015_0", "2015_10", "2015_2"}
 	var expected = []string{"2014_10", "2015_0", "2015_2", "2015_10", "2016_0"}
@@ -311,3 +589,86 @@ func TestFileOutputSort(t *testing.T) {
 		t.Error("Should properly sort file names using indexes", files, expected)
 	}
 }
+
+func TestFileOutputFlushInterval(t *testing.T) {
+	name := fmt.Sprintf("/tmp/%d", rand.Int63())
+	output := NewFileOutput(name, &FileOutputConfig{flushInterval: 50 * time.Millisecond, syncOnRotate: true})
+	defer os.Remove(name + "_0")
+
+	output.Write([]byte("1 1 1\ntest"))
+	time.Sleep(200 * time.Millisecond)
+
+	data, _ := ioutil.ReadFile(name + "_0")
+	if string(data) != "1 1 1\ntest"+payloadSeparator {
+		t.Errorf("Data should be flushed in background: %q", data)
+	}
+
+	output.Close()
+
+	if output.flush() {
+		t.Error("Flush should stop after output is closed")
+	}
+}
+
+func TestFileOutputLock(t *testing.T) {
+	name := fmt.Sprintf("/tmp/%d", rand.Int63())
+	output := NewFileOutput(name, &FileOutputConfig{})
+	defer os.Remove(name + "_0")
+
+	output.Write([]byte("1 1 1\ntest"))
+
+	// Lock is held by open file, so second open of the same file conflicts even in the same process
+	file, _ := os.OpenFile(name+"_0", os.O_WRONLY, 0660)
+	if err := lockFile(file); err != errFileLocked {
+		t.Error("Chunk should be locked while written:", err)
+	}
+	file.Close()
+
+	output.Close()
+
+	file, _ = os.OpenFile(name+"_0", os.O_WRONLY, 0660)
+	if err := lockFile(file); err != nil {
+		t.Error("Lock should be released after close:", err)
+	}
+	file.Close()
+}
+
+func TestFileOutputIndex(t *testing.T) {
+	for _, ext := range []string{".gz", ".zst", ".lz4", ""} {
+		name := fmt.Sprintf("/tmp/%d", rand.Int63()) + ext
+		output := NewFileOutput(name, &FileOutputConfig{indexInterval: 3})
+
+		for i := 1; i <= 10; i++ {
+			output.Write([]byte(fmt.Sprintf("1 id%d %d\nrequest%d", i, i, i)))
+			output.Write([]byte(fmt.Sprintf("2 id%d %d 1\nresponse%d", i, i, i)))
+		}
+		output.Close()
+
+		chunk := setFileIndex(name, 0)
+		defer os.Remove(chunk)
+		defer os.Remove(chunk + fileIndexExt)
+
+		index := loadFileIndex(chunk + fileIndexExt)
+		if len(index) != 3 || index[0].requests != 3 || index[0].timestamp != 4 {
+			t.Errorf("%s: wrong index %+v", ext, index)
+			continue
+		}
+
+		input := NewFileInput(chunk, &FileInputConfig{skip: 7, loopCount: 1})
+		buf := make([]byte, 1000)
+
+		var bodies []string
+		for {
+			n, err := input.Read(buf)
+			if err != nil {
+				break
+			}
+			bodies = append(bodies, string(payloadBody(buf[:n])))
+		}
+		input.Close()
+
+		if strings.Join(bodies, " ") != "request8 response8 request9 response9 request10 response10" {
+			t.Errorf("%s: should skip requests using index: %q", ext, bodies)
+		}
+	}
+}
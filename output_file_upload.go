@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Variables available in uploaded object name template. Date variables are taken from time when chunk was closed.
+var uploadNameFuncs = map[string]func(name string, t time.Time) string{
+	"%{name}":      func(name string, t time.Time) string { return filepath.Base(name) },
+	"%{hostname}":  func(name string, t time.Time) string { host, _ := os.Hostname(); return host },
+	"%{timestamp}": func(name string, t time.Time) string { return strconv.FormatInt(t.UnixNano(), 10) },
+	"%Y":           func(name string, t time.Time) string { return t.Format("2006") },
+	"%m":           func(name string, t time.Time) string { return t.Format("01") },
+	"%d":           func(name string, t time.Time) string { return t.Format("02") },
+	"%H":           func(name string, t time.Time) string { return t.Format("15") },
+	"%M":           func(name string, t time.Time) string { return t.Format("04") },
+	"%S":           func(name string, t time.Time) string { return t.Format("05") },
+}
+
+// Default object name is chunk file name prefixed with time when it was closed. Chunk index restarts from `_0`
+// once uploaded chunks are removed, for example after restart, so chunk name alone would overwrite older objects.
+const defaultUploadName = "%{timestamp}-%{name}"
+
+// uploadChunk holds closed chunk file and time when it was closed
+type uploadChunk struct {
+	name     string
+	closedAt time.Time
+}
+
+// chunkUploader uploads closed chunks of FileOutput to object storage in background, and removes local copies.
+// Chunks are uploaded only after they are closed, so half-written files are never shipped.
+type chunkUploader struct {
+	// Object storage path prefix, like `s3://bucket/prefix/`
+	target string
+	// Object name template, appended to target
+	nameTemplate string
+	upload       func(name, object string) error
+	queue        chan uploadChunk
+	done         chan struct{}
+}
+
+func newChunkUploader(target, nameTemplate string) (*chunkUploader, error) {
+	if nameTemplate == "" {
+		nameTemplate = defaultUploadName
+	}
+
+	u := &chunkUploader{target: target, nameTemplate: nameTemplate, queue: make(chan uploadChunk, 100), done: make(chan struct{})}
+
+	switch {
+	case strings.HasPrefix(target, "s3://"):
+		client := NewS3Client()
+		u.upload = func(name, object string) error {
+			file, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			stat, err := file.Stat()
+			if err != nil {
+				return err
+			}
+
+			bucket, key := parseS3Path(object)
+			return client.Upload(bucket, key, file, stat.Size())
+		}
+	case strings.HasPrefix(target, "gs://"):
+		client := NewGCSClient()
+		u.upload = func(name, object string) error {
+			file, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			stat, err := file.Stat()
+			if err != nil {
+				return err
+			}
+
+			bucket, key := parseGCSPath(object)
+			return client.Upload(bucket, key, file, stat.Size())
+		}
+	default:
+		return nil, errors.New("Unsupported upload target: " + target)
+	}
+
+	go u.run()
+
+	return u, nil
+}
+
+// objectName returns path of uploaded chunk: target prefix followed by rendered name template
+func (u *chunkUploader) objectName(chunk uploadChunk) string {
+	object := u.nameTemplate
+	for variable, fn := range uploadNameFuncs {
+		if strings.Contains(object, variable) {
+			object = strings.Replace(object, variable, fn(chunk.name, chunk.closedAt), -1)
+		}
+	}
+
+	return u.target + object
+}
+
+// Add schedules upload of closed chunk files, like chunk and its index, which get the same close time.
+// It should not be called after Close.
+func (u *chunkUploader) Add(names ...string) {
+	closedAt := time.Now()
+	for _, name := range names {
+		u.queue <- uploadChunk{name: name, closedAt: closedAt}
+	}
+}
+
+func (u *chunkUploader) run() {
+	defer close(u.done)
+
+	for chunk := range u.queue {
+		name := chunk.name
+		object := u.objectName(chunk)
+
+		var err error
+		for retries := 0; retries <= storageMaxRetries; retries++ {
+			if err = u.upload(name, object); err == nil {
+				break
+			}
+
+			log.Println("[FILE-OUTPUT] Error while uploading", name, "to", object, err)
+			time.Sleep(time.Duration(retries+1) * time.Second)
+		}
+
+		if err != nil {
+			log.Println("[FILE-OUTPUT] Giving up uploading", name, ", local file is kept")
+			continue
+		}
+
+		Debug("[FILE-OUTPUT] Uploaded", name, "to", object)
+		os.Remove(name)
+	}
+}
+
+// Close waits until all scheduled chunks are uploaded
+func (u *chunkUploader) Close() {
+	close(u.queue)
+	<-u.done
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/buger/gor/proto"
+	"golang.org/x/net/http2/hpack"
+)
+
+// GRPCOutputConfig struct for holding gRPC output configuration
+type GRPCOutputConfig struct {
+	Timeout        time.Duration
+	OriginalHost   bool
+	TrackResponses bool
+}
+
+// GRPCOutput replays captured gRPC calls. Calls are recorded as HTTP/1.1 requests with
+// length-prefixed messages in body, and are converted back to HTTP/2 streams.
+type GRPCOutput struct {
+	address   string
+	host      string
+	useTLS    bool
+	config    *GRPCOutputConfig
+	queue     chan []byte
+	responses chan response
+}
+
+// NewGRPCOutput constructor for GRPCOutput, address is 'host:port', 'grpc://host:port' or 'grpcs://host:port'
+// Initialize 10 workers, each with its own connection
+func NewGRPCOutput(address string, config *GRPCOutputConfig) io.Writer {
+	o := new(GRPCOutput)
+
+	o.config = config
+	o.queue = make(chan []byte, 1000)
+	o.responses = make(chan response, 1000)
+
+	if !strings.Contains(address, "://") {
+		address = "grpc://" + address
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		log.Fatal("[OUTPUT-GRPC] Wrong address: ", address)
+	}
+
+	o.useTLS = u.Scheme == "grpcs" || u.Scheme == "https"
+	o.host = u.Host
+	o.address = u.Host
+
+	if u.Port() == "" {
+		if o.useTLS {
+			o.address += ":443"
+		} else {
+			o.address += ":80"
+		}
+	}
+
+	if len(Settings.middleware) > 0 {
+		o.config.TrackResponses = true
+	}
+
+	for i := 0; i < 10; i++ {
+		go o.worker()
+	}
+
+	return o
+}
+
+// isGRPCRequest checks if captured request is gRPC call, by its content type
+func isGRPCRequest(request []byte) bool {
+	return proto.IsGRPCContentType(proto.Header(request, []byte("Content-Type")))
+}
+
+// grpcPayloadLabels returns meta labels of captured gRPC call: called method, and status for response
+func grpcPayloadLabels(request, response []byte) []string {
+	if !isGRPCRequest(request) {
+		return nil
+	}
+
+	labels := []string{"grpc-method=" + string(proto.Path(request))}
+	if response != nil {
+		if status := proto.Header(response, []byte("Grpc-Status")); len(status) > 0 {
+			labels = append(labels, "grpc-status="+string(status))
+		}
+	}
+
+	return labels
+}
+
+func (o *GRPCOutput) worker() {
+	client := NewHTTP2Client(o.address, o.useTLS, o.config.Timeout)
+
+	for data := range o.queue {
+		meta := payloadMeta(data)
+		if len(meta) < 2 {
+			continue
+		}
+
+		request := payloadBody(data)
+
+		start := time.Now()
+		resp, err := client.Send(o.headers(request), proto.Body(request))
+		if err != nil {
+			Debug("[OUTPUT-GRPC] Request error:", err)
+			continue
+		}
+
+		if o.config.TrackResponses {
+			o.responses <- response{resp.HTTP1(), meta[1], start.UnixNano(), time.Since(start).Nanoseconds(), -1}
+		}
+	}
+}
+
+// headers converts captured request to HTTP/2 header list
+func (o *GRPCOutput) headers(request []byte) []hpack.HeaderField {
+	scheme := "http"
+	if o.useTLS {
+		scheme = "https"
+	}
+
+	return http2RequestHeaders(request, scheme, o.host, o.config.OriginalHost)
+}
+
+// http2RequestHeaders converts HTTP/1.1 request line and headers to HTTP/2 header list. ':authority' is set to host,
+// or to original Host header if originalHost is set. Connection specific headers are not allowed in HTTP/2, and length is defined by stream.
+func http2RequestHeaders(request []byte, scheme, host string, originalHost bool) []hpack.HeaderField {
+	if originalHost {
+		if h := proto.Header(request, []byte("Host")); len(h) > 0 {
+			host = string(h)
+		}
+	}
+
+	headers := []hpack.HeaderField{
+		{Name: ":method", Value: string(proto.Method(request))},
+		{Name: ":scheme", Value: scheme},
+		{Name: ":path", Value: string(proto.Path(request))},
+		{Name: ":authority", Value: host},
+	}
+
+	proto.ParseHeaders([][]byte{request[proto.MIMEHeadersStartPos(request):]}, func(header []byte, value []byte) bool {
+		name := strings.ToLower(string(header))
+
+		switch name {
+		case "host", "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade", "content-length":
+		default:
+			headers = append(headers, hpack.HeaderField{Name: name, Value: string(value)})
+		}
+
+		return true
+	})
+
+	return headers
+}
+
+func (o *GRPCOutput) Write(data []byte) (n int, err error) {
+	if data[0] != RequestPayload || !isGRPCRequest(payloadBody(data)) {
+		return len(data), nil
+	}
+
+	// We have to copy, because sending data in multiple threads
+	buf := make([]byte, len(data))
+	copy(buf, data)
+
+	o.queue <- buf
+
+	return len(data), nil
+}
+
+func (o *GRPCOutput) Read(data []byte) (int, error) {
+	resp := <-o.responses
+
+	header := payloadHeader(ReplayedResponsePayload, resp.uuid, resp.roundTripTime, resp.startedAt)
+	copy(data[0:len(header)], header)
+	copy(data[len(header):], resp.payload)
+
+	return len(resp.payload) + len(header), nil
+}
+
+func (o *GRPCOutput) String() string {
+	return "gRPC output: " + o.address
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestGRPCOutput(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		requests <- req
+		bodies <- body
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte("\x00\x00\x00\x00\x01\x08"))
+		w.Header().Set("Grpc-Status", "0")
+	})
+
+	// Plain HTTP/2 with prior knowledge
+	server := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	output := NewGRPCOutput(address, &GRPCOutputConfig{Timeout: time.Second, TrackResponses: true})
+
+	message := "\x00\x00\x00\x00\x05hello"
+	// Regular HTTP requests are ignored
+	output.Write([]byte("1 a 1\nGET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	output.Write([]byte("1 b 1\nPOST /helloworld.Greeter/SayHello HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/grpc\r\nTe: trailers\r\nContent-Length: 10\r\n\r\n" + message))
+
+	select {
+	case req := <-requests:
+		if req.ProtoMajor != 2 {
+			t.Error("Should use HTTP/2", req.Proto)
+		}
+
+		if req.Method != "POST" || req.URL.Path != "/helloworld.Greeter/SayHello" || req.Host != address {
+			t.Error("Wrong request", req.Method, req.URL.Path, req.Host)
+		}
+
+		if req.Header.Get("Content-Type") != "application/grpc" || req.Header.Get("Te") != "trailers" {
+			t.Error("Wrong headers", req.Header)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Should send request headers")
+	}
+
+	select {
+	case body := <-bodies:
+		if string(body) != message {
+			t.Errorf("Expected body %q, got %q", message, body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Should send request body")
+	}
+
+	data := make([]byte, 1024)
+	n, _ := output.(io.Reader).Read(data)
+	resp := string(data[:n])
+
+	if !strings.HasPrefix(resp, "3 b ") || !strings.Contains(resp, "HTTP/1.1 200 OK\r\n") || !strings.Contains(resp, "Grpc-Status: 0\r\n") {
+		t.Errorf("Should emit response with trailers: %q", resp)
+	}
+}
+
+func TestGRPCPayloadLabels(t *testing.T) {
+	request := []byte("POST /helloworld.Greeter/SayHello HTTP/1.1\r\nContent-Type: application/grpc+proto\r\n\r\n")
+	response := []byte("HTTP/1.1 200 OK\r\nContent-Type: application/grpc\r\nGrpc-Status: 5\r\n\r\n")
+
+	if labels := grpcPayloadLabels(request, nil); len(labels) != 1 || labels[0] != "grpc-method=/helloworld.Greeter/SayHello" {
+		t.Error("Wrong request labels", labels)
+	}
+
+	header := appendPayloadLabels(payloadHeader(ResponsePayload, []byte("a"), 1, 1), grpcPayloadLabels(request, response))
+	if labels := payloadLabels(header); labels["grpc-method"] != "/helloworld.Greeter/SayHello" || labels["grpc-status"] != "5" {
+		t.Error("Wrong response labels", labels)
+	}
+
+	if labels := grpcPayloadLabels([]byte("POST / HTTP/1.1\r\nContent-Type: application/grpc-web\r\n\r\n"), nil); labels != nil {
+		t.Error("Should skip other requests", labels)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/buger/gor/proto"
+)
+
+// Requests without response for this time are written with empty response
+const harResponseTimeout = 10 * time.Second
+
+var harDocumentHeader = `{"log":{"version":"1.2","creator":{"name":"gor","version":"` + VERSION + `"},"entries":[` + "\n"
+
+// harPendingRequest is a request which waits for its response
+type harPendingRequest struct {
+	entry   harEntry
+	arrived time.Time
+}
+
+// harWriter writes payloads as HAR file. Request is written as entry once its response arrives,
+// or with empty response after timeout. File is valid only after Close, which writes the end of JSON document.
+type harWriter struct {
+	w       io.Writer
+	pending map[string]*harPendingRequest
+	// Ids of pending requests in order of arrival
+	order   []string
+	entries int
+	started bool
+}
+
+func newHARWriter(w io.Writer) *harWriter {
+	return &harWriter{w: w, pending: make(map[string]*harPendingRequest)}
+}
+
+func (h *harWriter) Write(payload []byte) error {
+	meta := payloadMeta(payload)
+	if len(meta) < 3 {
+		return nil
+	}
+
+	id := string(meta[1])
+	ts, _ := strconv.ParseInt(string(bytes.TrimSpace(meta[2])), 10, 64)
+	body := payloadBody(payload)
+
+	switch payload[0] {
+	case RequestPayload:
+		h.pending[id] = &harPendingRequest{entry: harEntry{
+			StartedDateTime: time.Unix(0, ts).UTC(),
+			Request:         harBuildRequest(body),
+			Response:        harResponse{Cookies: []harHeader{}, Headers: []harHeader{}},
+		}, arrived: time.Now()}
+		h.order = append(h.order, id)
+	case ResponsePayload:
+		req, ok := h.pending[id]
+		if !ok {
+			return nil
+		}
+		delete(h.pending, id)
+
+		req.entry.Response = harBuildResponse(body)
+		if len(meta) > 3 {
+			if latency, err := strconv.ParseInt(string(bytes.TrimSpace(meta[3])), 10, 64); err == nil {
+				req.entry.Time = float64(latency) / float64(time.Millisecond)
+				req.entry.Timings.Wait = req.entry.Time
+			}
+		}
+
+		if err := h.writeEntry(&req.entry); err != nil {
+			return err
+		}
+	}
+
+	return h.flushExpired(time.Now().Add(-harResponseTimeout))
+}
+
+// flushExpired writes requests which arrived before given time, and still wait for response
+func (h *harWriter) flushExpired(before time.Time) error {
+	for len(h.order) > 0 {
+		req, ok := h.pending[h.order[0]]
+		if ok && req.arrived.After(before) {
+			break
+		}
+
+		if ok {
+			delete(h.pending, h.order[0])
+			if err := h.writeEntry(&req.entry); err != nil {
+				return err
+			}
+		}
+
+		h.order = h.order[1:]
+	}
+
+	return nil
+}
+
+func (h *harWriter) writeEntry(entry *harEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if !h.started {
+		h.started = true
+		if _, err = io.WriteString(h.w, harDocumentHeader); err != nil {
+			return err
+		}
+	}
+
+	if h.entries > 0 {
+		if _, err = io.WriteString(h.w, ",\n"); err != nil {
+			return err
+		}
+	}
+	h.entries++
+
+	_, err = h.w.Write(data)
+	return err
+}
+
+// Close writes pending requests and the end of HAR document. Underlying writer is not closed.
+func (h *harWriter) Close() error {
+	if err := h.flushExpired(time.Now()); err != nil {
+		return err
+	}
+
+	if !h.started {
+		h.started = true
+		if _, err := io.WriteString(h.w, harDocumentHeader); err != nil {
+			return err
+		}
+	}
+
+	_, err := io.WriteString(h.w, "\n]}}\n")
+	return err
+}
+
+// harHeaders returns headers of HTTP message in original order
+func harHeaders(msg []byte) (headers []harHeader) {
+	headers = []harHeader{}
+	proto.ParseHeaders([][]byte{msg}, func(name []byte, value []byte) bool {
+		headers = append(headers, harHeader{Name: string(name), Value: string(value)})
+		return true
+	})
+
+	return
+}
+
+// harDecodeBody returns body without chunked and gzip encoding, or raw body if message can't be parsed
+func harDecodeBody(body io.ReadCloser, header http.Header, raw []byte) []byte {
+	defer body.Close()
+
+	var r io.Reader = body
+	if strings.EqualFold(header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return raw
+		}
+		r = gz
+	}
+
+	decoded, err := ioutil.ReadAll(r)
+	if err != nil && len(decoded) == 0 {
+		return raw
+	}
+
+	return decoded
+}
+
+func harBuildRequest(msg []byte) harRequest {
+	req := harRequest{
+		Method:      string(proto.Method(msg)),
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     []harHeader{},
+		Headers:     harHeaders(msg),
+		QueryString: []harHeader{},
+		HeadersSize: -1,
+	}
+
+	path := string(proto.Path(msg))
+	host := string(proto.Header(msg, []byte("Host")))
+	req.URL = "http://" + host + path
+
+	if u, err := url.Parse(path); err == nil {
+		for name, values := range u.Query() {
+			for _, v := range values {
+				req.QueryString = append(req.QueryString, harHeader{Name: name, Value: v})
+			}
+		}
+	}
+
+	body := proto.Body(msg)
+	if r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(msg))); err == nil {
+		req.HTTPVersion = r.Proto
+		for _, c := range r.Cookies() {
+			req.Cookies = append(req.Cookies, harHeader{Name: c.Name, Value: c.Value})
+		}
+		body = harDecodeBody(r.Body, r.Header, body)
+	}
+
+	req.BodySize = len(body)
+	if len(body) > 0 {
+		req.PostData = &harPostData{
+			MimeType: string(proto.Header(msg, []byte("Content-Type"))),
+			Text:     string(body),
+		}
+	}
+
+	return req
+}
+
+func harBuildResponse(msg []byte) harResponse {
+	resp := harResponse{
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     []harHeader{},
+		Headers:     harHeaders(msg),
+		HeadersSize: -1,
+	}
+
+	resp.Status, _ = strconv.Atoi(string(proto.Status(msg)))
+	resp.RedirectURL = string(proto.Header(msg, []byte("Location")))
+
+	body := proto.Body(msg)
+	if r, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(msg)), nil); err == nil {
+		resp.HTTPVersion = r.Proto
+		resp.StatusText = strings.TrimPrefix(r.Status, strconv.Itoa(r.StatusCode)+" ")
+		for _, c := range r.Cookies() {
+			resp.Cookies = append(resp.Cookies, harHeader{Name: c.Name, Value: c.Value})
+		}
+		body = harDecodeBody(r.Body, r.Header, body)
+	}
+
+	resp.BodySize = len(body)
+	resp.Content = harContent{Size: len(body), MimeType: string(proto.Header(msg, []byte("Content-Type")))}
+
+	if utf8.Valid(body) {
+		resp.Content.Text = string(body)
+	} else {
+		resp.Content.Text = base64.StdEncoding.EncodeToString(body)
+		resp.Content.Encoding = "base64"
+	}
+
+	return resp
+}
@@ -1,11 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/buger/gor/proto"
+	"golang.org/x/net/http2/hpack"
 )
 
 const initialDynamicWorkers = 10
@@ -15,6 +29,8 @@ type response struct {
 	uuid          []byte
 	roundTripTime int64
 	startedAt     int64
+	// Latency of original response, -1 if unknown
+	originalLatency int64
 }
 
 // HTTPOutputConfig struct for holding http output configuration
@@ -23,6 +39,36 @@ type HTTPOutputConfig struct {
 
 	stats   bool
 	workers int
+	// Bounds and target queue latency of dynamic worker pool
+	workersMin    int
+	workersMax    int
+	targetLatency time.Duration
+	// Limit of the whole request including connecting and redirects, and of its phases
+	requestTimeout        time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	// Bodies bigger than threshold are written after headers in chunks, and body of request with `Expect: 100-continue` waits for server
+	streamThreshold int
+	continueTimeout time.Duration
+	// Requests waiting for workers, and what to do when queue is full: block input, drop oldest or newest requests
+	maxQueue    int
+	queuePolicy string
+	// Each worker holds single connection to each target, so it limits number of workers too
+	maxConns     int
+	maxIdleConns int
+
+	// Requests failed with transient errors are retried given number of times, with exponential backoff
+	retries       int
+	retryBackoff  time.Duration
+	retryStatuses MultiOption
+	// Retry requests like POST, even if they could be already processed by target
+	retryNonIdempotent bool
+
+	// Circuit breaker is enabled if error rate is set
+	breakerErrorRate   float64
+	breakerMinRequests int
+	breakerWindow      time.Duration
+	breakerCooldown    time.Duration
 
 	elasticSearch string
 
@@ -33,33 +79,146 @@ type HTTPOutputConfig struct {
 	Debug bool
 
 	TrackResponses bool
+
+	IdleTimeout      time.Duration
+	DisableKeepAlive bool
+
+	// Replay using HTTP/2: h2c with prior knowledge for http://, and h2 negotiated by ALPN for https://
+	HTTP2 bool
+	// Experimental replay using HTTP/3 over QUIC, only https:// addresses are supported
+	HTTP3 bool
+
+	// Strategy of choosing target, if output has multiple ones
+	balance string
+	// Requests of one session, by key of hash balancing strategy, are sent by the same worker in recorded order
+	stickyWorkers bool
+
+	// Client certificates for mutual TLS
+	tlsCert      string
+	tlsKey       string
+	tlsHostCerts MultiOption
+
+	// Server certificate is verified if verification is enabled, or CA certificates are set
+	caCerts       MultiOption
+	verifyTLS     bool
+	tlsMinVersion string
+	tlsMaxVersion string
+
+	// Forward or SOCKS5 proxy, by default taken from HTTP_PROXY and HTTPS_PROXY environment variables
+	proxy string
+
+	// Addresses of hosts set by `host[:port]:ip`, other hosts are resolved by DNS server or OS and cached for TTL
+	resolve    MultiOption
+	dnsServer  string
+	resolveTTL time.Duration
+
+	// Requests are signed again with AWS Signature Version 4 for `service[:region]`, optionally with credentials of assumed role
+	awsSigV4 string
+	awsRole  string
+
+	// Bearer token fetched with OAuth2 client credentials flow replaces recorded Authorization header
+	oauth2TokenURL     string
+	oauth2ClientID     string
+	oauth2ClientSecret string
+	oauth2Scope        string
+	oauth2Params       MultiOption
+
+	// Encoding of replayed request bodies: `preserve` or `gzip`, and encodings of targets with given hosts
+	bodyEncoding      string
+	hostBodyEncodings MultiOption
+
+	// Rules checked against replayed responses, failures are written as JSON lines to report, "-" for stdout
+	assertions   MultiOption
+	assertReport string
+
+	// File where original and replayed latency percentiles by endpoint are written, "-" for stdout
+	latencyReport         string
+	latencyReportInterval time.Duration
 }
 
 // HTTPOutput plugin manage pool of workers which send request to replayed server
-// By default workers pool is dynamic and starts with 10 workers
+// By default workers pool is dynamic, starts with 10 workers and is scaled by queue length
 // You can specify fixed number of workers using `--output-http-workers`
 type HTTPOutput struct {
 	// Keep this as first element of struct because it guarantees 64bit
 	// alignment. atomic.* functions crash on 32bit machines if operand is not
 	// aligned at 64bit. See https://github.com/golang/go/issues/599
 	activeWorkers int64
+	// Workers waiting for requests with open connection
+	idleConns int64
+	// Requests retried at least once, and requests which still failed after all retries
+	retriedRequests int64
+	failedRequests  int64
+	// Counter of round-robin balancing
+	nextTarget int64
+	// Attempts which timed out
+	timedOutRequests int64
+	// Finished requests, and workers started and stopped by dynamic scaling
+	completedRequests int64
+	scaledUp          int64
+	scaledDown        int64
+	// Redirects followed by workers, and ones stopped by loop protection or limit
+	redirects RedirectStats
 
 	address string
 	limit   int
-	queue   chan []byte
+	queue   *payloadQueue
+	// Queues of sticky workers, requests with session key skip shared queue
+	lanes []*payloadQueue
 
 	responses chan response
-
-	needWorker chan int
+	latencies *originalLatencies
 
 	config *HTTPOutputConfig
 
 	queueStats *GorStat
+	// Latency histograms by endpoint, reported with stats
+	endpointLatencies *endpointLatencyStats
 
 	elasticSearch *ESPlugin
+
+	retryStatuses map[string]bool
+
+	signer *awsSigner
+	tokens *oauth2TokenSource
+	// Shared by all targets, nil if hosts are resolved by OS on each connection
+	resolver *targetResolver
+
+	assertions *responseAssertions
+
+	// Workers are added under lock, so none is started once Close waits for them
+	workersMu sync.Mutex
+	workers   sync.WaitGroup
+	closing   bool
+
+	// Comma separated addresses are replay targets, requests are balanced between them
+	targets     []*httpTarget
+	balance     int
+	balanceName string
 }
 
-// NewHTTPOutput constructor for HTTPOutput
+// httpTarget is single replay destination of HTTPOutput
+type httpTarget struct {
+	// Requests in flight, used by least-pending balancing
+	pending int64
+
+	address string
+	breaker *circuitBreaker
+	// Client certificate, verification and versions of TLS
+	tlsConfig *tls.Config
+	proxy     *url.URL
+	// Encoding of request bodies: `preserve` or `gzip`
+	bodyEncoding string
+
+	// Shared by all workers, requests are multiplexed over single connection
+	http2       *HTTP2Client
+	http3       *HTTP3Client
+	http2Scheme string
+	http2Host   string
+	http2Auth   string
+}
+
+// NewHTTPOutput constructor for HTTPOutput. Address can be list of comma separated targets.
 // Initialize workers
 func NewHTTPOutput(address string, config *HTTPOutputConfig) io.Writer {
 	o := new(HTTPOutput)
@@ -67,68 +226,314 @@ func NewHTTPOutput(address string, config *HTTPOutputConfig) io.Writer {
 	o.address = address
 	o.config = config
 
+	var err error
+	if o.balance, o.balanceName, err = parseBalanceStrategy(o.config.balance); err != nil {
+		log.Fatal("[OUTPUT-HTTP] ", err)
+	}
+
+	certs, err := loadHTTPClientCerts(o.config.tlsCert, o.config.tlsKey, o.config.tlsHostCerts)
+	if err != nil {
+		log.Fatal("[OUTPUT-HTTP] Can't load client certificate: ", err)
+	}
+
+	tlsConfig, err := o.config.baseTLSConfig()
+	if err != nil {
+		log.Fatal("[OUTPUT-HTTP] ", err)
+	}
+
+	for _, addr := range strings.Split(address, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			t := &httpTarget{address: addr, tlsConfig: tlsConfig.Clone()}
+			if cert := certs.forAddress(addr); cert != nil {
+				t.tlsConfig.Certificates = []tls.Certificate{*cert}
+			}
+
+			// Unix socket is local, proxy isn't used for it
+			if !strings.HasPrefix(addr, unixSocketPrefix) {
+				if t.proxy, err = targetProxy(o.config.proxy, addr); err != nil {
+					log.Fatal("[OUTPUT-HTTP] Wrong proxy: ", err)
+				}
+			}
+
+			o.targets = append(o.targets, t)
+		}
+	}
+
+	if len(o.config.resolve) > 0 || o.config.dnsServer != "" {
+		if o.resolver, err = newTargetResolver(o.config.resolve, o.config.dnsServer, o.config.resolveTTL, o.config.Timeout); err != nil {
+			log.Fatal("[OUTPUT-HTTP] Wrong host resolution: ", err)
+		}
+	}
+
+	if !validBodyEncoding(o.config.bodyEncoding) {
+		log.Fatal("[OUTPUT-HTTP] Body encoding should be preserve or gzip, got: ", o.config.bodyEncoding)
+	}
+
+	for _, t := range o.targets {
+		if t.bodyEncoding, err = targetBodyEncoding(t.address, o.config.bodyEncoding, o.config.hostBodyEncodings); err != nil {
+			log.Fatal("[OUTPUT-HTTP] ", err)
+		}
+	}
+
+	if o.config.awsSigV4 != "" {
+		if o.signer, err = newAWSSigner(o.config.awsSigV4, o.config.awsRole); err != nil {
+			log.Fatal("[OUTPUT-HTTP] AWS signing: ", err)
+		}
+	}
+
+	if o.config.oauth2TokenURL != "" {
+		if o.tokens, err = newOAuth2TokenSource(o.config.oauth2TokenURL, o.config.oauth2ClientID, o.config.oauth2ClientSecret, o.config.oauth2Scope, o.config.oauth2Params); err != nil {
+			log.Fatal("[OUTPUT-HTTP] OAuth2: ", err)
+		}
+	}
+
 	if o.config.stats {
 		o.queueStats = NewGorStat("output_http")
 	}
 
-	o.queue = make(chan []byte, 1000)
-	o.responses = make(chan response, 1000)
-	o.needWorker = make(chan int, 1)
-
-	// Initial workers count
-	if o.config.workers == 0 {
-		o.needWorker <- initialDynamicWorkers
-	} else {
-		o.needWorker <- o.config.workers
+	if o.config.maxQueue == 0 {
+		o.config.maxQueue = 1000
 	}
+	if o.queue, err = newPayloadQueue("OUTPUT-HTTP", o.config.maxQueue, o.config.queuePolicy); err != nil {
+		log.Fatal("[OUTPUT-HTTP] ", err)
+	}
+	o.responses = make(chan response, 1000)
 
 	if o.config.elasticSearch != "" {
 		o.elasticSearch = new(ESPlugin)
 		o.elasticSearch.Init(o.config.elasticSearch)
 	}
 
+	statuses := o.config.retryStatuses
+	if len(statuses) == 0 {
+		statuses = defaultRetryStatuses
+	}
+	o.retryStatuses = make(map[string]bool)
+	for _, status := range statuses {
+		o.retryStatuses[status] = true
+	}
+
+	if o.config.retryBackoff == 0 {
+		o.config.retryBackoff = 100 * time.Millisecond
+	}
+
+	if o.config.stats {
+		go o.reportRetryStats()
+
+		o.endpointLatencies = newEndpointLatencyStats()
+		go o.reportEndpointStats()
+
+		if o.config.redirectLimit > 0 {
+			go o.reportRedirectStats()
+		}
+	}
+
+	if o.config.HTTP2 && o.config.HTTP3 {
+		log.Fatal("[OUTPUT-HTTP] HTTP/2 and HTTP/3 can't be used together")
+	}
+
+	for _, t := range o.targets {
+		if o.config.HTTP2 {
+			o.initHTTP2(t)
+		}
+
+		if o.config.HTTP3 {
+			o.initHTTP3(t)
+		}
+
+		if o.config.breakerErrorRate > 0 {
+			t.breaker = newCircuitBreaker(t.address, o.config.breakerErrorRate/100, o.config.breakerMinRequests, o.config.breakerWindow, o.config.breakerCooldown)
+		}
+	}
+
 	if len(Settings.middleware) > 0 {
 		o.config.TrackResponses = true
 	}
 
-	go o.workerMaster()
+	if o.config.TrackResponses || o.config.latencyReport != "" {
+		out := o.responses
+		// Responses are not passed to other plugins, if only latency report needs them
+		if !o.config.TrackResponses {
+			out = make(chan response, 1000)
+			go func() {
+				for range out {
+				}
+			}()
+		}
 
-	return o
-}
+		o.latencies = newOriginalLatencies(out, o.config.Timeout)
+	}
 
-func (o *HTTPOutput) workerMaster() {
-	for {
-		newWorkers := <-o.needWorker
-		for i := 0; i < newWorkers; i++ {
-			go o.startWorker()
+	if len(o.config.assertions) > 0 {
+		if o.assertions, err = newResponseAssertions(o.config.assertions, o.config.assertReport, o.config.Timeout); err != nil {
+			log.Fatal("[OUTPUT-HTTP] Assertions: ", err)
+		}
+	}
+
+	if o.config.latencyReport != "" {
+		w := io.Writer(os.Stdout)
+		if o.config.latencyReport != "-" {
+			f, err := os.OpenFile(o.config.latencyReport, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+			if err != nil {
+				log.Fatal("[OUTPUT-HTTP] Can't open latency report: ", err)
+			}
+			w = f
+		}
+
+		if o.config.latencyReportInterval == 0 {
+			o.config.latencyReportInterval = 10 * time.Second
+		}
+
+		o.latencies.report = newLatencyReport(w, o.config.latencyReportInterval)
+	}
+
+	if o.config.stickyWorkers {
+		if o.config.workers == 0 {
+			log.Fatal("[OUTPUT-HTTP] Sticky workers require fixed number of workers, set by --output-http-workers")
+		}
+		if o.balance != balanceHashIP && o.balance != balanceHashHeader && o.balance != balanceHashCookie {
+			log.Fatal("[OUTPUT-HTTP] Sticky workers require hash-ip, hash-header or hash-cookie balancing")
+		}
+
+		size := o.config.maxQueue / o.config.workers
+		if size < 1 {
+			size = 1
+		}
+
+		o.lanes = make([]*payloadQueue, o.config.workers)
+		for i := range o.lanes {
+			if o.lanes[i], err = newPayloadQueue("OUTPUT-HTTP", size, o.config.queuePolicy); err != nil {
+				log.Fatal("[OUTPUT-HTTP] ", err)
+			}
+		}
+	}
+
+	if o.config.workers == 0 {
+		// Initial workers are started right away, so requests written before first scaling are sent
+		initial := initialDynamicWorkers
+		if initial < o.config.workersMin {
+			initial = o.config.workersMin
 		}
+		o.addWorkers(initial)
+
+		go o.autoscale()
 
-		// Disable dynamic scaling if workers poll fixed size
-		if o.config.workers != 0 {
-			return
+		if o.config.stats {
+			go o.reportWorkerStats()
+		}
+	} else {
+		started := o.addWorkers(o.config.workers)
+		// Workers can be limited by maximum number of connections, lanes without worker are not used
+		if o.lanes != nil {
+			o.lanes = o.lanes[:started]
 		}
 	}
+
+	return o
 }
 
-func (o *HTTPOutput) startWorker() {
-	client := NewHTTPClient(o.address, &HTTPClientConfig{
+func (o *HTTPOutput) newClient(t *httpTarget) *HTTPClient {
+	return NewHTTPClient(t.address, &HTTPClientConfig{
 		FollowRedirects:    o.config.redirectLimit,
+		Redirects:          &o.redirects,
 		Debug:              o.config.Debug,
 		OriginalHost:       o.config.OriginalHost,
 		Timeout:            o.config.Timeout,
 		ResponseBufferSize: o.config.BufferSize,
+		IdleTimeout:        o.config.IdleTimeout,
+		DisableKeepAlive:   o.config.DisableKeepAlive,
+		TLSConfig:          t.tlsConfig,
+		Proxy:              t.proxy,
+		Resolver:           o.resolver,
+
+		RequestTimeout:        o.config.requestTimeout,
+		TLSHandshakeTimeout:   o.config.tlsHandshakeTimeout,
+		ResponseHeaderTimeout: o.config.responseHeaderTimeout,
+		StreamThreshold:       o.config.streamThreshold,
+		ContinueTimeout:       o.config.continueTimeout,
 	})
+}
+
+// startWorker sends requests from shared queue, and from its own lane if workers are sticky
+func (o *HTTPOutput) startWorker(lane *payloadQueue) {
+	// Worker holds connection to each target it sent requests to, clients are created on first use
+	clients := make([]*HTTPClient, len(o.targets))
+
+	// Receiving from nil channel blocks forever, so without lane only shared queue is used.
+	// Worker stops once its queues are closed and drained.
+	queueCh := o.queue.ch
+	var laneCh chan []byte
+	if lane != nil {
+		laneCh = lane.ch
+	}
 
 	deathCount := 0
+	// Number of open connections counted as idle, while worker waits for request
+	idle := 0
 
-	atomic.AddInt64(&o.activeWorkers, 1)
+	release := func() {
+		atomic.AddInt64(&o.idleConns, -int64(idle))
+		idle = 0
+	}
+
+	// Otherwise connections of dead worker are kept open until garbage collected
+	defer func() {
+		release()
+		for _, client := range clients {
+			if client != nil {
+				client.Disconnect()
+			}
+		}
+	}()
 
 	for {
+		if idle == 0 {
+			for _, client := range clients {
+				if client == nil || client.conn == nil {
+					continue
+				}
+
+				if n := atomic.AddInt64(&o.idleConns, 1); o.config.maxIdleConns > 0 && n > int64(o.config.maxIdleConns) {
+					atomic.AddInt64(&o.idleConns, -1)
+					client.Disconnect()
+				} else {
+					idle++
+				}
+			}
+		}
+
 		select {
-		case data := <-o.queue:
-			o.sendRequest(client, data)
+		case data, ok := <-queueCh:
+			if !ok {
+				if queueCh = nil; laneCh == nil {
+					return
+				}
+				continue
+			}
+
+			release()
+			o.sendRequest(clients, data)
+			atomic.AddInt64(&o.completedRequests, 1)
 			deathCount = 0
+		case data, ok := <-laneCh:
+			if !ok {
+				if laneCh = nil; queueCh == nil {
+					return
+				}
+				continue
+			}
+
+			release()
+			o.sendRequest(clients, data)
+			atomic.AddInt64(&o.completedRequests, 1)
 		case <-time.After(time.Millisecond * 100):
+			release()
+			for _, client := range clients {
+				if client != nil {
+					client.CloseIdle()
+				}
+			}
+
 			// When dynamic scaling enabled workers die after 2s of inactivity
 			if o.config.workers == 0 {
 				deathCount++
@@ -136,39 +541,46 @@ func (o *HTTPOutput) startWorker() {
 				continue
 			}
 
-			if deathCount > 20 {
-				workersCount := atomic.LoadInt64(&o.activeWorkers)
-
-				// At least 1 startWorker should be alive
-				if workersCount != 1 {
-					atomic.AddInt64(&o.activeWorkers, -1)
-					return
-				}
+			// At least minimum number of workers should be alive
+			if deathCount > 20 && o.removeWorker() {
+				return
 			}
 		}
 	}
 }
 
 func (o *HTTPOutput) Write(data []byte) (n int, err error) {
-	if !isRequestPayload(data) {
-		return len(data), nil
+	// Original responses are only used to pair their latency and status with replayed ones
+	if data[0] == ResponsePayload && o.latencies != nil {
+		meta := payloadMeta(data)
+		if len(meta) > 3 {
+			if latency, err := strconv.ParseInt(string(meta[3]), 10, 64); err == nil {
+				o.latencies.original(meta[1], latency)
+			}
+		}
 	}
 
-	buf := make([]byte, len(data))
-	copy(buf, data)
+	if data[0] == ResponsePayload && o.assertions != nil {
+		o.assertions.original(payloadMeta(data)[1], proto.Status(payloadBody(data)))
+	}
 
-	o.queue <- buf
+	if !isRequestPayload(data) {
+		return len(data), nil
+	}
 
-	if o.config.stats {
-		o.queueStats.Write(len(o.queue))
+	if o.lanes != nil {
+		if key := o.sessionKey(payloadBody(data)); len(key) > 0 {
+			h := fnv.New32a()
+			h.Write(key)
+			o.lanes[h.Sum32()%uint32(len(o.lanes))].Push(data)
+			return len(data), nil
+		}
 	}
 
-	if o.config.workers == 0 {
-		workersCount := atomic.LoadInt64(&o.activeWorkers)
+	o.queue.Push(data)
 
-		if len(o.queue) > int(workersCount) {
-			o.needWorker <- len(o.queue)
-		}
+	if o.config.stats {
+		o.queueStats.Write(o.queue.Len())
 	}
 
 	return len(data), nil
@@ -180,13 +592,17 @@ func (o *HTTPOutput) Read(data []byte) (int, error) {
 	Debug("[OUTPUT-HTTP] Received response:", string(resp.payload))
 
 	header := payloadHeader(ReplayedResponsePayload, resp.uuid, resp.roundTripTime, resp.startedAt)
+	if resp.originalLatency != -1 {
+		header = append(header[:len(header)-1], " "+strconv.FormatInt(resp.originalLatency, 10)+"\n"...)
+	}
 	copy(data[0:len(header)], header)
 	copy(data[len(header):], resp.payload)
 
 	return len(resp.payload) + len(header), nil
 }
 
-func (o *HTTPOutput) sendRequest(client *HTTPClient, request []byte) {
+// sendRequest sends request to target chosen by balancer, clients are connections of worker to each target
+func (o *HTTPOutput) sendRequest(clients []*HTTPClient, request []byte) {
 	meta := payloadMeta(request)
 	if len(meta) < 2 {
 		return
@@ -198,16 +614,93 @@ func (o *HTTPOutput) sendRequest(client *HTTPClient, request []byte) {
 		return
 	}
 
-	start := time.Now()
-	resp, err := client.Send(body)
-	stop := time.Now()
+	i := o.pickTarget(body)
+	t := o.targets[i]
 
-	if err != nil {
-		Debug("Request error:", err)
+	if t.breaker != nil && !t.breaker.Allow() {
+		return
+	}
+
+	if t.bodyEncoding == bodyEncodingGzip {
+		var err error
+		if body, err = gzipRequestBody(body); err != nil {
+			Debug("[OUTPUT-HTTP] Body is sent as captured:", err)
+		}
+	}
+
+	if clients[i] == nil && t.http2 == nil && t.http3 == nil {
+		clients[i] = o.newClient(t)
+	}
+
+	atomic.AddInt64(&t.pending, 1)
+	defer atomic.AddInt64(&t.pending, -1)
+
+	var resp []byte
+	var err error
+	var start, stop time.Time
+
+	for attempt := 0; ; attempt++ {
+		payload := body
+		var token string
+		if o.tokens != nil {
+			payload, token = o.injectToken(payload)
+		}
+		if o.signer != nil {
+			// Each attempt is signed with current date
+			payload = o.signRequest(t, clients[i], payload)
+		}
+
+		start = time.Now()
+		if t.http2 != nil || t.http3 != nil {
+			resp, err = o.sendStream(t, payload)
+		} else {
+			resp, err = clients[i].Send(payload)
+		}
+		stop = time.Now()
+
+		if err != nil {
+			Debug("Request error:", err)
+		}
+
+		if token != "" && bytes.Equal(proto.Status(resp), []byte("401")) {
+			// Token could be revoked before it expired, next request fetches new one
+			o.tokens.Invalidate(token)
+		}
+
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() || bytes.Equal(proto.Status(resp), []byte(HTTP_TIMEOUT)) {
+			atomic.AddInt64(&o.timedOutRequests, 1)
+		}
+
+		if !o.retryable(body, resp, err) {
+			break
+		}
+
+		if attempt >= o.config.retries {
+			atomic.AddInt64(&o.failedRequests, 1)
+			break
+		}
+
+		if attempt == 0 {
+			atomic.AddInt64(&o.retriedRequests, 1)
+		}
+
+		time.Sleep(o.retryBackoff(attempt))
+	}
+
+	if t.breaker != nil {
+		t.breaker.Report(requestFailed(resp, err))
+	}
+
+	if o.latencies != nil {
+		o.latencies.replayed(response{resp, uuid, start.UnixNano(), stop.UnixNano() - start.UnixNano(), -1}, latencyEndpoint(body))
 	}
 
-	if o.config.TrackResponses {
-		o.responses <- response{resp, uuid, start.UnixNano(), stop.UnixNano() - start.UnixNano()}
+	if o.endpointLatencies != nil && len(resp) > 0 {
+		o.endpointLatencies.add(latencyEndpoint(body), stop.Sub(start))
+	}
+
+	if o.assertions != nil {
+		o.assertions.replayed(uuid, body, resp)
 	}
 
 	if o.elasticSearch != nil {
@@ -215,6 +708,163 @@ func (o *HTTPOutput) sendRequest(client *HTTPClient, request []byte) {
 	}
 }
 
+// injectToken replaces recorded Authorization header with current bearer token, and returns the token
+func (o *HTTPOutput) injectToken(request []byte) ([]byte, string) {
+	token, err := o.tokens.Token()
+	if err != nil {
+		log.Println("[OUTPUT-HTTP] Can't get OAuth2 token:", err)
+		return request, ""
+	}
+
+	return proto.SetHeader(request, []byte("Authorization"), []byte("Bearer "+token)), token
+}
+
+// signRequest signs request for Host which is sent to target: original one, or host of target address
+func (o *HTTPOutput) signRequest(t *httpTarget, client *HTTPClient, request []byte) []byte {
+	host := string(proto.Header(request, []byte("Host")))
+	if !o.config.OriginalHost {
+		if t.http2 != nil || t.http3 != nil {
+			host = t.http2Host
+		} else {
+			host = client.host
+		}
+	}
+
+	signed, err := o.signer.sign(request, host, time.Now())
+	if err != nil {
+		log.Println("[OUTPUT-HTTP] Can't sign request:", err)
+	}
+
+	return signed
+}
+
+func (o *HTTPOutput) initHTTP2(t *httpTarget) {
+	if strings.HasPrefix(t.address, unixSocketPrefix) {
+		log.Fatal("[OUTPUT-HTTP] HTTP/2 is not supported for unix socket: ", t.address)
+	}
+
+	hostPort := o.initStreamTarget(t, "http")
+
+	t.http2 = NewHTTP2Client(hostPort, t.http2Scheme == "https", o.config.Timeout)
+	t.http2.tlsConfig = t.tlsConfig
+	t.http2.proxy = t.proxy
+	t.http2.resolver = o.resolver
+}
+
+// initStreamTarget sets scheme, host and authorization sent with HTTP/2 and HTTP/3 requests, and returns `host:port` of target
+func (o *HTTPOutput) initStreamTarget(t *httpTarget, defaultScheme string) string {
+	address := t.address
+	if !strings.HasPrefix(address, "http") {
+		address = defaultScheme + "://" + address
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		log.Fatal("[OUTPUT-HTTP] Wrong address: ", t.address)
+	}
+
+	t.http2Scheme = u.Scheme
+	t.http2Host = u.Host
+
+	if u.User != nil {
+		t.http2Auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.String()))
+	}
+
+	hostPort := u.Host
+	if u.Port() == "" {
+		hostPort += ":" + defaultPorts[u.Scheme]
+	}
+
+	if o.config.Timeout == 0 {
+		o.config.Timeout = time.Second
+	}
+
+	if o.config.BufferSize == 0 {
+		o.config.BufferSize = 100 * 1024 // 100kb
+	}
+
+	return hostPort
+}
+
+// sendStream converts captured HTTP/1.1 request to HTTP/2 or HTTP/3 stream, and returns response converted back to HTTP/1.1.
+// Like HTTPClient, it returns error payload if request failed, and truncates response to buffer size.
+func (o *HTTPOutput) sendStream(t *httpTarget, request []byte) ([]byte, error) {
+	headers := http2RequestHeaders(request, t.http2Scheme, t.http2Host, o.config.OriginalHost)
+
+	if t.http2Auth != "" {
+		for i := 0; i < len(headers); i++ {
+			if headers[i].Name == "authorization" {
+				headers = append(headers[:i], headers[i+1:]...)
+				i--
+			}
+		}
+		headers = append(headers, hpack.HeaderField{Name: "authorization", Value: t.http2Auth})
+	}
+
+	body := proto.Body(request)
+
+	// HTTP/2 and HTTP/3 have no chunked encoding, stream is delimited by frames
+	if bytes.EqualFold(proto.Header(request, []byte("Transfer-Encoding")), []byte("chunked")) {
+		dechunked, err := ioutil.ReadAll(httputil.NewChunkedReader(bytes.NewReader(body)))
+		if err != nil {
+			Debug("[OUTPUT-HTTP] Malformed chunked body:", err)
+		}
+		body = dechunked
+	}
+
+	var resp *HTTP2Response
+	var err error
+
+	if t.http3 != nil {
+		if o.config.Debug {
+			Debug("[OUTPUT-HTTP] Sending HTTP/3:", headers)
+		}
+		resp, err = t.http3.Send(headers, body)
+	} else {
+		if o.config.Debug {
+			Debug("[OUTPUT-HTTP] Sending HTTP/2:", headers)
+		}
+		resp, err = t.http2.Send(headers, body)
+	}
+
+	if err != nil {
+		if netErr, ok := err.(net.Error); err == errHTTP2Timeout || err == errHTTP3Timeout || ok && netErr.Timeout() {
+			return errorPayload(HTTP_TIMEOUT), err
+		}
+		return errorPayload(HTTP_CONNECTION_ERROR), err
+	}
+
+	payload := resp.HTTP1()
+	if len(payload) > o.config.BufferSize {
+		payload = payload[:o.config.BufferSize]
+	}
+
+	return payload, nil
+}
+
+// Close stops accepting requests, waits until workers send queued ones, and writes summary of assertions
+func (o *HTTPOutput) Close() error {
+	o.workersMu.Lock()
+	if o.closing {
+		o.workersMu.Unlock()
+		return nil
+	}
+	o.closing = true
+	o.workersMu.Unlock()
+
+	o.queue.Close()
+	for _, lane := range o.lanes {
+		lane.Close()
+	}
+	o.workers.Wait()
+
+	if o.assertions != nil {
+		return o.assertions.Close()
+	}
+
+	return nil
+}
+
 func (o *HTTPOutput) String() string {
 	return "HTTP output: " + o.address
 }
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/gor/proto"
+)
+
+// Recorded statuses not claimed by replayed response for this time are forgotten
+const recordedStatusExpire = time.Minute
+
+const (
+	assertStatusRecorded = iota
+	assertStatus
+	assertBody
+)
+
+// assertionRule is single expectation of replayed response, optionally limited to paths matching regexp:
+//
+//	status=recorded             status is the same as of recorded response
+//	status=2xx, status!=5xx     status matches or doesn't match pattern, `x` matches any digit
+//	body~regexp, body!~regexp   decoded body matches or doesn't match regexp
+type assertionRule struct {
+	rule   string
+	path   *regexp.Regexp
+	kind   int
+	negate bool
+	status string
+	body   *regexp.Regexp
+}
+
+// parseAssertionRule parses rule like `status!=5xx` or `^/api/ body~"ok":true`
+func parseAssertionRule(s string) (*assertionRule, error) {
+	r := &assertionRule{rule: s}
+
+	// Path is separated by first space, checks start with `status` or `body`, so body regexp can contain spaces
+	check := strings.TrimSpace(s)
+	if i := strings.Index(check, " "); i != -1 && !strings.HasPrefix(check, "status") && !strings.HasPrefix(check, "body") {
+		re, err := regexp.Compile(check[:i])
+		if err != nil {
+			return nil, fmt.Errorf("wrong path of rule %q: %v", s, err)
+		}
+		r.path, check = re, strings.TrimSpace(check[i+1:])
+	}
+
+	switch {
+	case check == "status=recorded":
+		r.kind = assertStatusRecorded
+	case strings.HasPrefix(check, "status!="), strings.HasPrefix(check, "status="):
+		r.kind = assertStatus
+		r.negate = strings.HasPrefix(check, "status!=")
+		r.status = strings.ToLower(check[strings.Index(check, "=")+1:])
+		if len(r.status) != 3 {
+			return nil, fmt.Errorf("status of rule %q should be 3 digits or x, like 2xx", s)
+		}
+	case strings.HasPrefix(check, "body!~"), strings.HasPrefix(check, "body~"):
+		r.kind = assertBody
+		r.negate = strings.HasPrefix(check, "body!~")
+		re, err := regexp.Compile(check[strings.Index(check, "~")+1:])
+		if err != nil {
+			return nil, fmt.Errorf("wrong body of rule %q: %v", s, err)
+		}
+		r.body = re
+	default:
+		return nil, fmt.Errorf("unknown rule %q, expected status=recorded, status=<code>, status!=<code>, body~<regexp> or body!~<regexp>", s)
+	}
+
+	return r, nil
+}
+
+// statusMatches checks status against pattern like `2xx`
+func statusMatches(status []byte, pattern string) bool {
+	if len(status) != len(pattern) {
+		return false
+	}
+
+	for i := range pattern {
+		if pattern[i] != 'x' && pattern[i] != status[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// check returns description of failure, or empty string if response satisfies rule
+func (r *assertionRule) check(resp []byte, recorded []byte) string {
+	status := proto.Status(resp)
+
+	switch r.kind {
+	case assertStatusRecorded:
+		if string(status) != string(recorded) {
+			return "status " + string(status) + " differs from recorded " + string(recorded)
+		}
+	case assertStatus:
+		if statusMatches(status, r.status) == r.negate {
+			return "unexpected status " + string(status)
+		}
+	case assertBody:
+		body := normalizeBody(resp, nil)
+		if r.body.Match(body) == r.negate {
+			if r.negate {
+				return "body matches " + r.body.String()
+			}
+			return "body doesn't match " + r.body.String()
+		}
+	}
+
+	return ""
+}
+
+// assertionFailure is single line of report
+type assertionFailure struct {
+	ID             string `json:"id"`
+	Request        string `json:"request"`
+	Rule           string `json:"rule"`
+	Status         string `json:"status"`
+	RecordedStatus string `json:"recorded_status,omitempty"`
+	Detail         string `json:"detail"`
+}
+
+// assertionSummary is written to report when output is closed
+type assertionSummary struct {
+	Summary bool             `json:"summary"`
+	Checked int64            `json:"checked"`
+	Failed  int64            `json:"failed"`
+	Rules   map[string]int64 `json:"failures_by_rule"`
+}
+
+// responseAssertions checks replayed responses against rules, and reports failures as JSON lines.
+// Recorded status is paired with replayed response by request id, and they can come in any order,
+// so replayed response waits for recorded one up to timeout. If it is not seen, `status=recorded` is skipped.
+type responseAssertions struct {
+	// Keep atomic counters first for 64bit alignment
+	checked int64
+	failed  int64
+
+	rules   []*assertionRule
+	timeout time.Duration
+	// Replayed responses wait for recorded statuses only if some rule needs them
+	needRecorded bool
+
+	mu       sync.Mutex
+	recorded map[string]recordedStatus
+	pending  map[string]pendingAssertion
+	byRule   map[string]int64
+	report   io.WriteCloser
+}
+
+type recordedStatus struct {
+	status []byte
+	added  time.Time
+}
+
+type pendingAssertion struct {
+	id      string
+	request string
+	path    []byte
+	resp    []byte
+	added   time.Time
+}
+
+func newResponseAssertions(rules []string, report string, timeout time.Duration) (*responseAssertions, error) {
+	a := &responseAssertions{
+		timeout:  timeout,
+		recorded: make(map[string]recordedStatus),
+		pending:  make(map[string]pendingAssertion),
+		byRule:   make(map[string]int64),
+	}
+
+	for _, s := range rules {
+		r, err := parseAssertionRule(s)
+		if err != nil {
+			return nil, err
+		}
+		a.rules = append(a.rules, r)
+		a.needRecorded = a.needRecorded || r.kind == assertStatusRecorded
+	}
+
+	if report == "" || report == "-" {
+		a.report = os.Stdout
+	} else {
+		f, err := os.OpenFile(report, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+		if err != nil {
+			return nil, err
+		}
+		a.report = f
+	}
+
+	if a.needRecorded {
+		go a.gc()
+	}
+
+	return a, nil
+}
+
+// original records status of original response
+func (a *responseAssertions) original(uuid []byte, status []byte) {
+	if !a.needRecorded {
+		return
+	}
+
+	a.mu.Lock()
+	p, ok := a.pending[string(uuid)]
+	if !ok {
+		a.recorded[string(uuid)] = recordedStatus{append([]byte(nil), status...), time.Now()}
+		a.mu.Unlock()
+		return
+	}
+	delete(a.pending, string(uuid))
+	a.mu.Unlock()
+
+	a.check(p, status)
+}
+
+// replayed checks response of replayed request, once recorded status is known
+func (a *responseAssertions) replayed(uuid []byte, request []byte, resp []byte) {
+	p := pendingAssertion{
+		id:      string(uuid),
+		request: string(proto.Method(request)) + " " + string(proto.Path(request)),
+		path:    append([]byte(nil), proto.Path(request)...),
+		resp:    resp,
+		added:   time.Now(),
+	}
+
+	if !a.needRecorded {
+		a.check(p, nil)
+		return
+	}
+
+	a.mu.Lock()
+	r, ok := a.recorded[p.id]
+	if !ok {
+		a.pending[p.id] = p
+		a.mu.Unlock()
+		return
+	}
+	delete(a.recorded, p.id)
+	a.mu.Unlock()
+
+	a.check(p, r.status)
+}
+
+// check evaluates rules, recorded status is nil if it is unknown
+func (a *responseAssertions) check(p pendingAssertion, recorded []byte) {
+	atomic.AddInt64(&a.checked, 1)
+
+	failed := false
+	for _, r := range a.rules {
+		if r.path != nil && !r.path.Match(p.path) {
+			continue
+		}
+
+		if r.kind == assertStatusRecorded && recorded == nil {
+			continue
+		}
+
+		detail := "no response"
+		if len(p.resp) > 0 {
+			if detail = r.check(p.resp, recorded); detail == "" {
+				continue
+			}
+		}
+
+		failed = true
+
+		line, _ := json.Marshal(assertionFailure{
+			ID:             p.id,
+			Request:        p.request,
+			Rule:           r.rule,
+			Status:         string(proto.Status(p.resp)),
+			RecordedStatus: string(recorded),
+			Detail:         detail,
+		})
+
+		a.mu.Lock()
+		a.byRule[r.rule]++
+		a.report.Write(append(line, '\n'))
+		a.mu.Unlock()
+	}
+
+	if failed {
+		atomic.AddInt64(&a.failed, 1)
+	}
+}
+
+// gc checks replayed responses, which recorded statuses were not seen in time
+func (a *responseAssertions) gc() {
+	for range time.Tick(time.Second) {
+		a.flush(a.timeout)
+	}
+}
+
+// flush checks replayed responses waiting longer than given time
+func (a *responseAssertions) flush(wait time.Duration) {
+	var expired []pendingAssertion
+	now := time.Now()
+
+	a.mu.Lock()
+	for id, p := range a.pending {
+		if now.Sub(p.added) >= wait {
+			expired = append(expired, p)
+			delete(a.pending, id)
+		}
+	}
+
+	for id, r := range a.recorded {
+		if now.Sub(r.added) > recordedStatusExpire {
+			delete(a.recorded, id)
+		}
+	}
+	a.mu.Unlock()
+
+	for _, p := range expired {
+		a.check(p, nil)
+	}
+}
+
+// Close checks responses still waiting for recorded status, and writes summary to report
+func (a *responseAssertions) Close() error {
+	a.flush(0)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	summary := assertionSummary{Summary: true, Checked: atomic.LoadInt64(&a.checked), Failed: atomic.LoadInt64(&a.failed), Rules: a.byRule}
+	line, _ := json.Marshal(summary)
+	a.report.Write(append(line, '\n'))
+
+	log.Printf("[OUTPUT-HTTP] Assertions: checked %d responses, %d failed", summary.Checked, summary.Failed)
+
+	if a.report != os.Stdout {
+		return a.report.Close()
+	}
+
+	return nil
+}
+
+// failedAssertions returns number of responses which failed assertions in all HTTP outputs
+func failedAssertions() (failed int64) {
+	for _, p := range Plugins.All {
+		if o, ok := p.(*HTTPOutput); ok && o.assertions != nil {
+			failed += atomic.LoadInt64(&o.assertions.failed)
+		}
+	}
+
+	return
+}
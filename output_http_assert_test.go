@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseAssertionRule(t *testing.T) {
+	testCases := []struct {
+		rule     string
+		resp     string
+		recorded string
+		failed   bool
+	}{
+		{"status!=5xx", "HTTP/1.1 200 OK\r\n\r\n", "", false},
+		{"status!=5xx", "HTTP/1.1 503 Service Unavailable\r\n\r\n", "", true},
+		{"status=2XX", "HTTP/1.1 204 No Content\r\n\r\n", "", false},
+		{"status=200", "HTTP/1.1 201 Created\r\n\r\n", "", true},
+		{"status=recorded", "HTTP/1.1 404 Not Found\r\n\r\n", "404", false},
+		{"status=recorded", "HTTP/1.1 200 OK\r\n\r\n", "404", true},
+		{`body~"ok":\s*true`, "HTTP/1.1 200 OK\r\nContent-Length: 12\r\n\r\n{\"ok\": true}", "", false},
+		// Body regexp can contain spaces
+		{"body!~internal error", "HTTP/1.1 200 OK\r\nContent-Length: 14\r\n\r\ninternal error", "", true},
+		{"^/api/ body~ok", "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nfail", "", true},
+	}
+
+	for _, tc := range testCases {
+		r, err := parseAssertionRule(tc.rule)
+		if err != nil {
+			t.Errorf("%q: %v", tc.rule, err)
+			continue
+		}
+
+		if detail := r.check([]byte(tc.resp), []byte(tc.recorded)); (detail != "") != tc.failed {
+			t.Errorf("%q: expected failed %t, got %q", tc.rule, tc.failed, detail)
+		}
+	}
+
+	for _, rule := range []string{"status=20", "latency<1s", "^/api/ body~(", "( status=200"} {
+		if _, err := parseAssertionRule(rule); err == nil {
+			t.Errorf("%q should be invalid", rule)
+		}
+	}
+}
+
+func TestHTTPOutputAssertions(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+
+		switch r.URL.Path {
+		case "/api/fail":
+			w.WriteHeader(500)
+		case "/api/missing":
+			w.WriteHeader(404)
+		default:
+			// JSON body is matched in compact form
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"ok": true}`))
+		}
+	}))
+	defer server.Close()
+
+	f, _ := ioutil.TempFile("", "assertions")
+	f.Close()
+	defer os.Remove(f.Name())
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{
+		Timeout:      time.Second,
+		workers:      1,
+		assertions:   MultiOption{"status!=5xx", "status=recorded", "^/api/ok body~\"ok\":true"},
+		assertReport: f.Name(),
+	})
+
+	// Recorded response can come before or after replayed one
+	output.Write([]byte("2 2 1 1\nHTTP/1.1 200 OK\r\n\r\n"))
+	output.Write([]byte("1 1 1\nGET /api/ok HTTP/1.1\r\n\r\n"))
+	output.Write([]byte("1 2 1\nGET /api/missing HTTP/1.1\r\n\r\n"))
+	output.Write([]byte("1 3 1\nGET /api/fail HTTP/1.1\r\n\r\n"))
+
+	for i := 0; atomic.LoadInt64(&requests) < 3 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	output.Write([]byte("2 3 1 1\nHTTP/1.1 500 Internal Server Error\r\n\r\n"))
+	output.(*HTTPOutput).Close()
+
+	report, _ := os.Open(f.Name())
+	defer report.Close()
+
+	var failures []assertionFailure
+	var summary assertionSummary
+	scanner := bufio.NewScanner(report)
+	for scanner.Scan() {
+		if json.Unmarshal(scanner.Bytes(), &summary); summary.Summary {
+			break
+		}
+
+		var failure assertionFailure
+		json.Unmarshal(scanner.Bytes(), &failure)
+		failures = append(failures, failure)
+	}
+
+	// Missing page differs from recorded status, failed page is 5xx but matches recorded one
+	if len(failures) != 2 ||
+		failures[0].ID != "2" || failures[0].Rule != "status=recorded" || failures[0].RecordedStatus != "200" ||
+		failures[1].ID != "3" || failures[1].Rule != "status!=5xx" {
+		t.Errorf("Unexpected failures: %+v", failures)
+	}
+
+	if summary.Checked != 3 || summary.Failed != 2 || summary.Rules["status!=5xx"] != 1 {
+		t.Errorf("Unexpected summary: %+v", summary)
+	}
+}
+
+func TestHTTPOutputAssertionsCloseDrainsQueue(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.WriteHeader(500)
+	}))
+	defer server.Close()
+
+	f, _ := ioutil.TempFile("", "assertions")
+	f.Close()
+	defer os.Remove(f.Name())
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{
+		Timeout:      time.Second,
+		workers:      1,
+		assertions:   MultiOption{"status!=5xx"},
+		assertReport: f.Name(),
+	}).(*HTTPOutput)
+
+	// Input finishes while requests are still queued
+	for i := 0; i < 10; i++ {
+		output.Write([]byte(fmt.Sprintf("1 %d 1\nGET /api HTTP/1.1\r\n\r\n", i)))
+	}
+	output.Close()
+
+	if checked, failed := atomic.LoadInt64(&output.assertions.checked), atomic.LoadInt64(&output.assertions.failed); checked != 10 || failed != 10 {
+		t.Error("Queued requests should be checked before summary:", checked, failed)
+	}
+
+	// Writes after close are ignored
+	output.Write([]byte("1 11 1\nGET /api HTTP/1.1\r\n\r\n"))
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Interval of autoscaling decisions
+const autoscaleInterval = 100 * time.Millisecond
+
+// autoscale grows dynamic worker pool, when requests wait in queue. Without target latency pool grows by queue length,
+// once queue is longer than number of workers. With target latency, expected wait in queue is estimated from
+// throughput, and pool grows proportionally, until wait is within target. Idle workers stop themselves.
+func (o *HTTPOutput) autoscale() {
+	var lastCompleted int64
+
+	for range time.Tick(autoscaleInterval) {
+		o.workersMu.Lock()
+		closing := o.closing
+		o.workersMu.Unlock()
+
+		if closing {
+			return
+		}
+
+		completed := atomic.LoadInt64(&o.completedRequests)
+		throughput := float64(completed-lastCompleted) / autoscaleInterval.Seconds()
+		lastCompleted = completed
+
+		queued := o.queue.Len()
+		workers := int(atomic.LoadInt64(&o.activeWorkers))
+
+		if queued == 0 {
+			continue
+		}
+
+		need := 0
+
+		if o.config.targetLatency > 0 {
+			if throughput == 0 {
+				// Nothing finished yet, so wait can't be estimated
+				need = queued - workers
+			} else {
+				// Little's law: wait in queue is its length divided by throughput
+				wait := time.Duration(float64(queued) / throughput * float64(time.Second))
+				if wait > o.config.targetLatency {
+					need = int(math.Ceil(float64(workers) * (float64(wait)/float64(o.config.targetLatency) - 1)))
+				}
+			}
+		} else if queued > workers {
+			need = queued
+		}
+
+		if need > 0 {
+			if added := o.addWorkers(need); added > 0 {
+				Debug("[OUTPUT-HTTP] Scaled up by", added, "workers, queue:", queued, "throughput:", int(throughput))
+			}
+		}
+	}
+}
+
+// addWorkers starts up to n workers, within maximum number of workers and connections. Returns number of started workers.
+// Workers are not started once output is closing.
+func (o *HTTPOutput) addWorkers(n int) int {
+	o.workersMu.Lock()
+	defer o.workersMu.Unlock()
+
+	if o.closing {
+		return 0
+	}
+
+	limit := o.config.workersMax
+	if o.config.maxConns > 0 && (limit == 0 || o.config.maxConns < limit) {
+		limit = o.config.maxConns
+	}
+
+	if limit > 0 {
+		if free := limit - int(atomic.LoadInt64(&o.activeWorkers)); n > free {
+			n = free
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		// Sticky workers are started at once, each with its lane
+		var lane *payloadQueue
+		if i < len(o.lanes) {
+			lane = o.lanes[i]
+		}
+
+		atomic.AddInt64(&o.activeWorkers, 1)
+		o.workers.Add(1)
+		go func() {
+			defer o.workers.Done()
+			o.startWorker(lane)
+		}()
+	}
+
+	if n > 0 && o.config.workers == 0 {
+		atomic.AddInt64(&o.scaledUp, int64(n))
+	}
+
+	return n
+}
+
+// removeWorker is called by idle worker of dynamic pool, and returns true if it should stop, keeping minimum number of workers
+func (o *HTTPOutput) removeWorker() bool {
+	min := int64(o.config.workersMin)
+	if min < 1 {
+		min = 1
+	}
+
+	for {
+		workers := atomic.LoadInt64(&o.activeWorkers)
+		if workers <= min {
+			return false
+		}
+
+		if atomic.CompareAndSwapInt64(&o.activeWorkers, workers, workers-1) {
+			atomic.AddInt64(&o.scaledDown, 1)
+			return true
+		}
+	}
+}
+
+func (o *HTTPOutput) reportWorkerStats() {
+	for {
+		time.Sleep(rate * time.Second)
+
+		log.Printf("[OUTPUT-HTTP] Workers '%s': active: %d, scaled up: %d, scaled down: %d, queue: %d, dropped: %d\n", o.address, atomic.LoadInt64(&o.activeWorkers), atomic.LoadInt64(&o.scaledUp), atomic.LoadInt64(&o.scaledDown), o.queue.Len(), o.queue.Dropped())
+	}
+}
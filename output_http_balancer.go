@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"hash/fnv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/buger/gor/proto"
+)
+
+// Strategies of balancing requests between targets of HTTP output
+const (
+	balanceRoundRobin = iota
+	balanceLeastPending
+	balanceHashIP
+	balanceHashHeader
+	balanceHashCookie
+)
+
+// parseBalanceStrategy parses `round-robin`, `least-pending`, `hash-ip`, `hash-header:<name>` or `hash-cookie:<name>`
+func parseBalanceStrategy(s string) (strategy int, name string, err error) {
+	switch {
+	case s == "" || s == "round-robin":
+		return balanceRoundRobin, "", nil
+	case s == "least-pending":
+		return balanceLeastPending, "", nil
+	case s == "hash-ip":
+		return balanceHashIP, "", nil
+	case strings.HasPrefix(s, "hash-header:") && len(s) > len("hash-header:"):
+		return balanceHashHeader, s[len("hash-header:"):], nil
+	case strings.HasPrefix(s, "hash-cookie:") && len(s) > len("hash-cookie:"):
+		return balanceHashCookie, s[len("hash-cookie:"):], nil
+	}
+
+	return 0, "", errors.New("Unknown balancing strategy: " + s)
+}
+
+// clientIP returns address of client which sent request, from header added by --input-raw-realip-header,
+// or by proxy in front of application
+func clientIP(request []byte) []byte {
+	for _, name := range []string{Settings.inputRAWRealIPHeader, "X-Real-IP", "X-Forwarded-For"} {
+		if name == "" {
+			continue
+		}
+
+		if value := proto.Header(request, []byte(name)); len(value) > 0 {
+			// First address in the list is original client
+			if idx := strings.IndexByte(string(value), ','); idx != -1 {
+				value = value[:idx]
+			}
+			return []byte(strings.TrimSpace(string(value)))
+		}
+	}
+
+	return nil
+}
+
+// requestCookie returns value of cookie with given name
+func requestCookie(request []byte, name string) []byte {
+	for _, cookie := range bytes.Split(proto.Header(request, []byte("Cookie")), []byte(";")) {
+		cookie = bytes.TrimSpace(cookie)
+		if len(cookie) > len(name) && cookie[len(name)] == '=' && string(cookie[:len(name)]) == name {
+			return cookie[len(name)+1:]
+		}
+	}
+
+	return nil
+}
+
+// sessionKey returns key of hash balancing strategies: client IP, header or cookie value. Requests with the same key
+// belong to the same session, and are sent to the same target.
+func (o *HTTPOutput) sessionKey(request []byte) []byte {
+	switch o.balance {
+	case balanceHashIP:
+		return clientIP(request)
+	case balanceHashHeader:
+		return proto.Header(request, []byte(o.balanceName))
+	case balanceHashCookie:
+		return requestCookie(request, o.balanceName)
+	}
+
+	return nil
+}
+
+// pickTarget returns index of target for request. Requests without hash key are balanced using round-robin.
+func (o *HTTPOutput) pickTarget(request []byte) int {
+	if len(o.targets) == 1 {
+		return 0
+	}
+
+	if o.balance == balanceLeastPending {
+		best := 0
+		for i, t := range o.targets {
+			if atomic.LoadInt64(&t.pending) < atomic.LoadInt64(&o.targets[best].pending) {
+				best = i
+			}
+		}
+		return best
+	}
+
+	if key := o.sessionKey(request); len(key) > 0 {
+		return o.hashTarget(key)
+	}
+
+	return int(uint64(atomic.AddInt64(&o.nextTarget, 1)-1) % uint64(len(o.targets)))
+}
+
+// hashTarget chooses target using rendezvous hashing: target with the highest hash of key and address wins.
+// Adding or removing target moves only keys, which belong to it.
+func (o *HTTPOutput) hashTarget(key []byte) int {
+	best := 0
+	var bestScore uint32
+
+	for i, t := range o.targets {
+		h := fnv.New32a()
+		h.Write([]byte(t.address))
+		h.Write(key)
+
+		if score := h.Sum32(); i == 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+
+	return best
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPOutputBalance(t *testing.T) {
+	var counts [2]int64
+
+	var servers []*httptest.Server
+	for i := range counts {
+		i := i
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			atomic.AddInt64(&counts[i], 1)
+		}))
+		defer server.Close()
+		servers = append(servers, server)
+	}
+
+	address := servers[0].URL + "," + servers[1].URL
+
+	for balance, expected := range map[string][2]int64{
+		"round-robin":        {5, 5},
+		"hash-header:X-User": {10, 0},
+		"hash-ip":            {10, 0},
+		"hash-cookie:sid":    {10, 0},
+		"least-pending":      {10, 0},
+	} {
+		counts = [2]int64{}
+
+		output := NewHTTPOutput(address, &HTTPOutputConfig{Timeout: time.Second, TrackResponses: true, workers: 1, balance: balance})
+		o := output.(*HTTPOutput)
+
+		// Make sure that hashed requests go to the first server
+		key := "1"
+		for o.hashTarget([]byte(key)) != 0 {
+			key += "1"
+		}
+
+		data := make([]byte, 1024)
+		for i := 0; i < 10; i++ {
+			output.Write([]byte("1 a 1\nGET / HTTP/1.1\r\nX-User: " + key + "\r\nX-Forwarded-For: " + key + ", 10.0.0.1\r\nCookie: a=1; sid=" + key + "\r\n\r\n"))
+			o.Read(data)
+		}
+
+		if counts != expected {
+			t.Error(balance, "Wrong distribution", counts)
+		}
+	}
+}
+
+func TestHTTPOutputLeastPending(t *testing.T) {
+	o := &HTTPOutput{targets: []*httpTarget{{pending: 2}, {pending: 1}, {pending: 3}}, balance: balanceLeastPending}
+
+	if i := o.pickTarget([]byte("GET / HTTP/1.1\r\n\r\n")); i != 1 {
+		t.Error("Should pick target with fewest pending requests", i)
+	}
+}
+
+func TestHTTPOutputStickyWorkers(t *testing.T) {
+	var mu sync.Mutex
+	// Connections and order of requests by session
+	conns := make(map[string]map[string]bool)
+	order := make(map[string][]string)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		session := req.Header.Get("X-Session")
+
+		mu.Lock()
+		if conns[session] == nil {
+			conns[session] = make(map[string]bool)
+		}
+		conns[session][req.RemoteAddr] = true
+		order[session] = append(order[session], req.URL.Path)
+		mu.Unlock()
+
+		// Requests of other sessions are sent meanwhile
+		time.Sleep(time.Millisecond)
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{Timeout: time.Second, workers: 4, balance: "hash-header:X-Session", stickyWorkers: true})
+	o := output.(*HTTPOutput)
+
+	for i := 0; i < 10; i++ {
+		for _, session := range []string{"a", "b", "c", "d", "e"} {
+			output.Write([]byte("1 " + session + strconv.Itoa(i) + " 1\nGET /" + strconv.Itoa(i) + " HTTP/1.1\r\nX-Session: " + session + "\r\n\r\n"))
+		}
+	}
+
+	for i := 0; i < 200 && atomic.LoadInt64(&o.completedRequests) < 50; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for session, paths := range order {
+		if len(conns[session]) != 1 {
+			t.Error(session, "Requests of session should be sent over single connection", conns[session])
+		}
+
+		for i, path := range paths {
+			if path != "/"+strconv.Itoa(i) {
+				t.Error(session, "Requests should be sent in recorded order", paths)
+				break
+			}
+		}
+	}
+
+	if len(order) != 5 {
+		t.Error("All sessions should be replayed", len(order))
+	}
+}
+
+func TestRequestCookie(t *testing.T) {
+	request := []byte("GET / HTTP/1.1\r\nCookie: xsid=1; sid=abc;theme=dark\r\n\r\n")
+
+	if v := requestCookie(request, "sid"); string(v) != "abc" {
+		t.Error("Wrong cookie", string(v))
+	}
+
+	if v := requestCookie(request, "theme"); string(v) != "dark" {
+		t.Error("Wrong cookie", string(v))
+	}
+
+	if v := requestCookie(request, "lang"); v != nil {
+		t.Error("Missing cookie should be nil", string(v))
+	}
+}
+
+func TestParseBalanceStrategy(t *testing.T) {
+	if strategy, header, err := parseBalanceStrategy("hash-header:X-User-Id"); err != nil || strategy != balanceHashHeader || header != "X-User-Id" {
+		t.Error("Wrong strategy", strategy, header, err)
+	}
+
+	for _, s := range []string{"random", "hash-header:"} {
+		if _, _, err := parseBalanceStrategy(s); err == nil {
+			t.Error("Should reject", s)
+		}
+	}
+}
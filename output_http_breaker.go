@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/buger/gor/proto"
+)
+
+// Circuit breaker states
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker stops replaying to destination when its error rate is too high, so it can recover.
+// After cool-down period single probe request is sent: if it succeeds breaker closes, otherwise it opens again.
+type circuitBreaker struct {
+	mu sync.Mutex
+
+	name string
+	// Error rate, from 0 to 1, which opens breaker
+	errorRate   float64
+	minRequests int
+	window      time.Duration
+	cooldown    time.Duration
+
+	state       int
+	windowStart time.Time
+	requests    int
+	errors      int
+	openedAt    time.Time
+	probing     bool
+	// Requests dropped since breaker opened
+	dropped int
+}
+
+// requestFailed checks if request failed with connection error, timeout or server error status
+func requestFailed(resp []byte, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	status := proto.Status(resp)
+	return len(status) == 3 && status[0] == '5'
+}
+
+func newCircuitBreaker(name string, errorRate float64, minRequests int, window, cooldown time.Duration) *circuitBreaker {
+	if window == 0 {
+		window = 10 * time.Second
+	}
+
+	if cooldown == 0 {
+		cooldown = 30 * time.Second
+	}
+
+	return &circuitBreaker{
+		name:        name,
+		errorRate:   errorRate,
+		minRequests: minRequests,
+		window:      window,
+		cooldown:    cooldown,
+		windowStart: time.Now(),
+	}
+}
+
+// Allow checks if request can be sent. Requests are dropped while breaker is open, and while probe request is in flight.
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			b.dropped++
+			return false
+		}
+
+		b.state = breakerHalfOpen
+		b.probing = false
+		log.Printf("[OUTPUT-HTTP] Circuit breaker '%s' half-open, sending probe request\n", b.name)
+
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			b.dropped++
+			return false
+		}
+
+		b.probing = true
+	}
+
+	return true
+}
+
+// Report records result of request allowed by breaker
+func (b *circuitBreaker) Report(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		if failed {
+			b.open("probe request failed")
+		} else {
+			log.Printf("[OUTPUT-HTTP] Circuit breaker '%s' closed, %d requests were dropped\n", b.name, b.dropped)
+			b.state = breakerClosed
+			b.dropped = 0
+			b.resetWindow()
+		}
+
+		return
+	}
+
+	if b.state != breakerClosed {
+		return
+	}
+
+	if time.Since(b.windowStart) > b.window {
+		b.resetWindow()
+	}
+
+	b.requests++
+	if failed {
+		b.errors++
+	}
+
+	if b.requests >= b.minRequests && float64(b.errors) >= b.errorRate*float64(b.requests) {
+		b.open(fmt.Sprintf("%d of %d requests failed", b.errors, b.requests))
+	}
+}
+
+func (b *circuitBreaker) open(reason string) {
+	log.Printf("[OUTPUT-HTTP] Circuit breaker '%s' opened for %s: %s\n", b.name, b.cooldown, reason)
+
+	b.state = breakerOpen
+	b.openedAt = time.Now()
+	b.probing = false
+}
+
+func (b *circuitBreaker) resetWindow() {
+	b.windowStart = time.Now()
+	b.requests = 0
+	b.errors = 0
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker("test", 0.5, 4, time.Minute, 50*time.Millisecond)
+
+	for _, failed := range []bool{true, false, true} {
+		if !b.Allow() {
+			t.Fatal("Should allow requests while closed")
+		}
+		b.Report(failed)
+	}
+
+	// 3 of 4 requests failed
+	b.Allow()
+	b.Report(true)
+
+	if b.Allow() {
+		t.Error("Should drop requests while open")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if !b.Allow() {
+		t.Fatal("Should allow probe request after cool-down")
+	}
+	if b.Allow() {
+		t.Error("Should allow only single probe request")
+	}
+
+	b.Report(true)
+	if b.Allow() {
+		t.Error("Failed probe should open breaker again")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	b.Allow()
+	b.Report(false)
+	if !b.Allow() || b.state != breakerClosed {
+		t.Error("Successful probe should close breaker")
+	}
+}
+
+func TestHTTPOutputCircuitBreaker(t *testing.T) {
+	var requests int64
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{Timeout: time.Second, workers: 1, breakerErrorRate: 50, breakerMinRequests: 5, breakerCooldown: time.Minute})
+
+	for i := 0; i < 20; i++ {
+		output.Write([]byte("1 a 1\nGET / HTTP/1.1\r\n\r\n"))
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if n := atomic.LoadInt64(&requests); n != 5 {
+		t.Error("Should stop replaying when breaker opens", n)
+	}
+}
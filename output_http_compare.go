@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/gor/proto"
+)
+
+// Bodies are compared up to this size
+const compareResponseBufferSize = 1024 * 1024
+
+// Body mismatch is reported with this much context around the first difference
+const compareDiffContext = 64
+
+// HTTPCompareOutputConfig struct for holding compare output configuration
+type HTTPCompareOutputConfig struct {
+	Timeout      time.Duration
+	OriginalHost bool
+
+	workers int
+	// Response headers which are compared, other headers are ignored
+	headers MultiOption
+	// Regular expressions, matches are removed from bodies before comparing
+	ignore MultiOption
+	// File where mismatches are written as JSON lines, by default stdout
+	report string
+	// Requests waiting for workers, and what to do when queue is full. By default newest requests are dropped,
+	// so slow targets don't slow down other outputs.
+	maxQueue    int
+	queuePolicy string
+}
+
+// HTTPCompareOutput sends each request to two targets, like current and candidate build, and compares their responses:
+// status, allowed headers and normalized body. Mismatches are written to report.
+type HTTPCompareOutput struct {
+	// Keep atomic counters first for 64bit alignment
+	compared   int64
+	mismatched int64
+
+	address string
+	targets [2]string
+	config  *HTTPCompareOutputConfig
+	ignore  []*regexp.Regexp
+	queue   *payloadQueue
+
+	mu     sync.Mutex
+	report io.WriteCloser
+}
+
+// compareMismatch is single line of report
+type compareMismatch struct {
+	ID      string        `json:"id"`
+	Request string        `json:"request"`
+	Diffs   []compareDiff `json:"diffs"`
+}
+
+// compareDiff is difference of single field: `status`, `header:<name>` or `body`
+type compareDiff struct {
+	Field string `json:"field"`
+	A     string `json:"a"`
+	B     string `json:"b"`
+}
+
+// NewHTTPCompareOutput constructor for HTTPCompareOutput, address is pair of comma separated targets
+func NewHTTPCompareOutput(address string, config *HTTPCompareOutputConfig) io.Writer {
+	o := new(HTTPCompareOutput)
+
+	o.address = address
+	o.config = config
+
+	targets := strings.Split(address, ",")
+	if len(targets) != 2 {
+		log.Fatal("[OUTPUT-HTTP-COMPARE] Two comma separated targets expected: ", address)
+	}
+	o.targets = [2]string{strings.TrimSpace(targets[0]), strings.TrimSpace(targets[1])}
+
+	for _, expr := range config.ignore {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			log.Fatal("[OUTPUT-HTTP-COMPARE] Wrong ignore expression: ", err)
+		}
+		o.ignore = append(o.ignore, re)
+	}
+
+	if len(o.config.headers) == 0 {
+		o.config.headers = MultiOption{"Content-Type"}
+	}
+
+	if o.config.report == "" || o.config.report == "-" {
+		o.report = os.Stdout
+	} else {
+		f, err := os.OpenFile(o.config.report, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+		if err != nil {
+			log.Fatal("[OUTPUT-HTTP-COMPARE] Can't open report: ", err)
+		}
+		o.report = f
+	}
+
+	if o.config.workers == 0 {
+		o.config.workers = 10
+	}
+
+	if o.config.maxQueue == 0 {
+		o.config.maxQueue = 1000
+	}
+
+	if o.config.queuePolicy == "" {
+		o.config.queuePolicy = queueDropNewest
+	}
+
+	var err error
+	if o.queue, err = newPayloadQueue("OUTPUT-HTTP-COMPARE", o.config.maxQueue, o.config.queuePolicy); err != nil {
+		log.Fatal("[OUTPUT-HTTP-COMPARE] ", err)
+	}
+
+	for i := 0; i < o.config.workers; i++ {
+		go o.startWorker()
+	}
+
+	return o
+}
+
+func (o *HTTPCompareOutput) newClient(address string) *HTTPClient {
+	return NewHTTPClient(address, &HTTPClientConfig{
+		OriginalHost:       o.config.OriginalHost,
+		Timeout:            o.config.Timeout,
+		ResponseBufferSize: compareResponseBufferSize,
+	})
+}
+
+func (o *HTTPCompareOutput) startWorker() {
+	clients := [2]*HTTPClient{o.newClient(o.targets[0]), o.newClient(o.targets[1])}
+
+	for data := range o.queue.ch {
+		var responses [2][]byte
+		var wg sync.WaitGroup
+
+		request := payloadBody(data)
+
+		for i, client := range clients {
+			wg.Add(1)
+			go func(i int, client *HTTPClient) {
+				defer wg.Done()
+				// Response buffer of client is reused by next request
+				resp, _ := client.Send(request)
+				responses[i] = append([]byte(nil), resp...)
+			}(i, client)
+		}
+		wg.Wait()
+
+		diffs := compareResponses(responses[0], responses[1], o.config.headers, o.ignore)
+		if len(diffs) == 0 {
+			atomic.AddInt64(&o.compared, 1)
+			continue
+		}
+
+		var id string
+		if meta := payloadMeta(data); len(meta) > 1 {
+			id = string(meta[1])
+		}
+
+		line, _ := json.Marshal(compareMismatch{
+			ID:      id,
+			Request: string(proto.Method(request)) + " " + string(proto.Path(request)),
+			Diffs:   diffs,
+		})
+
+		o.mu.Lock()
+		o.report.Write(append(line, '\n'))
+		o.mu.Unlock()
+
+		atomic.AddInt64(&o.mismatched, 1)
+		atomic.AddInt64(&o.compared, 1)
+	}
+}
+
+// compareResponses returns differences of status, given headers and normalized bodies
+func compareResponses(a, b []byte, headers []string, ignore []*regexp.Regexp) (diffs []compareDiff) {
+	if status := [2]string{string(proto.Status(a)), string(proto.Status(b))}; status[0] != status[1] {
+		diffs = append(diffs, compareDiff{"status", status[0], status[1]})
+	}
+
+	for _, name := range headers {
+		if value := [2]string{string(proto.Header(a, []byte(name))), string(proto.Header(b, []byte(name)))}; value[0] != value[1] {
+			diffs = append(diffs, compareDiff{"header:" + name, value[0], value[1]})
+		}
+	}
+
+	bodyA, bodyB := normalizeBody(a, ignore), normalizeBody(b, ignore)
+	if !bytes.Equal(bodyA, bodyB) {
+		i := 0
+		for i < len(bodyA) && i < len(bodyB) && bodyA[i] == bodyB[i] {
+			i++
+		}
+
+		diffs = append(diffs, compareDiff{"body", diffSnippet(bodyA, i), diffSnippet(bodyB, i)})
+	}
+
+	return
+}
+
+// diffSnippet returns part of body around given position, with its offset
+func diffSnippet(body []byte, pos int) string {
+	start := pos - compareDiffContext
+	if start < 0 {
+		start = 0
+	}
+
+	end := pos + compareDiffContext
+	if end > len(body) {
+		end = len(body)
+	}
+
+	return "@" + strconv.Itoa(pos) + ": " + string(body[start:end])
+}
+
+// normalizeBody decodes chunked and gzipped body, formats JSON with sorted keys, and removes ignored parts
+func normalizeBody(payload []byte, ignore []*regexp.Regexp) []byte {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(payload)), nil)
+	if err != nil {
+		return proto.Body(payload)
+	}
+
+	// Body can be truncated by response buffer, so read errors are ignored
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		if r, err := gzip.NewReader(bytes.NewReader(body)); err == nil {
+			body, _ = ioutil.ReadAll(r)
+		}
+	}
+
+	// Numbers are kept as written, so big integers, like ids, are not rounded to float64
+	if strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		var v interface{}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err == nil {
+			if _, err = dec.Token(); err == io.EOF {
+				body, _ = json.Marshal(v)
+			}
+		}
+	}
+
+	for _, re := range ignore {
+		body = re.ReplaceAll(body, nil)
+	}
+
+	return body
+}
+
+func (o *HTTPCompareOutput) Write(data []byte) (n int, err error) {
+	if !isRequestPayload(data) {
+		return len(data), nil
+	}
+
+	o.queue.Push(data)
+
+	return len(data), nil
+}
+
+// Close reports count of compared and mismatched requests
+func (o *HTTPCompareOutput) Close() error {
+	o.queue.Close()
+	log.Printf("[OUTPUT-HTTP-COMPARE] Compared %d requests, %d mismatched", atomic.LoadInt64(&o.compared), atomic.LoadInt64(&o.mismatched))
+
+	if o.report != os.Stdout {
+		return o.report.Close()
+	}
+
+	return nil
+}
+
+func (o *HTTPCompareOutput) String() string {
+	return "HTTP compare output: " + o.address
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPCompareOutput(t *testing.T) {
+	current := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": 1, "name": "a", "time": 1000}`))
+	}))
+	defer current.Close()
+
+	candidate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if req.URL.Path == "/changed" {
+			w.WriteHeader(500)
+		}
+		w.Write([]byte(`{"time":2000,"name":"a","id":1}`))
+	}))
+	defer candidate.Close()
+
+	dir, _ := ioutil.TempDir("", "gor_compare")
+	defer os.RemoveAll(dir)
+	report := filepath.Join(dir, "report.jsonl")
+
+	output := NewHTTPCompareOutput(current.URL+","+candidate.URL, &HTTPCompareOutputConfig{
+		Timeout: time.Second,
+		workers: 1,
+		ignore:  MultiOption{`"time":\d+`},
+		report:  report,
+	})
+
+	output.Write([]byte("1 1 1\nGET /same HTTP/1.1\r\n\r\n"))
+	output.Write([]byte("1 2 1\nGET /changed HTTP/1.1\r\n\r\n"))
+
+	o := output.(*HTTPCompareOutput)
+	for i := 0; i < 100 && atomic.LoadInt64(&o.compared) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	o.Close()
+
+	data, _ := ioutil.ReadFile(report)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected single mismatch: %q", data)
+	}
+
+	var mismatch compareMismatch
+	json.Unmarshal([]byte(lines[0]), &mismatch)
+
+	if mismatch.ID != "2" || mismatch.Request != "GET /changed" || len(mismatch.Diffs) != 1 || mismatch.Diffs[0].B != "500" {
+		t.Error("Wrong mismatch", lines[0])
+	}
+}
+
+func TestCompareResponses(t *testing.T) {
+	a := []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n")
+	b := []byte("HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Length: 5\r\n\r\nhallo")
+
+	diffs := compareResponses(a, b, []string{"Content-Type"}, nil)
+	if len(diffs) != 2 || diffs[0].Field != "header:Content-Type" || diffs[1].Field != "body" || diffs[1].A != "@1: hello" {
+		t.Error("Wrong diffs", diffs)
+	}
+
+	if diffs = compareResponses(a, b, nil, []*regexp.Regexp{regexp.MustCompile("h[ae]llo")}); len(diffs) != 0 {
+		t.Error("Ignored body parts should not be compared", diffs)
+	}
+
+	// Integers above 2^53 differ, while their float64 values are equal
+	a = []byte("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 27\r\n\r\n{\"id\": 12345678901234567890}")
+	b = []byte("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 26\r\n\r\n{\"id\":12345678901234567891}")
+	if diffs = compareResponses(a, b, nil, nil); len(diffs) != 1 || diffs[0].Field != "body" {
+		t.Error("Big numbers should be compared exactly", diffs)
+	}
+}
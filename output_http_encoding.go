@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http/httputil"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/buger/gor/proto"
+)
+
+const (
+	// Request bodies are sent exactly as captured, with original Content-Encoding and framing
+	bodyEncodingPreserve = "preserve"
+	// Request bodies which are not encoded yet are compressed with gzip
+	bodyEncodingGzip = "gzip"
+)
+
+func validBodyEncoding(encoding string) bool {
+	return encoding == "" || encoding == bodyEncodingPreserve || encoding == bodyEncodingGzip
+}
+
+// targetBodyEncoding returns body encoding of target address. Host encodings are set as '<host>=<encoding>',
+// host can contain wildcards. First matching host wins, otherwise default encoding is used.
+func targetBodyEncoding(address string, defaultEncoding string, hostEncodings []string) (string, error) {
+	host, _ := addressHost(address)
+	encoding := defaultEncoding
+	matched := false
+
+	for _, option := range hostEncodings {
+		idx := strings.IndexByte(option, '=')
+		if idx <= 0 {
+			return "", errors.New("host body encoding should be set as '<host>=<encoding>': " + option)
+		}
+
+		pattern, hostEncoding := strings.ToLower(option[:idx]), option[idx+1:]
+		if _, err := path.Match(pattern, ""); err != nil {
+			return "", errors.New("wrong host pattern: " + pattern)
+		}
+		if !validBodyEncoding(hostEncoding) {
+			return "", errors.New("body encoding should be preserve or gzip, got: " + hostEncoding)
+		}
+
+		if ok, _ := path.Match(pattern, host); ok && !matched {
+			encoding, matched = hostEncoding, true
+		}
+	}
+
+	return encoding, nil
+}
+
+// gzipRequestBody compresses body of request and sets Content-Encoding and Content-Length headers to match it.
+// Requests without body, or with body which already has Content-Encoding, are returned unchanged.
+// Chunked bodies are decoded first, and sent with Content-Length, so their trailers are dropped.
+func gzipRequestBody(request []byte) ([]byte, error) {
+	body := proto.Body(request)
+	if len(body) == 0 || len(proto.Header(request, []byte("Content-Encoding"))) > 0 {
+		return request, nil
+	}
+
+	if bytes.EqualFold(proto.Header(request, []byte("Transfer-Encoding")), []byte("chunked")) {
+		dechunked, err := ioutil.ReadAll(httputil.NewChunkedReader(bytes.NewReader(body)))
+		if err != nil {
+			return request, fmt.Errorf("malformed chunked body: %v", err)
+		}
+		body = dechunked
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(body)
+	gz.Close()
+
+	// Headers are copied, so request shared with other attempts is not modified
+	head := append([]byte{}, request[:len(request)-len(proto.Body(request))]...)
+	head = proto.DeleteHeader(head, []byte("Transfer-Encoding"))
+	head = proto.SetHeader(head, []byte("Content-Encoding"), []byte("gzip"))
+	head = proto.SetHeader(head, []byte("Content-Length"), []byte(strconv.Itoa(buf.Len())))
+
+	return append(head, buf.Bytes()...), nil
+}
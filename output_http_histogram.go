@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds of latency histogram buckets in milliseconds, slower requests go to the last bucket without bound
+var latencyBuckets = [...]int64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+const (
+	// Endpoints above this number are aggregated together, so random paths don't grow memory
+	maxLatencyEndpoints = 1000
+	// Endpoints with the most total time are reported each interval
+	latencyStatsTopEndpoints = 20
+	otherLatencyEndpoint     = "other"
+)
+
+// latencyHistogram counts requests by latency bucket
+type latencyHistogram struct {
+	buckets [len(latencyBuckets) + 1]int64
+	count   int64
+	// In milliseconds
+	sum int64
+	max int64
+}
+
+func (h *latencyHistogram) add(latency time.Duration) {
+	ms := int64(latency / time.Millisecond)
+
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return ms <= latencyBuckets[i] })
+	h.buckets[i]++
+	h.count++
+	h.sum += ms
+	if ms > h.max {
+		h.max = ms
+	}
+}
+
+// percentile returns upper bound of bucket containing given percentile, or max latency if it is in the last bucket
+func (h *latencyHistogram) percentile(p float64) int64 {
+	rank := int64(p*float64(h.count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+
+	var seen int64
+	for i, n := range h.buckets {
+		if seen += n; seen >= rank {
+			if i < len(latencyBuckets) && latencyBuckets[i] < h.max {
+				return latencyBuckets[i]
+			}
+			return h.max
+		}
+	}
+
+	return h.max
+}
+
+func (h *latencyHistogram) String() string {
+	var buckets []string
+	for i, n := range h.buckets {
+		if n == 0 {
+			continue
+		}
+
+		if i < len(latencyBuckets) {
+			buckets = append(buckets, fmt.Sprintf("<=%dms:%d", latencyBuckets[i], n))
+		} else {
+			buckets = append(buckets, fmt.Sprintf(">%dms:%d", latencyBuckets[i-1], n))
+		}
+	}
+
+	return fmt.Sprintf("count: %d, mean: %dms, p50: %dms, p90: %dms, p99: %dms, max: %dms, histogram: %s",
+		h.count, h.sum/h.count, h.percentile(0.5), h.percentile(0.9), h.percentile(0.99), h.max, strings.Join(buckets, " "))
+}
+
+// endpointLatencyStats keeps latency histograms of replayed requests by method and normalized path, for current stats interval
+type endpointLatencyStats struct {
+	mu        sync.Mutex
+	endpoints map[string]*latencyHistogram
+}
+
+func newEndpointLatencyStats() *endpointLatencyStats {
+	return &endpointLatencyStats{endpoints: make(map[string]*latencyHistogram)}
+}
+
+func (s *endpointLatencyStats) add(endpoint string, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok := s.endpoints[endpoint]
+	if !ok {
+		if len(s.endpoints) >= maxLatencyEndpoints {
+			endpoint = otherLatencyEndpoint
+			h = s.endpoints[endpoint]
+		}
+
+		if h == nil {
+			h = new(latencyHistogram)
+			s.endpoints[endpoint] = h
+		}
+	}
+
+	h.add(latency)
+}
+
+// flush returns histograms of current interval and starts new one
+func (s *endpointLatencyStats) flush() map[string]*latencyHistogram {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	endpoints := s.endpoints
+	s.endpoints = make(map[string]*latencyHistogram)
+
+	return endpoints
+}
+
+func (o *HTTPOutput) reportEndpointStats() {
+	for {
+		time.Sleep(rate * time.Second)
+
+		endpoints := o.endpointLatencies.flush()
+
+		names := make([]string, 0, len(endpoints))
+		for name := range endpoints {
+			names = append(names, name)
+		}
+
+		// Endpoints which took the most time go first
+		sort.Slice(names, func(i, j int) bool {
+			if endpoints[names[i]].sum != endpoints[names[j]].sum {
+				return endpoints[names[i]].sum > endpoints[names[j]].sum
+			}
+			return names[i] < names[j]
+		})
+
+		for i, name := range names {
+			if i == latencyStatsTopEndpoints {
+				log.Printf("[OUTPUT-HTTP] Latency '%s': %d more endpoints\n", o.address, len(names)-i)
+				break
+			}
+
+			log.Printf("[OUTPUT-HTTP] Latency '%s' %s: %s\n", o.address, name, endpoints[name])
+		}
+	}
+}
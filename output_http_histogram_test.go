@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	h := new(latencyHistogram)
+
+	for i := 0; i < 90; i++ {
+		h.add(3 * time.Millisecond)
+	}
+	for i := 0; i < 9; i++ {
+		h.add(40 * time.Millisecond)
+	}
+	h.add(12 * time.Second)
+
+	if p := [3]int64{h.percentile(0.5), h.percentile(0.9), h.percentile(0.99)}; p != [3]int64{5, 5, 50} {
+		t.Errorf("Unexpected percentiles: %v", p)
+	}
+
+	// Percentile in the last bucket is max latency
+	if p := h.percentile(1); p != 12000 {
+		t.Errorf("Expected max latency, got %d", p)
+	}
+
+	if s := h.String(); !strings.Contains(s, "count: 100") || !strings.HasSuffix(s, "histogram: <=5ms:90 <=50ms:9 >10000ms:1") {
+		t.Errorf("Unexpected report: %s", s)
+	}
+}
+
+func TestEndpointLatencyStats(t *testing.T) {
+	s := newEndpointLatencyStats()
+
+	for i := 0; i < maxLatencyEndpoints+10; i++ {
+		s.add(latencyEndpoint([]byte("GET /items/"+strconv.Itoa(i)+" HTTP/1.1\r\n\r\n")), time.Millisecond)
+		s.add("GET /page-"+strconv.Itoa(i), time.Millisecond)
+	}
+
+	endpoints := s.flush()
+
+	if h := endpoints["GET /items/{id}"]; h == nil || h.count != maxLatencyEndpoints+10 {
+		t.Error("Requests should be aggregated by normalized path", h)
+	}
+
+	// Endpoints above limit are counted together
+	if len(endpoints) != maxLatencyEndpoints+1 || endpoints[otherLatencyEndpoint].count != 11 {
+		t.Errorf("Expected %d endpoints, got %d", maxLatencyEndpoints+1, len(endpoints))
+	}
+
+	if len(s.flush()) != 0 {
+		t.Error("Flush should start new interval")
+	}
+}
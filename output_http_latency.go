@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/gor/proto"
+)
+
+// Original latencies not claimed by replayed response for this time are forgotten
+const originalLatencyExpire = time.Minute
+
+// originalLatencies adds latency of original response to replayed one, so they can be compared without
+// correlating payloads. Original and replayed responses of the same request can come in any order,
+// so the one which comes first waits for the other.
+type originalLatencies struct {
+	mu        sync.Mutex
+	latencies map[string]originalLatency
+	pending   map[string]pendingResponse
+	// Until first original response is seen, input is assumed to not track responses
+	seen bool
+	// How long replayed response waits for original one
+	timeout time.Duration
+	out     chan response
+	// Optional aggregation of paired latencies by endpoint
+	report *latencyReport
+}
+
+type originalLatency struct {
+	latency int64
+	added   time.Time
+}
+
+type pendingResponse struct {
+	resp     response
+	endpoint string
+	added    time.Time
+}
+
+func newOriginalLatencies(out chan response, timeout time.Duration) *originalLatencies {
+	l := &originalLatencies{
+		latencies: make(map[string]originalLatency),
+		pending:   make(map[string]pendingResponse),
+		timeout:   timeout,
+		out:       out,
+	}
+
+	go l.gc()
+
+	return l
+}
+
+// original records latency of original response
+func (l *originalLatencies) original(uuid []byte, latency int64) {
+	l.mu.Lock()
+	l.seen = true
+
+	p, ok := l.pending[string(uuid)]
+	if !ok {
+		l.latencies[string(uuid)] = originalLatency{latency, time.Now()}
+		l.mu.Unlock()
+		return
+	}
+
+	delete(l.pending, string(uuid))
+	l.mu.Unlock()
+
+	p.resp.originalLatency = latency
+	if l.report != nil {
+		l.report.add(p.endpoint, latency, p.resp.startedAt)
+	}
+	l.out <- p.resp
+}
+
+// replayed emits replayed response, once latency of original response is known. Endpoint is used by latency report.
+func (l *originalLatencies) replayed(resp response, endpoint string) {
+	l.mu.Lock()
+
+	if !l.seen {
+		l.mu.Unlock()
+		l.out <- resp
+		return
+	}
+
+	o, ok := l.latencies[string(resp.uuid)]
+	if !ok {
+		l.pending[string(resp.uuid)] = pendingResponse{resp, endpoint, time.Now()}
+		l.mu.Unlock()
+		return
+	}
+
+	delete(l.latencies, string(resp.uuid))
+	l.mu.Unlock()
+
+	resp.originalLatency = o.latency
+	if l.report != nil {
+		l.report.add(endpoint, o.latency, resp.startedAt)
+	}
+	l.out <- resp
+}
+
+// gc emits replayed responses, which original responses were not seen in time, without original latency
+func (l *originalLatencies) gc() {
+	for range time.Tick(time.Second) {
+		var expired []response
+		now := time.Now()
+
+		l.mu.Lock()
+		for id, p := range l.pending {
+			if now.Sub(p.added) > l.timeout {
+				expired = append(expired, p.resp)
+				delete(l.pending, id)
+			}
+		}
+
+		for id, o := range l.latencies {
+			if now.Sub(o.added) > originalLatencyExpire {
+				delete(l.latencies, id)
+			}
+		}
+		l.mu.Unlock()
+
+		for _, resp := range expired {
+			l.out <- resp
+		}
+	}
+}
+
+// Samples of endpoint kept per report interval, later ones are dropped
+const latencyReportMaxSamples = 10000
+
+// latencyReport aggregates original and replayed latencies by endpoint, and periodically writes
+// their percentiles as JSON lines, answering if replayed build is slower than original one.
+type latencyReport struct {
+	mu        sync.Mutex
+	endpoints map[string]*endpointLatencies
+	w         io.Writer
+}
+
+type endpointLatencies struct {
+	original []int64
+	replayed []int64
+}
+
+// latencyReportLine is written for each endpoint with samples in report interval, latencies are in milliseconds
+type latencyReportLine struct {
+	Endpoint    string  `json:"endpoint"`
+	Count       int     `json:"count"`
+	OriginalP50 float64 `json:"original_p50_ms"`
+	ReplayedP50 float64 `json:"replayed_p50_ms"`
+	DeltaP50    float64 `json:"delta_p50_ms"`
+	OriginalP95 float64 `json:"original_p95_ms"`
+	ReplayedP95 float64 `json:"replayed_p95_ms"`
+	DeltaP95    float64 `json:"delta_p95_ms"`
+}
+
+func newLatencyReport(w io.Writer, interval time.Duration) *latencyReport {
+	r := &latencyReport{endpoints: make(map[string]*endpointLatencies), w: w}
+
+	go func() {
+		for range time.Tick(interval) {
+			r.flush()
+		}
+	}()
+
+	return r
+}
+
+// add records latencies of original and replayed response in nanoseconds
+func (r *latencyReport) add(endpoint string, original, replayed int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.endpoints[endpoint]
+	if !ok {
+		e = &endpointLatencies{}
+		r.endpoints[endpoint] = e
+	}
+
+	if len(e.original) < latencyReportMaxSamples {
+		e.original = append(e.original, original)
+		e.replayed = append(e.replayed, replayed)
+	}
+}
+
+// flush writes percentiles of endpoints, and starts new interval
+func (r *latencyReport) flush() {
+	r.mu.Lock()
+	endpoints := r.endpoints
+	r.endpoints = make(map[string]*endpointLatencies)
+	r.mu.Unlock()
+
+	names := make([]string, 0, len(endpoints))
+	for name := range endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		e := endpoints[name]
+		line := latencyReportLine{Endpoint: name, Count: len(e.original)}
+
+		line.OriginalP50, line.OriginalP95 = latencyPercentile(e.original, 50), latencyPercentile(e.original, 95)
+		line.ReplayedP50, line.ReplayedP95 = latencyPercentile(e.replayed, 50), latencyPercentile(e.replayed, 95)
+		line.DeltaP50, line.DeltaP95 = line.ReplayedP50-line.OriginalP50, line.ReplayedP95-line.OriginalP95
+
+		data, _ := json.Marshal(line)
+		r.w.Write(append(data, '\n'))
+	}
+}
+
+// latencyPercentile returns percentile of latencies in milliseconds, using nearest-rank method
+func latencyPercentile(latencies []int64, p int) float64 {
+	sorted := append([]int64(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	rank := (len(sorted)*p + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+
+	return float64(sorted[rank-1]) / float64(time.Millisecond)
+}
+
+var endpointIDPattern = regexp.MustCompile(`^([0-9]+|[0-9a-fA-F-]{16,})$`)
+
+// latencyEndpoint returns method and path of request without query, with numeric and hex ids replaced by `{id}`,
+// so requests to the same resource are aggregated together
+func latencyEndpoint(request []byte) string {
+	path := string(proto.Path(request))
+	if idx := strings.IndexByte(path, '?'); idx != -1 {
+		path = path[:idx]
+	}
+
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		if endpointIDPattern.MatchString(s) {
+			segments[i] = "{id}"
+		}
+	}
+
+	return string(proto.Method(request)) + " " + strings.Join(segments, "/")
+}
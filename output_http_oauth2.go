@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Suffix of OpenID Connect discovery document, token endpoint is read from it
+const oidcDiscoveryPath = "/.well-known/openid-configuration"
+
+// Token is fetched again this long before it expires, or after this part of its lifetime if it is short
+const (
+	oauth2RefreshWindow   = time.Minute
+	oauth2RefreshFraction = 10
+)
+
+// Failed token request is not repeated by each replayed request, but at most this often
+const oauth2RetryInterval = time.Second
+
+// oauth2TokenSource fetches bearer tokens using OAuth2 client credentials flow, and caches them until they are about to
+// expire. Token endpoint is given directly, or discovered from OpenID Connect issuer configuration.
+type oauth2TokenSource struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scope        string
+	// Additional parameters of token request, like `audience`
+	params url.Values
+
+	client *http.Client
+
+	mu       sync.Mutex
+	token    string
+	expiry   time.Time
+	failedAt time.Time
+	err      error
+}
+
+type oauth2TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// newOAuth2TokenSource constructor for oauth2TokenSource, params are `key=value` pairs added to token request
+func newOAuth2TokenSource(tokenURL, clientID, clientSecret, scope string, params []string) (*oauth2TokenSource, error) {
+	s := &oauth2TokenSource{
+		tokenURL:     tokenURL,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		scope:        scope,
+		params:       url.Values{},
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+
+	if clientID == "" {
+		return nil, errors.New("client id should be set")
+	}
+
+	for _, param := range params {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("expected `key=value` parameter, got %q", param)
+		}
+		s.params.Add(kv[0], kv[1])
+	}
+
+	if strings.HasSuffix(tokenURL, oidcDiscoveryPath) {
+		endpoint, err := s.discoverTokenURL(tokenURL)
+		if err != nil {
+			return nil, err
+		}
+		s.tokenURL = endpoint
+	}
+
+	return s, nil
+}
+
+// discoverTokenURL reads token endpoint from OpenID Connect discovery document of issuer
+func (s *oauth2TokenSource) discoverTokenURL(configURL string) (string, error) {
+	resp, err := s.client.Get(configURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("OpenID configuration request failed: %s %s", resp.Status, msg)
+	}
+
+	var config struct {
+		TokenEndpoint string `json:"token_endpoint"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return "", err
+	}
+
+	if config.TokenEndpoint == "" {
+		return "", errors.New("OpenID configuration has no token endpoint")
+	}
+
+	return config.TokenEndpoint, nil
+}
+
+// Token returns cached token or fetches new one if it is about to expire
+func (s *oauth2TokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	if s.token != "" && now.Before(s.expiry) {
+		return s.token, nil
+	}
+
+	if s.err != nil && now.Sub(s.failedAt) < oauth2RetryInterval {
+		return "", s.err
+	}
+
+	resp, err := s.fetchToken()
+	if err != nil {
+		s.err, s.failedAt = err, now
+		return "", err
+	}
+	s.err = nil
+
+	s.token = resp.AccessToken
+	s.expiry = now.Add(oauth2Lifetime(time.Duration(resp.ExpiresIn) * time.Second))
+
+	return s.token, nil
+}
+
+// oauth2Lifetime returns how long token is used, renewing it before it expires. Token without expiration is
+// used until it is rejected.
+func oauth2Lifetime(expiresIn time.Duration) time.Duration {
+	if expiresIn <= 0 {
+		return 100 * 365 * 24 * time.Hour
+	}
+
+	window := oauth2RefreshWindow
+	if short := expiresIn / oauth2RefreshFraction; short < window {
+		window = short
+	}
+
+	return expiresIn - window
+}
+
+// Invalidate drops cached token, after it was rejected by target
+func (s *oauth2TokenSource) Invalidate(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Token can be already renewed by other worker
+	if s.token == token {
+		s.token = ""
+	}
+}
+
+func (s *oauth2TokenSource) fetchToken() (*oauth2TokenResponse, error) {
+	form := url.Values{}
+	for k, v := range s.params {
+		form[k] = v
+	}
+	form.Set("grant_type", "client_credentials")
+	if s.scope != "" {
+		form.Set("scope", s.scope)
+	}
+
+	req, err := http.NewRequest("POST", s.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// client_secret_basic authentication, see https://tools.ietf.org/html/rfc6749#section-2.3.1
+	req.SetBasicAuth(url.QueryEscape(s.clientID), url.QueryEscape(s.clientSecret))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("Token request failed: %s %s", resp.Status, msg)
+	}
+
+	var token oauth2TokenResponse
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+
+	if token.AccessToken == "" {
+		return nil, errors.New("Token response has no access token")
+	}
+
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return nil, fmt.Errorf("Unsupported token type: %s", token.TokenType)
+	}
+
+	return &token, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestTokenServer(t *testing.T, issued *int64) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == oidcDiscoveryPath {
+			fmt.Fprintf(w, `{"issuer": "%s", "token_endpoint": "%s/token"}`, server.URL, server.URL)
+			return
+		}
+
+		// Credentials are form encoded before Basic auth
+		id, secret, _ := r.BasicAuth()
+		if secret, _ = url.QueryUnescape(secret); id != "replay" || secret != "s3cr%t" {
+			t.Error("Wrong client credentials", id, secret)
+		}
+
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("scope") != "read write" || r.Form.Get("audience") != "api" {
+			t.Error("Wrong token request", r.Form)
+		}
+
+		n := atomic.AddInt64(issued, 1)
+		fmt.Fprintf(w, `{"access_token": "token-%d", "token_type": "Bearer", "expires_in": 3600}`, n)
+	}))
+
+	return server
+}
+
+func TestHTTPOutputOAuth2(t *testing.T) {
+	var issued int64
+	auth := newTestTokenServer(t, &issued)
+	defer auth.Close()
+
+	tokens := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("Authorization")
+		tokens <- token
+
+		// First token is revoked
+		if token == "Bearer token-1" {
+			w.WriteHeader(401)
+		}
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{
+		Timeout:            time.Second,
+		workers:            1,
+		oauth2TokenURL:     auth.URL + oidcDiscoveryPath,
+		oauth2ClientID:     "replay",
+		oauth2ClientSecret: "s3cr%t",
+		oauth2Scope:        "read write",
+		oauth2Params:       MultiOption{"audience=api"},
+	})
+
+	for i := 0; i < 3; i++ {
+		output.Write([]byte("1 1 1\nGET / HTTP/1.1\r\nAuthorization: Bearer expired\r\n\r\n"))
+
+		select {
+		case token := <-tokens:
+			// Revoked token is replaced by new one
+			if expected := map[bool]string{true: "Bearer token-1", false: "Bearer token-2"}[i == 0]; token != expected {
+				t.Errorf("Request %d: expected %q, got %q", i, expected, token)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Request not received")
+		}
+	}
+
+	if atomic.LoadInt64(&issued) != 2 {
+		t.Error("Token should be cached", issued)
+	}
+}
+
+func TestOAuth2Lifetime(t *testing.T) {
+	if d := oauth2Lifetime(time.Hour); d != 59*time.Minute {
+		t.Error("Long token should be renewed minute before expiry", d)
+	}
+
+	if d := oauth2Lifetime(30 * time.Second); d != 27*time.Second {
+		t.Error("Short token should be renewed after 90% of lifetime", d)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	socks "golang.org/x/net/proxy"
+)
+
+// targetProxy returns proxy for replay target. Explicit proxy is used for all targets, otherwise
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are honored.
+func targetProxy(proxy string, target string) (*url.URL, error) {
+	if proxy != "" {
+		if !strings.Contains(proxy, "://") {
+			proxy = "http://" + proxy
+		}
+
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, err
+		}
+
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+			return u, nil
+		}
+
+		return nil, errors.New("unsupported proxy scheme: " + u.Scheme)
+	}
+
+	if !strings.HasPrefix(target, "http") {
+		target = "http://" + target
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.ProxyFromEnvironment(&http.Request{URL: u})
+}
+
+// dialProxy opens connection to address through proxy. HTTP proxies should allow CONNECT method to target port.
+func dialProxy(proxy *url.URL, address string, timeout time.Duration) (net.Conn, error) {
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		switch proxy.Scheme {
+		case "https":
+			proxyAddr += ":443"
+		case "socks5", "socks5h":
+			proxyAddr += ":1080"
+		default:
+			proxyAddr += ":80"
+		}
+	}
+
+	if proxy.Scheme == "socks5" || proxy.Scheme == "socks5h" {
+		return dialSOCKS5(proxy, proxyAddr, address, timeout)
+	}
+
+	conn, err := net.DialTimeout("tcp", proxyAddr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, ServerName: proxy.Hostname()})
+		conn = tlsConn
+		if err = tlsConn.Handshake(); err == nil {
+			err = httpConnect(conn, proxy, address)
+		}
+	} else {
+		err = httpConnect(conn, proxy, address)
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// dialSOCKS5 opens connection using SOCKS5 CONNECT command. With `socks5` scheme host is resolved locally,
+// with `socks5h` by proxy. Host is already resolved by dialTarget if --output-http-resolve options are used,
+// otherwise OS resolver is used within the same timeout.
+func dialSOCKS5(proxy *url.URL, proxyAddr, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if proxy.Scheme == "socks5" {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+
+		if net.ParseIP(host) == nil {
+			ips, err := net.DefaultResolver.LookupHost(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			address = net.JoinHostPort(ips[0], port)
+		}
+	}
+
+	var auth *socks.Auth
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		auth = &socks.Auth{User: proxy.User.Username(), Password: password}
+	}
+
+	dialer, err := socks.SOCKS5("tcp", proxyAddr, auth, &net.Dialer{Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+
+	return dialer.(socks.ContextDialer).DialContext(ctx, "tcp", address)
+}
+
+// httpConnect opens tunnel using CONNECT method
+func httpConnect(conn net.Conn, proxy *url.URL, address string) error {
+	req := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n"
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(proxy.User.Username()+":"+password)) + "\r\n"
+	}
+	req += "\r\n"
+
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return err
+	}
+
+	// Target does not send data before request, so reader does not buffer any of it
+	resp, err := http.ReadResponse(bufio.NewReaderSize(conn, 1), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("proxy refused connection to " + address + ": " + resp.Status)
+	}
+
+	return nil
+}
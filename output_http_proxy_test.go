@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTestProxy starts HTTP CONNECT or SOCKS5 proxy, which counts tunnels it opened
+func startTestProxy(t *testing.T, socks bool, tunnels *int64) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				var address string
+				if socks {
+					// Greeting without authentication, then CONNECT with IPv4 address
+					buf := make([]byte, 10)
+					io.ReadFull(conn, buf[:2])
+					io.ReadFull(conn, make([]byte, buf[1]))
+					conn.Write([]byte{5, 0})
+
+					io.ReadFull(conn, buf)
+					address = (&net.TCPAddr{IP: net.IP(buf[4:8]), Port: int(buf[8])<<8 | int(buf[9])}).String()
+				} else {
+					req, err := http.ReadRequest(bufio.NewReader(conn))
+					if err != nil || req.Method != "CONNECT" {
+						return
+					}
+					address = req.Host
+				}
+
+				target, err := net.Dial("tcp", address)
+				if err != nil {
+					return
+				}
+				defer target.Close()
+
+				atomic.AddInt64(tunnels, 1)
+
+				if socks {
+					conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				} else {
+					conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				}
+
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+
+	return listener
+}
+
+func TestHTTPOutputProxy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	tlsServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+
+	var tunnels int64
+	httpProxy := startTestProxy(t, false, &tunnels)
+	defer httpProxy.Close()
+	socksProxy := startTestProxy(t, true, &tunnels)
+	defer socksProxy.Close()
+
+	for name, tc := range map[string]struct {
+		address string
+		config  HTTPOutputConfig
+	}{
+		"HTTP proxy":          {server.URL, HTTPOutputConfig{proxy: httpProxy.Addr().String()}},
+		"HTTP proxy, TLS":     {tlsServer.URL, HTTPOutputConfig{proxy: "http://" + httpProxy.Addr().String()}},
+		"SOCKS5 proxy":        {server.URL, HTTPOutputConfig{proxy: "socks5://" + socksProxy.Addr().String()}},
+		"SOCKS5 proxy, HTTP2": {tlsServer.URL, HTTPOutputConfig{proxy: "socks5://" + socksProxy.Addr().String(), HTTP2: true}},
+	} {
+		atomic.StoreInt64(&tunnels, 0)
+
+		config := tc.config
+		config.Timeout = time.Second
+		config.TrackResponses = true
+
+		output := NewHTTPOutput(tc.address, &config)
+		output.Write([]byte("1 a 1\nGET / HTTP/1.1\r\n\r\n"))
+
+		data := make([]byte, 1024)
+		n, _ := output.(*HTTPOutput).Read(data)
+
+		if resp := string(payloadBody(data[:n])); !strings.HasPrefix(resp, "HTTP/1.1 200") {
+			t.Errorf("%s: Wrong response: %q", name, resp)
+		}
+
+		if atomic.LoadInt64(&tunnels) != 1 {
+			t.Error(name, "Request should be sent through proxy")
+		}
+	}
+}
+
+func TestTargetProxy(t *testing.T) {
+	if proxy, err := targetProxy("user:secret@proxy.internal:3128", "staging.com"); err != nil || proxy.Scheme != "http" || proxy.Host != "proxy.internal:3128" {
+		t.Error("Wrong proxy", proxy, err)
+	}
+
+	if _, err := targetProxy("ftp://proxy.internal", "staging.com"); err == nil {
+		t.Error("Should reject unsupported proxy scheme")
+	}
+}
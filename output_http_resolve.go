@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Answers are cached at least for this time, even if DNS server returns smaller TTL
+const minResolveTTL = time.Second
+
+// Answers of OS resolver are cached for this time by default
+const defaultResolveTTL = 30 * time.Second
+
+// Resolver resolves host name to IP addresses, and tells how long they can be used
+type Resolver interface {
+	Resolve(host string) (ips []string, ttl time.Duration, err error)
+}
+
+// systemResolver uses resolver of OS, which doesn't expose TTL, so answers are cached for fixed time
+type systemResolver struct {
+	ttl time.Duration
+}
+
+func (r *systemResolver) Resolve(host string) ([]string, time.Duration, error) {
+	ips, err := net.LookupHost(host)
+	return ips, r.ttl, err
+}
+
+// dnsResolver queries A and AAAA records directly from DNS server, like internal one of split-horizon DNS,
+// and uses TTL of answers
+type dnsResolver struct {
+	server  string
+	timeout time.Duration
+}
+
+func (r *dnsResolver) Resolve(host string) ([]string, time.Duration, error) {
+	var ips []string
+	var ttl uint32
+	var lastErr error
+
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		found, t, err := r.query(host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if len(found) > 0 && (len(ips) == 0 || t < ttl) {
+			ttl = t
+		}
+		ips = append(ips, found...)
+	}
+
+	if len(ips) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no addresses of %s", host)
+		}
+		return nil, 0, lastErr
+	}
+
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+func (r *dnsResolver) query(host string, qtype dnsmessage.Type) (ips []string, ttl uint32, err error) {
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+
+	name, err := dnsmessage.NewName(host)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	id := uint16(rand.Uint32())
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := r.exchange("udp", packed)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err == nil && h.Truncated {
+		// Answer doesn't fit UDP packet
+		if resp, err = r.exchange("tcp", packed); err != nil {
+			return nil, 0, err
+		}
+		h, err = p.Start(resp)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if h.ID != id {
+		return nil, 0, errors.New("DNS response id doesn't match query")
+	}
+
+	if h.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("DNS lookup of %s failed: %v", host, h.RCode)
+	}
+
+	if err = p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	// Answer can contain CNAME chain, followed by addresses
+	for {
+		ah, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		switch ah.Type {
+		case dnsmessage.TypeA:
+			a, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(a.A[:]).String())
+		case dnsmessage.TypeAAAA:
+			a, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(a.AAAA[:]).String())
+		default:
+			p.SkipAnswer()
+			continue
+		}
+
+		if len(ips) == 1 || ah.TTL < ttl {
+			ttl = ah.TTL
+		}
+	}
+
+	return ips, ttl, nil
+}
+
+// exchange sends query and reads response, messages sent over TCP are prefixed by length
+func (r *dnsResolver) exchange(network string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, r.server, r.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(r.timeout))
+
+	if network == "udp" {
+		if _, err = conn.Write(query); err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		return buf[:n], err
+	}
+
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err = conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var size [2]byte
+	if _, err = io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, binary.BigEndian.Uint16(size[:]))
+	_, err = io.ReadFull(conn, resp)
+
+	return resp, err
+}
+
+// targetResolver resolves hosts of replay targets: overrides set by --output-http-resolve come first, other hosts
+// are resolved by Resolver and cached for TTL of answer. Once it expires, host is resolved again, so replay
+// follows DNS changes, like failover to other instances.
+type targetResolver struct {
+	// IPs by `host:port` or `host`
+	overrides map[string][]string
+	resolver  Resolver
+
+	mu    sync.Mutex
+	cache map[string]resolvedHost
+	// Connections are spread between addresses of host
+	next uint32
+}
+
+type resolvedHost struct {
+	ips     []string
+	expires time.Time
+}
+
+// parseResolveOverride parses override like `host:ip`, `host:port:ip` or `host:ip,ip`. IPv6 can be in brackets.
+func parseResolveOverride(s string) (key string, ips []string, err error) {
+	i := strings.IndexByte(s, ':')
+	if i <= 0 {
+		return "", nil, fmt.Errorf("host:ip expected, got %q", s)
+	}
+
+	key, rest := strings.ToLower(s[:i]), s[i+1:]
+	if j := strings.IndexByte(rest, ':'); j > 0 {
+		if _, err := strconv.ParseUint(rest[:j], 10, 16); err == nil {
+			key, rest = net.JoinHostPort(key, rest[:j]), rest[j+1:]
+		}
+	}
+
+	for _, ip := range strings.Split(rest, ",") {
+		ip = strings.Trim(strings.TrimSpace(ip), "[]")
+		if net.ParseIP(ip) == nil {
+			return "", nil, fmt.Errorf("wrong IP %q in %q", ip, s)
+		}
+		ips = append(ips, ip)
+	}
+
+	return key, ips, nil
+}
+
+func newTargetResolver(overrides []string, dnsServer string, ttl, timeout time.Duration) (*targetResolver, error) {
+	r := &targetResolver{overrides: make(map[string][]string), cache: make(map[string]resolvedHost)}
+
+	for _, o := range overrides {
+		key, ips, err := parseResolveOverride(o)
+		if err != nil {
+			return nil, err
+		}
+		r.overrides[key] = append(r.overrides[key], ips...)
+	}
+
+	if dnsServer != "" {
+		if _, _, err := net.SplitHostPort(dnsServer); err != nil {
+			dnsServer = net.JoinHostPort(dnsServer, "53")
+		}
+		r.resolver = &dnsResolver{server: dnsServer, timeout: timeout}
+	} else {
+		if ttl == 0 {
+			ttl = defaultResolveTTL
+		}
+		r.resolver = &systemResolver{ttl: ttl}
+	}
+
+	return r, nil
+}
+
+// lookup returns cached addresses of host, or resolves it again if TTL expired
+func (r *targetResolver) lookup(host string) ([]string, error) {
+	r.mu.Lock()
+	cached, ok := r.cache[host]
+	r.mu.Unlock()
+
+	if ok && time.Now().Before(cached.expires) {
+		return cached.ips, nil
+	}
+
+	ips, ttl, err := r.resolver.Resolve(host)
+	if err != nil {
+		// Expired answer is better than none, while DNS is unavailable
+		if ok {
+			Debug("[OUTPUT-HTTP] Using expired addresses of", host, err)
+			return cached.ips, nil
+		}
+		return nil, err
+	}
+
+	if ttl < minResolveTTL {
+		ttl = minResolveTTL
+	}
+
+	r.mu.Lock()
+	r.cache[host] = resolvedHost{ips, time.Now().Add(ttl)}
+	r.mu.Unlock()
+
+	return ips, nil
+}
+
+// addresses returns `ip:port` addresses of `host:port`, starting from next one in turn
+func (r *targetResolver) addresses(address string) ([]string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return []string{address}, nil
+	}
+
+	host = strings.ToLower(host)
+	ips, ok := r.overrides[net.JoinHostPort(host, port)]
+	if !ok {
+		ips, ok = r.overrides[host]
+	}
+	if !ok {
+		if ips, err = r.lookup(host); err != nil {
+			return nil, err
+		}
+	}
+
+	n := int(atomic.AddUint32(&r.next, 1))
+	addrs := make([]string, len(ips))
+	for i := range ips {
+		addrs[i] = net.JoinHostPort(ips[(n+i)%len(ips)], port)
+	}
+
+	return addrs, nil
+}
+
+// current checks if connection to address still goes to one of its addresses
+func (r *targetResolver) current(address string, remote net.Addr) bool {
+	addrs, err := r.addresses(address)
+	if err != nil {
+		return true
+	}
+
+	for _, addr := range addrs {
+		if addr == remote.String() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dialTarget opens connection to address, directly or through proxy. With resolver, addresses of host are tried
+// in turn until connection succeeds. SOCKS5 proxy with remote DNS resolves host itself.
+func dialTarget(resolver *targetResolver, proxy *url.URL, address string, timeout time.Duration) (net.Conn, error) {
+	deadline := time.Now().Add(timeout)
+	dial := func(addr string) (net.Conn, error) {
+		if proxy != nil {
+			return dialProxy(proxy, addr, time.Until(deadline))
+		}
+		return net.DialTimeout("tcp", addr, time.Until(deadline))
+	}
+
+	if resolver == nil || (proxy != nil && proxy.Scheme == "socks5h") {
+		return dial(address)
+	}
+
+	addrs, err := resolver.addresses(address)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		var conn net.Conn
+		if conn, err = dial(addr); err == nil {
+			return conn, nil
+		}
+		Debug("[OUTPUT-HTTP] Can't connect to", addr, "of", address, err)
+	}
+
+	return nil, err
+}
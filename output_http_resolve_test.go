@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseResolveOverride(t *testing.T) {
+	testCases := []struct {
+		override string
+		key      string
+		ips      string
+	}{
+		{"api.example.com:10.0.0.1", "api.example.com", "10.0.0.1"},
+		{"API.example.com:8443:10.0.0.1,10.0.0.2", "api.example.com:8443", "10.0.0.1,10.0.0.2"},
+		{"api.example.com:[::1]", "api.example.com", "::1"},
+		{"api.example.com:443:[2001:db8::1]", "api.example.com:443", "2001:db8::1"},
+	}
+
+	for _, tc := range testCases {
+		key, ips, err := parseResolveOverride(tc.override)
+		if err != nil || key != tc.key || strings.Join(ips, ",") != tc.ips {
+			t.Errorf("%q: expected %s %s, got %s %v %v", tc.override, tc.key, tc.ips, key, ips, err)
+		}
+	}
+
+	for _, override := range []string{"api.example.com", ":10.0.0.1", "api.example.com:api2.example.com"} {
+		if _, _, err := parseResolveOverride(override); err == nil {
+			t.Errorf("%q should be invalid", override)
+		}
+	}
+}
+
+// startTestDNSServer answers A queries with address returned by ip, and TTL of 1 second
+func startTestDNSServer(t *testing.T, ip func() string, queries *int64) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			var query dnsmessage.Message
+			if query.Unpack(buf[:n]) != nil {
+				continue
+			}
+
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true},
+				Questions: query.Questions,
+			}
+
+			if q := query.Questions[0]; q.Type == dnsmessage.TypeA {
+				atomic.AddInt64(queries, 1)
+
+				var a [4]byte
+				copy(a[:], net.ParseIP(ip()).To4())
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 1},
+					Body:   &dnsmessage.AResource{A: a},
+				})
+			}
+
+			packed, _ := resp.Pack()
+			conn.WriteTo(packed, addr)
+		}
+	}()
+
+	return conn
+}
+
+func TestTargetResolver(t *testing.T) {
+	var conns [2]int64
+	var servers []net.Listener
+
+	// Two instances of the same service on different addresses
+	for i, addr := range []string{"127.0.0.1:0", "127.0.0.2:0"} {
+		if i == 1 {
+			addr = "127.0.0.2:" + strings.Split(servers[0].Addr().String(), ":")[1]
+		}
+
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Skip("Can't listen on second loopback address: ", err)
+		}
+		defer ln.Close()
+		servers = append(servers, ln)
+
+		server := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(r.Host))
+			}),
+			ConnState: func(i int) func(net.Conn, http.ConnState) {
+				return func(c net.Conn, state http.ConnState) {
+					if state == http.StateNew {
+						atomic.AddInt64(&conns[i], 1)
+					}
+				}
+			}(i),
+		}
+		go server.Serve(ln)
+	}
+
+	port := strings.Split(servers[0].Addr().String(), ":")[1]
+
+	var current atomic.Value
+	current.Store("127.0.0.1")
+	var queries int64
+	dns := startTestDNSServer(t, func() string { return current.Load().(string) }, &queries)
+	defer dns.Close()
+
+	resolver, err := newTargetResolver(MultiOption{"static.example.test:127.0.0.2"}, dns.LocalAddr().String(), 0, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewHTTPClient("http://api.example.test:"+port, &HTTPClientConfig{Resolver: resolver})
+	request := []byte("GET / HTTP/1.1\r\n\r\n")
+
+	resp, _ := client.Send(request)
+	client.Send(request)
+	if string(resp[len(resp)-len("api.example.test:"+port):]) != "api.example.test:"+port || atomic.LoadInt64(&conns[0]) != 1 {
+		t.Errorf("Host should be resolved by DNS server, and connection reused: %q, %d", resp, conns[0])
+	}
+
+	// After TTL address is resolved again, and keep-alive connection moves to new one
+	current.Store("127.0.0.2")
+	time.Sleep(minResolveTTL + 100*time.Millisecond)
+	client.Send(request)
+
+	if atomic.LoadInt64(&conns[1]) != 1 || atomic.LoadInt64(&queries) != 2 {
+		t.Errorf("Connection should move to new address: %v, queries: %d", conns, queries)
+	}
+
+	// Overrides don't use DNS
+	static := NewHTTPClient("http://static.example.test:"+port, &HTTPClientConfig{Resolver: resolver})
+	static.Send(request)
+
+	if atomic.LoadInt64(&conns[1]) != 2 || atomic.LoadInt64(&queries) != 2 {
+		t.Errorf("Override should be used: %v, queries: %d", conns, queries)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/gor/proto"
+)
+
+// Backoff between retries doubles after each attempt, up to this value
+const maxRetryBackoff = 10 * time.Second
+
+// Statuses of transient errors, retried if --output-http-retry-status is not set
+var defaultRetryStatuses = []string{"502", "503", "504"}
+
+// Methods which can be repeated without additional side effects, see https://tools.ietf.org/html/rfc7231#section-4.2.2
+var idempotentMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+	"TRACE":   true,
+	"PUT":     true,
+	"DELETE":  true,
+}
+
+// retryable checks if request failed with transient error: connection or timeout error, or retryable status.
+// Non-idempotent requests, like POST, are retried only if connection failed before request was sent,
+// unless retrying them is enabled.
+func (o *HTTPOutput) retryable(request []byte, resp []byte, err error) bool {
+	if err != nil && bytes.Equal(proto.Status(resp), []byte(HTTP_CONNECTION_ERROR)) {
+		return true
+	}
+
+	if !o.config.retryNonIdempotent && !idempotentMethods[string(proto.Method(request))] {
+		return false
+	}
+
+	if err != nil {
+		return true
+	}
+
+	if len(resp) == 0 {
+		return false
+	}
+
+	return o.retryStatuses[string(proto.Status(resp))]
+}
+
+// retryBackoff returns pause before given retry attempt, starting from 0
+func (o *HTTPOutput) retryBackoff(attempt int) time.Duration {
+	backoff := o.config.retryBackoff
+	for i := 0; i < attempt && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+
+	return backoff
+}
+
+func (o *HTTPOutput) reportRetryStats() {
+	for {
+		time.Sleep(rate * time.Second)
+
+		log.Printf("[OUTPUT-HTTP] Retries '%s': retried requests: %d, failed requests: %d, timed out attempts: %d\n", o.address, atomic.LoadInt64(&o.retriedRequests), atomic.LoadInt64(&o.failedRequests), atomic.LoadInt64(&o.timedOutRequests))
+	}
+}
+
+func (o *HTTPOutput) reportRedirectStats() {
+	for {
+		time.Sleep(rate * time.Second)
+
+		log.Printf("[OUTPUT-HTTP] Redirects '%s': followed: %d, loops: %d, above limit: %d\n", o.address, atomic.LoadInt64(&o.redirects.Followed), atomic.LoadInt64(&o.redirects.Loops), atomic.LoadInt64(&o.redirects.Limited))
+	}
+}
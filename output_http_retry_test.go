@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPOutputRetries(t *testing.T) {
+	var requests int64
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt64(&requests, 1)
+
+		switch {
+		case req.URL.Path == "/down":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case n <= 2:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{Timeout: time.Second, TrackResponses: true, retries: 3, retryBackoff: time.Millisecond})
+	o := output.(*HTTPOutput)
+	data := make([]byte, 1024)
+
+	output.Write([]byte("1 a 1\nGET / HTTP/1.1\r\n\r\n"))
+	n, _ := o.Read(data)
+	if resp := string(payloadBody(data[:n])); !strings.HasPrefix(resp, "HTTP/1.1 200") {
+		t.Errorf("Should retry transient errors: %q", resp)
+	}
+
+	if requests != 3 || o.retriedRequests != 1 || o.failedRequests != 0 {
+		t.Error("Wrong counters", requests, o.retriedRequests, o.failedRequests)
+	}
+
+	output.Write([]byte("1 b 1\nGET /down HTTP/1.1\r\n\r\n"))
+	n, _ = o.Read(data)
+	if resp := string(payloadBody(data[:n])); !strings.HasPrefix(resp, "HTTP/1.1 503") {
+		t.Errorf("Should return last response: %q", resp)
+	}
+
+	if requests != 7 || o.retriedRequests != 2 || o.failedRequests != 1 {
+		t.Error("Wrong counters", requests, o.retriedRequests, o.failedRequests)
+	}
+}
+
+func TestHTTPOutputRetryBackoff(t *testing.T) {
+	o := &HTTPOutput{config: &HTTPOutputConfig{retryBackoff: time.Second}}
+
+	for attempt, backoff := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		if b := o.retryBackoff(attempt); b != backoff {
+			t.Error(attempt, "Wrong backoff", b)
+		}
+	}
+}
+
+func TestHTTPOutputRetryNonIdempotent(t *testing.T) {
+	var requests int64
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		retryNonIdempotent bool
+		requests           int64
+	}{{false, 1}, {true, 3}} {
+		atomic.StoreInt64(&requests, 0)
+
+		output := NewHTTPOutput(server.URL, &HTTPOutputConfig{Timeout: time.Second, TrackResponses: true, retries: 2, retryBackoff: time.Millisecond, retryNonIdempotent: tc.retryNonIdempotent})
+		output.Write([]byte("1 a 1\nPOST / HTTP/1.1\r\nContent-Length: 1\r\n\r\na"))
+		output.(*HTTPOutput).Read(make([]byte, 1024))
+
+		if n := atomic.LoadInt64(&requests); n != tc.requests {
+			t.Error("Wrong number of attempts", tc.retryNonIdempotent, n)
+		}
+	}
+}
+
+func TestHTTPOutputTimeoutDropsConnection(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte(req.URL.Path))
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{Timeout: 100 * time.Millisecond, TrackResponses: true, workers: 1})
+	o := output.(*HTTPOutput)
+	data := make([]byte, 1024)
+
+	output.Write([]byte("1 a 1\nGET /slow HTTP/1.1\r\n\r\n"))
+	o.Read(data)
+
+	// Late response to timed out request should not be read as response to the next one
+	time.Sleep(200 * time.Millisecond)
+	output.Write([]byte("1 b 1\nGET /fast HTTP/1.1\r\n\r\n"))
+	n, _ := o.Read(data)
+
+	if resp := string(payloadBody(data[:n])); !strings.HasSuffix(resp, "/fast") {
+		t.Errorf("Wrong response: %q", resp)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/gor/proto"
+)
+
+// Temporary credentials of assumed role are renewed this long before they expire
+const awsCredentialsRefreshWindow = 5 * time.Minute
+
+// Headers of recorded signature, replaced when request is signed again
+var awsSignatureHeaders = []string{"Authorization", "X-Amz-Date", "X-Amz-Content-Sha256", "X-Amz-Security-Token"}
+
+// awsSigner re-signs replayed requests with AWS Signature Version 4, so they are accepted by API Gateway or S3 compatible
+// targets, while recorded signatures are expired or made for different host.
+//
+// Credentials are read from the standard AWS_* environment variables. If role is set, they are used to assume it,
+// and requests are signed with temporary credentials of the role. Set AWS_ENDPOINT_URL_STS to use different STS endpoint.
+type awsSigner struct {
+	service string
+	region  string
+	role    string
+
+	stsEndpoint string
+	client      *http.Client
+
+	mu      sync.Mutex
+	creds   AWSCredentials
+	expires time.Time
+}
+
+// newAWSSigner constructor for awsSigner, spec is `service[:region]`, like `execute-api:eu-west-1` or `s3`
+func newAWSSigner(spec, role string) (*awsSigner, error) {
+	s := &awsSigner{
+		service:     spec,
+		region:      awsRegionFromEnv(),
+		role:        role,
+		stsEndpoint: strings.TrimSuffix(os.Getenv("AWS_ENDPOINT_URL_STS"), "/"),
+		client:      &http.Client{Timeout: 30 * time.Second},
+		creds:       awsCredentialsFromEnv(),
+	}
+
+	if idx := strings.IndexByte(spec, ':'); idx != -1 {
+		s.service, s.region = spec[:idx], spec[idx+1:]
+	}
+
+	if s.service == "" || s.region == "" {
+		return nil, fmt.Errorf("expected `service[:region]`, got %q", spec)
+	}
+
+	if s.creds.AccessKey == "" || s.creds.SecretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY should be set")
+	}
+
+	if s.stsEndpoint == "" {
+		s.stsEndpoint = "https://sts." + s.region + ".amazonaws.com"
+	}
+
+	return s, nil
+}
+
+// sign returns request signed for given host, with current date and hash of its body. Recorded signature is removed.
+func (s *awsSigner) sign(payload []byte, host string, now time.Time) ([]byte, error) {
+	creds, err := s.credentials(now)
+	if err != nil {
+		return payload, err
+	}
+
+	for _, name := range awsSignatureHeaders {
+		payload = proto.DeleteHeader(payload, []byte(name))
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(payload[:proto.MIMEHeadersEndPos(payload)+4])))
+	if err != nil {
+		return payload, err
+	}
+	req.Host = host
+
+	// Only headers which are not changed by client or proxies on the way are signed
+	headers := http.Header{}
+	for name, values := range req.Header {
+		if name == "Content-Type" || strings.HasPrefix(name, "X-Amz-") {
+			headers[name] = values
+		}
+	}
+	req.Header = headers
+
+	body := proto.Body(payload)
+	if bytes.EqualFold(proto.Header(payload, []byte("Transfer-Encoding")), []byte("chunked")) {
+		// Hash is computed from content, chunks are only framing
+		body, err = ioutil.ReadAll(httputil.NewChunkedReader(bytes.NewReader(body)))
+		if err != nil {
+			return payload, err
+		}
+	}
+
+	signAWSRequestV4(req, sha256Hex(body), creds, s.region, s.service, now)
+
+	for _, name := range awsSignatureHeaders {
+		if value := req.Header.Get(name); value != "" {
+			payload = proto.SetHeader(payload, []byte(name), []byte(value))
+		}
+	}
+
+	return payload, nil
+}
+
+// credentials returns credentials from environment, or temporary credentials of role, assuming it again when they expire
+func (s *awsSigner) credentials(now time.Time) (AWSCredentials, error) {
+	if s.role == "" {
+		return s.creds, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Before(s.expires) {
+		return s.creds, nil
+	}
+
+	creds, expires, err := s.assumeRole(now)
+	if err != nil {
+		return creds, err
+	}
+
+	s.creds = creds
+	s.expires = expires.Add(-awsCredentialsRefreshWindow)
+
+	return creds, nil
+}
+
+type stsAssumeRoleResponse struct {
+	AccessKeyID     string    `xml:"AssumeRoleResult>Credentials>AccessKeyId"`
+	SecretAccessKey string    `xml:"AssumeRoleResult>Credentials>SecretAccessKey"`
+	SessionToken    string    `xml:"AssumeRoleResult>Credentials>SessionToken"`
+	Expiration      time.Time `xml:"AssumeRoleResult>Credentials>Expiration"`
+}
+
+// assumeRole calls STS AssumeRole action, see https://docs.aws.amazon.com/STS/latest/APIReference/API_AssumeRole.html
+func (s *awsSigner) assumeRole(now time.Time) (creds AWSCredentials, expires time.Time, err error) {
+	form := url.Values{}
+	form.Set("Action", "AssumeRole")
+	form.Set("Version", "2011-06-15")
+	form.Set("RoleArn", s.role)
+	form.Set("RoleSessionName", "gor")
+	body := []byte(form.Encode())
+
+	req, err := http.NewRequest("POST", s.stsEndpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	signAWSRequestV4(req, sha256Hex(body), awsCredentialsFromEnv(), s.region, "sts", now)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("STS AssumeRole %s: %s %s", s.role, resp.Status, msg)
+		return
+	}
+
+	var result stsAssumeRoleResponse
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return
+	}
+
+	creds = AWSCredentials{AccessKey: result.AccessKeyID, SecretKey: result.SecretAccessKey, SessionToken: result.SessionToken}
+
+	return creds, result.Expiration, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// verifyAWSSignature signs received request again with given credentials, using only headers listed in its signature
+func verifyAWSSignature(r *http.Request, creds AWSCredentials, region, service string) error {
+	auth := r.Header.Get("Authorization")
+
+	idx := strings.Index(auth, "SignedHeaders=")
+	if idx == -1 {
+		return fmt.Errorf("request is not signed: %q", auth)
+	}
+	signed := strings.Split(strings.SplitN(auth[idx+len("SignedHeaders="):], ",", 2)[0], ";")
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if hash := sha256Hex(body); r.Header.Get("X-Amz-Content-Sha256") != hash {
+		return fmt.Errorf("wrong payload hash: %s", r.Header.Get("X-Amz-Content-Sha256"))
+	}
+
+	now, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return err
+	}
+
+	req, _ := http.NewRequest(r.Method, "http://"+r.Host+r.RequestURI, nil)
+	for _, name := range signed {
+		if name != "host" {
+			req.Header.Set(name, r.Header.Get(name))
+		}
+	}
+
+	signAWSRequestV4(req, sha256Hex(body), creds, region, service, now)
+
+	if expected := req.Header.Get("Authorization"); auth != expected {
+		return fmt.Errorf("wrong signature: %q, expected: %q", auth, expected)
+	}
+
+	return nil
+}
+
+func TestHTTPOutputAWSSigV4(t *testing.T) {
+	creds := AWSCredentials{AccessKey: "AKIDEXAMPLE", SecretKey: "secret", SessionToken: "token"}
+	os.Setenv("AWS_ACCESS_KEY_ID", creds.AccessKey)
+	os.Setenv("AWS_SECRET_ACCESS_KEY", creds.SecretKey)
+	os.Setenv("AWS_SESSION_TOKEN", creds.SessionToken)
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	defer os.Unsetenv("AWS_SESSION_TOKEN")
+
+	errors := make(chan error, 10)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		errors <- verifyAWSSignature(r, creds, "eu-west-1", "execute-api")
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	for _, http2 := range []bool{false, true} {
+		output := NewHTTPOutput(server.URL, &HTTPOutputConfig{Timeout: time.Second, HTTP2: http2, awsSigV4: "execute-api:eu-west-1"})
+
+		output.Write([]byte("1 1 1\nGET /stage/users/a%20b?b=2&a=1 HTTP/1.1\r\nHost: api.example.com\r\nAuthorization: AWS4-HMAC-SHA256 Credential=stale\r\nX-Amz-Date: 20150830T123600Z\r\nUser-Agent: test\r\n\r\n"))
+		output.Write([]byte("1 2 1\nPOST /stage/users HTTP/1.1\r\nHost: api.example.com\r\nContent-Type: application/json\r\nTransfer-Encoding: chunked\r\n\r\n4\r\n{\"a\"\r\n3\r\n: 1\r\n1\r\n}\r\n0\r\n\r\n"))
+
+		for i := 0; i < 2; i++ {
+			select {
+			case err := <-errors:
+				if err != nil {
+					t.Error("HTTP/2:", http2, err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("HTTP/2:", http2, "Request not received")
+			}
+		}
+	}
+}
+
+func TestAWSSignerAssumeRole(t *testing.T) {
+	base := AWSCredentials{AccessKey: "AKIDEXAMPLE", SecretKey: "secret"}
+	os.Setenv("AWS_ACCESS_KEY_ID", base.AccessKey)
+	os.Setenv("AWS_SECRET_ACCESS_KEY", base.SecretKey)
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	calls := 0
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := verifyAWSSignature(r, base, "us-east-1", "sts"); err != nil {
+			t.Error(err)
+		}
+		calls++
+
+		fmt.Fprintf(w, "<AssumeRoleResponse><AssumeRoleResult><Credentials><AccessKeyId>ASIA%d</AccessKeyId><SecretAccessKey>role-secret</SecretAccessKey><SessionToken>role-token</SessionToken><Expiration>%s</Expiration></Credentials></AssumeRoleResult></AssumeRoleResponse>",
+			calls, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer sts.Close()
+
+	os.Setenv("AWS_ENDPOINT_URL_STS", sts.URL)
+	defer os.Unsetenv("AWS_ENDPOINT_URL_STS")
+
+	signer, err := newAWSSigner("s3:us-east-1", "arn:aws:iam::123456789012:role/replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	payload, err := signer.sign([]byte("GET /bucket/key HTTP/1.1\r\nHost: s3.amazonaws.com\r\n\r\n"), "s3.amazonaws.com", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(payload), "Credential=ASIA1/") || !strings.Contains(string(payload), "X-Amz-Security-Token: role-token") {
+		t.Errorf("Should be signed with role credentials: %q", payload)
+	}
+
+	// Credentials are cached until they are about to expire
+	signer.sign(payload, "s3.amazonaws.com", now.Add(30*time.Minute))
+	signer.sign(payload, "s3.amazonaws.com", now.Add(time.Hour))
+
+	if calls != 2 {
+		t.Error("Role should be assumed again only after credentials expire", calls)
+	}
+}
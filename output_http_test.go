@@ -1,14 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	_ "net/http/httputil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/buger/gor/proto"
 )
 
 func TestHTTPOutput(t *testing.T) {
@@ -152,3 +162,285 @@ func BenchmarkHTTPOutput(b *testing.B) {
 
 	close(quit)
 }
+
+func TestHTTPOutputOriginalLatency(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{Timeout: time.Second, TrackResponses: true})
+
+	// Original response can come before or after replayed one
+	output.Write([]byte("2 a 1 100\nHTTP/1.1 200 OK\r\n\r\n"))
+	output.Write([]byte("1 a 1\nGET / HTTP/1.1\r\n\r\n"))
+	output.Write([]byte("1 b 1\nGET / HTTP/1.1\r\n\r\n"))
+
+	data := make([]byte, 1024)
+	n, _ := output.(io.Reader).Read(data)
+	if meta := payloadMeta(data[:n]); len(meta) != 5 || string(meta[1]) != "a" || string(meta[4]) != "100" {
+		t.Errorf("Replayed response should have original latency: %q", meta)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	output.Write([]byte("2 b 1 200\nHTTP/1.1 200 OK\r\n\r\n"))
+
+	n, _ = output.(io.Reader).Read(data)
+	if meta := payloadMeta(data[:n]); len(meta) != 5 || string(meta[1]) != "b" || string(meta[4]) != "200" {
+		t.Errorf("Replayed response should wait for original latency: %q", meta)
+	}
+}
+
+func TestHTTPOutputLatencyReport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "gor_latency")
+	defer os.RemoveAll(dir)
+	report := filepath.Join(dir, "latency.jsonl")
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{Timeout: time.Second, latencyReport: report, latencyReportInterval: 100 * time.Millisecond})
+
+	for i, id := range []string{"1", "2", "3"} {
+		output.Write([]byte("2 " + id + " 1 " + strconv.Itoa((i+1)*int(time.Second)) + "\nHTTP/1.1 200 OK\r\n\r\n"))
+		output.Write([]byte("1 " + id + " 1\nGET /users/" + id + "?full=1 HTTP/1.1\r\n\r\n"))
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	data, _ := ioutil.ReadFile(report)
+
+	var line latencyReportLine
+	json.Unmarshal(bytes.SplitN(data, []byte("\n"), 2)[0], &line)
+
+	if line.Endpoint != "GET /users/{id}" || line.Count != 3 || line.OriginalP50 != 2000 || line.OriginalP95 != 3000 || line.DeltaP50 >= 0 {
+		t.Errorf("Wrong latency report: %s", data)
+	}
+}
+
+func TestHTTPOutputHTTP2(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 2 {
+			t.Error("Should use HTTP/2", req.Proto)
+		}
+
+		if user, pass, _ := req.BasicAuth(); user != "user" || pass != "pass" {
+			t.Error("Wrong auth", user, pass)
+		}
+
+		body, _ := ioutil.ReadAll(req.Body)
+
+		// Concurrent requests should be in flight at the same time
+		time.Sleep(50 * time.Millisecond)
+
+		w.Header().Set("X-Remote", req.RemoteAddr)
+		w.Write(append([]byte(req.Method+" "+req.URL.Path+" "), body...))
+	})
+
+	server := httptest.NewUnstartedServer(handler)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	address := strings.Replace(server.URL, "://", "://user:pass@", 1)
+	output := NewHTTPOutput(address, &HTTPOutputConfig{Timeout: time.Second, TrackResponses: true, HTTP2: true})
+
+	output.Write([]byte("1 a 1\nPOST /chunked HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n"))
+	for i := 0; i < 20; i++ {
+		output.Write([]byte("1 b 1\nGET /get HTTP/1.1\r\nHost: example.com\r\nConnection: keep-alive\r\n\r\n"))
+	}
+
+	remotes := make(map[string]bool)
+	data := make([]byte, 1024)
+
+	for i := 0; i < 21; i++ {
+		n, _ := output.(io.Reader).Read(data)
+		payload := payloadBody(data[:n])
+
+		if !strings.HasPrefix(string(payload), "HTTP/1.1 200 OK\r\n") {
+			t.Fatalf("Wrong response %q", payload)
+		}
+
+		if body := string(proto.Body(payload)); body != "POST /chunked abc" && body != "GET /get " {
+			t.Errorf("Wrong body %q", body)
+		}
+
+		remotes[string(proto.Header(payload, []byte("X-Remote")))] = true
+	}
+
+	if len(remotes) != 1 {
+		t.Error("Requests should be multiplexed over single connection", remotes)
+	}
+}
+
+func TestHTTPOutputMaxConns(t *testing.T) {
+	var mu sync.Mutex
+	var active, maxActive int
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{Timeout: time.Second, TrackResponses: true, maxConns: 2})
+
+	for i := 0; i < 20; i++ {
+		output.Write([]byte("1 a 1\nGET / HTTP/1.1\r\n\r\n"))
+	}
+
+	data := make([]byte, 1024)
+	for i := 0; i < 20; i++ {
+		output.(io.Reader).Read(data)
+	}
+
+	if maxActive != 2 {
+		t.Error("Should use at most 2 connections", maxActive)
+	}
+}
+
+func TestHTTPOutputQueuePolicy(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{Timeout: time.Second, workers: 1, maxQueue: 2, queuePolicy: queueDropNewest})
+
+	// Single worker is busy with the first request, and the next two are queued
+	output.Write([]byte("1 a 1\nGET / HTTP/1.1\r\n\r\n"))
+	for i := 0; i < 100 && output.(*HTTPOutput).queue.Len() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 9; i++ {
+			output.Write([]byte("1 a 1\nGET / HTTP/1.1\r\n\r\n"))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Input should not be blocked")
+	}
+
+	if dropped := output.(*HTTPOutput).queue.Dropped(); dropped != 7 {
+		t.Error("Should drop requests, which don't fit in queue", dropped)
+	}
+}
+
+func TestHTTPOutputAutoscale(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{Timeout: time.Second, workersMin: 12, workersMax: 15, targetLatency: 10 * time.Millisecond})
+	o := output.(*HTTPOutput)
+
+	for i := 0; i < 300; i++ {
+		output.Write([]byte("1 a 1\nGET / HTTP/1.1\r\n\r\n"))
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	if workers := atomic.LoadInt64(&o.activeWorkers); workers != 15 {
+		t.Error("Should scale up to maximum workers", workers)
+	}
+
+	// Idle workers stop after 2 seconds
+	for i := 0; i < 50 && atomic.LoadInt64(&o.activeWorkers) > 12; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if workers := atomic.LoadInt64(&o.activeWorkers); workers != 12 || atomic.LoadInt64(&o.scaledDown) != 3 {
+		t.Error("Should scale down to minimum workers", workers)
+	}
+}
+
+func TestHTTPOutputBodyEncoding(t *testing.T) {
+	type received struct {
+		encoding string
+		length   int64
+		body     []byte
+	}
+
+	requests := make(chan received, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- received{r.Header.Get("Content-Encoding"), r.ContentLength, body}
+	}))
+	defer server.Close()
+
+	chunked := []byte("1 1 1\nPOST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n3\r\ndef\r\n0\r\n\r\n")
+	encoded := []byte("1 2 1\nPOST / HTTP/1.1\r\nContent-Encoding: br\r\nContent-Length: 3\r\n\r\nabc")
+
+	gunzip := func(body []byte) string {
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return err.Error()
+		}
+		data, _ := ioutil.ReadAll(r)
+		return string(data)
+	}
+
+	testCases := []struct {
+		encoding string
+		payload  []byte
+		check    func(received) bool
+	}{
+		{bodyEncodingGzip, chunked, func(r received) bool {
+			return r.encoding == "gzip" && r.length == int64(len(r.body)) && gunzip(r.body) == "abcdef"
+		}},
+		// Already encoded body is not compressed twice
+		{bodyEncodingGzip, encoded, func(r received) bool { return r.encoding == "br" && string(r.body) == "abc" }},
+		{bodyEncodingPreserve, chunked, func(r received) bool { return r.encoding == "" && string(r.body) == "abcdef" }},
+	}
+
+	for _, tc := range testCases {
+		output := NewHTTPOutput(server.URL, &HTTPOutputConfig{Timeout: time.Second, workers: 1, bodyEncoding: tc.encoding})
+		output.Write(tc.payload)
+
+		select {
+		case r := <-requests:
+			if !tc.check(r) {
+				t.Errorf("%s: unexpected request %q %d %q", tc.encoding, r.encoding, r.length, r.body)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: request not received", tc.encoding)
+		}
+	}
+}
+
+func TestTargetBodyEncoding(t *testing.T) {
+	hosts := []string{"waf.*=gzip", "*.staging.com=preserve"}
+
+	for address, expected := range map[string]string{
+		"https://waf.staging.com:8080": bodyEncodingGzip,
+		"api.staging.com":              bodyEncodingPreserve,
+		"localhost:8080":               "",
+	} {
+		if encoding, err := targetBodyEncoding(address, "", hosts); err != nil || encoding != expected {
+			t.Errorf("%s: expected %q, got %q %v", address, expected, encoding, err)
+		}
+	}
+
+	for _, option := range []string{"gzip", "waf.*=br", "[=gzip"} {
+		if _, err := targetBodyEncoding("staging.com", "", []string{option}); err == nil {
+			t.Error("Should not accept", option)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// httpClientCerts holds client certificates for mutual TLS, selected by target host
+type httpClientCerts struct {
+	defaultCert *tls.Certificate
+	hosts       []string
+	certs       []*tls.Certificate
+}
+
+// loadHTTPClientCerts loads default certificate, and per host certificates set as `<host pattern>=<cert file>,<key file>`
+func loadHTTPClientCerts(certFile, keyFile string, hostCerts []string) (*httpClientCerts, error) {
+	c := &httpClientCerts{}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("both client certificate and key should be set")
+		}
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.defaultCert = &cert
+	}
+
+	for _, option := range hostCerts {
+		idx := strings.IndexByte(option, '=')
+		files := strings.Split(option[idx+1:], ",")
+		if idx <= 0 || len(files) != 2 {
+			return nil, errors.New("host certificate should be set as '<host>=<cert file>,<key file>': " + option)
+		}
+
+		host := strings.ToLower(option[:idx])
+		if _, err := path.Match(host, ""); err != nil {
+			return nil, errors.New("wrong host pattern: " + host)
+		}
+
+		cert, err := tls.LoadX509KeyPair(files[0], files[1])
+		if err != nil {
+			return nil, err
+		}
+
+		c.hosts = append(c.hosts, host)
+		c.certs = append(c.certs, &cert)
+	}
+
+	return c, nil
+}
+
+// forAddress returns certificate for target address. First matching host pattern wins, otherwise default certificate is used.
+func (c *httpClientCerts) forAddress(address string) *tls.Certificate {
+	host, err := addressHost(address)
+	if err != nil {
+		return c.defaultCert
+	}
+
+	for i, pattern := range c.hosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return c.certs[i]
+		}
+	}
+
+	return c.defaultCert
+}
+
+// addressHost returns lower case host of target address, without scheme and port
+func addressHost(address string) (string, error) {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", err
+	}
+
+	host := strings.ToLower(u.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return host, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// baseTLSConfig returns TLS settings shared by all targets: verification of server certificates and TLS versions
+func (c *HTTPOutputConfig) baseTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: !c.verifyTLS && len(c.caCerts) == 0}
+
+	if len(c.caCerts) > 0 {
+		var err error
+		if config.RootCAs, err = loadCertPool(c.caCerts); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, v := range []struct {
+		value  string
+		target *uint16
+	}{{c.tlsMinVersion, &config.MinVersion}, {c.tlsMaxVersion, &config.MaxVersion}} {
+		if v.value == "" {
+			continue
+		}
+
+		version, ok := tlsVersions[v.value]
+		if !ok {
+			return nil, errors.New("unknown TLS version: " + v.value)
+		}
+		*v.target = version
+	}
+
+	return config, nil
+}
+
+// loadCertPool loads CA certificates in PEM format, each file can contain multiple certificates
+func loadCertPool(files []string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+
+	for _, file := range files {
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no CA certificates found in " + file)
+		}
+	}
+
+	return pool, nil
+}
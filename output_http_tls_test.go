@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes self-signed certificate with given common name, and its key to dir
+func writeTestCert(t *testing.T, dir, name string) (certFile, keyFile string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	return
+}
+
+func TestHTTPOutputClientCert(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_tls")
+	defer os.RemoveAll(dir)
+
+	defaultCert, defaultKey := writeTestCert(t, dir, "default")
+	hostCert, hostKey := writeTestCert(t, dir, "host")
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	for name, tc := range map[string]struct {
+		config   HTTPOutputConfig
+		expected string
+	}{
+		"Default":         {HTTPOutputConfig{tlsCert: defaultCert, tlsKey: defaultKey}, "default"},
+		"Host":            {HTTPOutputConfig{tlsCert: defaultCert, tlsKey: defaultKey, tlsHostCerts: MultiOption{"127.0.0.*=" + hostCert + "," + hostKey}}, "host"},
+		"HTTP/2":          {HTTPOutputConfig{tlsCert: defaultCert, tlsKey: defaultKey, HTTP2: true}, "default"},
+		"No certificate":  {HTTPOutputConfig{}, ""},
+		"Other host cert": {HTTPOutputConfig{tlsHostCerts: MultiOption{"example.com=" + hostCert + "," + hostKey}}, ""},
+	} {
+		config := tc.config
+		config.Timeout = time.Second
+		config.TrackResponses = true
+
+		output := NewHTTPOutput(server.URL, &config)
+		output.Write([]byte("1 a 1\nGET / HTTP/1.1\r\n\r\n"))
+
+		data := make([]byte, 1024)
+		n, _ := output.(*HTTPOutput).Read(data)
+		resp := string(payloadBody(data[:n]))
+
+		if tc.expected == "" {
+			if strings.HasPrefix(resp, "HTTP/1.1 200") {
+				t.Error(name, "Should fail without client certificate")
+			}
+		} else if !strings.HasSuffix(resp, "\r\n\r\n"+tc.expected) {
+			t.Errorf("%s: Wrong client certificate: %q", name, resp)
+		}
+	}
+}
+
+func TestLoadHTTPClientCerts(t *testing.T) {
+	if _, err := loadHTTPClientCerts("client.crt", "", nil); err == nil {
+		t.Error("Should require both certificate and key")
+	}
+
+	if _, err := loadHTTPClientCerts("", "", []string{"example.com"}); err == nil {
+		t.Error("Should require host certificate files")
+	}
+}
+
+func TestHTTPOutputTLSVerify(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_tls")
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	ca := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+
+	for name, tc := range map[string]struct {
+		config HTTPOutputConfig
+		ok     bool
+	}{
+		"Skip verify":       {HTTPOutputConfig{}, true},
+		"Unknown CA":        {HTTPOutputConfig{verifyTLS: true}, false},
+		"Custom CA":         {HTTPOutputConfig{caCerts: MultiOption{ca}}, true},
+		"Custom CA, HTTP/2": {HTTPOutputConfig{caCerts: MultiOption{ca}, HTTP2: true}, true},
+		"Min version":       {HTTPOutputConfig{tlsMinVersion: "1.3"}, false},
+	} {
+		config := tc.config
+		config.Timeout = time.Second
+		config.TrackResponses = true
+
+		output := NewHTTPOutput(server.URL, &config)
+		output.Write([]byte("1 a 1\nGET / HTTP/1.1\r\n\r\n"))
+
+		data := make([]byte, 1024)
+		n, _ := output.(*HTTPOutput).Read(data)
+
+		if ok := strings.HasPrefix(string(payloadBody(data[:n])), "HTTP/1.1 200"); ok != tc.ok {
+			t.Error(name, "Wrong result", ok)
+		}
+	}
+
+	if _, err := (&HTTPOutputConfig{tlsMaxVersion: "1.4"}).baseTLSConfig(); err == nil {
+		t.Error("Should reject unknown TLS version")
+	}
+}
@@ -30,6 +30,13 @@ type KafkaMessage struct {
 	ReqMethod  string            `json:"Req_Method"`
 	ReqBody    string            `json:"Req_Body,omitempty"`
 	ReqHeaders map[string]string `json:"Req_Headers,omitempty"`
+
+	// Responses are linked to request by id
+	Type        string            `json:"Type,omitempty"`
+	ID          string            `json:"ID,omitempty"`
+	RespStatus  string            `json:"Resp_Status,omitempty"`
+	RespBody    string            `json:"Resp_Body,omitempty"`
+	RespHeaders map[string]string `json:"Resp_Headers,omitempty"`
 }
 
 // KafkaOutputFrequency in milliseconds
@@ -78,11 +85,25 @@ func (o *KafkaOutput) Write(data []byte) (n int, err error) {
 
 	req := payloadBody(data)
 
-	kafkaMessage := KafkaMessage{
-		ReqURL:     string(proto.Path(req)),
-		ReqMethod:  string(proto.Method(req)),
-		ReqBody:    string(proto.Body(req)),
-		ReqHeaders: headers,
+	var kafkaMessage KafkaMessage
+	if isResponsePayload(data) {
+		kafkaMessage = KafkaMessage{
+			RespStatus:  string(proto.Status(req)),
+			RespBody:    string(proto.Body(req)),
+			RespHeaders: headers,
+		}
+	} else {
+		kafkaMessage = KafkaMessage{
+			ReqURL:     string(proto.Path(req)),
+			ReqMethod:  string(proto.Method(req)),
+			ReqBody:    string(proto.Body(req)),
+			ReqHeaders: headers,
+		}
+	}
+
+	kafkaMessage.Type = payloadKinds[data[0]]
+	if meta := payloadMeta(data); len(meta) > 1 {
+		kafkaMessage.ID = string(meta[1])
 	}
 	jsonMessage, _ := json.Marshal(&kafkaMessage)
 	message := sarama.StringEncoder(jsonMessage)
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/gor/proto"
+)
+
+// ParquetOutputConfig holds settings of Parquet output
+type ParquetOutputConfig struct {
+	// Max rows in a single file
+	rowsPerFile int
+	// Max size of buffered data, file is written when reached
+	sizeLimit unitSizeVar
+	// File is written at least once per interval, if there are buffered rows
+	flushInterval time.Duration
+}
+
+// parquetRow is a single request or response, fields set to nil are written as nulls
+type parquetRow struct {
+	kind    string
+	id      []byte
+	ts      int64
+	latency []byte
+	method  []byte
+	path    []byte
+	status  []byte
+	headers [][2][]byte
+	body    []byte
+}
+
+var payloadKinds = map[byte]string{
+	RequestPayload:          "request",
+	ResponsePayload:         "response",
+	ReplayedResponsePayload: "replayed_response",
+}
+
+// ParquetOutput writes requests and responses as Parquet rows, so they can be queried by Athena, BigQuery or Spark.
+// Rows are buffered in memory, and each file is written at once, as a single row group.
+type ParquetOutput struct {
+	mu       sync.Mutex
+	path     string
+	config   *ParquetOutputConfig
+	rows     []parquetRow
+	size     int
+	index    int
+	lastSave time.Time
+	closed   bool
+}
+
+// NewParquetOutput constructor for ParquetOutput, accepts path of output files, which get `_N` suffix
+func NewParquetOutput(path string, config *ParquetOutputConfig) *ParquetOutput {
+	o := &ParquetOutput{path: path, config: config, lastSave: time.Now()}
+
+	// Continue numbering after existing files
+	ext := filepath.Ext(path)
+	if matches, err := filepath.Glob(strings.TrimSuffix(path, ext) + "_*" + ext); err == nil && len(matches) > 0 {
+		sort.Sort(sortByFileIndex(matches))
+		o.index = getFileIndex(matches[len(matches)-1]) + 1
+	}
+
+	if config.flushInterval > 0 {
+		go func() {
+			for {
+				time.Sleep(time.Second)
+
+				o.mu.Lock()
+				if o.closed {
+					o.mu.Unlock()
+					return
+				}
+				if len(o.rows) > 0 && time.Since(o.lastSave) >= config.flushInterval {
+					o.save()
+				}
+				o.mu.Unlock()
+			}
+		}()
+	}
+
+	return o
+}
+
+func (o *ParquetOutput) Write(data []byte) (n int, err error) {
+	meta := payloadMeta(data)
+	if len(meta) < 3 {
+		return len(data), nil
+	}
+
+	kind, ok := payloadKinds[data[0]]
+	if !ok {
+		return len(data), nil
+	}
+
+	// Data buffer is reused by caller
+	payload := make([]byte, len(data))
+	copy(payload, data)
+	meta = payloadMeta(payload)
+	body := payloadBody(payload)
+
+	row := parquetRow{kind: kind, id: meta[1], body: proto.Body(body)}
+	row.ts, _ = strconv.ParseInt(string(meta[2]), 10, 64)
+
+	if len(meta) > 3 && len(meta[3]) > 0 && !isPayloadLabel(meta[3]) {
+		row.latency = meta[3]
+	}
+
+	if data[0] == RequestPayload {
+		row.method = proto.Method(body)
+		row.path = proto.Path(body)
+	} else {
+		row.status = proto.Status(body)
+	}
+
+	row.headers = [][2][]byte{}
+	proto.ParseHeaders([][]byte{body}, func(header []byte, value []byte) bool {
+		row.headers = append(row.headers, [2][]byte{header, value})
+		return true
+	})
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.rows = append(o.rows, row)
+	o.size += len(payload)
+
+	if (o.config.rowsPerFile > 0 && len(o.rows) >= o.config.rowsPerFile) ||
+		(o.config.sizeLimit > 0 && o.size >= int(o.config.sizeLimit)) {
+		o.save()
+	}
+
+	return len(data), nil
+}
+
+// columns converts buffered rows to Parquet columns
+func (o *ParquetOutput) columns() []*parquetColumn {
+	column := func(typ int32, maxDef, maxRep int, path ...string) *parquetColumn {
+		return &parquetColumn{path: path, typ: typ, maxDef: maxDef, maxRep: maxRep}
+	}
+
+	kind := column(parquetByteArray, 0, 0, "type")
+	id := column(parquetByteArray, 0, 0, "id")
+	ts := column(parquetInt64, 0, 0, "timestamp")
+	latency := column(parquetInt64, 1, 0, "latency")
+	method := column(parquetByteArray, 1, 0, "method")
+	path := column(parquetByteArray, 1, 0, "path")
+	status := column(parquetInt32, 1, 0, "status")
+	key := column(parquetByteArray, 2, 1, "headers", "key_value", "key")
+	value := column(parquetByteArray, 3, 1, "headers", "key_value", "value")
+	body := column(parquetByteArray, 1, 0, "body")
+
+	optionalBinary := func(c *parquetColumn, v []byte) {
+		if v == nil {
+			c.add(0, 0, nil)
+		} else {
+			c.add(0, 1, parquetPlainBinary(v))
+		}
+	}
+
+	for _, r := range o.rows {
+		kind.add(0, 0, parquetPlainBinary([]byte(r.kind)))
+		id.add(0, 0, parquetPlainBinary(r.id))
+		ts.add(0, 0, parquetPlainInt64(r.ts/int64(time.Microsecond)))
+
+		if l, err := strconv.ParseInt(string(r.latency), 10, 64); err == nil {
+			latency.add(0, 1, parquetPlainInt64(l))
+		} else {
+			latency.add(0, 0, nil)
+		}
+
+		optionalBinary(method, r.method)
+		optionalBinary(path, r.path)
+
+		if s, err := strconv.Atoi(string(r.status)); err == nil {
+			status.add(0, 1, parquetPlainInt32(int32(s)))
+		} else {
+			status.add(0, 0, nil)
+		}
+
+		// Empty map is defined on level 1, each entry on level 2, and non null value on level 3
+		if len(r.headers) == 0 {
+			key.add(0, 1, nil)
+			value.add(0, 1, nil)
+		}
+		for i, h := range r.headers {
+			rep := 1
+			if i == 0 {
+				rep = 0
+			}
+			key.add(rep, 2, parquetPlainBinary(h[0]))
+			value.add(rep, 3, parquetPlainBinary(h[1]))
+		}
+
+		optionalBinary(body, r.body)
+	}
+
+	return []*parquetColumn{kind, id, ts, latency, method, path, status, key, value, body}
+}
+
+var parquetOutputSchema = []parquetSchemaElement{
+	{name: "gor", repetition: -1, children: 9, convertedType: parquetNoConvertedType},
+	{name: "type", typ: parquetByteArray, repetition: parquetRequired, convertedType: parquetUTF8},
+	{name: "id", typ: parquetByteArray, repetition: parquetRequired, convertedType: parquetUTF8},
+	{name: "timestamp", typ: parquetInt64, repetition: parquetRequired, convertedType: parquetTimestampMicros},
+	{name: "latency", typ: parquetInt64, repetition: parquetOptional, convertedType: parquetNoConvertedType},
+	{name: "method", typ: parquetByteArray, repetition: parquetOptional, convertedType: parquetUTF8},
+	{name: "path", typ: parquetByteArray, repetition: parquetOptional, convertedType: parquetUTF8},
+	{name: "status", typ: parquetInt32, repetition: parquetOptional, convertedType: parquetNoConvertedType},
+	{name: "headers", repetition: parquetOptional, children: 1, convertedType: parquetMap},
+	{name: "key_value", repetition: parquetRepeated, children: 2, convertedType: parquetNoConvertedType},
+	{name: "key", typ: parquetByteArray, repetition: parquetRequired, convertedType: parquetUTF8},
+	{name: "value", typ: parquetByteArray, repetition: parquetOptional, convertedType: parquetUTF8},
+	{name: "body", typ: parquetByteArray, repetition: parquetOptional, convertedType: parquetNoConvertedType},
+}
+
+// save writes buffered rows to the next file. File is written under temporary name and renamed,
+// so readers never see incomplete files.
+func (o *ParquetOutput) save() {
+	if len(o.rows) == 0 {
+		return
+	}
+
+	name := setFileIndex(o.path, o.index)
+	tmp := filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+
+	file, err := os.Create(tmp)
+	if err != nil {
+		log.Println("[PARQUET-OUTPUT] Can't create file", tmp, err)
+		return
+	}
+
+	w := bufio.NewWriter(file)
+	err = writeParquetFile(w, parquetOutputSchema, o.columns(), len(o.rows))
+	if err == nil {
+		err = w.Flush()
+	}
+	file.Close()
+
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+
+	if err != nil {
+		log.Println("[PARQUET-OUTPUT] Can't write file", name, err)
+		os.Remove(tmp)
+		return
+	}
+
+	Debug("[PARQUET-OUTPUT] Written", len(o.rows), "rows to", name)
+
+	o.index++
+	o.rows = nil
+	o.size = 0
+	o.lastSave = time.Now()
+}
+
+func (o *ParquetOutput) String() string {
+	return "Parquet output: " + o.path
+}
+
+// Close writes buffered rows
+func (o *ParquetOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.save()
+	o.closed = true
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestParquetOutput(t *testing.T) {
+	name := fmt.Sprintf("/tmp/%d.parquet", rand.Int63())
+	output := NewParquetOutput(name, &ParquetOutputConfig{rowsPerFile: 2})
+
+	output.Write([]byte("1 a 1500000000000000000\nPOST /test?a=1 HTTP/1.1\r\nHost: example.org\r\nContent-Length: 4\r\n\r\nbody"))
+	output.Write([]byte("2 a 1500000000000000000 250\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	output.Write([]byte("1 b 1500000001000000000\nGET / HTTP/1.1\r\n\r\n"))
+	output.Close()
+
+	for i, rows := range []int64{2, 1} {
+		file := setFileIndex(name, i)
+		defer os.Remove(file)
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.HasPrefix(data, parquetMagic) || !bytes.HasSuffix(data, parquetMagic) {
+			t.Fatal("Should be Parquet file:", file)
+		}
+
+		footerSize := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+		footer := data[len(data)-8-footerSize : len(data)-8]
+
+		// num_rows field of FileMetaData follows schema list: i64 type with field id delta 1
+		var rowsField bytes.Buffer
+		rowsField.WriteByte(1<<4 | thriftI64)
+		rowsField.WriteByte(byte(rows << 1))
+		if !bytes.Contains(footer, rowsField.Bytes()) || !bytes.Contains(footer, []byte("key_value")) {
+			t.Errorf("Wrong footer of %s: %q", file, footer)
+		}
+	}
+
+	data, _ := ioutil.ReadFile(setFileIndex(name, 0))
+	for _, value := range []string{"POST", "/test?a=1", "example.org", "body", "ok"} {
+		if !bytes.Contains(data, parquetPlainBinary([]byte(value))) {
+			t.Error("Value should be written:", value)
+		}
+	}
+}
+
+func TestThriftWriter(t *testing.T) {
+	w := newThriftWriter()
+	w.structBegin()
+	w.i32(1, 3)
+	w.i64(20, -1)
+	w.list(21, thriftBinary, 1)
+	w.binaryElem([]byte("a"))
+	w.structEnd()
+
+	expected := []byte{0x15, 6, 0x06, 40, 1, 0x19, 0x18, 1, 'a', 0}
+	if !bytes.Equal(w.buf.Bytes(), expected) {
+		t.Errorf("Wrong encoding: %v", w.buf.Bytes())
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -16,15 +18,34 @@ type TCPOutput struct {
 	limit    int
 	buf      chan []byte
 	bufStats *GorStat
+	// Set if connections use TLS
+	tlsConfig *tls.Config
+}
+
+// TCPOutputConfig struct for holding TCP output configuration
+type TCPOutputConfig struct {
+	// Connect over TLS. Enabled by CA or client certificate as well.
+	secure bool
+	// Server certificate is verified with these CAs, by default with system ones
+	caCerts    MultiOption
+	skipVerify bool
+	// Client certificate and its key in PEM format, for mutual authentication
+	tlsCert string
+	tlsKey  string
 }
 
 // NewTCPOutput constructor for TCPOutput
 // Initialize 10 workers which hold keep-alive connection
-func NewTCPOutput(address string) io.Writer {
+func NewTCPOutput(address string, config *TCPOutputConfig) io.Writer {
 	o := new(TCPOutput)
 
 	o.address = address
 
+	var err error
+	if o.tlsConfig, err = config.tlsConfig(); err != nil {
+		log.Fatal("[OUTPUT-TCP] TLS: ", err)
+	}
+
 	o.buf = make(chan []byte, 100)
 	if Settings.outputTCPStats {
 		o.bufStats = NewGorStat("output_tcp")
@@ -71,7 +92,7 @@ func (o *TCPOutput) worker() {
 }
 
 func (o *TCPOutput) Write(data []byte) (n int, err error) {
-	if !isOriginPayload(data) {
+	if !isStoredPayload(data) {
 		return len(data), nil
 	}
 
@@ -89,11 +110,45 @@ func (o *TCPOutput) Write(data []byte) (n int, err error) {
 }
 
 func (o *TCPOutput) connect(address string) (conn net.Conn, err error) {
+	if o.tlsConfig != nil {
+		return tls.Dial("tcp", address, o.tlsConfig)
+	}
+
 	conn, err = net.Dial("tcp", address)
 
 	return
 }
 
+// tlsConfig returns TLS settings of connections, or nil if TLS is not enabled
+func (c *TCPOutputConfig) tlsConfig() (*tls.Config, error) {
+	if !c.secure && len(c.caCerts) == 0 && c.tlsCert == "" && c.tlsKey == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{InsecureSkipVerify: c.skipVerify, MinVersion: tls.VersionTLS12}
+
+	if len(c.caCerts) > 0 {
+		var err error
+		if config.RootCAs, err = loadCertPool(c.caCerts); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.tlsCert != "" || c.tlsKey != "" {
+		if c.tlsCert == "" || c.tlsKey == "" {
+			return nil, errors.New("both client certificate and key should be set")
+		}
+
+		cert, err := tls.LoadX509KeyPair(c.tlsCert, c.tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
 func (o *TCPOutput) String() string {
 	return fmt.Sprintf("TCP output %s, limit: %d", o.address, o.limit)
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// Max size of UDP payload over IPv4
+const udpMaxDatagramSize = 65507
+
+// UDPOutputConfig struct for holding UDP output configuration
+type UDPOutputConfig struct {
+	Timeout        time.Duration
+	TrackResponses bool
+}
+
+// UDPOutput replays captured UDP request datagrams to given address.
+// When responses are tracked, each datagram is sent from new socket, so response can be matched to its request.
+type UDPOutput struct {
+	address   string
+	config    *UDPOutputConfig
+	queue     chan []byte
+	responses chan response
+}
+
+// NewUDPOutput constructor for UDPOutput
+// Initialize 10 workers
+func NewUDPOutput(address string, config *UDPOutputConfig) io.Writer {
+	o := new(UDPOutput)
+
+	o.address = address
+	o.config = config
+
+	o.queue = make(chan []byte, 1000)
+	o.responses = make(chan response, 1000)
+
+	if len(Settings.middleware) > 0 {
+		o.config.TrackResponses = true
+	}
+
+	for i := 0; i < 10; i++ {
+		go o.worker()
+	}
+
+	return o
+}
+
+func (o *UDPOutput) worker() {
+	var conn net.Conn
+	var err error
+
+	for data := range o.queue {
+		if o.config.TrackResponses {
+			o.sendTracked(data)
+			continue
+		}
+
+		if conn == nil {
+			if conn, err = net.Dial("udp", o.address); err != nil {
+				log.Println("[OUTPUT-UDP] Can't resolve", o.address, err)
+				continue
+			}
+		}
+
+		if _, err = conn.Write(payloadBody(data)); err != nil {
+			Debug("[OUTPUT-UDP] Write error:", err)
+		}
+	}
+}
+
+// sendTracked sends datagram from new socket, and waits for the first response
+func (o *UDPOutput) sendTracked(data []byte) {
+	meta := payloadMeta(data)
+	if len(meta) < 2 {
+		return
+	}
+
+	conn, err := net.Dial("udp", o.address)
+	if err != nil {
+		log.Println("[OUTPUT-UDP] Can't resolve", o.address, err)
+		return
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if _, err = conn.Write(payloadBody(data)); err != nil {
+		Debug("[OUTPUT-UDP] Write error:", err)
+		return
+	}
+
+	buf := make([]byte, udpMaxDatagramSize)
+	conn.SetReadDeadline(start.Add(o.config.Timeout))
+
+	n, err := conn.Read(buf)
+	if err != nil {
+		Debug("[OUTPUT-UDP] No response:", err)
+		return
+	}
+
+	o.responses <- response{buf[:n], meta[1], start.UnixNano(), time.Since(start).Nanoseconds(), -1}
+}
+
+func (o *UDPOutput) Write(data []byte) (n int, err error) {
+	if data[0] != UDPRequestPayload {
+		return len(data), nil
+	}
+
+	// We have to copy, because sending data in multiple threads
+	buf := make([]byte, len(data))
+	copy(buf, data)
+
+	o.queue <- buf
+
+	return len(data), nil
+}
+
+func (o *UDPOutput) Read(data []byte) (int, error) {
+	resp := <-o.responses
+
+	header := payloadHeader(ReplayedResponsePayload, resp.uuid, resp.roundTripTime, resp.startedAt)
+	copy(data[0:len(header)], header)
+	copy(data[len(header):], resp.payload)
+
+	return len(resp.payload) + len(header), nil
+}
+
+func (o *UDPOutput) String() string {
+	return fmt.Sprintf("UDP output %s", o.address)
+}
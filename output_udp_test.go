@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPOutput(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			server.WriteTo(append([]byte("reply:"), buf[:n]...), addr)
+		}
+	}()
+
+	output := NewUDPOutput(server.LocalAddr().String(), &UDPOutputConfig{Timeout: time.Second, TrackResponses: true}).(*UDPOutput)
+
+	// HTTP requests and recorded responses are ignored
+	output.Write([]byte("1 1 1\nGET / HTTP/1.1\r\n\r\n"))
+	output.Write([]byte("5 2 1 1\n\x00reply"))
+	output.Write([]byte("4 2 1\n\x00\x01query"))
+
+	buf := make([]byte, 1024)
+	n, _ := output.Read(buf)
+	payload := buf[:n]
+
+	if payload[0] != ReplayedResponsePayload {
+		t.Error("Should emit replayed response", string(payload))
+	}
+
+	if id := payloadMeta(payload)[1]; !bytes.Equal(id, []byte("2")) {
+		t.Error("Response should have id of request", string(id))
+	}
+
+	if body := payloadBody(payload); !bytes.Equal(body, []byte("reply:\x00\x01query")) {
+		t.Errorf("Wrong response %q", body)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/gor/proto"
+)
+
+const (
+	// Replayed connections without frames for this time are closed
+	webSocketSessionExpire = 10 * time.Minute
+	webSocketOpClose       = 0x8
+)
+
+// WebSocketOutputConfig struct for holding WebSocket output configuration
+type WebSocketOutputConfig struct {
+	Timeout      time.Duration
+	OriginalHost bool
+}
+
+// WebSocketOutput replays WebSocket connections: handshake request is sent to given address,
+// and client frames recorded for it are replayed with original timing.
+type WebSocketOutput struct {
+	address string
+	host    string
+	useTLS  bool
+	config  *WebSocketOutputConfig
+
+	mu       sync.Mutex
+	sessions map[string]*webSocketSession
+}
+
+// webSocketSession is replayed connection, frames are queued until handshake is done
+type webSocketSession struct {
+	id     string
+	frames chan []byte
+	// Recorded time of handshake request
+	origStart int64
+}
+
+// NewWebSocketOutput constructor for WebSocketOutput, address is 'host:port', 'ws://host:port' or 'wss://host:port'
+func NewWebSocketOutput(address string, config *WebSocketOutputConfig) io.Writer {
+	o := new(WebSocketOutput)
+
+	o.config = config
+	o.sessions = make(map[string]*webSocketSession)
+
+	if !strings.Contains(address, "://") {
+		address = "ws://" + address
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		log.Fatal("[OUTPUT-WEBSOCKET] Wrong address: ", address)
+	}
+
+	o.useTLS = u.Scheme == "wss" || u.Scheme == "https"
+	o.host = u.Host
+	o.address = u.Host
+
+	if u.Port() == "" {
+		if o.useTLS {
+			o.address += ":443"
+		} else {
+			o.address += ":80"
+		}
+	}
+
+	return o
+}
+
+// isWebSocketHandshake checks if request asks to upgrade connection to WebSocket
+func isWebSocketHandshake(request []byte) bool {
+	return bytes.EqualFold(proto.Header(request, []byte("Upgrade")), []byte("websocket"))
+}
+
+func (o *WebSocketOutput) Write(data []byte) (n int, err error) {
+	meta := payloadMeta(data)
+	if len(meta) < 3 {
+		return len(data), nil
+	}
+
+	id := string(meta[1])
+
+	switch data[0] {
+	case RequestPayload:
+		if !isWebSocketHandshake(payloadBody(data)) {
+			return len(data), nil
+		}
+
+		ts, _ := strconv.ParseInt(string(meta[2]), 10, 64)
+		session := &webSocketSession{id: id, frames: make(chan []byte, 1000), origStart: ts}
+
+		o.mu.Lock()
+		o.sessions[id] = session
+		o.mu.Unlock()
+
+		go o.replay(session, append([]byte(nil), payloadBody(data)...))
+	case WebSocketClientPayload:
+		o.mu.Lock()
+		session, ok := o.sessions[id]
+		o.mu.Unlock()
+
+		if !ok {
+			return len(data), nil
+		}
+
+		select {
+		case session.frames <- append([]byte(nil), data...):
+		default:
+			Debug("[OUTPUT-WEBSOCKET] Dropping frame, connection is too slow:", id)
+		}
+	}
+
+	return len(data), nil
+}
+
+// replay establishes connection, and sends frames until client closes it
+func (o *WebSocketOutput) replay(session *webSocketSession, handshake []byte) {
+	defer func() {
+		o.mu.Lock()
+		delete(o.sessions, session.id)
+		o.mu.Unlock()
+	}()
+
+	conn, err := o.handshake(handshake)
+	if err != nil {
+		Debug("[OUTPUT-WEBSOCKET] Handshake error:", err)
+		return
+	}
+	defer conn.Close()
+
+	start := time.Now()
+
+	for {
+		select {
+		case payload := <-session.frames:
+			ts, _ := strconv.ParseInt(string(payloadMeta(payload)[2]), 10, 64)
+
+			// Keep original delay between handshake and frame
+			if delay := time.Duration(ts-session.origStart) - time.Since(start); delay > 0 {
+				time.Sleep(delay)
+			}
+
+			frame := payloadBody(payload)
+			if _, err := conn.Write(maskWebSocketFrame(frame)); err != nil {
+				Debug("[OUTPUT-WEBSOCKET] Write error:", err)
+				return
+			}
+
+			if len(frame) > 0 && frame[0]&0x0F == webSocketOpClose {
+				return
+			}
+		case <-time.After(webSocketSessionExpire):
+			return
+		}
+	}
+}
+
+// handshake sends upgrade request, and checks that server switched protocols
+func (o *WebSocketOutput) handshake(request []byte) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: o.config.Timeout}
+
+	var conn net.Conn
+	var err error
+
+	if o.useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", o.address, &tls.Config{InsecureSkipVerify: true})
+	} else {
+		conn, err = dialer.Dial("tcp", o.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !o.config.OriginalHost {
+		request = proto.SetHeader(request, []byte("Host"), []byte(o.host))
+	}
+
+	conn.SetDeadline(time.Now().Add(o.config.Timeout))
+
+	reader := bufio.NewReader(conn)
+	if _, err = conn.Write(request); err == nil {
+		var resp *http.Response
+		if resp, err = http.ReadResponse(reader, nil); err == nil && resp.StatusCode != http.StatusSwitchingProtocols {
+			err = errors.New("server did not switch protocols: " + resp.Status)
+		}
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	// Server frames are not replayed, but should be read
+	go io.Copy(ioutil.Discard, reader)
+
+	return conn, nil
+}
+
+// maskWebSocketFrame converts recorded frame to client frame, masked with random key
+func maskWebSocketFrame(frame []byte) []byte {
+	if len(frame) < 2 {
+		return frame
+	}
+
+	header := 2
+	switch frame[1] & 0x7F {
+	case 126:
+		header += 2
+	case 127:
+		header += 8
+	}
+
+	if len(frame) < header {
+		return frame
+	}
+
+	key := make([]byte, 4)
+	rand.Read(key)
+
+	masked := make([]byte, 0, len(frame)+len(key))
+	masked = append(masked, frame[:header]...)
+	masked[1] |= 0x80
+	masked = append(masked, key...)
+
+	for i, b := range frame[header:] {
+		masked = append(masked, b^key[i%4])
+	}
+
+	return masked
+}
+
+func (o *WebSocketOutput) String() string {
+	return "WebSocket output: " + o.address
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWebSocketOutput(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan []byte, 1)
+	hosts := make(chan string, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		hosts <- req.Host
+
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+
+		// Masked frame with 5 bytes payload
+		frame := make([]byte, 11)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return
+		}
+		received <- frame
+	}()
+
+	output := NewWebSocketOutput(listener.Addr().String(), &WebSocketOutputConfig{Timeout: time.Second})
+
+	start := time.Now().UnixNano()
+	output.Write([]byte("1 a " + strconv.FormatInt(start, 10) + "\nGET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\n\r\n"))
+	// Frames of other connections, and server frames are ignored
+	output.Write([]byte("6 b " + strconv.FormatInt(start, 10) + "\n\x81\x01x"))
+	output.Write([]byte("7 a " + strconv.FormatInt(start, 10) + "\n\x81\x01y"))
+	output.Write([]byte("6 a " + strconv.FormatInt(start+int64(50*time.Millisecond), 10) + "\n\x81\x05hello"))
+
+	select {
+	case host := <-hosts:
+		if host != listener.Addr().String() {
+			t.Error("Should replace Host header", host)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Should send handshake")
+	}
+
+	select {
+	case frame := <-received:
+		if time.Since(time.Unix(0, start)) < 50*time.Millisecond {
+			t.Error("Should keep original delay")
+		}
+
+		if frame[0] != 0x81 || frame[1] != 0x85 {
+			t.Errorf("Should be masked frame: %q", frame)
+		}
+
+		payload := frame[6:]
+		for i := range payload {
+			payload[i] ^= frame[2+i%4]
+		}
+
+		if !bytes.Equal(payload, []byte("hello")) {
+			t.Errorf("Wrong payload %q", payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Should send frame")
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Minimal Parquet writer: single row group, one data page per column, PLAIN encoding, no compression.
+// Format is described at https://github.com/apache/parquet-format
+var parquetMagic = []byte("PAR1")
+
+// Parquet physical types
+const (
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetByteArray = 6
+)
+
+// Parquet repetition types
+const (
+	parquetRequired = 0
+	parquetOptional = 1
+	parquetRepeated = 2
+)
+
+// Parquet converted (logical) types
+const (
+	parquetNoConvertedType = -1
+	parquetUTF8            = 0
+	parquetMap             = 1
+	parquetTimestampMicros = 10
+)
+
+const (
+	parquetEncodingPlain = 0
+	parquetEncodingRLE   = 3
+	parquetDataPage      = 0
+	parquetUncompressed  = 0
+)
+
+// parquetSchemaElement describes group (typ is 0 and children set) or leaf column
+type parquetSchemaElement struct {
+	name          string
+	typ           int32
+	repetition    int32
+	children      int
+	convertedType int32
+}
+
+// parquetColumn holds encoded data of a leaf column
+type parquetColumn struct {
+	path   []string
+	typ    int32
+	maxDef int
+	maxRep int
+
+	def    []int
+	rep    []int
+	values bytes.Buffer
+}
+
+// add appends levels of a single value (or null), and value itself if it is not nil
+func (c *parquetColumn) add(rep, def int, value []byte) {
+	if c.maxRep > 0 {
+		c.rep = append(c.rep, rep)
+	}
+	if c.maxDef > 0 {
+		c.def = append(c.def, def)
+	}
+	c.values.Write(value)
+}
+
+// numValues returns number of values including nulls
+func (c *parquetColumn) numValues() int {
+	switch {
+	case c.maxDef > 0:
+		return len(c.def)
+	case c.maxRep > 0:
+		return len(c.rep)
+	default:
+		return -1
+	}
+}
+
+func parquetPlainBinary(value []byte) []byte {
+	buf := make([]byte, 4+len(value))
+	binary.LittleEndian.PutUint32(buf, uint32(len(value)))
+	copy(buf[4:], value)
+
+	return buf
+}
+
+func parquetPlainInt64(value int64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(value))
+
+	return buf
+}
+
+func parquetPlainInt32(value int32) []byte {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, uint32(value))
+
+	return buf
+}
+
+// parquetLevels encodes levels with RLE hybrid encoding, prefixed by length. Only RLE runs are used.
+func parquetLevels(levels []int, maxLevel int) []byte {
+	width := 0
+	for l := maxLevel; l > 0; l >>= 1 {
+		width++
+	}
+
+	var runs bytes.Buffer
+	varint := make([]byte, binary.MaxVarintLen64)
+
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+
+		n := binary.PutUvarint(varint, uint64(j-i)<<1)
+		runs.Write(varint[:n])
+		// Value is stored in ceil(width/8) bytes, levels are always smaller than 256
+		if width > 0 {
+			runs.WriteByte(byte(levels[i]))
+		}
+
+		i = j
+	}
+
+	buf := make([]byte, 4, 4+runs.Len())
+	binary.LittleEndian.PutUint32(buf, uint32(runs.Len()))
+
+	return append(buf, runs.Bytes()...)
+}
+
+// writeParquetFile writes columns as a single row group. Schema starts with root element.
+func writeParquetFile(w io.Writer, schema []parquetSchemaElement, columns []*parquetColumn, numRows int) error {
+	type chunk struct {
+		offset int64
+		size   int64
+		values int
+	}
+
+	offset := int64(len(parquetMagic))
+	if _, err := w.Write(parquetMagic); err != nil {
+		return err
+	}
+
+	chunks := make([]chunk, len(columns))
+	var total int64
+
+	for i, c := range columns {
+		var page bytes.Buffer
+		if c.maxRep > 0 {
+			page.Write(parquetLevels(c.rep, c.maxRep))
+		}
+		if c.maxDef > 0 {
+			page.Write(parquetLevels(c.def, c.maxDef))
+		}
+		page.Write(c.values.Bytes())
+
+		values := c.numValues()
+		if values == -1 {
+			values = numRows
+		}
+
+		header := newThriftWriter()
+		header.structBegin()
+		header.i32(1, parquetDataPage)
+		header.i32(2, int32(page.Len()))
+		header.i32(3, int32(page.Len()))
+		header.fieldStruct(5)
+		header.i32(1, int32(values))
+		header.i32(2, parquetEncodingPlain)
+		header.i32(3, parquetEncodingRLE)
+		header.i32(4, parquetEncodingRLE)
+		header.structEnd()
+		header.structEnd()
+
+		if _, err := w.Write(header.buf.Bytes()); err != nil {
+			return err
+		}
+		if _, err := w.Write(page.Bytes()); err != nil {
+			return err
+		}
+
+		size := int64(header.buf.Len() + page.Len())
+		chunks[i] = chunk{offset: offset, size: size, values: values}
+		offset += size
+		total += size
+	}
+
+	meta := newThriftWriter()
+	meta.structBegin()
+	meta.i32(1, 1)
+
+	meta.list(2, thriftStruct, len(schema))
+	for _, s := range schema {
+		meta.structBegin()
+		if s.children == 0 {
+			meta.i32(1, s.typ)
+		}
+		// Root element has no repetition type
+		if s.repetition >= 0 {
+			meta.i32(3, s.repetition)
+		}
+		meta.binary(4, []byte(s.name))
+		if s.children > 0 {
+			meta.i32(5, int32(s.children))
+		}
+		if s.convertedType != parquetNoConvertedType {
+			meta.i32(6, s.convertedType)
+		}
+		meta.structEnd()
+	}
+
+	meta.i64(3, int64(numRows))
+
+	meta.list(4, thriftStruct, 1)
+	meta.structBegin()
+	meta.list(1, thriftStruct, len(columns))
+	for i, c := range columns {
+		meta.structBegin()
+		meta.i64(2, chunks[i].offset)
+		meta.fieldStruct(3)
+		meta.i32(1, c.typ)
+		meta.list(2, thriftI32, 2)
+		meta.i32Elem(parquetEncodingPlain)
+		meta.i32Elem(parquetEncodingRLE)
+		meta.list(3, thriftBinary, len(c.path))
+		for _, p := range c.path {
+			meta.binaryElem([]byte(p))
+		}
+		meta.i32(4, parquetUncompressed)
+		meta.i64(5, int64(chunks[i].values))
+		meta.i64(6, chunks[i].size)
+		meta.i64(7, chunks[i].size)
+		meta.i64(9, chunks[i].offset)
+		meta.structEnd()
+		meta.structEnd()
+	}
+	meta.i64(2, total)
+	meta.i64(3, int64(numRows))
+	meta.structEnd()
+
+	meta.binary(6, []byte("gor"))
+	meta.structEnd()
+
+	footerSize := make([]byte, 4)
+	binary.LittleEndian.PutUint32(footerSize, uint32(meta.buf.Len()))
+
+	for _, data := range [][]byte{meta.buf.Bytes(), footerSize, parquetMagic} {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Thrift compact protocol types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structs with Thrift compact protocol, used by Parquet metadata
+type thriftWriter struct {
+	buf bytes.Buffer
+	// Last field id of each open struct
+	last []int
+}
+
+func newThriftWriter() *thriftWriter {
+	return &thriftWriter{}
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, v)
+	t.buf.Write(buf[:n])
+}
+
+func (t *thriftWriter) zigzag(v int64) {
+	t.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) field(id int, typ byte) {
+	last := &t.last[len(t.last)-1]
+
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta<<4) | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.zigzag(int64(id))
+	}
+
+	*last = id
+}
+
+func (t *thriftWriter) structBegin() {
+	t.last = append(t.last, 0)
+}
+
+func (t *thriftWriter) structEnd() {
+	t.buf.WriteByte(0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+// fieldStruct starts struct field, should be closed with structEnd
+func (t *thriftWriter) fieldStruct(id int) {
+	t.field(id, thriftStruct)
+	t.structBegin()
+}
+
+func (t *thriftWriter) i32(id int, v int32) {
+	t.field(id, thriftI32)
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) i64(id int, v int64) {
+	t.field(id, thriftI64)
+	t.zigzag(v)
+}
+
+func (t *thriftWriter) binary(id int, v []byte) {
+	t.field(id, thriftBinary)
+	t.binaryElem(v)
+}
+
+// list writes list field header, followed by elements
+func (t *thriftWriter) list(id int, elemType byte, size int) {
+	t.field(id, thriftList)
+
+	if size < 15 {
+		t.buf.WriteByte(byte(size<<4) | elemType)
+	} else {
+		t.buf.WriteByte(0xf0 | elemType)
+		t.varint(uint64(size))
+	}
+}
+
+func (t *thriftWriter) i32Elem(v int32) {
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) binaryElem(v []byte) {
+	t.varint(uint64(len(v)))
+	t.buf.Write(v)
+}
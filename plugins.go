@@ -2,10 +2,10 @@ package main
 
 import (
 	"io"
+	"log"
 	"reflect"
 	"strings"
 	"sync"
-	"time"
 )
 
 // InOutPlugins struct for holding references to plugins
@@ -104,28 +104,68 @@ func InitPlugins() {
 		engine = EngineRawSocket
 	} else if Settings.inputRAWEngine == "pcap_file" {
 		engine = EnginePcapFile
+	} else if Settings.inputRAWEngine == "af_packet" {
+		engine = EngineAFPacket
+	} else if Settings.inputRAWEngine == "xdp" {
+		engine = EngineXDP
 	}
 
 	for _, options := range Settings.inputRAW {
-		registerPlugin(NewRAWInput, options, engine, Settings.inputRAWTrackResponse, time.Duration(0), Settings.inputRAWRealIPHeader)
+		registerPlugin(NewRAWInput, options, engine, Settings.inputRAWTrackResponse, Settings.inputRAWExpire, Settings.inputRAWRealIPHeader)
+	}
+
+	for _, options := range Settings.inputRAWPcapDir {
+		registerPlugin(NewRAWInput, options, EnginePcapDir, Settings.inputRAWTrackResponse, Settings.inputRAWExpire, Settings.inputRAWRealIPHeader)
 	}
 
 	for _, options := range Settings.inputTCP {
-		registerPlugin(NewTCPInput, options)
+		registerPlugin(NewTCPInput, options, &Settings.inputTCPConfig)
+	}
+
+	for _, options := range Settings.inputUnix {
+		registerPlugin(NewUnixInput, options, Settings.inputUnixTrackResponse)
 	}
 
 	for _, options := range Settings.outputTCP {
-		registerPlugin(NewTCPOutput, options)
+		registerPlugin(NewTCPOutput, options, &Settings.outputTCPConfig)
+	}
+
+	for _, options := range Settings.outputUDP {
+		registerPlugin(NewUDPOutput, options, &Settings.outputUDPConfig)
 	}
 
 	for _, options := range Settings.inputFile {
-		registerPlugin(NewFileInput, options, Settings.inputFileLoop)
+		// Captures made by tcpdump are parsed same way as traffic intercepted by raw input
+		if path, _ := extractLimitOptions(options); isPcapFile(path) {
+			registerPlugin(NewRAWInput, options, EnginePcapFile, Settings.inputRAWTrackResponse, Settings.inputRAWExpire, Settings.inputRAWRealIPHeader)
+			continue
+		}
+
+		registerPlugin(NewFileInput, options, &Settings.inputFileConfig)
+	}
+
+	if Settings.inputStdin {
+		registerPlugin(NewFileInput, stdinPath, &Settings.inputFileConfig)
 	}
 
 	for _, options := range Settings.outputFile {
+		if path, _ := extractLimitOptions(options); isPartitionedPath(path) {
+			registerPlugin(NewPartitionedFileOutput, options, &Settings.outputFileConfig)
+			continue
+		}
+
+		if Settings.outputFileConfig.shards > 1 {
+			registerPlugin(NewShardedFileOutput, options, &Settings.outputFileConfig)
+			continue
+		}
+
 		registerPlugin(NewFileOutput, options, &Settings.outputFileConfig)
 	}
 
+	for _, options := range Settings.outputParquet {
+		registerPlugin(NewParquetOutput, options, &Settings.outputParquetConfig)
+	}
+
 	for _, options := range Settings.inputHTTP {
 		registerPlugin(NewHTTPInput, options)
 	}
@@ -139,8 +179,45 @@ func InitPlugins() {
 		}
 	}
 
-	for _, options := range Settings.outputHTTP {
-		registerPlugin(NewHTTPOutput, options, &Settings.outputHTTPConfig)
+	Settings.outputHTTPConfig.verifyTLS = !Settings.outputHTTPInsecureSkipVerify
+
+	if Settings.outputHTTPTrackResponse {
+		Settings.outputHTTPConfig.TrackResponses = true
+		Settings.outputGRPCConfig.TrackResponses = true
+	}
+
+	encodings := Settings.outputHTTPBodyEncoding
+	if len(encodings) > 1 && len(encodings) != len(Settings.outputHTTP) {
+		log.Fatal("--output-http-body-encoding should be set once, or for each --output-http")
+	}
+	if len(encodings) == 1 {
+		Settings.outputHTTPConfig.bodyEncoding = encodings[0]
+	}
+
+	for i, options := range Settings.outputHTTP {
+		config := &Settings.outputHTTPConfig
+		if len(encodings) > 1 {
+			// Each output gets own copy of config with its body encoding
+			c := Settings.outputHTTPConfig
+			c.bodyEncoding = encodings[i]
+			config = &c
+		}
+		registerPlugin(NewHTTPOutput, options, config)
+	}
+
+	Settings.outputWebSocketConfig.OriginalHost = Settings.outputHTTPConfig.OriginalHost
+	for _, options := range Settings.outputWebSocket {
+		registerPlugin(NewWebSocketOutput, options, &Settings.outputWebSocketConfig)
+	}
+
+	Settings.outputGRPCConfig.OriginalHost = Settings.outputHTTPConfig.OriginalHost
+	for _, options := range Settings.outputGRPC {
+		registerPlugin(NewGRPCOutput, options, &Settings.outputGRPCConfig)
+	}
+
+	Settings.outputHTTPCompareConfig.OriginalHost = Settings.outputHTTPConfig.OriginalHost
+	for _, options := range Settings.outputHTTPCompare {
+		registerPlugin(NewHTTPCompareOutput, options, &Settings.outputHTTPCompareConfig)
 	}
 
 	if Settings.outputKafkaConfig.host != "" && Settings.outputKafkaConfig.topic != "" {
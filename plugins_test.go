@@ -2,6 +2,7 @@ package main
 
 import (
 	"io"
+	"strings"
 	"testing"
 )
 
@@ -45,3 +46,28 @@ func TestPluginsRegistration(t *testing.T) {
 	}
 
 }
+
+func TestPluginsHTTPBodyEncoding(t *testing.T) {
+	Plugins.Inputs = []io.Reader{}
+	Plugins.Outputs = []io.Writer{}
+
+	Settings.outputHTTP = MultiOption{"www.example.com", "waf.example.com"}
+	Settings.outputHTTPBodyEncoding = MultiOption{"preserve", "gzip"}
+	defer func() {
+		Settings.outputHTTP = nil
+		Settings.outputHTTPBodyEncoding = nil
+	}()
+
+	InitPlugins()
+
+	var encodings []string
+	for _, out := range Plugins.Outputs {
+		if o, ok := out.(*HTTPOutput); ok {
+			encodings = append(encodings, o.config.bodyEncoding)
+		}
+	}
+
+	if strings.Join(encodings, ",") != "preserve,gzip" {
+		t.Errorf("Each output should get own body encoding: %v", encodings)
+	}
+}
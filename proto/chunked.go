@@ -0,0 +1,137 @@
+package proto
+
+import (
+	"errors"
+)
+
+// ErrMalformedChunked returned if body does not follow chunked encoding
+var ErrMalformedChunked = errors.New("malformed chunked body")
+
+// Chunks bigger than this are treated as malformed, to not wait for data which will never come
+const maxChunkSize = 1 << 40
+
+const (
+	chunkSize = iota
+	chunkExtension
+	chunkData
+	chunkDataEnd
+	chunkTrailer
+	chunkDone
+)
+
+// ChunkedState tracks chunked body, which is received in parts, like TCP packets or reads from connection.
+// It finds end of the body: last chunk of zero size, followed by optional trailers and empty line.
+// Content of chunks is not inspected, so data which looks like last chunk does not end the body.
+type ChunkedState struct {
+	state    int
+	size     int64
+	hasSize  bool
+	lineSize int
+}
+
+// Feed processes next part of body. Returns number of bytes which belong to the body, and true if the body is complete.
+// Bytes after the end, like next pipelined message, are not consumed.
+func (c *ChunkedState) Feed(data []byte) (n int, done bool, err error) {
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+
+		switch c.state {
+		case chunkSize:
+			switch {
+			case b >= '0' && b <= '9':
+				c.size = c.size<<4 | int64(b-'0')
+				c.hasSize = true
+			case b >= 'a' && b <= 'f':
+				c.size = c.size<<4 | int64(b-'a'+10)
+				c.hasSize = true
+			case b >= 'A' && b <= 'F':
+				c.size = c.size<<4 | int64(b-'A'+10)
+				c.hasSize = true
+			case b == ';' || b == ' ' || b == '\t':
+				c.state = chunkExtension
+			case b == '\r':
+			case b == '\n':
+				if err = c.endSizeLine(); err != nil {
+					return i, false, err
+				}
+			default:
+				return i, false, ErrMalformedChunked
+			}
+
+			if c.size > maxChunkSize {
+				return i, false, ErrMalformedChunked
+			}
+		case chunkExtension:
+			if b == '\n' {
+				if err = c.endSizeLine(); err != nil {
+					return i, false, err
+				}
+			}
+		case chunkData:
+			// Skip content of chunk at once
+			skip := int64(len(data) - i)
+			if skip > c.size {
+				skip = c.size
+			}
+			c.size -= skip
+			i += int(skip) - 1
+
+			if c.size == 0 {
+				c.state = chunkDataEnd
+			}
+		case chunkDataEnd:
+			switch b {
+			case '\r':
+			case '\n':
+				c.state = chunkSize
+			default:
+				return i, false, ErrMalformedChunked
+			}
+		case chunkTrailer:
+			switch b {
+			case '\r':
+			case '\n':
+				if c.lineSize == 0 {
+					c.state = chunkDone
+					return i + 1, true, nil
+				}
+				c.lineSize = 0
+			default:
+				c.lineSize++
+			}
+		case chunkDone:
+			return i, true, nil
+		}
+	}
+
+	return len(data), c.state == chunkDone, nil
+}
+
+func (c *ChunkedState) endSizeLine() error {
+	if !c.hasSize {
+		return ErrMalformedChunked
+	}
+
+	if c.size == 0 {
+		c.state = chunkTrailer
+		c.lineSize = 0
+	} else {
+		c.state = chunkData
+	}
+
+	c.hasSize = false
+
+	return nil
+}
+
+// ChunkedBodyEnd returns length of complete chunked body, including trailers, or -1 if body is not finished yet
+func ChunkedBodyEnd(body []byte) (int, error) {
+	var c ChunkedState
+
+	n, done, err := c.Feed(body)
+	if err != nil || !done {
+		return -1, err
+	}
+
+	return n, nil
+}
@@ -0,0 +1,56 @@
+package proto
+
+import (
+	"testing"
+)
+
+func TestChunkedBodyEnd(t *testing.T) {
+	testCases := []struct {
+		body string
+		end  int
+	}{
+		{"0\r\n\r\n", 5},
+		{"3\r\nabc\r\n0\r\n\r\n", 13},
+		// Chunk content looks like end of body
+		{"10\r\n\r\n0\r\n\r\n012345678\r\n0\r\n\r\n", 27},
+		{"a;name=value\r\n0123456789\r\n0\r\n\r\n", 31},
+		{"3\r\nabc\r\n0\r\nExpires: never\r\nX-Checksum: 1\r\n\r\n", 44},
+		// Next pipelined request is not part of the body
+		{"1\r\na\r\n0\r\n\r\nGET / HTTP/1.1\r\n\r\n", 11},
+		{"3\r\nabc\r\n", -1},
+		{"3\r\nabc\r\n0\r\n", -1},
+		{"3\r\nabc\r\n0\r\nExpires: never\r\n", -1},
+		{"10\r\n\r\n0\r\n\r\n", -1},
+	}
+
+	for _, tc := range testCases {
+		if end, err := ChunkedBodyEnd([]byte(tc.body)); end != tc.end || err != nil {
+			t.Errorf("%q: expected %d, got %d %v", tc.body, tc.end, end, err)
+		}
+	}
+
+	for _, body := range []string{"x\r\nabc\r\n0\r\n\r\n", "3\r\nabcd\r\n0\r\n\r\n", "\r\n0\r\n\r\n"} {
+		if _, err := ChunkedBodyEnd([]byte(body)); err != ErrMalformedChunked {
+			t.Errorf("%q: should be malformed", body)
+		}
+	}
+}
+
+func TestChunkedStateFeed(t *testing.T) {
+	body := []byte("10\r\n0\r\n\r\n0123456789a\r\n0\r\nExpires: never\r\n\r\n")
+
+	// Body split at every position should give the same result
+	for split := 1; split < len(body); split++ {
+		var c ChunkedState
+
+		n1, done, err := c.Feed(body[:split])
+		if done || err != nil {
+			t.Fatalf("Split %d: first part should not complete body: %v", split, err)
+		}
+
+		n2, done, err := c.Feed(body[split:])
+		if !done || err != nil || n1+n2 != len(body) {
+			t.Errorf("Split %d: expected complete body, got %d %t %v", split, n1+n2, done, err)
+		}
+	}
+}
@@ -448,6 +448,13 @@ func Status(payload []byte) []byte {
 	return Path(payload)
 }
 
+// IsGRPCContentType checks if content type is used by gRPC, for example 'application/grpc+proto'
+func IsGRPCContentType(contentType []byte) bool {
+	grpc := []byte("application/grpc")
+
+	return bytes.Equal(contentType, grpc) || bytes.HasPrefix(contentType, []byte("application/grpc+")) || bytes.HasPrefix(contentType, []byte("application/grpc;"))
+}
+
 var httpMethods []string = []string{
 	"GET ", "OPTI", "HEAD", "POST", "PUT ", "DELE", "TRAC", "CONN", "PATC" /* custom methods */, "BAN", "PURG",
 }
@@ -306,3 +306,18 @@ func TestSetHostHTTP10(t *testing.T) {
 		t.Error("Should replace host", string(payload))
 	}
 }
+
+func TestIsGRPCContentType(t *testing.T) {
+	for contentType, expected := range map[string]bool{
+		"application/grpc":               true,
+		"application/grpc+proto":         true,
+		"application/grpc;charset=utf-8": true,
+		"application/grpc-web":           false,
+		"application/json":               false,
+		"":                               false,
+	} {
+		if IsGRPCContentType([]byte(contentType)) != expected {
+			t.Error("Wrong result for", contentType)
+		}
+	}
+}
@@ -11,6 +11,12 @@ const (
 	RequestPayload          = '1'
 	ResponsePayload         = '2'
 	ReplayedResponsePayload = '3'
+	// Each UDP datagram is separate payload, response has id of last request of the same flow
+	UDPRequestPayload  = '4'
+	UDPResponsePayload = '5'
+	// Frames of upgraded WebSocket connection have id of handshake request
+	WebSocketClientPayload = '6'
+	WebSocketServerPayload = '7'
 )
 
 func uuid() []byte {
@@ -89,9 +95,77 @@ func payloadMeta(payload []byte) [][]byte {
 	return bytes.Split(payload[:headerSize], []byte{' '})
 }
 
+// Labels are appended to meta line after positional fields, as key=value pairs
+func isPayloadLabel(field []byte) bool {
+	return bytes.IndexByte(field, '=') > 0
+}
+
+// appendPayloadLabels adds key=value labels to the end of meta line
+func appendPayloadLabels(header []byte, labels []string) []byte {
+	if len(labels) == 0 {
+		return header
+	}
+
+	h := make([]byte, 0, len(header)+64)
+	h = append(h, header[:len(header)-1]...)
+	for _, label := range labels {
+		h = append(h, ' ')
+		h = append(h, label...)
+	}
+
+	return append(h, '\n')
+}
+
+// payloadLabels returns key=value labels of meta line
+func payloadLabels(payload []byte) map[string]string {
+	labels := make(map[string]string)
+
+	for _, field := range payloadMeta(payload) {
+		if isPayloadLabel(field) {
+			kv := bytes.SplitN(bytes.TrimSpace(field), []byte{'='}, 2)
+			labels[string(kv[0])] = string(kv[1])
+		}
+	}
+
+	return labels
+}
+
+// payloadWithTimestamp returns copy of payload with timestamp in meta line replaced
+func payloadWithTimestamp(payload []byte, timestamp int64) []byte {
+	meta := payloadMeta(payload)
+	if len(meta) < 3 {
+		return payload
+	}
+
+	ts := strconv.AppendInt(nil, timestamp, 10)
+	if bytes.HasSuffix(meta[2], []byte{'\r'}) {
+		ts = append(ts, '\r')
+	}
+	meta[2] = ts
+
+	header := bytes.Join(meta, []byte{' '})
+	return append(header, payload[bytes.IndexByte(payload, '\n'):]...)
+}
+
 func isOriginPayload(payload []byte) bool {
 	switch payload[0] {
-	case RequestPayload, ResponsePayload:
+	case RequestPayload, ResponsePayload, UDPRequestPayload, UDPResponsePayload, WebSocketClientPayload, WebSocketServerPayload:
+		return true
+	default:
+		return false
+	}
+}
+
+// isStoredPayload checks if payload is written by file and TCP outputs: original payloads, and replayed responses
+// if they are tracked with --output-http-track-response
+func isStoredPayload(payload []byte) bool {
+	return isOriginPayload(payload) || payload[0] == ReplayedResponsePayload && Settings.outputHTTPTrackResponse
+}
+
+// isResponsePayload checks if payload is sent by server: recorded or replayed response, or WebSocket server frame
+func isResponsePayload(payload []byte) bool {
+	switch payload[0] {
+	case ResponsePayload, ReplayedResponsePayload, UDPResponsePayload, WebSocketServerPayload:
 		return true
 	default:
 		return false
@@ -0,0 +1,154 @@
+package rawSocket
+
+import (
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+// Ring buffer of each socket: 64 blocks of 1MB, each block holds multiple packets
+const (
+	afpacketFrameSize = 65536
+	afpacketBlockSize = 1 << 20
+	afpacketNumBlocks = 64
+)
+
+// Last used fanout group ID. Groups are shared by all sockets of network namespace, so each device of each listener
+// gets its own group, starting from process ID to not join groups of other processes.
+var afpacketGroupID = uint32(os.Getpid())
+
+// readAFPacket captures traffic using AF_PACKET sockets with TPACKET_V3 ring buffer, which is much faster than libpcap.
+// With fanout, each device is read by multiple sockets, and kernel spreads connections between them.
+func (t *Listener) readAFPacket() {
+	devices, err := findPcapDevices(t.addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if devices, err = t.filterPcapDevices(devices); err != nil {
+		log.Fatal(err)
+	}
+
+	fanout := t.afpacketFanout
+	if fanout < 1 {
+		fanout = 1
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(devices) * fanout)
+
+	for _, d := range devices {
+		// Fanout group is unique for device and listener
+		groupID := uint16(atomic.AddUint32(&afpacketGroupID, 1))
+
+		for j := 0; j < fanout; j++ {
+			go func(device pcap.Interface) {
+				handle, err := t.openAFPacket(device, devices, groupID, fanout)
+				if err != nil {
+					log.Println("AF_PACKET Error while opening device", device.Name, err)
+					wg.Done()
+					return
+				}
+				defer handle.Close()
+
+				wg.Done()
+
+				for {
+					data, ci, err := handle.ReadPacketData()
+
+					if err == afpacket.ErrTimeout || err == afpacket.ErrPoll {
+						continue
+					} else if err != nil {
+						return
+					}
+
+					of, ok := t.skipVLANTags(data, 14)
+					if !ok {
+						continue
+					}
+
+					t.processIPPacket(data[of:], device, devices, true, ci.Timestamp)
+				}
+			}(d)
+		}
+	}
+
+	wg.Wait()
+	t.readyCh <- true
+}
+
+func (t *Listener) openAFPacket(device pcap.Interface, devices []pcap.Interface, groupID uint16, fanout int) (*afpacket.TPacket, error) {
+	handle, err := afpacket.NewTPacket(
+		afpacket.OptInterface(device.Name),
+		afpacket.OptFrameSize(afpacketFrameSize),
+		afpacket.OptBlockSize(afpacketBlockSize),
+		afpacket.OptNumBlocks(afpacketNumBlocks),
+		afpacket.OptTPacketVersion(afpacket.TPacketVersion3),
+		afpacket.OptPollTimeout(t.messageExpire),
+		// Kernel strips VLAN tags, and they are needed to check VLAN IDs
+		afpacket.OptAddVLANHeader(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Filter is compiled by libpcap, and attached to socket. Kernel strips VLAN tags before socket filter,
+	// so VLAN clauses would never match, and VLAN IDs are checked after tags are added back to packet.
+	expr := t.deviceBPF(device, devices, true, false)
+	instructions, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, afpacketFrameSize, expr)
+	if err != nil {
+		handle.Close()
+		if t.bpfFilter != "" {
+			log.Fatal("BPF filter error: ", err, " Device: ", device.Name, " ", expr)
+		}
+		return nil, err
+	}
+
+	filter := make([]bpf.RawInstruction, len(instructions))
+	for i, ins := range instructions {
+		filter[i] = bpf.RawInstruction{Op: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+
+	if err = handle.SetBPF(filter); err != nil {
+		handle.Close()
+		return nil, err
+	}
+
+	if fanout > 1 {
+		// Hash of connection is the same for both directions, so whole connection is read by one socket
+		if err = handle.SetFanout(afpacket.FanoutHashWithDefrag, groupID); err != nil {
+			handle.Close()
+			return nil, err
+		}
+	}
+
+	t.mu.Lock()
+	t.captureHandles = append(t.captureHandles, afpacketHandle{handle})
+	t.mu.Unlock()
+
+	return handle, nil
+}
+
+// afpacketHandle reports socket counters of AF_PACKET handle
+type afpacketHandle struct {
+	*afpacket.TPacket
+}
+
+func (h afpacketHandle) captureStats() Stats {
+	// Kernel resets counters on each read, and TPacket accumulates them
+	_, s, err := h.SocketStats()
+	if err != nil {
+		return Stats{}
+	}
+
+	return Stats{
+		PacketsReceived: uint64(s.Packets()),
+		PacketsDropped:  uint64(s.Drops()),
+	}
+}
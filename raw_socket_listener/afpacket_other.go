@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package rawSocket
+
+import (
+	"log"
+)
+
+// readAFPacket is not available, since AF_PACKET sockets are Linux specific
+func (t *Listener) readAFPacket() {
+	log.Fatal("af_packet engine is supported only on Linux")
+}
@@ -0,0 +1,446 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buger/gor/proto"
+	"golang.org/x/net/http2/hpack"
+)
+
+// HTTP/2 connection preface, sent by client before any frames. Connections are detected by it,
+// so only connections started after Gor (h2c with prior knowledge, or upgraded from HTTP/1.1) can be decoded:
+// header compression state depends on all previous frames.
+var http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// HTTP/2 frame types and flags, see https://tools.ietf.org/html/rfc7540#section-6
+const (
+	http2FrameData         = 0x0
+	http2FrameHeaders      = 0x1
+	http2FrameRSTStream    = 0x3
+	http2FrameSettings     = 0x4
+	http2FrameContinuation = 0x9
+
+	http2FlagEndStream  = 0x1
+	http2FlagAck        = 0x1
+	http2FlagEndHeaders = 0x4
+	http2FlagPadded     = 0x8
+	http2FlagPriority   = 0x20
+
+	http2SettingHeaderTableSize = 0x1
+
+	http2FrameHeaderSize = 9
+	// Bigger frames are not allowed by protocol, so connection is treated as broken
+	http2MaxFrameSize = 1<<24 - 1
+)
+
+// http2Message is request or response part of a stream
+type http2Message struct {
+	headers []hpack.HeaderField
+	// Only kept for gRPC, where they carry call status
+	trailers []hpack.HeaderField
+	// Header block is split to HEADERS and CONTINUATION frames
+	block     []byte
+	endStream bool
+	data      []byte
+	start     time.Time
+	// Packet which finished the message
+	last *TCPPacket
+	done bool
+}
+
+type http2Stream struct {
+	request  http2Message
+	response http2Message
+	// Emitted request, response is emitted only after it
+	requestMessage *TCPMessage
+}
+
+// http2Direction decodes frames sent by one side of connection
+type http2Direction struct {
+	stream  *tcpStream
+	buf     []byte
+	decoder *hpack.Decoder
+	// Stream which header block is not finished yet, and its message
+	continuation    uint32
+	continuationMsg *http2Message
+	// Set if stream can't be decoded anymore, for example after lost packet
+	broken bool
+}
+
+func newHTTP2Direction(maxPending int) *http2Direction {
+	return &http2Direction{stream: newTCPStream(maxPending), decoder: hpack.NewDecoder(4096, nil)}
+}
+
+// http2Conn converts HTTP/2 streams to HTTP/1.1 messages, so they can be replayed as usual
+type http2Conn struct {
+	client        *http2Direction
+	server        *http2Direction
+	streams       map[uint32]*http2Stream
+	trackResponse bool
+	prefaceFound  bool
+	lastSeen      time.Time
+}
+
+func newHTTP2Conn(trackResponse bool, maxPending int) *http2Conn {
+	return &http2Conn{
+		client:        newHTTP2Direction(maxPending),
+		server:        newHTTP2Direction(maxPending),
+		streams:       make(map[uint32]*http2Stream),
+		trackResponse: trackResponse,
+		lastSeen:      time.Now(),
+	}
+}
+
+// isHTTP2Preface checks if data starts HTTP/2 connection
+func isHTTP2Preface(data []byte) bool {
+	return bytes.HasPrefix(data, http2Preface)
+}
+
+// processHTTP2Packet passes packet to HTTP/2 connection it belongs to. Returns false if it is not HTTP/2 packet.
+func (t *Listener) processHTTP2Packet(packet *TCPPacket) bool {
+	id, isIncoming := t.connID(packet)
+
+	conn, ok := t.http2Conns[id]
+	if !ok {
+		if !isIncoming || !isHTTP2Preface(packet.Data) {
+			return false
+		}
+
+		conn = newHTTP2Conn(t.trackResponse, t.reassemblyLimit)
+		t.http2Conns[id] = conn
+	}
+
+	for _, m := range conn.process(packet, isIncoming) {
+		t.messagesChan <- m
+	}
+
+	if packet.IsFIN {
+		delete(t.http2Conns, id)
+	}
+
+	return true
+}
+
+// process handles packet of connection, and returns messages completed by it
+func (c *http2Conn) process(packet *TCPPacket, isIncoming bool) (messages []*TCPMessage) {
+	c.lastSeen = time.Now()
+
+	dir := c.server
+	if isIncoming {
+		dir = c.client
+	}
+
+	if dir.broken {
+		return
+	}
+
+	dir.buf = append(dir.buf, dir.stream.add(packet.Seq, packet.Data)...)
+
+	if isIncoming && !c.prefaceFound {
+		if len(dir.buf) < len(http2Preface) {
+			return
+		}
+		if !isHTTP2Preface(dir.buf) {
+			dir.broken = true
+			return
+		}
+		dir.buf = dir.buf[len(http2Preface):]
+		c.prefaceFound = true
+	}
+
+	for len(dir.buf) >= http2FrameHeaderSize {
+		length := int(dir.buf[0])<<16 | int(dir.buf[1])<<8 | int(dir.buf[2])
+		if length > http2MaxFrameSize {
+			dir.broken = true
+			return
+		}
+
+		if len(dir.buf) < http2FrameHeaderSize+length {
+			break
+		}
+
+		typ, flags := dir.buf[3], dir.buf[4]
+		streamID := binary.BigEndian.Uint32(dir.buf[5:9]) & 0x7fffffff
+		payload := dir.buf[http2FrameHeaderSize : http2FrameHeaderSize+length]
+
+		if !c.processFrame(dir, packet, isIncoming, typ, flags, streamID, payload, &messages) {
+			dir.broken = true
+			return
+		}
+
+		dir.buf = dir.buf[http2FrameHeaderSize+length:]
+	}
+
+	// Release memory of processed frames
+	if len(dir.buf) == 0 {
+		dir.buf = nil
+	}
+
+	return
+}
+
+// http2Unpad removes padding and returns nil if frame is malformed
+func http2Unpad(flags byte, payload []byte) []byte {
+	if flags&http2FlagPadded == 0 {
+		return payload
+	}
+
+	if len(payload) == 0 || int(payload[0]) >= len(payload) {
+		return nil
+	}
+
+	return payload[1 : len(payload)-int(payload[0])]
+}
+
+// processFrame returns false if connection can't be decoded anymore
+func (c *http2Conn) processFrame(dir *http2Direction, packet *TCPPacket, isIncoming bool, typ, flags byte, streamID uint32, payload []byte, messages *[]*TCPMessage) bool {
+	// Header block should be continued without any other frames in between
+	if dir.continuation != 0 && (typ != http2FrameContinuation || streamID != dir.continuation) {
+		return false
+	}
+
+	stream := c.streams[streamID]
+
+	var msg *http2Message
+	if stream != nil {
+		msg = &stream.response
+		if isIncoming {
+			msg = &stream.request
+		}
+	}
+
+	switch typ {
+	case http2FrameData:
+		if msg == nil {
+			return true
+		}
+
+		if payload = http2Unpad(flags, payload); payload == nil {
+			return false
+		}
+		msg.data = append(msg.data, payload...)
+
+		if flags&http2FlagEndStream != 0 {
+			c.finish(streamID, isIncoming, packet, messages)
+		}
+	case http2FrameHeaders:
+		if payload = http2Unpad(flags, payload); payload == nil {
+			return false
+		}
+		if flags&http2FlagPriority != 0 {
+			if len(payload) < 5 {
+				return false
+			}
+			payload = payload[5:]
+		}
+
+		if msg == nil {
+			if isIncoming {
+				stream = &http2Stream{}
+				c.streams[streamID] = stream
+				msg = &stream.request
+			} else {
+				// Header block still should be decoded to keep decoder state, it is just not used
+				msg = &http2Message{}
+			}
+		}
+
+		if msg.start.IsZero() {
+			msg.start = packet.timestamp
+		}
+		msg.block = append(msg.block[:0], payload...)
+		msg.endStream = flags&http2FlagEndStream != 0
+
+		if flags&http2FlagEndHeaders == 0 {
+			dir.continuation, dir.continuationMsg = streamID, msg
+			return true
+		}
+
+		return c.endHeaders(dir, msg, streamID, isIncoming, packet, messages)
+	case http2FrameContinuation:
+		if dir.continuation == 0 {
+			return false
+		}
+
+		msg = dir.continuationMsg
+		msg.block = append(msg.block, payload...)
+
+		if flags&http2FlagEndHeaders != 0 {
+			dir.continuation, dir.continuationMsg = 0, nil
+			return c.endHeaders(dir, msg, streamID, isIncoming, packet, messages)
+		}
+	case http2FrameRSTStream:
+		delete(c.streams, streamID)
+	case http2FrameSettings:
+		if flags&http2FlagAck != 0 {
+			return true
+		}
+
+		// Table size set by one side limits encoder of other side
+		other := c.client
+		if isIncoming {
+			other = c.server
+		}
+
+		for i := 0; i+6 <= len(payload); i += 6 {
+			if binary.BigEndian.Uint16(payload[i:]) == http2SettingHeaderTableSize {
+				other.decoder.SetAllowedMaxDynamicTableSize(binary.BigEndian.Uint32(payload[i+2:]))
+			}
+		}
+	}
+
+	return true
+}
+
+// endHeaders decodes complete header block
+func (c *http2Conn) endHeaders(dir *http2Direction, msg *http2Message, streamID uint32, isIncoming bool, packet *TCPPacket, messages *[]*TCPMessage) bool {
+	headers, err := dir.decoder.DecodeFull(msg.block)
+	msg.block = nil
+	if err != nil {
+		return false
+	}
+
+	// Second header block is trailers, they are not replayed unless stream is gRPC call
+	if msg.headers == nil {
+		msg.headers = headers
+	} else {
+		msg.trailers = headers
+	}
+
+	if msg.endStream {
+		c.finish(streamID, isIncoming, packet, messages)
+	}
+
+	return true
+}
+
+// finish converts completed request or response to message
+func (c *http2Conn) finish(streamID uint32, isIncoming bool, packet *TCPPacket, messages *[]*TCPMessage) {
+	stream, ok := c.streams[streamID]
+	if !ok {
+		return
+	}
+
+	msg := &stream.response
+	if isIncoming {
+		msg = &stream.request
+	}
+	msg.done = true
+	// Packet data is not copied, and can be reused by capture engine
+	msg.last = &TCPPacket{SrcPort: packet.SrcPort, DestPort: packet.DestPort, Seq: packet.Seq, Ack: packet.Ack, Addr: append([]byte(nil), packet.Addr...), timestamp: packet.timestamp}
+
+	if isIncoming {
+		stream.requestMessage = newHTTP2Message(true, streamID, msg, nil)
+		*messages = append(*messages, stream.requestMessage)
+
+		if !c.trackResponse {
+			delete(c.streams, streamID)
+			return
+		}
+	}
+
+	// Response can be finished before request, if server does not wait for request body
+	if stream.request.done && stream.response.done {
+		*messages = append(*messages, newHTTP2Message(false, streamID, &stream.response, stream.requestMessage))
+		delete(c.streams, streamID)
+	}
+}
+
+// newHTTP2Message builds message with a single packet, which contains HTTP/1.1 version of request or response
+func newHTTP2Message(isIncoming bool, streamID uint32, msg *http2Message, request *TCPMessage) *TCPMessage {
+	last := msg.last
+
+	// Message ID is made of ack number, so each stream should have its own
+	p := &TCPPacket{SrcPort: last.SrcPort, DestPort: last.DestPort, Seq: last.Seq, Ack: last.Ack + streamID, Data: msg.http1(isIncoming)}
+	p = ParseTCPPacket(last.Addr, p.dump().data, msg.start)
+	p.DstAddr = last.DstAddr
+
+	m := NewTCPMessage(p.Seq, p.Ack, isIncoming, msg.start)
+	m.packets = []*TCPPacket{p}
+	m.End = last.timestamp
+	m.complete = true
+
+	if request != nil {
+		m.AssocMessage = request
+		m.uuid = request.uuid
+		request.AssocMessage = m
+	}
+
+	return m
+}
+
+// http1 converts message to HTTP/1.1, pseudo headers are converted to request or status line
+func (m *http2Message) http1(isRequest bool) []byte {
+	var buf bytes.Buffer
+	var method, path, authority, status string
+	var cookies []string
+	hasHost, hasLength, isGRPC := false, false, false
+
+	for _, h := range m.headers {
+		switch h.Name {
+		case ":method":
+			method = h.Value
+		case ":path":
+			path = h.Value
+		case ":authority":
+			authority = h.Value
+		case ":status":
+			status = h.Value
+		case "host":
+			hasHost = true
+		case "content-length":
+			hasLength = true
+		case "content-type":
+			isGRPC = proto.IsGRPCContentType([]byte(h.Value))
+		case "cookie":
+			// Cookies can be split to separate headers in HTTP/2, but not in HTTP/1.1
+			cookies = append(cookies, h.Value)
+		}
+	}
+
+	if isRequest {
+		if path == "" {
+			path = authority
+		}
+		buf.WriteString(method + " " + path + " HTTP/1.1\r\n")
+		if !hasHost && authority != "" {
+			buf.WriteString("Host: " + authority + "\r\n")
+		}
+	} else {
+		code, _ := strconv.Atoi(status)
+		buf.WriteString("HTTP/1.1 " + status + " " + http.StatusText(code) + "\r\n")
+	}
+
+	for _, h := range m.headers {
+		if h.IsPseudo() || h.Name == "cookie" {
+			continue
+		}
+		buf.WriteString(http.CanonicalHeaderKey(h.Name) + ": " + h.Value + "\r\n")
+	}
+
+	if len(cookies) > 0 {
+		buf.WriteString("Cookie: " + strings.Join(cookies, "; ") + "\r\n")
+	}
+
+	// gRPC status is sent in trailers, HTTP/1.1 version has them as regular headers
+	if isGRPC {
+		for _, h := range m.trailers {
+			buf.WriteString(http.CanonicalHeaderKey(h.Name) + ": " + h.Value + "\r\n")
+		}
+	}
+
+	// HTTP/2 messages end with stream, HTTP/1.1 needs length of the body
+	if !hasLength && (len(m.data) > 0 || (isRequest && method != "GET" && method != "HEAD")) {
+		buf.WriteString("Content-Length: " + strconv.Itoa(len(m.data)) + "\r\n")
+	}
+
+	buf.WriteString("\r\n")
+	buf.Write(m.data)
+
+	return buf.Bytes()
+}
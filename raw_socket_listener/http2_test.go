@@ -0,0 +1,178 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+func http2Frame(typ, flags byte, streamID uint32, payload []byte) []byte {
+	frame := make([]byte, 9, 9+len(payload))
+	frame[0], frame[1], frame[2] = byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload))
+	frame[3], frame[4] = typ, flags
+	binary.BigEndian.PutUint32(frame[5:], streamID)
+
+	return append(frame, payload...)
+}
+
+func http2HeaderBlock(enc *hpack.Encoder, buf *bytes.Buffer, headers ...string) []byte {
+	buf.Reset()
+	for i := 0; i < len(headers); i += 2 {
+		enc.WriteField(hpack.HeaderField{Name: headers[i], Value: headers[i+1]})
+	}
+
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+func TestRawListenerHTTP2(t *testing.T) {
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond)
+	defer listener.Close()
+
+	var reqBuf, respBuf bytes.Buffer
+	reqEnc, respEnc := hpack.NewEncoder(&reqBuf), hpack.NewEncoder(&respBuf)
+
+	client := append([]byte(nil), http2Preface...)
+	client = append(client, http2Frame(http2FrameSettings, 0, 0, nil)...)
+	// Header block split to HEADERS and CONTINUATION frames
+	block := http2HeaderBlock(reqEnc, &reqBuf, ":method", "POST", ":scheme", "http", ":path", "/upload", ":authority", "example.com", "cookie", "a=1", "cookie", "b=2")
+	client = append(client, http2Frame(http2FrameHeaders, 0, 1, block[:5])...)
+	client = append(client, http2Frame(http2FrameContinuation, http2FlagEndHeaders, 1, block[5:])...)
+	client = append(client, http2Frame(http2FrameData, http2FlagPadded, 1, []byte("\x02hello\x00\x00"))...)
+	client = append(client, http2Frame(http2FrameData, http2FlagEndStream, 1, []byte(" world"))...)
+	// Second request reuses dynamic table of the first one
+	block = http2HeaderBlock(reqEnc, &reqBuf, ":method", "GET", ":scheme", "http", ":path", "/", ":authority", "example.com")
+	client = append(client, http2Frame(http2FrameHeaders, http2FlagEndHeaders|http2FlagEndStream, 3, block)...)
+
+	block = http2HeaderBlock(respEnc, &respBuf, ":status", "404", "content-type", "text/plain")
+	server := http2Frame(http2FrameSettings, 0, 0, nil)
+	server = append(server, http2Frame(http2FrameHeaders, http2FlagEndHeaders, 3, block)...)
+	server = append(server, http2Frame(http2FrameData, http2FlagEndStream, 3, []byte("not found"))...)
+
+	// Client data is sent in 3 packets, with last two swapped
+	seq := uint32(100)
+	packets := []*TCPPacket{
+		buildPacket(true, 1, seq, client[:30], time.Now()),
+		buildPacket(true, 1, seq+60, client[60:], time.Now()),
+		buildPacket(true, 1, seq+30, client[30:60], time.Now()),
+		buildPacket(false, seq+uint32(len(client)), 1, server, time.Now()),
+	}
+	for _, p := range packets {
+		listener.packetsChan <- p.dump()
+	}
+
+	expected := []string{
+		"POST /upload HTTP/1.1\r\nHost: example.com\r\nCookie: a=1; b=2\r\nContent-Length: 11\r\n\r\nhello world",
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"HTTP/1.1 404 Not Found\r\nContent-Type: text/plain\r\nContent-Length: 9\r\n\r\nnot found",
+	}
+
+	var messages []*TCPMessage
+	for _, e := range expected {
+		select {
+		case m := <-listener.Receiver():
+			messages = append(messages, m)
+			if string(m.Bytes()) != e {
+				t.Errorf("Expected %q, got %q", e, m.Bytes())
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("Should decode HTTP/2 message", e)
+		}
+	}
+
+	if !messages[0].IsIncoming || messages[2].IsIncoming || messages[2].AssocMessage != messages[1] {
+		t.Error("Response should be associated with request of its stream")
+	}
+
+	if bytes.Equal(messages[0].UUID(), messages[1].UUID()) {
+		t.Error("Each stream should have its own id")
+	}
+}
+
+func TestRawListenerGRPC(t *testing.T) {
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond)
+	defer listener.Close()
+
+	var reqBuf, respBuf bytes.Buffer
+	reqEnc, respEnc := hpack.NewEncoder(&reqBuf), hpack.NewEncoder(&respBuf)
+
+	// Length-prefixed message: compression flag, 4 bytes of length, and protobuf data
+	message := []byte("\x00\x00\x00\x00\x02\x08\x01")
+
+	client := append([]byte(nil), http2Preface...)
+	block := http2HeaderBlock(reqEnc, &reqBuf, ":method", "POST", ":scheme", "http", ":path", "/helloworld.Greeter/SayHello", ":authority", "example.com", "content-type", "application/grpc", "te", "trailers")
+	client = append(client, http2Frame(http2FrameHeaders, http2FlagEndHeaders, 1, block)...)
+	client = append(client, http2Frame(http2FrameData, http2FlagEndStream, 1, message)...)
+
+	server := http2Frame(http2FrameHeaders, http2FlagEndHeaders, 1, http2HeaderBlock(respEnc, &respBuf, ":status", "200", "content-type", "application/grpc"))
+	server = append(server, http2Frame(http2FrameData, 0, 1, message)...)
+	server = append(server, http2Frame(http2FrameHeaders, http2FlagEndHeaders|http2FlagEndStream, 1, http2HeaderBlock(respEnc, &respBuf, "grpc-status", "0", "grpc-message", "OK"))...)
+
+	listener.packetsChan <- buildPacket(true, 1, 100, client, time.Now()).dump()
+	listener.packetsChan <- buildPacket(false, 100+uint32(len(client)), 1, server, time.Now()).dump()
+
+	expected := []string{
+		"POST /helloworld.Greeter/SayHello HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/grpc\r\nTe: trailers\r\nContent-Length: 7\r\n\r\n" + string(message),
+		"HTTP/1.1 200 OK\r\nContent-Type: application/grpc\r\nGrpc-Status: 0\r\nGrpc-Message: OK\r\nContent-Length: 7\r\n\r\n" + string(message),
+	}
+
+	for _, e := range expected {
+		select {
+		case m := <-listener.Receiver():
+			if string(m.Bytes()) != e {
+				t.Errorf("Expected %q, got %q", e, m.Bytes())
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("Should decode gRPC message", e)
+		}
+	}
+}
+
+func TestTCPStream(t *testing.T) {
+	s := newTCPStream(tcpStreamMaxPending)
+
+	if data := s.add(10, []byte("abc")); string(data) != "abc" {
+		t.Error("Should return data in order", string(data))
+	}
+	if data := s.add(16, []byte("ghi")); data != nil {
+		t.Error("Should wait for missing data", string(data))
+	}
+	// Retransmission overlaps already received data
+	if data := s.add(11, []byte("bcdef")); string(data) != "defghi" {
+		t.Error("Should return pending data after gap is filled", string(data))
+	}
+	if data := s.add(13, []byte("def")); data != nil {
+		t.Error("Should skip retransmitted data", string(data))
+	}
+}
+
+func TestHTTP2ConnIDClientIP(t *testing.T) {
+	listener := &Listener{ports: []portRange{{80, 80}}}
+
+	packet := func(src, dst []byte, srcPort, dstPort uint16) *TCPPacket {
+		return &TCPPacket{Addr: src, DstAddr: dst, SrcPort: srcPort, DestPort: dstPort}
+	}
+
+	client1, client2, server := []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2}, []byte{10, 0, 0, 100}
+
+	// Clients on different hosts can use the same port
+	req1, _ := listener.connID(packet(client1, server, 5000, 80))
+	req2, _ := listener.connID(packet(client2, server, 5000, 80))
+	if req1 == req2 {
+		t.Error("Connections of different clients should differ")
+	}
+
+	resp1, isIncoming := listener.connID(packet(server, client1, 80, 5000))
+	if isIncoming || resp1 != req1 {
+		t.Error("Response should belong to connection of its client", resp1, req1)
+	}
+
+	// Raw socket engine does not know destination address
+	req, _ := listener.connID(packet(client1, nil, 5000, 80))
+	resp, _ := listener.connID(packet(server, nil, 80, 5000))
+	if req != resp {
+		t.Error("Connection should be identified by ports, if destination is unknown", req, resp)
+	}
+}
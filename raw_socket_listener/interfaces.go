@@ -0,0 +1,33 @@
+package rawSocket
+
+import (
+	"errors"
+
+	"github.com/google/gopacket/pcap"
+)
+
+var errNoInterfacesMatched = errors.New("no network interfaces match include and exclude patterns")
+
+// interfaceAllowed checks interface name against include and exclude patterns
+func (t *Listener) interfaceAllowed(name string) bool {
+	if t.interfaceInclude != nil && !t.interfaceInclude.MatchString(name) {
+		return false
+	}
+
+	return t.interfaceExclude == nil || !t.interfaceExclude.MatchString(name)
+}
+
+// filterPcapDevices keeps only devices allowed by include and exclude patterns
+func (t *Listener) filterPcapDevices(devices []pcap.Interface) (filtered []pcap.Interface, err error) {
+	for _, device := range devices {
+		if t.interfaceAllowed(device.Name) {
+			filtered = append(filtered, device)
+		}
+	}
+
+	if len(filtered) == 0 {
+		return nil, errNoInterfacesMatched
+	}
+
+	return
+}
@@ -0,0 +1,137 @@
+package rawSocket
+
+import (
+	"encoding/binary"
+)
+
+// IPv6 extension headers, see https://tools.ietf.org/html/rfc8200#section-4
+const (
+	ipv6HopByHop    = 0
+	ipv6Routing     = 43
+	ipv6Fragment    = 44
+	ipv6AH          = 51
+	ipv6DestOptions = 60
+	ipv6Mobility    = 135
+	ipv6HIP         = 139
+	ipv6Shim6       = 140
+
+	ipProtocolTCP = 6
+
+	ipv6HeaderSize = 40
+)
+
+// parseIPPacket returns source and destination addresses, and TCP segment of IPv4 or IPv6 packet.
+// Returns false if packet is truncated, or does not contain TCP segment.
+func parseIPPacket(data []byte) (srcIP, dstIP, tcp []byte, ok bool) {
+	srcIP, dstIP, tcp, protocol, ok := parseIPHeader(data)
+
+	return srcIP, dstIP, tcp, ok && protocol == ipProtocolTCP
+}
+
+// transportProtocol returns IP protocol number of captured traffic
+func (t *Listener) transportProtocol() byte {
+	if t.udp {
+		return ipProtocolUDP
+	}
+
+	return ipProtocolTCP
+}
+
+// parseIPHeader returns addresses, payload and its protocol of IPv4 or IPv6 packet
+func parseIPHeader(data []byte) (srcIP, dstIP, payload []byte, protocol byte, ok bool) {
+	if len(data) == 0 {
+		return
+	}
+
+	switch data[0] >> 4 {
+	case 4:
+		return parseIPv4Packet(data)
+	case 6:
+		return parseIPv6Packet(data)
+	}
+
+	return
+}
+
+func parseIPv4Packet(data []byte) (srcIP, dstIP, payload []byte, protocol byte, ok bool) {
+	ihl := int(data[0]&0x0F) * 4
+
+	// Truncated IP info
+	if len(data) < 20 || len(data) < ihl {
+		return
+	}
+
+	ipLength := int(binary.BigEndian.Uint16(data[2:4]))
+
+	// Too small IP packet, or invalid length
+	if ipLength < 20 || ihl > ipLength {
+		return
+	}
+
+	if cmp := len(data) - ipLength; cmp > 0 {
+		data = data[:ipLength]
+	} else if cmp < 0 {
+		// Truncated packet
+		return
+	}
+
+	return data[12:16], data[16:20], data[ihl:], data[9], true
+}
+
+// parseIPv6Packet skips extension headers until upper layer protocol. Fragmented packets are not reassembled, and skipped.
+func parseIPv6Packet(data []byte) (srcIP, dstIP, payload []byte, protocol byte, ok bool) {
+	// Truncated IP info
+	if len(data) < ipv6HeaderSize {
+		return
+	}
+
+	srcIP, dstIP = data[8:24], data[24:40]
+
+	// Zero length is used by jumbograms, which have length in hop-by-hop option
+	if payloadLength := int(binary.BigEndian.Uint16(data[4:6])); payloadLength > 0 {
+		if cmp := len(data) - ipv6HeaderSize - payloadLength; cmp > 0 {
+			data = data[:ipv6HeaderSize+payloadLength]
+		} else if cmp < 0 {
+			return
+		}
+	}
+
+	next := data[6]
+	data = data[ipv6HeaderSize:]
+
+	for {
+		var length int
+
+		switch next {
+		case ipv6HopByHop, ipv6Routing, ipv6DestOptions, ipv6Mobility, ipv6HIP, ipv6Shim6:
+			if len(data) < 8 {
+				return
+			}
+			length = (int(data[1]) + 1) * 8
+		case ipv6Fragment:
+			if len(data) < 8 {
+				return
+			}
+			// Only not fragmented packets: offset is 0 and no more fragments
+			if binary.BigEndian.Uint16(data[2:4])&0xFFF9 != 0 {
+				return
+			}
+			length = 8
+		case ipv6AH:
+			if len(data) < 8 {
+				return
+			}
+			length = (int(data[1]) + 2) * 4
+		default:
+			// Upper layer protocol, like TCP or UDP
+			return srcIP, dstIP, data, next, true
+		}
+
+		if len(data) < length {
+			return
+		}
+
+		next = data[0]
+		data = data[length:]
+	}
+}
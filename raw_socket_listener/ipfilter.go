@@ -0,0 +1,87 @@
+package rawSocket
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// ParseIPNets parses list of IP addresses and CIDR ranges. Single address is treated as range
+// of one address.
+func ParseIPNets(list []string) (nets []*net.IPNet, err error) {
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("wrong IP address: %q", s)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+				bits = 8 * net.IPv4len
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("wrong CIDR range: %q", s)
+		}
+		nets = append(nets, n)
+	}
+
+	return
+}
+
+// clientAllowed checks client address against allow and deny lists. Deny list takes precedence,
+// and empty allow list allows all addresses.
+func (t *Listener) clientAllowed(ip net.IP) bool {
+	for _, n := range t.denyIPs {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(t.allowIPs) == 0 {
+		return true
+	}
+
+	for _, n := range t.allowIPs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterClient checks address of client side of captured packet: source address of request,
+// or destination address of response. Packets with unknown client address are not filtered.
+func (t *Listener) filterClient(srcIP, dstIP []byte, destPort uint16) bool {
+	if len(t.allowIPs) == 0 && len(t.denyIPs) == 0 {
+		return true
+	}
+
+	client := srcIP
+	if !t.isListenPort(destPort) {
+		client = dstIP
+	}
+
+	if len(client) == 0 {
+		return true
+	}
+
+	if t.clientAllowed(net.IP(client)) {
+		return true
+	}
+
+	atomic.AddUint64(&t.stats.FilteredPackets, 1)
+
+	return false
+}
@@ -23,11 +23,14 @@ import (
 	"io"
 	"log"
 	"net"
+	"regexp"
 	"runtime"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,6 +38,7 @@ var _ = fmt.Println
 
 type packet struct {
 	srcIP		[]byte
+	dstIP     []byte
 	data		[]byte
 	timestamp	time.Time
 }
@@ -58,21 +62,76 @@ type Listener struct {
 	// Ack -> ID
 	respWithoutReq map[uint32]tcpID
 
+	// HTTP/2 connections are decoded as streams, instead of separate messages
+	http2Conns map[tcpConnID]*http2Conn
+
+	// Decryption state of TLS connections, if keys are provided
+	tlsKeys  *TLSKeys
+	tlsConns map[tcpConnID]*tlsConn
+
+	// TLS connections are filtered by server name patterns and ALPN protocols of ClientHello
+	tlsServerNames []string
+	tlsALPN        []string
+	tlsFilterConns map[tcpConnID]*tlsFilterConn
+
+	// Upgraded WebSocket connections, their frames are emitted to separate channel
+	wsConns    map[tcpConnID]*wsConn
+	framesChan chan *WebSocketFrame
+
+	bpfFilter string
+	vlans     []uint16
+	// Capture only interfaces with names matching include pattern, and not matching exclude pattern
+	interfaceInclude *regexp.Regexp
+	interfaceExclude *regexp.Regexp
+
+	// Packets of clients not matching allow list, or matching deny list, are skipped
+	allowIPs    []*net.IPNet
+	denyIPs     []*net.IPNet
+	decapsulate bool
+
+	// UDP datagrams are captured instead of TCP, and emitted to separate channel
+	udp           bool
+	udpFlows      map[udpFlowID]*udpFlow
+	datagramsChan chan *UDPDatagram
+
+	// Max size of out of order data buffered per message or stream
+	reassemblyLimit int
+
+	// Options of libpcap handles
+	snapLen       int
+	promiscuous   bool
+	immediateMode bool
+	bufferSize    int
+
+	afpacketFanout int
+	captureHandles []interface {
+		Close()
+	}
+
 	// Messages ready to be send to client
 	packetsChan chan *packet
 
 	// Messages ready to be send to client
 	messagesChan chan *TCPMessage
 
-	addr string // IP to listen
-	port uint16 // Port to listen
+	addr  string      // IP to listen
+	ports []portRange // Ports to listen
 
 	trackResponse bool
 	messageExpire time.Duration
+	// Idle timeout of HTTP/2, TLS and WebSocket connections
+	connExpire time.Duration
+	// Max number of tracked messages and connections, 0 if not limited
+	maxFlows int
+	// Larger messages are dropped, 0 if not limited
+	maxMessageSize int
 
 	conn        net.PacketConn
 	pcapHandles []*pcap.Handle
 
+	// Reassembly counters, capture counters are read from handles
+	stats Stats
+
 	quit    chan bool
 	readyCh chan bool
 }
@@ -88,10 +147,72 @@ const (
 	EngineRawSocket = 1 << iota
 	EnginePcap
 	EnginePcapFile
+	EngineAFPacket
+	EngineXDP
+	EnginePcapDir
 )
 
+// ListenerConfig holds optional Listener settings
+type ListenerConfig struct {
+	// Keys used to decrypt captured TLS traffic
+	TLSKeys *TLSKeys
+	// Additional BPF expression, combined with filter by address and port. Supported only by pcap engines.
+	BPFFilter string
+	// Capture only packets with given VLAN IDs
+	VLANs []uint16
+	// Extract packets from VXLAN, Geneve and GRE tunnels
+	Decapsulate bool
+	// Number of AF_PACKET sockets reading each device, spread by connection hash
+	AFPacketFanout int
+	// Capture UDP datagrams instead of TCP messages
+	UDP bool
+	// Max size of out of order data buffered per connection direction, while waiting for missing packet.
+	// Messages exceeding it are dropped. Default is 4MB.
+	ReassemblyLimit int
+	// Connections tracked as stream (HTTP/2, TLS and WebSocket) without packets for this time are forgotten.
+	// Default is 10 minutes.
+	ConnExpire time.Duration
+	// Max number of messages and connections tracked at once. When reached, least recently seen are evicted.
+	// Not limited by default.
+	MaxFlows int
+	// Larger messages are dropped, to keep memory bounded when body is streamed without end. Not limited by default.
+	MaxMessageSize int
+	// Capture only traffic of clients with addresses from these ranges. All clients by default.
+	AllowIPs []*net.IPNet
+	// Skip traffic of clients with addresses from these ranges, takes precedence over AllowIPs
+	DenyIPs []*net.IPNet
+	// Capture only TLS connections with server name (SNI) matching one of these patterns, like '*.example.com'.
+	// Connections which are not TLS are not filtered.
+	TLSServerNames []string
+	// Capture only TLS connections offering one of these ALPN protocols, like 'h2'
+	TLSALPN []string
+	// Capture only interfaces with names matching this pattern. All interfaces by default.
+	InterfaceInclude *regexp.Regexp
+	// Skip interfaces with names matching this pattern, for example 'veth.*|docker0'
+	InterfaceExclude *regexp.Regexp
+	// Max number of bytes captured from each packet by libpcap engine. Default is 65536.
+	SnapLen int
+	// Do not put interfaces to promiscuous mode, capture only traffic addressed to host
+	NoPromiscuous bool
+	// Deliver packets as soon as they arrive, instead of buffering them by libpcap
+	ImmediateMode bool
+	// Size of kernel buffer of libpcap engine. libpcap default (usually 2MB) is used if not set.
+	BufferSize int
+}
+
+// Default max number of bytes captured from each packet
+const defaultSnapLen = 65536
+
+// Default idle timeout of connections, which are tracked as stream
+const defaultConnExpire = 10 * time.Minute
+
 // NewListener creates and initializes new Listener object
 func NewListener(addr string, port string, engine int, trackResponse bool, expire time.Duration) (l *Listener) {
+	return NewListenerWithConfig(addr, port, engine, trackResponse, expire, ListenerConfig{})
+}
+
+// NewListenerWithConfig creates Listener with optional settings
+func NewListenerWithConfig(addr string, port string, engine int, trackResponse bool, expire time.Duration, config ListenerConfig) (l *Listener) {
 	l = &Listener{}
 
 	l.packetsChan = make(chan *packet, 10000)
@@ -104,11 +225,50 @@ func NewListener(addr string, port string, engine int, trackResponse bool, expir
 	l.seqWithData = make(map[uint32]uint32)
 	l.respAliases = make(map[uint32]*TCPMessage)
 	l.respWithoutReq = make(map[uint32]tcpID)
+	l.http2Conns = make(map[tcpConnID]*http2Conn)
+	l.tlsKeys = config.TLSKeys
+	l.tlsConns = make(map[tcpConnID]*tlsConn)
+	l.tlsServerNames = config.TLSServerNames
+	l.tlsALPN = config.TLSALPN
+	l.tlsFilterConns = make(map[tcpConnID]*tlsFilterConn)
+	l.wsConns = make(map[tcpConnID]*wsConn)
+	l.framesChan = make(chan *WebSocketFrame, 10000)
+	l.bpfFilter = config.BPFFilter
+	l.vlans = config.VLANs
+	l.interfaceInclude = config.InterfaceInclude
+	l.interfaceExclude = config.InterfaceExclude
+	l.allowIPs = config.AllowIPs
+	l.denyIPs = config.DenyIPs
+	l.decapsulate = config.Decapsulate
+	l.afpacketFanout = config.AFPacketFanout
+	l.snapLen = config.SnapLen
+	if l.snapLen <= 0 {
+		l.snapLen = defaultSnapLen
+	}
+	l.promiscuous = !config.NoPromiscuous
+	l.immediateMode = config.ImmediateMode
+	l.bufferSize = config.BufferSize
+	l.udp = config.UDP
+	l.reassemblyLimit = config.ReassemblyLimit
+	if l.reassemblyLimit <= 0 {
+		l.reassemblyLimit = tcpStreamMaxPending
+	}
+	l.connExpire = config.ConnExpire
+	if l.connExpire <= 0 {
+		l.connExpire = defaultConnExpire
+	}
+	l.maxFlows = config.MaxFlows
+	l.maxMessageSize = config.MaxMessageSize
+	l.udpFlows = make(map[udpFlowID]*udpFlow)
+	l.datagramsChan = make(chan *UDPDatagram, 10000)
 	l.trackResponse = trackResponse
 
 	l.addr = addr
-	_port, _ := strconv.Atoi(port)
-	l.port = uint16(_port)
+	ports, err := parsePorts(port)
+	if err != nil {
+		log.Fatal(err)
+	}
+	l.ports = ports
 
 	if expire.Nanoseconds() == 0 {
 		expire = 2000 * time.Millisecond
@@ -119,12 +279,18 @@ func NewListener(addr string, port string, engine int, trackResponse bool, expir
 	go l.listen()
 
 	// Special case for testing
-	if l.port != 0 {
+	if port != "0" {
 		switch engine {
 		case EnginePcap:
 			go l.readPcap()
 		case EnginePcapFile:
 			go l.readPcapFile()
+		case EngineAFPacket:
+			go l.readAFPacket()
+		case EngineXDP:
+			go l.readXDP()
+		case EnginePcapDir:
+			go l.readPcapDir()
 		default:
 			log.Fatal("Unknown traffic interception engine:", engine)
 		}
@@ -144,7 +310,17 @@ func (t *Listener) listen() {
 			}
 			return
 		case packet := <-t.packetsChan:
+			if t.maxFlows > 0 && t.flowsCount() >= t.maxFlows {
+				t.evictFlows()
+			}
+
+			if t.udp {
+				t.processUDPPacket(packet)
+				continue
+			}
+
 			tcpPacket := ParseTCPPacket(packet.srcIP, packet.data, packet.timestamp)
+			tcpPacket.DstAddr = packet.dstIP
 			t.processTCPPacket(tcpPacket)
 		case <-gcTicker:
 			now := time.Now()
@@ -155,6 +331,46 @@ func (t *Listener) listen() {
 					t.dispatchMessage(message)
 				}
 			}
+
+			var expired uint64
+
+			for id, conn := range t.http2Conns {
+				if now.Sub(conn.lastSeen) >= t.connExpire {
+					delete(t.http2Conns, id)
+					expired++
+				}
+			}
+
+			for id, conn := range t.tlsConns {
+				if now.Sub(conn.lastSeen) >= t.connExpire {
+					delete(t.tlsConns, id)
+					expired++
+				}
+			}
+
+			for id, conn := range t.tlsFilterConns {
+				if now.Sub(conn.lastSeen) >= t.connExpire {
+					delete(t.tlsFilterConns, id)
+					expired++
+				}
+			}
+
+			for id, conn := range t.wsConns {
+				// Handshake without response is forgotten as usual message
+				if now.Sub(conn.lastSeen) >= t.connExpire || !conn.upgraded && now.Sub(conn.lastSeen) >= t.messageExpire {
+					delete(t.wsConns, id)
+					expired++
+				}
+			}
+
+			for id, flow := range t.udpFlows {
+				if now.Sub(flow.lastSeen) >= t.messageExpire {
+					delete(t.udpFlows, id)
+					expired++
+				}
+			}
+
+			atomic.AddUint64(&t.stats.ExpiredConnections, expired)
 		}
 	}
 }
@@ -172,6 +388,67 @@ func (t *Listener) deleteMessage(message *TCPMessage) {
 	delete(t.respAliases, message.ResponseAck)
 }
 
+// flowsCount returns number of tracked messages and connections
+func (t *Listener) flowsCount() int {
+	return len(t.messages) + len(t.http2Conns) + len(t.tlsConns) + len(t.tlsFilterConns) + len(t.wsConns) + len(t.udpFlows)
+}
+
+// evictFlows makes room for new flows, by removing tenth of tracked messages and connections which were seen
+// least recently. Evicted messages are dispatched as if they expired.
+func (t *Listener) evictFlows() {
+	type flow struct {
+		lastSeen time.Time
+		evict    func()
+	}
+
+	flows := make([]flow, 0, t.flowsCount())
+
+	for _, m := range t.messages {
+		m := m
+		flows = append(flows, flow{m.End, func() { t.dispatchMessage(m) }})
+	}
+	for id, conn := range t.http2Conns {
+		id := id
+		flows = append(flows, flow{conn.lastSeen, func() { delete(t.http2Conns, id) }})
+	}
+	for id, conn := range t.tlsConns {
+		id := id
+		flows = append(flows, flow{conn.lastSeen, func() { delete(t.tlsConns, id) }})
+	}
+	for id, conn := range t.tlsFilterConns {
+		id := id
+		flows = append(flows, flow{conn.lastSeen, func() { delete(t.tlsFilterConns, id) }})
+	}
+	for id, conn := range t.wsConns {
+		id := id
+		flows = append(flows, flow{conn.lastSeen, func() { delete(t.wsConns, id) }})
+	}
+	for id, f := range t.udpFlows {
+		id := id
+		flows = append(flows, flow{f.lastSeen, func() { delete(t.udpFlows, id) }})
+	}
+
+	sort.Slice(flows, func(i, j int) bool { return flows[i].lastSeen.Before(flows[j].lastSeen) })
+
+	n := len(flows)/10 + 1
+	if n > len(flows) {
+		n = len(flows)
+	}
+
+	for _, f := range flows[:n] {
+		f.evict()
+	}
+
+	atomic.AddUint64(&t.stats.EvictedFlows, uint64(n))
+}
+
+// dropMessage releases message data, and skips rest of its packets until it expires
+func (t *Listener) dropMessage(message *TCPMessage) {
+	message.dropped = true
+	message.complete = false
+	message.packets = message.packets[:1]
+}
+
 func (t *Listener) dispatchMessage(message *TCPMessage) {
 	// If already dispatched
 	if _, ok := t.messages[message.ID()]; !ok {
@@ -181,6 +458,10 @@ func (t *Listener) dispatchMessage(message *TCPMessage) {
 	t.deleteMessage(message)
 
 	if !message.complete {
+		if !message.dropped {
+			atomic.AddUint64(&t.stats.IncompleteMessages, 1)
+		}
+
 		if !message.IsIncoming {
 			delete(t.respAliases, message.Ack)
 			delete(t.respWithoutReq, message.Ack)
@@ -308,12 +589,109 @@ func findPcapDevices(addr string) (interfaces []pcap.Interface, err error) {
 	}
 }
 
+// deviceBPF returns BPF expression for device, which matches listened addresses and ports.
+// With vlanTags, it also matches packets with VLAN tags, which are visible to filter only in libpcap.
+func (t *Listener) deviceBPF(device pcap.Interface, devices []pcap.Interface, bpfSupported bool, vlanTags bool) (bpf string) {
+	var bpfDstHost, bpfSrcHost string
+	var loopback = isLoopback(device)
+
+	if loopback {
+		var allAddr []string
+		for _, dc := range devices {
+			for _, addr := range dc.Addresses {
+				allAddr = append(allAddr, "(dst host "+addr.IP.String()+" and src host "+addr.IP.String()+")")
+			}
+		}
+
+		bpfDstHost = strings.Join(allAddr, " or ")
+		bpfSrcHost = bpfDstHost
+	} else {
+		for i, addr := range device.Addresses {
+			bpfDstHost += "dst host " + addr.IP.String()
+			bpfSrcHost += "src host " + addr.IP.String()
+			if i != len(device.Addresses)-1 {
+				bpfDstHost += " or "
+				bpfSrcHost += " or "
+			}
+		}
+	}
+
+	if !bpfSupported {
+		return t.bpfFilter
+	}
+
+	// IPv6 packets with extension headers are matched only by address, ports are checked after parsing
+	protocol := strconv.Itoa(int(t.transportProtocol()))
+	ipv6Ext := "ip6 and not ip6 proto " + protocol + " and ip6 protochain " + protocol
+
+	if t.trackResponse {
+		bpf = "(" + t.portsBPF("dst") + " and (" + bpfDstHost + ")) or (" + t.portsBPF("src") + " and (" + bpfSrcHost + ")) or (" + ipv6Ext + " and (" + bpfDstHost + " or " + bpfSrcHost + "))"
+	} else {
+		bpf = "(" + t.portsBPF("dst") + " and (" + bpfDstHost + ")) or (" + ipv6Ext + " and (" + bpfDstHost + "))"
+	}
+
+	if vlanTags {
+		bpf = t.vlanBPF(bpf)
+	}
+
+	// Tunnels go first, since offsets are shifted by 'vlan' keyword
+	if t.decapsulate {
+		bpf = "(" + tunnelBPF + ") or " + bpf
+	}
+
+	// User filter goes first, since offsets are not shifted by 'vlan' keyword yet
+	if t.bpfFilter != "" {
+		bpf = "(" + t.bpfFilter + ") and (" + bpf + ")"
+	}
+
+	return
+}
+
+// openPcap activates libpcap handle with configured snap length, buffer size and modes
+func (t *Listener) openPcap(device string) (*pcap.Handle, error) {
+	inactive, err := pcap.NewInactiveHandle(device)
+	if err != nil {
+		return nil, err
+	}
+	defer inactive.CleanUp()
+
+	if err = inactive.SetSnapLen(t.snapLen); err != nil {
+		return nil, err
+	}
+
+	if err = inactive.SetPromisc(t.promiscuous); err != nil {
+		return nil, err
+	}
+
+	if err = inactive.SetTimeout(t.messageExpire); err != nil {
+		return nil, err
+	}
+
+	if t.immediateMode {
+		if err = inactive.SetImmediateMode(true); err != nil {
+			return nil, err
+		}
+	}
+
+	if t.bufferSize > 0 {
+		if err = inactive.SetBufferSize(t.bufferSize); err != nil {
+			return nil, err
+		}
+	}
+
+	return inactive.Activate()
+}
+
 func (t *Listener) readPcap() {
 	devices, err := findPcapDevices(t.addr)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if devices, err = t.filterPcapDevices(devices); err != nil {
+		log.Fatal(err)
+	}
+
 	bpfSupported := true
 	if runtime.GOOS == "darwin" {
 		bpfSupported = false
@@ -324,7 +702,7 @@ func (t *Listener) readPcap() {
 
 	for _, d := range devices {
 		go func(device pcap.Interface) {
-			handle, err := pcap.OpenLive(device.Name, 65536, true, t.messageExpire)
+			handle, err := t.openPcap(device.Name)
 			if err != nil {
 				log.Println("Pcap Error while opening device", device.Name, err)
 				wg.Done()
@@ -332,48 +710,22 @@ func (t *Listener) readPcap() {
 			}
 			defer handle.Close()
 
-			t.mu.Lock()
-			t.pcapHandles = append(t.pcapHandles, handle)
-
-			var bpfDstHost, bpfSrcHost string
-			var loopback = isLoopback(device)
-
-			if loopback {
-				var allAddr []string
-				for _, dc := range devices {
-					for _, addr := range dc.Addresses {
-						allAddr = append(allAddr, "(dst host "+addr.IP.String()+" and src host "+addr.IP.String()+")")
-					}
-				}
-
-				bpfDstHost = strings.Join(allAddr, " or ")
-				bpfSrcHost = bpfDstHost
-			} else {
-				for i, addr := range device.Addresses {
-					bpfDstHost += "dst host " + addr.IP.String()
-					bpfSrcHost += "src host " + addr.IP.String()
-					if i != len(device.Addresses)-1 {
-						bpfDstHost += " or "
-						bpfSrcHost += " or "
+			// Filter is set before handle is registered, so failed handle is not kept, and lock is not held on error
+			if bpf := t.deviceBPF(device, devices, bpfSupported, true); bpf != "" {
+				if err := handle.SetBPFFilter(bpf); err != nil {
+					// User provided filter is likely wrong, and should be fixed
+					if t.bpfFilter != "" {
+						log.Fatal("BPF filter error: ", err, " Device: ", device.Name, " ", bpf)
 					}
-				}
-			}
-
-			if bpfSupported {
-				var bpf string
-
-				if t.trackResponse {
-					bpf = "(tcp dst port " + strconv.Itoa(int(t.port)) + " and (" + bpfDstHost + ")) or (" + "tcp src port " + strconv.Itoa(int(t.port)) + " and (" + bpfSrcHost + "))"
-				} else {
-					bpf = "tcp dst port " + strconv.Itoa(int(t.port)) + " and (" + bpfDstHost + ")"
-				}
 
-				if err := handle.SetBPFFilter(bpf); err != nil {
 					log.Println("BPF filter error:", err, "Device:", device.Name, bpf)
 					wg.Done()
 					return
 				}
 			}
+
+			t.mu.Lock()
+			t.pcapHandles = append(t.pcapHandles, handle)
 			t.mu.Unlock()
 
 			var decoder gopacket.Decoder
@@ -391,8 +743,6 @@ func (t *Listener) readPcap() {
 
 			wg.Done()
 
-			var data, srcIP, dstIP []byte
-
 			for {
 				packet, err := source.NextPacket()
 
@@ -424,175 +774,214 @@ func (t *Listener) readPcap() {
 					break
 				}
 
-				data = packet.Data()[of:]
-
-				version := uint8(data[0]) >> 4
-				ipLength := int(binary.BigEndian.Uint16(data[2:4]))
-
-				if version == 4 {
-					ihl := uint8(data[0]) & 0x0F
-
-					// Truncated IP info
-					if len(data) < int(ihl*4) {
-						continue
-					}
-
-					srcIP = data[12:16]
-					dstIP = data[16:20]
-
-					// Too small IP packet
-					if ipLength < 20 {
-						continue
-					}
-
-					// Invalid length
-					if int(ihl*4) > ipLength {
+				// Packets on trunk interfaces carry VLAN tags before network layer
+				if decoder == layers.LinkTypeEthernet || decoder == layers.LinkTypeLinuxSLL {
+					var ok bool
+					if of, ok = t.skipVLANTags(packet.Data(), of); !ok {
 						continue
 					}
+				}
 
-					if cmp := len(data) - ipLength; cmp > 0 {
-						data = data[:ipLength]
-					} else if cmp < 0 {
-						// Truncated packet
-						continue
-					}
+				t.processIPPacket(packet.Data()[of:], device, devices, bpfSupported, packet.Metadata().Timestamp)
+			}
+		}(d)
+	}
 
-					data = data[ihl*4:]
-				} else {
-					// Truncated IP info
-					if len(data) < 40 {
-						continue
-					}
+	wg.Wait()
+	t.readyCh <- true
+}
 
-					srcIP = data[8:24]
-					dstIP = data[24:40]
+// processIPPacket filters captured IP packet by listened ports and addresses, and sends TCP segment or UDP datagram to processing
+func (t *Listener) processIPPacket(data []byte, device pcap.Interface, devices []pcap.Interface, bpfSupported bool, timestamp time.Time) {
+	srcIP, dstIP, data, tunneled, ok := t.parseNetworkPacket(data)
+	if !ok {
+		return
+	}
 
-					data = data[40:]
-				}
+	// We need only packets with data inside
+	if t.hasPayload(data) {
+		destPort := binary.BigEndian.Uint16(data[2:4])
+		srcPort := binary.BigEndian.Uint16(data[0:2])
 
-				// Truncated TCP info
-				if len(data) <= 13 {
-					continue
-				}
+		// BPF can't check ports of IPv6 packets with extension headers
+		if bpfSupported && !t.isListenPort(destPort) && !(t.trackResponse && t.isListenPort(srcPort)) {
+			return
+		}
 
-				dataOffset := (data[12] & 0xF0) >> 4
-				isFIN := data[13]&0x01 != 0
+		if !t.filterClient(srcIP, dstIP, destPort) {
+			return
+		}
 
-				// We need only packets with data inside
-				// Check that the buffer is larger than the size of the TCP header
-				if len(data) > int(dataOffset*4) || isFIN {
-					if !bpfSupported {
-						destPort := binary.BigEndian.Uint16(data[2:4])
-						srcPort := binary.BigEndian.Uint16(data[0:2])
+		// Addresses of tunneled packets are not local
+		if !bpfSupported && !tunneled {
+			var addrCheck []byte
 
-						var addrCheck []byte
+			if t.isListenPort(destPort) {
+				addrCheck = dstIP
+			}
 
-						if destPort == t.port {
-							addrCheck = dstIP
-						}
+			if t.trackResponse && t.isListenPort(srcPort) {
+				addrCheck = srcIP
+			}
 
-						if t.trackResponse && srcPort == t.port {
-							addrCheck = srcIP
-						}
+			if len(addrCheck) == 0 {
+				return
+			}
 
-						if len(addrCheck) == 0 {
-							continue
-						}
+			addrMatched := false
 
-						addrMatched := false
-
-						if loopback {
-							for _, dc := range devices {
-								if addrMatched {
-									break
-								}
-								for _, a := range dc.Addresses {
-									if a.IP.Equal(net.IP(addrCheck)) {
-										addrMatched = true
-										break
-									}
-								}
-							}
+			if isLoopback(device) {
+				for _, dc := range devices {
+					if addrMatched {
+						break
+					}
+					for _, a := range dc.Addresses {
+						if a.IP.Equal(net.IP(addrCheck)) {
 							addrMatched = true
-						} else {
-							for _, a := range device.Addresses {
-								if a.IP.Equal(net.IP(addrCheck)) {
-									addrMatched = true
-									break
-								}
-							}
-						}
-
-						if !addrMatched {
-							continue
+							break
 						}
 					}
-
-					t.packetsChan <- t.buildPacket(srcIP, data, packet.Metadata().Timestamp)
+				}
+				addrMatched = true
+			} else {
+				for _, a := range device.Addresses {
+					if a.IP.Equal(net.IP(addrCheck)) {
+						addrMatched = true
+						break
+					}
 				}
 			}
-		}(d)
+
+			if !addrMatched {
+				return
+			}
+		}
+
+		t.packetsChan <- t.buildPacket(srcIP, dstIP, data, timestamp)
 	}
+}
 
-	wg.Wait()
-	t.readyCh <- true
+// hasPayload checks that TCP segment has data or FIN flag, or that UDP datagram is not empty
+func (t *Listener) hasPayload(data []byte) bool {
+	if t.udp {
+		return len(data) > udpHeaderSize
+	}
+
+	// Truncated TCP info
+	if len(data) <= 13 {
+		return false
+	}
+
+	dataOffset := (data[12] & 0xF0) >> 4
+	isFIN := data[13]&0x01 != 0
+
+	// Check that the buffer is larger than the size of the TCP header
+	return len(data) > int(dataOffset*4) || isFIN
 }
 
 func (t *Listener) readPcapFile() {
 	if handle, err := pcap.OpenOffline(t.addr); err != nil {
 		log.Fatal(err)
 	} else {
+		t.setPcapFileFilter(handle)
 		t.readyCh <- true
-		packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-
-		for {
-			packet, err := packetSource.NextPacket()
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				log.Println("Error:", err)
-				continue
-			}
+		t.readPcapFileHandle(handle)
+	}
+}
 
-			var addr, data []byte
+// setPcapFileFilter applies user provided BPF filter to opened capture file
+func (t *Listener) setPcapFileFilter(handle *pcap.Handle) {
+	if t.bpfFilter != "" {
+		if err := handle.SetBPFFilter(t.bpfFilter); err != nil {
+			log.Fatal("BPF filter error: ", err, " ", t.bpfFilter)
+		}
+	}
+}
+
+// readPcapFileHandle reads all packets of capture file. Ports are not known, so direction
+// is guessed by ephemeral port range.
+func (t *Listener) readPcapFileHandle(handle *pcap.Handle) {
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+
+	for {
+		packet, err := packetSource.NextPacket()
+		// File may be truncated, if capture was interrupted
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			log.Println("Error:", err)
+			continue
+		}
 
-			if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-				tcp, _ := tcpLayer.(*layers.TCP)
-				data = append(tcp.LayerContents(), tcp.LayerPayload()...)
+		var addr, data []byte
 
-				if tcp.SrcPort >= 32768 && tcp.SrcPort <= 61000 {
-					copy(data[0:2], []byte{0, 0})
-					copy(data[2:4], []byte{0, 1})
-				} else {
-					copy(data[0:2], []byte{0, 1})
-					copy(data[2:4], []byte{0, 0})
+		if len(t.vlans) > 0 && !t.matchVLANLayers(packet) {
+			continue
+		}
+
+		if t.udp {
+			// Tunneled packets have multiple UDP layers, and the last one belongs to captured datagram
+			var udp *layers.UDP
+			for _, layer := range packet.Layers() {
+				if l, ok := layer.(*layers.UDP); ok {
+					udp = l
 				}
-			} else {
+			}
+
+			if udp == nil {
 				continue
 			}
 
-			if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
-				ip, _ := ipLayer.(*layers.IPv4)
-				addr = ip.SrcIP
-			} else if ipLayer = packet.Layer(layers.LayerTypeIPv6); ipLayer != nil {
-				ip, _ := ipLayer.(*layers.IPv6)
-				addr = ip.SrcIP
+			data = append(udp.LayerContents(), udp.LayerPayload()...)
+
+			// Client port is kept, since UDP responses are matched to requests by ports
+			if udp.SrcPort >= 32768 && udp.SrcPort <= 61000 {
+				copy(data[2:4], []byte{0, 1})
 			} else {
-				// log.Println("Can't find IP layer", packet)
-				continue
+				copy(data[0:2], []byte{0, 1})
 			}
+		} else if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
+			tcp, _ := tcpLayer.(*layers.TCP)
+			data = append(tcp.LayerContents(), tcp.LayerPayload()...)
 
-			dataOffset := (data[12] & 0xF0) >> 4
-			isFIN := data[13]&0x01 != 0
+			if tcp.SrcPort >= 32768 && tcp.SrcPort <= 61000 {
+				copy(data[0:2], []byte{0, 0})
+				copy(data[2:4], []byte{0, 1})
+			} else {
+				copy(data[0:2], []byte{0, 1})
+				copy(data[2:4], []byte{0, 0})
+			}
+		} else {
+			continue
+		}
 
-			// We need only packets with data inside
-			// Check that the buffer is larger than the size of the TCP header
-			if len(data) <= int(dataOffset*4) && !isFIN {
-				continue
+		var dstAddr []byte
+
+		// Tunneled packets have multiple IP layers, and the last one belongs to TCP
+		for _, layer := range packet.Layers() {
+			switch ip := layer.(type) {
+			case *layers.IPv4:
+				addr, dstAddr = ip.SrcIP, ip.DstIP
+			case *layers.IPv6:
+				addr, dstAddr = ip.SrcIP, ip.DstIP
 			}
+		}
 
-			t.packetsChan <- t.buildPacket(addr, data, packet.Metadata().Timestamp)
+		if addr == nil {
+			// log.Println("Can't find IP layer", packet)
+			continue
+		}
+
+		if !t.filterClient(addr, dstAddr, binary.BigEndian.Uint16(data[2:4])) {
+			continue
+		}
+
+		// We need only packets with data inside
+		if !t.hasPayload(data) {
+			continue
 		}
+
+		t.packetsChan <- t.buildPacket(addr, dstAddr, data, packet.Metadata().Timestamp)
 	}
 }
 
@@ -623,14 +1012,15 @@ func (t *Listener) readRAWSocket() {
 		}
 
 		if n > 0 {
-			if t.isValidPacket(buf[:n]) {
-				t.packetsChan <- t.buildPacket([]byte(addr.(*net.IPAddr).IP), buf[:n], time.Now())
+			// Only source address is known, responses of skipped requests are not dispatched anyway
+			if t.isValidPacket(buf[:n]) && t.filterClient([]byte(addr.(*net.IPAddr).IP), nil, binary.BigEndian.Uint16(buf[2:4])) {
+				t.packetsChan <- t.buildPacket([]byte(addr.(*net.IPAddr).IP), nil, buf[:n], time.Now())
 			}
 		}
 	}
 }
 
-func (t *Listener) buildPacket(packetSrcIP []byte, packetData []byte, timestamp time.Time) *packet {
+func (t *Listener) buildPacket(packetSrcIP []byte, packetDstIP []byte, packetData []byte, timestamp time.Time) *packet {
 	copyPacketSrcIP := make([]byte, 16)
 	copyPacketData := make([]byte, len(packetData))
 
@@ -639,6 +1029,7 @@ func (t *Listener) buildPacket(packetSrcIP []byte, packetData []byte, timestamp
 
 	return &packet{
 		srcIP: packetSrcIP,
+		dstIP:     packetDstIP,
 		data: packetData,
 		timestamp:timestamp,
 	}
@@ -651,7 +1042,7 @@ func (t *Listener) isValidPacket(buf []byte) bool {
 	srcPort := binary.BigEndian.Uint16(buf[0:2])
 
 	// Because RAW_SOCKET can't be bound to port, we have to control it by ourself
-	if destPort == t.port || (t.trackResponse && srcPort == t.port) {
+	if t.isListenPort(destPort) || (t.trackResponse && t.isListenPort(srcPort)) {
 		// Get the 'data offset' (size of the TCP header in 32-bit words)
 		dataOffset := (buf[12] & 0xF0) >> 4
 
@@ -677,9 +1068,25 @@ func (t *Listener) processTCPPacket(packet *TCPPacket) {
 		}
 	}()
 
+	if !t.filterTLSPacket(packet) {
+		return
+	}
+
+	if t.processTLSPacket(packet) {
+		return
+	}
+
+	if t.processWebSocketPacket(packet) {
+		return
+	}
+
+	if t.processHTTP2Packet(packet) {
+		return
+	}
+
 	var message *TCPMessage
 
-	isIncoming := packet.DestPort == t.port
+	isIncoming := t.isListenPort(packet.DestPort)
 
 	// Seek for 100-expect chunks
 	if parentAck, ok := t.seqWithData[packet.Seq]; ok {
@@ -728,6 +1135,7 @@ func (t *Listener) processTCPPacket(packet *TCPPacket) {
 	if !ok {
 		message = NewTCPMessage(packet.Seq, packet.Ack, isIncoming, packet.timestamp)
 		t.messages[packet.ID] = message
+		t.setWebSocketHandshakeID(packet, message)
 
 		if !isIncoming {
 			if responseRequest != nil {
@@ -739,8 +1147,29 @@ func (t *Listener) processTCPPacket(packet *TCPPacket) {
 		}
 	}
 
+	// Rest of dropped message is skipped, until it expires
+	if message.dropped {
+		message.End = time.Now()
+		return
+	}
+
 	// Adding packet to message
-	message.AddPacket(packet)
+	if message.AddPacket(packet) {
+		atomic.AddUint64(&t.stats.RetransmittedPackets, 1)
+	}
+
+	if t.maxMessageSize > 0 && message.size > t.maxMessageSize {
+		atomic.AddUint64(&t.stats.OversizedMessages, 1)
+		t.dropMessage(message)
+		return
+	}
+
+	// Missing packet is likely lost, and data following it can't be buffered anymore
+	if message.pendingSize > t.reassemblyLimit {
+		atomic.AddUint64(&t.stats.ReassemblyDropped, 1)
+		t.dropMessage(message)
+		return
+	}
 
 	// Handling Expect: 100-continue requests
 	if message.expectType == httpExpect100Continue && len(message.packets) == message.headerPacket+1 {
@@ -828,6 +1257,16 @@ func (t *Listener) Receiver() chan *TCPMessage {
 	return t.messagesChan
 }
 
+// WebSocketReceiver returns channel of frames sent over upgraded WebSocket connections
+func (t *Listener) WebSocketReceiver() chan *WebSocketFrame {
+	return t.framesChan
+}
+
+// DatagramReceiver returns channel of captured UDP datagrams, if listener captures UDP
+func (t *Listener) DatagramReceiver() chan *UDPDatagram {
+	return t.datagramsChan
+}
+
 func (t *Listener) Close() {
 	close(t.quit)
 	if t.conn != nil {
@@ -838,5 +1277,9 @@ func (t *Listener) Close() {
 		h.Close()
 	}
 
+	for _, h := range t.captureHandles {
+		h.Close()
+	}
+
 	return
 }
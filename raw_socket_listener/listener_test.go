@@ -4,9 +4,14 @@ import (
 	"bytes"
 	"log"
 	"math/rand"
+	"net"
+	"regexp"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/google/gopacket/pcap"
 )
 
 func TestRawListenerInput(t *testing.T) {
@@ -475,3 +480,346 @@ func TestRawListenerBench(t *testing.T) {
 		}
 	}
 }
+
+func TestListenerPorts(t *testing.T) {
+	ports, err := parsePorts("8000, 8001,9000-9010")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &Listener{ports: ports}
+
+	for port, expected := range map[uint16]bool{8000: true, 8001: true, 8002: false, 9000: true, 9005: true, 9010: true, 9011: false} {
+		if l.isListenPort(port) != expected {
+			t.Error("Wrong port match", port)
+		}
+	}
+
+	if bpf := l.portsBPF("dst"); bpf != "(tcp dst port 8000 or tcp dst port 8001 or tcp dst portrange 9000-9010)" {
+		t.Error("Wrong BPF expression", bpf)
+	}
+
+	for _, p := range []string{"", "80a", "70000", "9010-9000", "1-2-3"} {
+		if _, err := parsePorts(p); err == nil {
+			t.Error("Should return error for wrong port", p)
+		}
+	}
+}
+
+func TestParseIPPacket(t *testing.T) {
+	tcp := []byte("\x00\x50\x1f\x90tcp header and data")
+
+	ipv4 := append([]byte{0x45, 0, 0, byte(20 + len(tcp)), 0, 0, 0, 0, 64, 6, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2}, tcp...)
+
+	ipv6 := func(next byte, ext []byte) []byte {
+		payload := append(append([]byte(nil), ext...), tcp...)
+		header := []byte{0x60, 0, 0, 0, 0, byte(len(payload)), next, 64}
+		header = append(header, bytes.Repeat([]byte{1}, 16)...)
+		header = append(header, bytes.Repeat([]byte{2}, 16)...)
+
+		return append(header, payload...)
+	}
+
+	// Hop-by-hop options followed by not fragmented fragment header
+	ext := []byte{ipv6Fragment, 0, 1, 0, 0, 0, 0, 0}
+	ext = append(ext, ipProtocolTCP, 0, 0, 0, 0, 0, 0, 1)
+
+	for name, packet := range map[string][]byte{
+		"IPv4":                   ipv4,
+		"IPv4 with padding":      append(append([]byte(nil), ipv4...), 0, 0, 0),
+		"IPv6":                   ipv6(ipProtocolTCP, nil),
+		"IPv6 extension headers": ipv6(ipv6HopByHop, ext),
+	} {
+		_, dstIP, data, ok := parseIPPacket(packet)
+		if !ok || !bytes.Equal(data, tcp) {
+			t.Error(name, "Should find TCP segment", ok, data)
+		}
+		if dstIP[len(dstIP)-1] != 2 {
+			t.Error(name, "Wrong destination address", dstIP)
+		}
+	}
+
+	fragment := []byte{ipProtocolTCP, 0, 0, 9, 0, 0, 0, 1}
+	for name, packet := range map[string][]byte{
+		"Truncated IPv4": ipv4[:30],
+		"Truncated IPv6": ipv6(ipProtocolTCP, nil)[:50],
+		"Fragment":       ipv6(ipv6Fragment, fragment),
+		"UDP":            ipv6(17, nil),
+	} {
+		if _, _, _, ok := parseIPPacket(packet); ok {
+			t.Error(name, "Should skip packet")
+		}
+	}
+}
+
+func TestSkipVLANTags(t *testing.T) {
+	header := bytes.Repeat([]byte{0}, 12)
+	ip := []byte{0x45, 0, 0, 0}
+
+	frame := func(tags ...uint16) []byte {
+		f := append([]byte(nil), header...)
+		for _, id := range tags {
+			f = append(f, 0x81, 0x00, byte(id>>8), byte(id))
+		}
+		return append(append(f, 0x08, 0x00), ip...)
+	}
+
+	all := &Listener{}
+	filtered := &Listener{vlans: []uint16{200}}
+
+	for name, tc := range map[string]struct {
+		frame  []byte
+		of     int
+		passed bool
+	}{
+		"Not tagged": {frame(), 14, false},
+		"VLAN":       {frame(100), 18, false},
+		"QinQ":       {frame(100, 200), 22, true},
+	} {
+		of, ok := all.skipVLANTags(tc.frame, 14)
+		if !ok || of != tc.of || !bytes.Equal(tc.frame[of:], ip) {
+			t.Error(name, "Wrong network layer offset", of)
+		}
+
+		if _, ok := filtered.skipVLANTags(tc.frame, 14); ok != tc.passed {
+			t.Error(name, "Wrong VLAN filter result", ok)
+		}
+	}
+
+	if _, ok := all.skipVLANTags(frame(100)[:16], 14); ok {
+		t.Error("Should skip truncated tag")
+	}
+}
+
+func TestDeviceBPFVLANTags(t *testing.T) {
+	l := &Listener{ports: []portRange{{80, 80}}, vlans: []uint16{200}}
+	device := pcap.Interface{Name: "eth0", Addresses: []pcap.InterfaceAddress{{IP: net.ParseIP("10.0.0.1")}}}
+
+	if bpf := l.deviceBPF(device, []pcap.Interface{device}, true, true); !strings.Contains(bpf, "vlan") {
+		t.Error("Should match VLAN tags:", bpf)
+	}
+
+	// AF_PACKET sockets get packets with stripped tags, and check VLAN IDs after filter
+	if bpf := l.deviceBPF(device, []pcap.Interface{device}, true, false); strings.Contains(bpf, "vlan") || !strings.Contains(bpf, "dst port 80") {
+		t.Error("Should not match VLAN tags:", bpf)
+	}
+}
+
+func TestParseNetworkPacket(t *testing.T) {
+	tcp := []byte("\x00\x50\x1f\x90tcp header and data")
+
+	ipv4 := func(protocol byte, src byte, payload []byte) []byte {
+		length := 20 + len(payload)
+		header := []byte{0x45, 0, byte(length >> 8), byte(length), 0, 0, 0, 0, 64, protocol, 0, 0, src, 0, 0, 1, 10, 0, 0, 2}
+		return append(header, payload...)
+	}
+	ethernet := func(payload []byte) []byte {
+		frame := append(bytes.Repeat([]byte{0}, 12), 0x81, 0x00, 0, 100, 0x08, 0x00)
+		return append(frame, payload...)
+	}
+	udp := func(port uint16, payload []byte) []byte {
+		return append([]byte{0, 1, byte(port >> 8), byte(port), 0, 0, 0, 0}, payload...)
+	}
+
+	inner := ipv4(ipProtocolTCP, 192, tcp)
+
+	packets := map[string][]byte{
+		"VXLAN":       ipv4(ipProtocolUDP, 10, udp(vxlanPort, append([]byte{0x08, 0, 0, 0, 0, 0, 1, 0}, ethernet(inner)...))),
+		"VXLAN Linux": ipv4(ipProtocolUDP, 10, udp(vxlanLinuxPort, append([]byte{0x08, 0, 0, 0, 0, 0, 1, 0}, ethernet(inner)...))),
+		"Geneve":      ipv4(ipProtocolUDP, 10, udp(genevePort, append([]byte{1, 0, 0x08, 0x00, 0, 0, 1, 0, 1, 2, 3, 4}, inner...))),
+		"GRE":         ipv4(ipProtocolGRE, 10, append([]byte{0x20, 0, 0x08, 0x00, 0, 0, 0, 1}, inner...)),
+		"ERSPAN":      ipv4(ipProtocolGRE, 10, append([]byte{0x10, 0, 0x88, 0xBE, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}, ethernet(inner)...)),
+	}
+
+	l := &Listener{decapsulate: true}
+	for name, packet := range packets {
+		srcIP, _, data, tunneled, ok := l.parseNetworkPacket(packet)
+		if !ok || !tunneled || srcIP[0] != 192 || !bytes.Equal(data, tcp) {
+			t.Error(name, "Should decapsulate packet", ok, tunneled, srcIP, data)
+		}
+
+		if _, _, _, _, ok := (&Listener{}).parseNetworkPacket(packet); ok {
+			t.Error(name, "Should skip tunnels if decapsulation is disabled")
+		}
+	}
+
+	if _, _, data, tunneled, ok := l.parseNetworkPacket(inner); !ok || tunneled || !bytes.Equal(data, tcp) {
+		t.Error("Should parse not tunneled packet")
+	}
+}
+
+func TestListenerStats(t *testing.T) {
+	listener := NewListenerWithConfig("", "0", EnginePcap, false, 10*time.Millisecond, ListenerConfig{MaxMessageSize: 1024 * 1024})
+	defer listener.Close()
+
+	// Body packet is never captured
+	listener.packetsChan <- buildPacket(true, 1, 1, []byte("POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nabc"), time.Now()).dump()
+
+	// Body is larger than max message size
+	header := []byte("POST / HTTP/1.1\r\nContent-Length: 100000000\r\n\r\n")
+	listener.packetsChan <- buildPacket(true, 2, 1, header, time.Now()).dump()
+
+	chunk := make([]byte, 64*1024)
+	seq := uint32(1 + len(header))
+	for size := 0; size <= 1024*1024; size += len(chunk) {
+		listener.packetsChan <- buildPacket(true, 2, seq, chunk, time.Now()).dump()
+		seq += uint32(len(chunk))
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	select {
+	case <-listener.messagesChan:
+		t.Error("Should not emit incomplete messages")
+	default:
+	}
+
+	stats := listener.Stats()
+	if stats.IncompleteMessages != 1 {
+		t.Error("Should count incomplete message", stats.IncompleteMessages)
+	}
+
+	if stats.OversizedMessages != 1 {
+		t.Error("Should count oversized message", stats.OversizedMessages)
+	}
+}
+
+func TestListenerReassemblyLimit(t *testing.T) {
+	listener := NewListenerWithConfig("", "0", EnginePcap, false, 10*time.Millisecond, ListenerConfig{ReassemblyLimit: 10})
+	defer listener.Close()
+
+	header := []byte("POST / HTTP/1.1\r\nContent-Length: 30\r\n\r\n")
+	seq := uint32(1 + len(header))
+
+	listener.packetsChan <- buildPacket(true, 1, 1, header, time.Now()).dump()
+	// First body packet is lost, following data exceeds the limit
+	listener.packetsChan <- buildPacket(true, 1, seq+10, []byte("0123456789"), time.Now()).dump()
+	listener.packetsChan <- buildPacket(true, 1, seq+20, []byte("0123456789"), time.Now()).dump()
+	listener.packetsChan <- buildPacket(true, 1, seq+20, []byte("0123456789"), time.Now()).dump()
+
+	time.Sleep(100 * time.Millisecond)
+
+	stats := listener.Stats()
+	if stats.ReassemblyDropped != 1 {
+		t.Error("Should drop message exceeding reassembly limit", stats.ReassemblyDropped)
+	}
+
+	if stats.IncompleteMessages != 0 {
+		t.Error("Dropped message should not be counted as incomplete", stats.IncompleteMessages)
+	}
+}
+
+func TestListenerMaxFlows(t *testing.T) {
+	listener := NewListenerWithConfig("", "0", EnginePcap, false, time.Minute, ListenerConfig{MaxFlows: 2})
+	defer listener.Close()
+
+	// Messages waiting for body, the oldest one is evicted when the third one comes
+	for i := uint32(1); i <= 3; i++ {
+		listener.packetsChan <- buildPacket(true, i, 1, []byte("POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nabc"), time.Now()).dump()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	stats := listener.Stats()
+	if stats.EvictedFlows != 1 {
+		t.Error("Should evict the oldest message", stats.EvictedFlows)
+	}
+
+	if stats.IncompleteMessages != 1 {
+		t.Error("Evicted message should be dispatched as expired", stats.IncompleteMessages)
+	}
+}
+
+func TestListenerIPFilter(t *testing.T) {
+	if _, err := ParseIPNets([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("Should not accept wrong range")
+	}
+
+	allow, _ := ParseIPNets([]string{"10.0.0.0/8", "fd00::/8"})
+	deny, err := ParseIPNets([]string{" 10.1.2.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ports, _ := parsePorts("80")
+	listener := &Listener{ports: ports, allowIPs: allow, denyIPs: deny}
+	server := []byte{10, 0, 0, 1}
+
+	for name, tc := range map[string]struct {
+		src, dst []byte
+		destPort uint16
+		passed   bool
+	}{
+		"Allowed request":   {[]byte{10, 2, 0, 1}, server, 80, true},
+		"Allowed response":  {server, []byte{10, 2, 0, 1}, 50000, true},
+		"Denied request":    {[]byte{10, 1, 2, 3}, server, 80, false},
+		"Denied response":   {server, []byte{10, 1, 2, 3}, 50000, false},
+		"Not allowed":       {[]byte{192, 168, 0, 1}, server, 80, false},
+		"IPv6":              {net.ParseIP("fd00::1"), net.ParseIP("fd00::2"), 80, true},
+		"Unknown client IP": {server, nil, 50000, true},
+	} {
+		if listener.filterClient(tc.src, tc.dst, tc.destPort) != tc.passed {
+			t.Error(name, "Wrong filter result")
+		}
+	}
+
+	if s := listener.Stats(); s.FilteredPackets != 3 {
+		t.Error("Filtered packets should be counted", s.FilteredPackets)
+	}
+}
+
+func TestListenerDstIP(t *testing.T) {
+	listener := NewListener("", "0", EnginePcap, false, 10*time.Millisecond)
+	defer listener.Close()
+
+	p := buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n"), time.Now()).dump()
+	p.dstIP = []byte{10, 0, 0, 2}
+	listener.packetsChan <- p
+
+	select {
+	case m := <-listener.messagesChan:
+		if !m.DstIP().Equal(net.IP{10, 0, 0, 2}) {
+			t.Error("Wrong destination address", m.DstIP())
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Error("Should return request")
+	}
+}
+
+func TestListenerInterfaceFilter(t *testing.T) {
+	devices := []pcap.Interface{{Name: "lo"}, {Name: "eth0"}, {Name: "eth1"}, {Name: "veth1a2b"}, {Name: "docker0"}}
+
+	for name, tc := range map[string]struct {
+		include, exclude string
+		names            []string
+	}{
+		"All":     {"", "", []string{"lo", "eth0", "eth1", "veth1a2b", "docker0"}},
+		"Include": {"^eth.*$", "", []string{"eth0", "eth1"}},
+		"Exclude": {"", "^(veth.*|docker0)$", []string{"lo", "eth0", "eth1"}},
+		"Both":    {"^(eth|veth).*$", "^eth1$", []string{"eth0", "veth1a2b"}},
+	} {
+		listener := &Listener{}
+		if tc.include != "" {
+			listener.interfaceInclude = regexp.MustCompile(tc.include)
+		}
+		if tc.exclude != "" {
+			listener.interfaceExclude = regexp.MustCompile(tc.exclude)
+		}
+
+		filtered, _ := listener.filterPcapDevices(devices)
+
+		var names []string
+		for _, d := range filtered {
+			names = append(names, d.Name)
+		}
+
+		if strings.Join(names, ",") != strings.Join(tc.names, ",") {
+			t.Error(name, "Wrong interfaces", names)
+		}
+	}
+
+	listener := &Listener{interfaceInclude: regexp.MustCompile("^wlan0$")}
+	if _, err := listener.filterPcapDevices(devices); err != errNoInterfacesMatched {
+		t.Error("Should return error if no interfaces matched")
+	}
+}
@@ -0,0 +1,99 @@
+package rawSocket
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// How often directory of capture files is checked for rotated files
+const pcapDirPollInterval = time.Second
+
+// pcapDirFile is identified by name and modification time, since ring buffer files are rewritten
+type pcapDirFile struct {
+	path    string
+	modTime time.Time
+}
+
+// readPcapDir follows directory of capture files, rotated by tcpdump ('-C', '-G' and '-W' options).
+// Capture process writes only the latest file, so file is read once newer file appears.
+// Files which were complete before start are skipped.
+func (t *Listener) readPcapDir() {
+	done := make(map[string]time.Time)
+
+	files, err := completePcapFiles(t.addr)
+	if err != nil {
+		log.Fatal("Can't read capture directory: ", err)
+	}
+	for _, f := range files {
+		done[f.path] = f.modTime
+	}
+
+	t.readyCh <- true
+
+	ticker := time.NewTicker(pcapDirPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.quit:
+			return
+		case <-ticker.C:
+		}
+
+		files, err := completePcapFiles(t.addr)
+		if err != nil {
+			log.Println("Can't read capture directory:", err)
+			continue
+		}
+
+		for _, f := range files {
+			if modTime, ok := done[f.path]; ok && modTime.Equal(f.modTime) {
+				continue
+			}
+			done[f.path] = f.modTime
+
+			handle, err := pcap.OpenOffline(f.path)
+			if err != nil {
+				log.Println("Can't open capture file:", f.path, err)
+				continue
+			}
+
+			t.setPcapFileFilter(handle)
+			t.readPcapFileHandle(handle)
+			handle.Close()
+		}
+	}
+}
+
+// completePcapFiles lists files of directory, except the latest modified one, which is still written.
+// Files are sorted by modification time.
+func completePcapFiles(dir string) (files []pcapDirFile, err error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		// tcpdump does not add extension to rotated files, so all regular files are read
+		if !e.Mode().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		files = append(files, pcapDirFile{filepath.Join(dir, e.Name()), e.ModTime()})
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	if len(files) > 0 {
+		files = files[:len(files)-1]
+	}
+
+	return files, nil
+}
@@ -0,0 +1,39 @@
+package rawSocket
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompletePcapFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap_dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	for i, name := range []string{"traffic1", "traffic0", "traffic2", ".hidden"} {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, nil, 0644)
+		os.Chtimes(path, now, now.Add(time.Duration(i)*time.Second))
+	}
+	os.Mkdir(filepath.Join(dir, "subdir"), 0755)
+
+	files, err := completePcapFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Latest file is still written by tcpdump
+	if len(files) != 2 || files[0].path != filepath.Join(dir, "traffic1") || files[1].path != filepath.Join(dir, "traffic0") {
+		t.Error("Wrong complete files", files)
+	}
+
+	if _, err := completePcapFiles(filepath.Join(dir, "missing")); err == nil {
+		t.Error("Should return error for missing directory")
+	}
+}
@@ -0,0 +1,67 @@
+package rawSocket
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// portRange is inclusive range of listened ports, single port has same min and max
+type portRange struct {
+	min, max uint16
+}
+
+// parsePorts parses comma separated list of ports and port ranges, like "8000,8001,9000-9010"
+func parsePorts(ports string) (ranges []portRange, err error) {
+	for _, p := range strings.Split(ports, ",") {
+		p = strings.TrimSpace(p)
+
+		bounds := strings.SplitN(p, "-", 2)
+		min, err := strconv.ParseUint(bounds[0], 10, 16)
+		if err != nil {
+			return nil, errors.New("wrong port: " + p)
+		}
+		max := min
+
+		if len(bounds) == 2 {
+			if max, err = strconv.ParseUint(bounds[1], 10, 16); err != nil || max < min {
+				return nil, errors.New("wrong port range: " + p)
+			}
+		}
+
+		ranges = append(ranges, portRange{uint16(min), uint16(max)})
+	}
+
+	return
+}
+
+// isListenPort checks if port is one of listened ports
+func (t *Listener) isListenPort(port uint16) bool {
+	for _, r := range t.ports {
+		if port >= r.min && port <= r.max {
+			return true
+		}
+	}
+
+	return false
+}
+
+// portsBPF returns BPF expression matching listened ports, direction is "src" or "dst"
+func (t *Listener) portsBPF(direction string) string {
+	var exprs []string
+
+	protocol := "tcp "
+	if t.udp {
+		protocol = "udp "
+	}
+
+	for _, r := range t.ports {
+		if r.min == r.max {
+			exprs = append(exprs, protocol+direction+" port "+strconv.Itoa(int(r.min)))
+		} else {
+			exprs = append(exprs, protocol+direction+" portrange "+strconv.Itoa(int(r.min))+"-"+strconv.Itoa(int(r.max)))
+		}
+	}
+
+	return "(" + strings.Join(exprs, " or ") + ")"
+}
@@ -0,0 +1,75 @@
+package rawSocket
+
+import (
+	"sync/atomic"
+)
+
+// Stats holds counters of capture engine and TCP reassembly, summed over all devices since listener start.
+// Packet counters are reported by kernel, and are not available for pcap files and raw socket engine.
+type Stats struct {
+	// Packets received by capture engine, before userspace filtering
+	PacketsReceived uint64
+	// Packets dropped by kernel, since capture buffer was full
+	PacketsDropped uint64
+	// Packets dropped by network interface or its driver
+	PacketsIfDropped uint64
+
+	// Messages expired before all their packets were captured
+	IncompleteMessages uint64
+	// Messages dropped since they exceeded max message size
+	OversizedMessages uint64
+	// Messages dropped since data following missing packet exceeded reassembly limit
+	ReassemblyDropped uint64
+	// Packets which contained already received data, fully or partially
+	RetransmittedPackets uint64
+
+	// HTTP/2, TLS and WebSocket connections, and UDP flows, forgotten after idle timeout
+	ExpiredConnections uint64
+	// Messages and connections evicted, since number of tracked flows reached the limit
+	EvictedFlows uint64
+	// Packets skipped by client IP allow and deny lists, and by TLS server name and ALPN filter
+	FilteredPackets uint64
+}
+
+// captureStats is implemented by capture handles, which can report kernel counters
+type captureStats interface {
+	captureStats() Stats
+}
+
+func (s *Stats) add(other Stats) {
+	s.PacketsReceived += other.PacketsReceived
+	s.PacketsDropped += other.PacketsDropped
+	s.PacketsIfDropped += other.PacketsIfDropped
+}
+
+// Stats returns current capture and reassembly counters
+func (t *Listener) Stats() (stats Stats) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, h := range t.pcapHandles {
+		if s, err := h.Stats(); err == nil {
+			stats.add(Stats{
+				PacketsReceived:  uint64(s.PacketsReceived),
+				PacketsDropped:   uint64(s.PacketsDropped),
+				PacketsIfDropped: uint64(s.PacketsIfDropped),
+			})
+		}
+	}
+
+	for _, h := range t.captureHandles {
+		if s, ok := h.(captureStats); ok {
+			stats.add(s.captureStats())
+		}
+	}
+
+	stats.IncompleteMessages = atomic.LoadUint64(&t.stats.IncompleteMessages)
+	stats.OversizedMessages = atomic.LoadUint64(&t.stats.OversizedMessages)
+	stats.ReassemblyDropped = atomic.LoadUint64(&t.stats.ReassemblyDropped)
+	stats.RetransmittedPackets = atomic.LoadUint64(&t.stats.RetransmittedPackets)
+	stats.ExpiredConnections = atomic.LoadUint64(&t.stats.ExpiredConnections)
+	stats.EvictedFlows = atomic.LoadUint64(&t.stats.EvictedFlows)
+	stats.FilteredPackets = atomic.LoadUint64(&t.stats.FilteredPackets)
+
+	return
+}
@@ -2,7 +2,7 @@ package rawSocket
 
 import (
 	"bytes"
-	"crypto/sha1"
+	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
 	"github.com/buger/gor/proto"
@@ -33,6 +33,9 @@ type TCPMessage struct {
 	End          time.Time
 	IsIncoming   bool
 
+	// Correlation id, generated for request at capture time and copied to its response
+	uuid []byte
+
 	packets []*TCPPacket
 
 	delChan chan *TCPMessage
@@ -45,11 +48,20 @@ type TCPMessage struct {
 	headerPacket  int
 	contentLength int
 	complete      bool
+
+	// Size of added packets, and if message was dropped, since it exceeded max size or reassembly limit
+	size    int
+	dropped bool
+	// Size of data received after missing packet
+	pendingSize int
 }
 
 // NewTCPMessage pointer created from a Acknowledgment number and a channel of messages readuy to be deleted
 func NewTCPMessage(Seq, Ack uint32, IsIncoming bool, timestamp time.Time) (msg *TCPMessage) {
 	msg = &TCPMessage{Seq: Seq, Ack: Ack, IsIncoming: IsIncoming, Start: timestamp}
+	if IsIncoming {
+		msg.uuid = newMessageUUID()
+	}
 
 	return
 }
@@ -101,33 +113,18 @@ func (t *TCPMessage) Size() (size int) {
 }
 
 // AddPacket to the message and ensure packet uniqueness
-// TCP allows that packet can be re-send multiple times
-func (t *TCPMessage) AddPacket(packet *TCPPacket) {
-	packetFound := false
+// TCP allows that packet can be re-send multiple times, and retransmitted packet can overlap several received ones,
+// so only data which was not received yet is added. Returns true if packet contained already received data.
+func (t *TCPMessage) AddPacket(packet *TCPPacket) (retransmitted bool) {
+	pieces := t.newData(packet)
+	retransmitted = len(pieces) != 1 || pieces[0] != packet
 
-	for _, pkt := range t.packets {
-		if packet.Seq == pkt.Seq {
-			packetFound = true
-			break
-		}
+	for _, p := range pieces {
+		t.size += len(p.Data)
+		t.insertPacket(p)
 	}
 
-	if !packetFound {
-		// Packets not always captured in same Seq order, and sometimes we need to prepend
-		if len(t.packets) == 0 || packet.Seq > t.packets[len(t.packets)-1].Seq {
-			t.packets = append(t.packets, packet)
-		} else if packet.Seq < t.packets[0].Seq {
-			t.packets = append([]*TCPPacket{packet}, t.packets...)
-			t.Seq = packet.Seq // Message Seq should indicated starting seq
-		} else { // insert somewhere in the middle...
-			for i, p := range t.packets {
-				if packet.Seq < p.Seq {
-					t.packets = append(t.packets[:i], append([]*TCPPacket{packet}, t.packets[i:]...)...)
-					break
-				}
-			}
-		}
-
+	if len(pieces) > 0 {
 		if t.IsIncoming {
 			t.End = time.Now()
 		} else {
@@ -149,10 +146,87 @@ func (t *TCPMessage) AddPacket(packet *TCPPacket) {
 	t.updateBodyType()
 	t.checkIfComplete()
 	t.check100Continue()
+
+	return
+}
+
+// seqLess compares sequence numbers, which wrap around
+func seqLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// newData returns parts of packet, which are not covered by already received packets.
+// Packet itself is returned if it does not overlap any of them.
+func (t *TCPMessage) newData(packet *TCPPacket) (pieces []*TCPPacket) {
+	// Packets without data, like FIN, are only checked for duplicates
+	if len(packet.Data) == 0 {
+		for _, p := range t.packets {
+			if p.Seq == packet.Seq && len(p.Data) == 0 {
+				return nil
+			}
+		}
+
+		return []*TCPPacket{packet}
+	}
+
+	// Offsets relative to packet start, packets are sorted by sequence
+	cursor, size := 0, len(packet.Data)
+
+	// Packets mostly come in order, so overlapping ones are searched from the end
+	first := len(t.packets)
+	for first > 0 && int(int32(t.packets[first-1].Seq-packet.Seq))+len(t.packets[first-1].Data) > 0 {
+		first--
+	}
+
+	for _, p := range t.packets[first:] {
+		start := int(int32(p.Seq - packet.Seq))
+		end := start + len(p.Data)
+
+		if end <= cursor || len(p.Data) == 0 {
+			continue
+		}
+		if start >= size {
+			break
+		}
+
+		if start > cursor {
+			pieces = append(pieces, packet.piece(cursor, start))
+		}
+		cursor = end
+
+		if cursor >= size {
+			return pieces
+		}
+	}
+
+	if cursor == 0 {
+		return []*TCPPacket{packet}
+	}
+
+	return append(pieces, packet.piece(cursor, size))
+}
+
+// insertPacket adds packet keeping sequence order
+func (t *TCPMessage) insertPacket(packet *TCPPacket) {
+	i := len(t.packets)
+	for i > 0 && seqLess(packet.Seq, t.packets[i-1].Seq) {
+		i--
+	}
+
+	t.packets = append(t.packets, nil)
+	copy(t.packets[i+1:], t.packets[i:])
+	t.packets[i] = packet
+
+	// Message Seq should indicated starting seq
+	if i == 0 {
+		t.Seq = packet.Seq
+	}
 }
 
 // Check if there is missing packet
 func (t *TCPMessage) checkSeqIntegrity() {
+	t.pendingSize = 0
+
 	if len(t.packets) == 1 {
 		t.seqMissing = false
 	}
@@ -182,13 +256,12 @@ func (t *TCPMessage) checkSeqIntegrity() {
 		nextSeq := p.Seq + uint32(len(p.Data))
 
 		if np.Seq != nextSeq {
-			if t.expectType == httpExpect100Continue {
-				if np.Seq != nextSeq+22 {
-					t.seqMissing = true
-					return
-				}
-			} else {
+			if t.expectType != httpExpect100Continue || np.Seq != nextSeq+22 {
 				t.seqMissing = true
+
+				for _, p := range t.packets[i+1:] {
+					t.pendingSize += len(p.Data)
+				}
 				return
 			}
 		}
@@ -198,7 +271,6 @@ func (t *TCPMessage) checkSeqIntegrity() {
 }
 
 var bEmptyLine = []byte("\r\n\r\n")
-var bChunkEnd = []byte("0\r\n\r\n")
 
 func (t *TCPMessage) updateHeadersPacket() {
 	if len(t.packets) == 1 {
@@ -250,8 +322,9 @@ func (t *TCPMessage) checkIfComplete() {
 				t.complete = true
 			}
 		case httpBodyChunked:
-			lastPacket := t.packets[len(t.packets)-1]
-			if bytes.LastIndex(lastPacket.Data, bChunkEnd) != -1 {
+			// Body ends with empty line, after last chunk or trailers. Only then chunks are parsed, because data inside
+			// of chunks can look like the last one.
+			if t.hasSuffix(bEmptyLine) && t.chunkedBodyComplete() {
 				t.complete = true
 			}
 		default:
@@ -267,6 +340,44 @@ func (t *TCPMessage) checkIfComplete() {
 	}
 }
 
+// hasSuffix returns true if message ends with suffix, which can be split between packets
+func (t *TCPMessage) hasSuffix(suffix []byte) bool {
+	for i := len(t.packets) - 1; i >= 0 && len(suffix) > 0; i-- {
+		d := t.packets[i].Data
+
+		n := len(suffix)
+		if n > len(d) {
+			n = len(d)
+		}
+
+		if !bytes.Equal(d[len(d)-n:], suffix[len(suffix)-n:]) {
+			return false
+		}
+		suffix = suffix[:len(suffix)-n]
+	}
+
+	return len(suffix) == 0
+}
+
+// chunkedBodyComplete parses chunked body, and returns true if it has last chunk and trailers. Malformed body is
+// considered complete as well, waiting for more packets won't fix it.
+func (t *TCPMessage) chunkedBodyComplete() bool {
+	var c proto.ChunkedState
+
+	for i, p := range t.packets[t.headerPacket:] {
+		data := p.Data
+		if i == 0 {
+			data = proto.Body(data)
+		}
+
+		if _, done, err := c.Feed(data); done || err != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
 type httpMethodType uint8
 
 const (
@@ -457,6 +568,9 @@ func (t *TCPMessage) check100Continue() {
 
 func (t *TCPMessage) setAssocMessage(m *TCPMessage) {
 	t.AssocMessage = m
+	if !t.IsIncoming && m != nil {
+		t.uuid = m.uuid
+	}
 	t.checkIfComplete()
 }
 
@@ -482,22 +596,23 @@ func (t *TCPMessage) UpdateResponseAck() uint32 {
 	return t.ResponseAck
 }
 
+// UUID returns id of request, response gets the same id as its request
 func (t *TCPMessage) UUID() []byte {
-	var key []byte
-
-	if t.IsIncoming {
-		// log.Println("UUID:", t.Ack, t.Start.UnixNano())
-		key = strconv.AppendInt(key, t.Start.UnixNano(), 10)
-		key = strconv.AppendUint(key, uint64(t.Ack), 10)
-	} else {
-		// log.Println("RequestMessage:", t.AssocMessage.Ack, t.AssocMessage.Start.UnixNano())
-		key = strconv.AppendInt(key, t.AssocMessage.Start.UnixNano(), 10)
-		key = strconv.AppendUint(key, uint64(t.AssocMessage.Ack), 10)
+	if t.uuid == nil && t.AssocMessage != nil {
+		return t.AssocMessage.uuid
 	}
 
+	return t.uuid
+}
+
+// newMessageUUID returns random request id. Unlike ids derived from addresses, ports and sequence numbers,
+// it does not collide when they are reused, for example by different captures merged together.
+func newMessageUUID() []byte {
+	b := make([]byte, 20)
+	rand.Read(b)
+
 	uuid := make([]byte, 40)
-	sha := sha1.Sum(key)
-	hex.Encode(uuid, sha[:20])
+	hex.Encode(uuid, b)
 
 	return uuid
 }
@@ -509,3 +624,8 @@ func (t *TCPMessage) ID() tcpID {
 func (t *TCPMessage) IP() net.IP {
 	return net.IP(t.packets[0].Addr)
 }
+
+// DstIP returns destination address of message, or nil if capture engine does not provide it
+func (t *TCPMessage) DstIP() net.IP {
+	return net.IP(t.packets[0].DstAddr)
+}
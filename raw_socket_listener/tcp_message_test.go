@@ -70,7 +70,7 @@ func TestTCPMessagePacketsOrder(t *testing.T) {
 
 func TestTCPMessageSize(t *testing.T) {
 	msg := buildMessage(buildPacket(true, 1, 1, []byte("POST / HTTP/1.1\r\nContent-Length: 2\r\n\r\na"), time.Now()))
-	msg.AddPacket(buildPacket(true, 1, 2, []byte("b"), time.Now()))
+	msg.AddPacket(buildPacket(true, 1, 40, []byte("b"), time.Now()))
 
 	if msg.BodySize() != 2 {
 		t.Error("Should count only body", msg.BodySize())
@@ -97,8 +97,12 @@ func TestTCPMessageIsComplete(t *testing.T) {
 		{false, "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\na", true, true},
 		{false, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", true, true},
 
+		{true, "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\nX-Checksum: 1\r\n\r\n", false, true},
+
 		// chunked not finished
 		{false, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n", true, false},
+		// content of chunk looks like last chunk
+		{true, "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n10\r\n\r\n0\r\n\r\n", false, false},
 
 		// content-length != actual length
 		{true, "POST / HTTP/1.1\r\nContent-Length: 2\r\n\r\na", false, false},
@@ -123,6 +127,23 @@ func TestTCPMessageIsComplete(t *testing.T) {
 	}
 }
 
+func TestTCPMessageChunkedSplit(t *testing.T) {
+	p1 := buildPacket(true, 1, 1, []byte("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r"), time.Now())
+	p2 := buildPacket(true, 1, p1.Seq+uint32(len(p1.Data)), []byte("\n"), time.Now())
+
+	msg := buildMessage(p1)
+	msg.checkIfComplete()
+	if msg.complete {
+		t.Error("Should wait for the rest of last chunk")
+	}
+
+	msg.AddPacket(p2)
+	msg.checkIfComplete()
+	if !msg.complete {
+		t.Error("Last chunk split between packets should complete message")
+	}
+}
+
 func TestTCPMessageIsSeqMissing(t *testing.T) {
 	p1 := buildPacket(false, 1, 1, []byte("HTTP/1.1 200 OK\r\n"), time.Now())
 	p2 := buildPacket(false, 1, p1.Seq+uint32(len(p1.Data)), []byte("Content-Length: 10\r\n\r\n"), time.Now())
@@ -256,3 +277,49 @@ func TestTcpMessageStart(t *testing.T) {
 	}
 }
 
+
+func TestTCPMessageOverlappingPackets(t *testing.T) {
+	// Retransmitted packet covers end of the first packet and the missing one
+	msg := buildMessage(buildPacket(true, 1, 1, []byte("abc"), time.Now()))
+	msg.AddPacket(buildPacket(true, 1, 7, []byte("gh"), time.Now()))
+
+	if !msg.AddPacket(buildPacket(true, 1, 2, []byte("bcdefgh"), time.Now())) {
+		t.Error("Should report retransmitted data")
+	}
+
+	if !bytes.Equal(msg.Bytes(), []byte("abcdefgh")) || msg.seqMissing {
+		t.Errorf("Should add only missing data: %q", msg.Bytes())
+	}
+
+	if msg.AddPacket(buildPacket(true, 1, 9, []byte("i"), time.Now())) {
+		t.Error("Should not report new data as retransmitted")
+	}
+
+	// Sequence numbers wrap around
+	msg = buildMessage(buildPacket(true, 1, 1<<32-2, []byte("ab"), time.Now()))
+	msg.AddPacket(buildPacket(true, 1, 1, []byte("d"), time.Now()))
+	msg.AddPacket(buildPacket(true, 1, 0, []byte("c"), time.Now()))
+
+	if !bytes.Equal(msg.Bytes(), []byte("abcd")) || msg.seqMissing {
+		t.Errorf("Should order packets across sequence wrap: %q", msg.Bytes())
+	}
+}
+
+func TestMessageUUID(t *testing.T) {
+	start := time.Now()
+
+	// Requests of the same connection with the same timestamp and ack
+	req1 := NewTCPMessage(1, 1, true, start)
+	req2 := NewTCPMessage(1, 1, true, start)
+
+	if len(req1.UUID()) != 40 || bytes.Equal(req1.UUID(), req2.UUID()) {
+		t.Error("Requests should have different ids", string(req1.UUID()), string(req2.UUID()))
+	}
+
+	resp := NewTCPMessage(1, 1, false, start)
+	resp.setAssocMessage(req1)
+
+	if !bytes.Equal(resp.UUID(), req1.UUID()) {
+		t.Error("Response should have id of its request")
+	}
+}
@@ -39,8 +39,13 @@ type TCPPacket struct {
 	Raw  []byte
 	Data []byte
 	Addr []byte
+	// Destination address, if known. Raw socket engine does not provide it.
+	DstAddr   []byte
 	timestamp time.Time
 	ID   tcpID
+
+	// Packet with data decrypted from TLS connection
+	decrypted bool
 }
 
 // ParseTCPPacket takes address and tcp payload and returns parsed TCPPacket
@@ -68,6 +73,15 @@ func (p *TCPPacket) UpdateAck(ack uint32) {
 	p.GenID()
 }
 
+// piece returns copy of packet with data limited to given range, and sequence number moved to its start
+func (p *TCPPacket) piece(start, end int) *TCPPacket {
+	piece := *p
+	piece.Seq = p.Seq + uint32(start)
+	piece.Data = p.Data[start:end]
+
+	return &piece
+}
+
 // ParseBasic set of fields
 func (t *TCPPacket) ParseBasic() {
 	t.DestPort = binary.BigEndian.Uint16(t.Raw[2:4])
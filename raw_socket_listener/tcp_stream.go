@@ -0,0 +1,97 @@
+package rawSocket
+
+// tcpConnID identifies connection by client address and ports. Client address of response packets is their destination,
+// which is not known for raw socket engine, so then connections are identified only by ports.
+type tcpConnID struct {
+	clientIP   string
+	clientPort uint16
+	serverPort uint16
+}
+
+// connID returns connection of packet, and if it is sent by client
+func (t *Listener) connID(packet *TCPPacket) (id tcpConnID, isIncoming bool) {
+	if t.isListenPort(packet.DestPort) {
+		id = tcpConnID{clientPort: packet.SrcPort, serverPort: packet.DestPort}
+		if len(packet.DstAddr) > 0 {
+			id.clientIP = string(packet.Addr)
+		}
+		return id, true
+	}
+
+	return tcpConnID{clientIP: string(packet.DstAddr), clientPort: packet.DestPort, serverPort: packet.SrcPort}, false
+}
+
+// Default max size of out of order data kept per connection direction, while waiting for missing packet
+const tcpStreamMaxPending = 4 * 1024 * 1024
+
+// tcpStream reassembles one direction of TCP connection into continuous byte stream.
+// Unlike TCPMessage, it does not depend on HTTP/1 message boundaries, and used for protocols which are parsed as stream.
+type tcpStream struct {
+	started bool
+	next    uint32
+	// Out of order packets by sequence number
+	pending     map[uint32][]byte
+	pendingSize int
+	maxPending  int
+}
+
+func newTCPStream(maxPending int) *tcpStream {
+	return &tcpStream{pending: make(map[uint32][]byte), maxPending: maxPending}
+}
+
+// add accepts packet data, and returns data which became available in order, if any.
+// Retransmitted data is skipped. If missing packet never arrives, stream is broken and all following data is pending.
+func (s *tcpStream) add(seq uint32, data []byte) (ready []byte) {
+	if len(data) == 0 {
+		return nil
+	}
+
+	if !s.started {
+		s.started = true
+		s.next = seq
+	}
+
+	// Sequence numbers wrap around, so they are compared by difference
+	if diff := int32(seq - s.next); diff > 0 {
+		if _, ok := s.pending[seq]; !ok && s.pendingSize+len(data) <= s.maxPending {
+			s.pending[seq] = append([]byte(nil), data...)
+			s.pendingSize += len(data)
+		}
+		return nil
+	} else if diff < 0 {
+		// Partially retransmitted packet
+		if int(-diff) >= len(data) {
+			return nil
+		}
+		data = data[-diff:]
+	}
+
+	ready = append(ready, data...)
+	s.next += uint32(len(data))
+
+	for len(s.pending) > 0 {
+		found := false
+
+		for seq, data := range s.pending {
+			diff := int32(seq - s.next)
+			if diff > 0 {
+				continue
+			}
+
+			delete(s.pending, seq)
+			s.pendingSize -= len(data)
+			found = true
+
+			if int(-diff) < len(data) {
+				ready = append(ready, data[-diff:]...)
+				s.next += uint32(len(data) + int(diff))
+			}
+		}
+
+		if !found {
+			break
+		}
+	}
+
+	return ready
+}
@@ -0,0 +1,572 @@
+package rawSocket
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"hash"
+	"time"
+)
+
+// TLS record and handshake types
+const (
+	tlsRecordChangeCipherSpec = 20
+	tlsRecordHandshake        = 22
+	tlsRecordApplicationData  = 23
+
+	tlsHandshakeClientHello       = 1
+	tlsHandshakeServerHello       = 2
+	tlsHandshakeClientKeyExchange = 16
+	tlsHandshakeFinished          = 20
+
+	tlsExtensionExtendedMasterSecret = 23
+	tlsExtensionSupportedVersions    = 43
+
+	tlsVersion13 = 0x0304
+
+	tlsRecordHeaderSize = 5
+	// Max size of encrypted record, with overhead allowed by TLS 1.2
+	tlsMaxRecordSize = 1<<14 + 2048
+)
+
+// tlsCipherSuite describes supported cipher suite. Only AES ciphers are supported, in GCM or CBC mode.
+type tlsCipherSuite struct {
+	keyLen int
+	// MAC of CBC suites, nil for AEAD
+	mac func() hash.Hash
+	// Hash used by PRF or HKDF
+	hash func() hash.Hash
+	// Pre-master secret is encrypted by server RSA key
+	rsaKeyExchange bool
+	tls13          bool
+}
+
+var tlsCipherSuites = map[uint16]*tlsCipherSuite{
+	0x002f: {keyLen: 16, mac: sha1.New, hash: sha256.New, rsaKeyExchange: true},   // TLS_RSA_WITH_AES_128_CBC_SHA
+	0x0035: {keyLen: 32, mac: sha1.New, hash: sha256.New, rsaKeyExchange: true},   // TLS_RSA_WITH_AES_256_CBC_SHA
+	0x003c: {keyLen: 16, mac: sha256.New, hash: sha256.New, rsaKeyExchange: true}, // TLS_RSA_WITH_AES_128_CBC_SHA256
+	0x009c: {keyLen: 16, hash: sha256.New, rsaKeyExchange: true},                  // TLS_RSA_WITH_AES_128_GCM_SHA256
+	0x009d: {keyLen: 32, hash: sha512.New384, rsaKeyExchange: true},               // TLS_RSA_WITH_AES_256_GCM_SHA384
+	0xc009: {keyLen: 16, mac: sha1.New, hash: sha256.New},                         // TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA
+	0xc00a: {keyLen: 32, mac: sha1.New, hash: sha256.New},                         // TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA
+	0xc013: {keyLen: 16, mac: sha1.New, hash: sha256.New},                         // TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA
+	0xc014: {keyLen: 32, mac: sha1.New, hash: sha256.New},                         // TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA
+	0xc02b: {keyLen: 16, hash: sha256.New},                                        // TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+	0xc02c: {keyLen: 32, hash: sha512.New384},                                     // TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384
+	0xc02f: {keyLen: 16, hash: sha256.New},                                        // TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	0xc030: {keyLen: 32, hash: sha512.New384},                                     // TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+	0x1301: {keyLen: 16, hash: sha256.New, tls13: true},                           // TLS_AES_128_GCM_SHA256
+	0x1302: {keyLen: 32, hash: sha512.New384, tls13: true},                        // TLS_AES_256_GCM_SHA384
+}
+
+// tlsRecordCipher decrypts records of one direction
+type tlsRecordCipher struct {
+	suite *tlsCipherSuite
+	aead  cipher.AEAD
+	block cipher.Block
+	// Fixed part of nonce for GCM, or MAC key for CBC
+	iv     []byte
+	macKey []byte
+	seq    uint64
+}
+
+func newTLSRecordCipher(suite *tlsCipherSuite, key, iv, macKey []byte) *tlsRecordCipher {
+	block, _ := aes.NewCipher(key)
+	c := &tlsRecordCipher{suite: suite, block: block, iv: iv, macKey: macKey}
+
+	if suite.mac == nil {
+		c.aead, _ = cipher.NewGCM(block)
+	}
+
+	return c
+}
+
+// newTLS13RecordCipher derives keys from traffic secret
+func newTLS13RecordCipher(suite *tlsCipherSuite, secret []byte) *tlsRecordCipher {
+	key := hkdfExpandLabel(suite.hash, secret, "key", suite.keyLen)
+	iv := hkdfExpandLabel(suite.hash, secret, "iv", 12)
+
+	return newTLSRecordCipher(suite, key, iv, nil)
+}
+
+// decrypt returns plain data of record, header is 5 bytes record header. Returns nil if record can't be decrypted.
+func (c *tlsRecordCipher) decrypt(header, fragment []byte) []byte {
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, c.seq)
+
+	var plain []byte
+	var err error
+
+	switch {
+	case c.suite.tls13:
+		nonce := append([]byte(nil), c.iv...)
+		for i := 0; i < 8; i++ {
+			nonce[4+i] ^= seq[i]
+		}
+		plain, err = c.aead.Open(nil, nonce, fragment, header)
+	case c.aead != nil:
+		// Explicit part of nonce is sent with record
+		if len(fragment) < 8+c.aead.Overhead() {
+			return nil
+		}
+		nonce := append(append([]byte(nil), c.iv...), fragment[:8]...)
+		ad := append(append(seq, header[:3]...), 0, 0)
+		binary.BigEndian.PutUint16(ad[11:], uint16(len(fragment)-8-c.aead.Overhead()))
+		plain, err = c.aead.Open(nil, nonce, fragment[8:], ad)
+	default:
+		if plain = c.decryptCBC(seq, header, fragment); plain == nil {
+			return nil
+		}
+	}
+
+	if err != nil {
+		return nil
+	}
+
+	c.seq++
+
+	// Empty record is still decrypted successfully
+	if plain == nil {
+		plain = []byte{}
+	}
+
+	return plain
+}
+
+// decryptCBC decrypts record with explicit IV, and checks its padding and MAC
+func (c *tlsRecordCipher) decryptCBC(seq, header, fragment []byte) []byte {
+	size := aes.BlockSize
+	macSize := c.suite.mac().Size()
+
+	if len(fragment) < size*2 || len(fragment)%size != 0 {
+		return nil
+	}
+
+	plain := make([]byte, len(fragment)-size)
+	cipher.NewCBCDecrypter(c.block, fragment[:size]).CryptBlocks(plain, fragment[size:])
+
+	padding := int(plain[len(plain)-1]) + 1
+	if padding+macSize > len(plain) {
+		return nil
+	}
+	for _, b := range plain[len(plain)-padding:] {
+		if int(b) != padding-1 {
+			return nil
+		}
+	}
+	plain = plain[:len(plain)-padding]
+
+	data, mac := plain[:len(plain)-macSize], plain[len(plain)-macSize:]
+
+	h := hmac.New(c.suite.mac, c.macKey)
+	h.Write(seq)
+	h.Write(header[:3])
+	h.Write([]byte{byte(len(data) >> 8), byte(len(data))})
+	h.Write(data)
+	if !hmac.Equal(h.Sum(nil), mac) {
+		return nil
+	}
+
+	return data
+}
+
+// tlsDirection holds state of one side of TLS connection
+type tlsDirection struct {
+	stream *tcpStream
+	buf    []byte
+	// Not encrypted handshake messages can be split to multiple records
+	handshake []byte
+	// Set after ChangeCipherSpec in TLS 1.2, or after ServerHello in TLS 1.3
+	encrypted bool
+	cipher    *tlsRecordCipher
+	// TLS 1.3 handshake is encrypted with its own keys, traffic keys are used after Finished
+	handshakeCipher *tlsRecordCipher
+	// Offset of decrypted data, used as sequence number of decrypted packets
+	base   uint32
+	offset uint32
+	broken bool
+}
+
+func newTLSDirection(maxPending int) *tlsDirection {
+	return &tlsDirection{stream: newTCPStream(maxPending)}
+}
+
+// tlsConn decrypts TLS connection, and returns decrypted data of each direction
+type tlsConn struct {
+	keys   *TLSKeys
+	client *tlsDirection
+	server *tlsDirection
+
+	clientRandom []byte
+	serverRandom []byte
+	suite        *tlsCipherSuite
+	// Handshake messages up to ClientKeyExchange, needed for extended master secret
+	transcript           []byte
+	extendedMasterSecret bool
+	masterSecret         []byte
+
+	lastSeen time.Time
+}
+
+func newTLSConn(keys *TLSKeys, maxPending int) *tlsConn {
+	return &tlsConn{keys: keys, client: newTLSDirection(maxPending), server: newTLSDirection(maxPending), lastSeen: time.Now()}
+}
+
+// isTLSClientHello checks if data starts with handshake record containing ClientHello
+func isTLSClientHello(data []byte) bool {
+	return len(data) > tlsRecordHeaderSize && data[0] == tlsRecordHandshake && data[1] == 3 && data[5] == tlsHandshakeClientHello
+}
+
+// process handles packet of connection, and returns decrypted application data, if any
+func (c *tlsConn) process(packet *TCPPacket, isIncoming bool) (plain []byte) {
+	c.lastSeen = time.Now()
+
+	dir, other := c.server, c.client
+	if isIncoming {
+		dir, other = c.client, c.server
+	}
+
+	if dir.broken {
+		return
+	}
+
+	if !dir.stream.started {
+		dir.base = packet.Seq
+		if !other.stream.started {
+			other.base = packet.Ack
+		}
+	}
+
+	dir.buf = append(dir.buf, dir.stream.add(packet.Seq, packet.Data)...)
+
+	for len(dir.buf) >= tlsRecordHeaderSize {
+		length := int(binary.BigEndian.Uint16(dir.buf[3:5]))
+		if length > tlsMaxRecordSize {
+			dir.broken = true
+			return
+		}
+
+		if len(dir.buf) < tlsRecordHeaderSize+length {
+			break
+		}
+
+		header := dir.buf[:tlsRecordHeaderSize]
+		fragment := dir.buf[tlsRecordHeaderSize : tlsRecordHeaderSize+length]
+
+		data, ok := c.processRecord(dir, isIncoming, header, fragment)
+		if !ok {
+			dir.broken = true
+			return
+		}
+		plain = append(plain, data...)
+
+		dir.buf = dir.buf[tlsRecordHeaderSize+length:]
+	}
+
+	if len(dir.buf) == 0 {
+		dir.buf = nil
+	}
+
+	return
+}
+
+// processRecord returns application data of record, and false if connection can't be decrypted
+func (c *tlsConn) processRecord(dir *tlsDirection, isIncoming bool, header, fragment []byte) ([]byte, bool) {
+	typ := header[0]
+
+	if typ == tlsRecordChangeCipherSpec {
+		// In TLS 1.3 it is sent only for compatibility
+		if c.suite != nil && !c.suite.tls13 {
+			dir.encrypted = true
+			dir.cipher = c.tls12Cipher(isIncoming)
+		}
+		return nil, true
+	}
+
+	if !dir.encrypted {
+		if typ == tlsRecordHandshake {
+			return nil, c.processHandshake(dir, isIncoming, fragment)
+		}
+		return nil, true
+	}
+
+	if c.suite.tls13 {
+		return c.processTLS13Record(dir, header, fragment)
+	}
+
+	// Secrets are not known, connection can't be decrypted
+	if dir.cipher == nil {
+		return nil, false
+	}
+
+	plain := dir.cipher.decrypt(header, fragment)
+	if plain == nil {
+		return nil, false
+	}
+
+	if typ == tlsRecordApplicationData {
+		return plain, true
+	}
+
+	return nil, true
+}
+
+// processTLS13Record decrypts record, real record type is the last non zero byte of decrypted data
+func (c *tlsConn) processTLS13Record(dir *tlsDirection, header, fragment []byte) ([]byte, bool) {
+	if header[0] != tlsRecordApplicationData {
+		return nil, true
+	}
+
+	var plain []byte
+	if dir.handshakeCipher != nil {
+		plain = dir.handshakeCipher.decrypt(header, fragment)
+	} else if dir.cipher != nil {
+		plain = dir.cipher.decrypt(header, fragment)
+
+		// Without handshake secrets, handshake records are skipped until traffic keys start to work
+		if plain == nil && dir.cipher.seq == 0 {
+			return nil, true
+		}
+	}
+
+	if plain == nil {
+		return nil, false
+	}
+
+	i := len(plain) - 1
+	for i >= 0 && plain[i] == 0 {
+		i--
+	}
+	if i < 0 {
+		return nil, false
+	}
+
+	typ, plain := plain[i], plain[:i]
+
+	switch typ {
+	case tlsRecordApplicationData:
+		return plain, true
+	case tlsRecordHandshake:
+		// Handshake ends with Finished, after which traffic keys are used
+		if dir.handshakeCipher != nil && len(plain) > 0 && plain[0] == tlsHandshakeFinished {
+			dir.handshakeCipher = nil
+		}
+	}
+
+	return nil, true
+}
+
+// processHandshake parses not encrypted handshake messages
+func (c *tlsConn) processHandshake(dir *tlsDirection, isIncoming bool, fragment []byte) bool {
+	dir.handshake = append(dir.handshake, fragment...)
+
+	for len(dir.handshake) >= 4 {
+		length := int(dir.handshake[1])<<16 | int(dir.handshake[2])<<8 | int(dir.handshake[3])
+		if length > tlsMaxRecordSize*4 {
+			return false
+		}
+
+		if len(dir.handshake) < 4+length {
+			break
+		}
+
+		msg := dir.handshake[:4+length]
+		body := msg[4:]
+		dir.handshake = dir.handshake[4+length:]
+
+		if c.masterSecret == nil {
+			c.transcript = append(c.transcript, msg...)
+		}
+
+		switch msg[0] {
+		case tlsHandshakeClientHello:
+			if len(body) < 34 {
+				return false
+			}
+			c.clientRandom = append([]byte(nil), body[2:34]...)
+		case tlsHandshakeServerHello:
+			if !c.parseServerHello(body) {
+				return false
+			}
+
+			if c.suite.tls13 {
+				c.startTLS13()
+			}
+		case tlsHandshakeClientKeyExchange:
+			if c.suite != nil && c.suite.rsaKeyExchange && c.keys.rsaKey != nil && len(body) > 2 {
+				c.decryptPreMasterSecret(body[2:])
+			}
+		}
+	}
+
+	return true
+}
+
+func (c *tlsConn) parseServerHello(body []byte) bool {
+	if len(body) < 35 {
+		return false
+	}
+	c.serverRandom = append([]byte(nil), body[2:34]...)
+
+	pos := 35 + int(body[34])
+	if len(body) < pos+3 {
+		return false
+	}
+
+	suite, ok := tlsCipherSuites[binary.BigEndian.Uint16(body[pos:])]
+	if !ok {
+		return false
+	}
+	c.suite = suite
+	pos += 3
+
+	// Extensions
+	if len(body) < pos+2 {
+		return !suite.tls13
+	}
+	pos += 2
+
+	for len(body) >= pos+4 {
+		typ := binary.BigEndian.Uint16(body[pos:])
+		length := int(binary.BigEndian.Uint16(body[pos+2:]))
+		pos += 4
+		if len(body) < pos+length {
+			return false
+		}
+
+		switch typ {
+		case tlsExtensionExtendedMasterSecret:
+			c.extendedMasterSecret = true
+		case tlsExtensionSupportedVersions:
+			if length == 2 && binary.BigEndian.Uint16(body[pos:]) != tlsVersion13 {
+				return false
+			}
+		}
+
+		pos += length
+	}
+
+	return true
+}
+
+// startTLS13 sets up ciphers for TLS 1.3, where everything after ServerHello is encrypted
+func (c *tlsConn) startTLS13() {
+	secrets := []struct {
+		dir                          *tlsDirection
+		handshakeLabel, trafficLabel string
+	}{
+		{c.client, keyLogClientHandshakeSecret, keyLogClientTrafficSecret},
+		{c.server, keyLogServerHandshakeSecret, keyLogServerTrafficSecret},
+	}
+
+	for _, s := range secrets {
+		s.dir.encrypted = true
+
+		if secret := c.keys.secret(s.handshakeLabel, c.clientRandom); secret != nil {
+			s.dir.handshakeCipher = newTLS13RecordCipher(c.suite, secret)
+		}
+		if secret := c.keys.secret(s.trafficLabel, c.clientRandom); secret != nil {
+			s.dir.cipher = newTLS13RecordCipher(c.suite, secret)
+		}
+	}
+}
+
+// decryptPreMasterSecret computes master secret of session with RSA key exchange
+func (c *tlsConn) decryptPreMasterSecret(encrypted []byte) {
+	preMaster := make([]byte, 48)
+	// Random key is used on error, so connection just won't be decrypted
+	rand.Read(preMaster)
+	if err := rsa.DecryptPKCS1v15SessionKey(nil, c.keys.rsaKey, encrypted, preMaster); err != nil {
+		return
+	}
+
+	if c.extendedMasterSecret {
+		h := c.suite.hash()
+		h.Write(c.transcript)
+		c.masterSecret = tlsPRF(c.suite.hash, preMaster, "extended master secret", h.Sum(nil), 48)
+	} else {
+		c.masterSecret = tlsPRF(c.suite.hash, preMaster, "master secret", append(append([]byte(nil), c.clientRandom...), c.serverRandom...), 48)
+	}
+	c.transcript = nil
+}
+
+// tls12Cipher derives keys of given direction from master secret
+func (c *tlsConn) tls12Cipher(isClient bool) *tlsRecordCipher {
+	if c.masterSecret == nil {
+		c.masterSecret = c.keys.secret(keyLogMasterSecret, c.clientRandom)
+		if c.masterSecret == nil {
+			return nil
+		}
+		c.transcript = nil
+	}
+
+	macLen, ivLen := 0, 4
+	if c.suite.mac != nil {
+		macLen, ivLen = c.suite.mac().Size(), aes.BlockSize
+	}
+
+	seed := append(append([]byte(nil), c.serverRandom...), c.clientRandom...)
+	keys := tlsPRF(c.suite.hash, c.masterSecret, "key expansion", seed, 2*(macLen+c.suite.keyLen+ivLen))
+
+	clientMAC, keys := keys[:macLen], keys[macLen:]
+	serverMAC, keys := keys[:macLen], keys[macLen:]
+	clientKey, keys := keys[:c.suite.keyLen], keys[c.suite.keyLen:]
+	serverKey, keys := keys[:c.suite.keyLen], keys[c.suite.keyLen:]
+	clientIV, serverIV := keys[:ivLen], keys[ivLen:]
+
+	if isClient {
+		return newTLSRecordCipher(c.suite, clientKey, clientIV, clientMAC)
+	}
+
+	return newTLSRecordCipher(c.suite, serverKey, serverIV, serverMAC)
+}
+
+// processTLSPacket decrypts packet of TLS connection, and processes decrypted data as separate packet.
+// Returns false if packet is not part of TLS connection.
+func (t *Listener) processTLSPacket(packet *TCPPacket) bool {
+	if t.tlsKeys == nil || packet.decrypted {
+		return false
+	}
+
+	id, isIncoming := t.connID(packet)
+
+	conn, ok := t.tlsConns[id]
+	if !ok {
+		if !isIncoming || !isTLSClientHello(packet.Data) {
+			return false
+		}
+
+		conn = newTLSConn(t.tlsKeys, t.reassemblyLimit)
+		t.tlsConns[id] = conn
+	}
+
+	dir, other := conn.server, conn.client
+	if isIncoming {
+		dir, other = conn.client, conn.server
+	}
+
+	plain := conn.process(packet, isIncoming)
+
+	if len(plain) > 0 || packet.IsFIN {
+		// Decrypted packet has own sequence numbers, same as if data was sent without encryption
+		p := &TCPPacket{SrcPort: packet.SrcPort, DestPort: packet.DestPort, Seq: dir.base + dir.offset, Ack: other.base + other.offset, Data: plain, IsFIN: packet.IsFIN}
+		p = ParseTCPPacket(append([]byte(nil), packet.Addr...), p.dump().data, packet.timestamp)
+		p.DstAddr = packet.DstAddr
+		p.decrypted = true
+		dir.offset += uint32(len(plain))
+
+		t.processTCPPacket(p)
+	}
+
+	if packet.IsFIN {
+		delete(t.tlsConns, id)
+	}
+
+	return true
+}
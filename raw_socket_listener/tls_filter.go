@@ -0,0 +1,237 @@
+package rawSocket
+
+import (
+	"encoding/binary"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// TLS extensions parsed from ClientHello
+const (
+	tlsExtServerName = 0
+	tlsExtALPN       = 16
+)
+
+// ClientHello split to more packets than this is not parsed, and connection is skipped
+const tlsFilterMaxPending = 8
+
+// tlsClientHello holds ClientHello fields used by server name and ALPN filter
+type tlsClientHello struct {
+	serverName string
+	alpn       []string
+}
+
+// tlsFilterConn is decision of TLS filter about connection. Until ClientHello is complete,
+// its packets are held.
+type tlsFilterConn struct {
+	decided bool
+	allowed bool
+	data    []byte
+	pending []*TCPPacket
+
+	lastSeen time.Time
+}
+
+// isTLSRecord checks if data looks like start of TLS record
+func isTLSRecord(data []byte) bool {
+	return len(data) >= tlsRecordHeaderSize && data[0] >= tlsRecordChangeCipherSpec && data[0] <= tlsRecordApplicationData && data[1] == 3
+}
+
+// parseTLSClientHello parses ClientHello, which can be split to multiple handshake records.
+// Returns false if more data is needed, and nil ClientHello if data is not valid.
+func parseTLSClientHello(data []byte) (*tlsClientHello, bool) {
+	var msg []byte
+
+	for len(data) >= tlsRecordHeaderSize {
+		if data[0] != tlsRecordHandshake {
+			return nil, true
+		}
+
+		length := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < tlsRecordHeaderSize+length {
+			break
+		}
+
+		msg = append(msg, data[tlsRecordHeaderSize:tlsRecordHeaderSize+length]...)
+		data = data[tlsRecordHeaderSize+length:]
+	}
+
+	if len(msg) < 4 {
+		return nil, false
+	}
+
+	if msg[0] != tlsHandshakeClientHello {
+		return nil, true
+	}
+
+	length := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+	if len(msg) < 4+length {
+		return nil, false
+	}
+
+	return parseTLSClientHelloBody(msg[4 : 4+length]), true
+}
+
+// parseTLSClientHelloBody reads server name and ALPN extensions of ClientHello message
+func parseTLSClientHelloBody(body []byte) *tlsClientHello {
+	// Version and random
+	of := 34
+
+	// Session ID, cipher suites and compression methods
+	for _, lenSize := range []int{1, 2, 1} {
+		if len(body) < of+lenSize {
+			return nil
+		}
+
+		n := int(body[of])
+		if lenSize == 2 {
+			n = int(binary.BigEndian.Uint16(body[of:]))
+		}
+		of += lenSize + n
+	}
+
+	hello := &tlsClientHello{}
+
+	// ClientHello without extensions
+	if len(body) < of+2 {
+		return hello
+	}
+
+	extensions := body[of+2:]
+	if n := int(binary.BigEndian.Uint16(body[of:])); n < len(extensions) {
+		extensions = extensions[:n]
+	}
+
+	for len(extensions) >= 4 {
+		typ := binary.BigEndian.Uint16(extensions[0:2])
+		n := int(binary.BigEndian.Uint16(extensions[2:4]))
+		if len(extensions) < 4+n {
+			return nil
+		}
+		ext := extensions[4 : 4+n]
+		extensions = extensions[4+n:]
+
+		switch typ {
+		case tlsExtServerName:
+			// List of names, only host name type is defined
+			if len(ext) >= 5 && ext[2] == 0 {
+				if l := int(binary.BigEndian.Uint16(ext[3:5])); len(ext) >= 5+l {
+					hello.serverName = strings.ToLower(string(ext[5 : 5+l]))
+				}
+			}
+		case tlsExtALPN:
+			if len(ext) < 2 {
+				continue
+			}
+
+			for list := ext[2:]; len(list) > 0 && len(list) > int(list[0]); list = list[1+int(list[0]):] {
+				hello.alpn = append(hello.alpn, string(list[1:1+int(list[0])]))
+			}
+		}
+	}
+
+	return hello
+}
+
+// tlsClientHelloAllowed checks ClientHello against server name patterns and ALPN protocols
+func (t *Listener) tlsClientHelloAllowed(hello *tlsClientHello) bool {
+	if hello == nil {
+		return false
+	}
+
+	if len(t.tlsServerNames) > 0 {
+		matched := false
+		for _, pattern := range t.tlsServerNames {
+			if ok, _ := path.Match(pattern, hello.serverName); ok {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	if len(t.tlsALPN) > 0 {
+		for _, proto := range hello.alpn {
+			for _, allowed := range t.tlsALPN {
+				if proto == allowed {
+					return true
+				}
+			}
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// filterTLSPacket skips packets of TLS connections, which server name or ALPN protocols do not match filter.
+// Connections which are not TLS are not affected. TLS connections started before capture are skipped, since
+// their ClientHello is not known. Returns false if packet is skipped, or held until ClientHello is complete.
+func (t *Listener) filterTLSPacket(packet *TCPPacket) bool {
+	if len(t.tlsServerNames) == 0 && len(t.tlsALPN) == 0 || packet.decrypted {
+		return true
+	}
+
+	id, isIncoming := t.connID(packet)
+
+	conn, ok := t.tlsFilterConns[id]
+	if !ok {
+		if !isTLSRecord(packet.Data) {
+			return true
+		}
+
+		conn = &tlsFilterConn{}
+		if !isIncoming || !isTLSClientHello(packet.Data) {
+			conn.decided = true
+		}
+		t.tlsFilterConns[id] = conn
+	}
+
+	conn.lastSeen = time.Now()
+
+	if packet.IsFIN {
+		defer delete(t.tlsFilterConns, id)
+	}
+
+	if conn.decided {
+		if !conn.allowed {
+			atomic.AddUint64(&t.stats.FilteredPackets, 1)
+		}
+		return conn.allowed
+	}
+
+	if isIncoming {
+		conn.data = append(conn.data, packet.Data...)
+	}
+	conn.pending = append(conn.pending, packet)
+
+	hello, complete := parseTLSClientHello(conn.data)
+	if !complete && len(conn.pending) < tlsFilterMaxPending && !packet.IsFIN {
+		return false
+	}
+
+	conn.decided = true
+	conn.allowed = complete && t.tlsClientHelloAllowed(hello)
+	conn.data = nil
+
+	pending := conn.pending
+	conn.pending = nil
+
+	if !conn.allowed {
+		atomic.AddUint64(&t.stats.FilteredPackets, uint64(len(pending)))
+		return false
+	}
+
+	// Held packets are processed in order they were captured
+	for _, p := range pending[:len(pending)-1] {
+		t.processTCPPacket(p)
+	}
+
+	return true
+}
@@ -0,0 +1,89 @@
+package rawSocket
+
+import (
+	"crypto/tls"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordClientHello returns first flight of TLS client, which contains ClientHello
+func recordClientHello(serverName string, alpn []string) []byte {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	go tls.Client(clientConn, &tls.Config{ServerName: serverName, NextProtos: alpn, InsecureSkipVerify: true}).Handshake()
+
+	buf := make([]byte, 16*1024)
+	n, _ := serverConn.Read(buf)
+	clientConn.Close()
+
+	return buf[:n]
+}
+
+func TestParseTLSClientHello(t *testing.T) {
+	data := recordClientHello("API.example.com", []string{"h2", "http/1.1"})
+
+	hello, complete := parseTLSClientHello(data)
+	if !complete || hello == nil {
+		t.Fatal("Should parse ClientHello")
+	}
+
+	if hello.serverName != "api.example.com" || !reflect.DeepEqual(hello.alpn, []string{"h2", "http/1.1"}) {
+		t.Error("Wrong ClientHello", hello.serverName, hello.alpn)
+	}
+
+	if _, complete := parseTLSClientHello(data[:100]); complete {
+		t.Error("Should wait for the rest of ClientHello")
+	}
+
+	if hello, complete := parseTLSClientHello([]byte("\x17\x03\x03\x00\x01a")); !complete || hello != nil {
+		t.Error("Should not parse application data")
+	}
+}
+
+func TestListenerTLSFilter(t *testing.T) {
+	listener := NewListenerWithConfig("", "0", EnginePcap, true, time.Hour, ListenerConfig{TLSServerNames: []string{"*.example.com"}, TLSALPN: []string{"h2"}})
+	listener.Close()
+
+	packet := func(srcPort uint16, seq uint32, data []byte) *TCPPacket {
+		p := buildPacket(true, 1, seq, data, time.Now())
+		p.SrcPort = srcPort
+		return p
+	}
+
+	// ClientHello split to two packets
+	hello := recordClientHello("api.example.com", []string{"h2"})
+	if listener.filterTLSPacket(packet(2, 1, hello[:100])) {
+		t.Error("Should hold packet until ClientHello is complete")
+	}
+	if !listener.filterTLSPacket(packet(2, 101, hello[100:])) {
+		t.Error("Should allow matching server name")
+	}
+	if len(listener.messages) != 1 {
+		t.Error("Held packet should be processed", len(listener.messages))
+	}
+	if !listener.filterTLSPacket(packet(2, uint32(len(hello)+1), []byte("\x17\x03\x03\x00\x01a"))) {
+		t.Error("Should allow rest of connection")
+	}
+
+	for name, data := range map[string][]byte{
+		"Other server name": recordClientHello("example.org", []string{"h2"}),
+		"Other ALPN":        recordClientHello("api.example.com", []string{"http/1.1"}),
+		"Unknown TLS":       []byte("\x17\x03\x03\x00\x01a"),
+	} {
+		if listener.filterTLSPacket(packet(3, 1, data)) {
+			t.Error(name, "Should skip connection")
+		}
+		delete(listener.tlsFilterConns, tcpConnID{clientPort: 3})
+	}
+
+	if !listener.filterTLSPacket(packet(4, 1, []byte("GET / HTTP/1.1\r\n\r\n"))) {
+		t.Error("Should not filter connections which are not TLS")
+	}
+
+	if s := listener.Stats(); s.FilteredPackets != 3 {
+		t.Error("Skipped packets should be counted", s.FilteredPackets)
+	}
+}
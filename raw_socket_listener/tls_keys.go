@@ -0,0 +1,186 @@
+package rawSocket
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"hash"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Labels of secrets in key log file, see https://developer.mozilla.org/en-US/docs/Mozilla/Projects/NSS/Key_Log_Format
+const (
+	keyLogMasterSecret          = "CLIENT_RANDOM"
+	keyLogClientHandshakeSecret = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogServerHandshakeSecret = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogClientTrafficSecret   = "CLIENT_TRAFFIC_SECRET_0"
+	keyLogServerTrafficSecret   = "SERVER_TRAFFIC_SECRET_0"
+)
+
+// TLSKeys holds secrets used to decrypt captured TLS sessions: server RSA key, which works only for
+// sessions with RSA key exchange, and/or key log file written by client or server (SSLKEYLOGFILE).
+type TLSKeys struct {
+	mu     sync.Mutex
+	rsaKey *rsa.PrivateKey
+
+	keyLogPath string
+	// Key log is appended by application while running, so it is read again from last position when secret is not found
+	keyLogOffset int64
+	// Label -> client random -> secret
+	secrets map[string]map[string][]byte
+}
+
+// NewTLSKeys loads PEM encoded RSA private key and key log file, either can be empty
+func NewTLSKeys(rsaKeyPath, keyLogPath string) (*TLSKeys, error) {
+	k := &TLSKeys{keyLogPath: keyLogPath, secrets: make(map[string]map[string][]byte)}
+
+	if rsaKeyPath != "" {
+		data, err := ioutil.ReadFile(rsaKeyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if k.rsaKey, err = parseRSAKey(data); err != nil {
+			return nil, errors.New(rsaKeyPath + ": " + err.Error())
+		}
+	}
+
+	if keyLogPath != "" {
+		if _, err := os.Stat(keyLogPath); err != nil {
+			return nil, err
+		}
+		k.readKeyLog()
+	}
+
+	return k, nil
+}
+
+func parseRSAKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("key should be PEM encoded")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+		return rsaKey, nil
+	}
+
+	return nil, errors.New("only RSA keys are supported")
+}
+
+// readKeyLog reads lines added to key log since last read
+func (k *TLSKeys) readKeyLog() {
+	file, err := os.Open(k.keyLogPath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	if _, err = file.Seek(k.keyLogOffset, 0); err != nil {
+		return
+	}
+
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadString('\n')
+		// Last line can be still written
+		if err != nil {
+			return
+		}
+		k.keyLogOffset += int64(len(line))
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		secret, err := hex.DecodeString(fields[2])
+		if err != nil {
+			continue
+		}
+
+		if k.secrets[fields[0]] == nil {
+			k.secrets[fields[0]] = make(map[string][]byte)
+		}
+		k.secrets[fields[0]][strings.ToLower(fields[1])] = secret
+	}
+}
+
+// secret returns secret with given label for session identified by client random, or nil if it is unknown
+func (k *TLSKeys) secret(label string, clientRandom []byte) []byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	random := hex.EncodeToString(clientRandom)
+	if secret, ok := k.secrets[label][random]; ok {
+		return secret
+	}
+
+	if k.keyLogPath != "" {
+		k.readKeyLog()
+	}
+
+	return k.secrets[label][random]
+}
+
+// tlsPRF is TLS 1.2 pseudorandom function, see https://tools.ietf.org/html/rfc5246#section-5
+func tlsPRF(newHash func() hash.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	seed = append([]byte(label), seed...)
+	result := make([]byte, 0, length)
+
+	mac := hmac.New(newHash, secret)
+	mac.Write(seed)
+	a := mac.Sum(nil)
+
+	for len(result) < length {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		result = mac.Sum(result)
+
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+
+	return result[:length]
+}
+
+// hkdfExpandLabel derives TLS 1.3 keys from traffic secret, see https://tools.ietf.org/html/rfc8446#section-7.1
+func hkdfExpandLabel(newHash func() hash.Hash, secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := []byte{byte(length >> 8), byte(length), byte(len(label))}
+	info = append(info, label...)
+	// Empty context
+	info = append(info, 0)
+
+	var result, prev []byte
+	mac := hmac.New(newHash, secret)
+
+	for i := byte(1); len(result) < length; i++ {
+		mac.Reset()
+		mac.Write(prev)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		prev = mac.Sum(nil)
+		result = append(result, prev...)
+	}
+
+	return result[:length]
+}
@@ -0,0 +1,210 @@
+package rawSocket
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	mrand "math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tlsRecorder logs data written by both sides of connection in order
+type tlsRecorder struct {
+	sync.Mutex
+	writes []tlsWrite
+}
+
+type tlsWrite struct {
+	isIncoming bool
+	data       []byte
+}
+
+type recordedConn struct {
+	net.Conn
+	rec        *tlsRecorder
+	isIncoming bool
+}
+
+func (c *recordedConn) Write(data []byte) (int, error) {
+	c.rec.Lock()
+	c.rec.writes = append(c.rec.writes, tlsWrite{c.isIncoming, append([]byte(nil), data...)})
+	c.rec.Unlock()
+
+	return c.Conn.Write(data)
+}
+
+func tlsTestCertificate(t *testing.T) (tls.Certificate, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	return tls.Certificate{Certificate: [][]byte{cert}, PrivateKey: key}, keyPEM
+}
+
+// recordTLSSession makes request over TLS connection, and returns data sent by client and server
+func recordTLSSession(t *testing.T, cert tls.Certificate, version uint16, suite uint16, keyLog string) []tlsWrite {
+	clientConn, serverConn := net.Pipe()
+	rec := &tlsRecorder{}
+
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: version, MaxVersion: version}
+	clientConfig := &tls.Config{InsecureSkipVerify: true, ServerName: "example.com", MinVersion: version, MaxVersion: version}
+	if suite != 0 {
+		serverConfig.CipherSuites = []uint16{suite}
+		clientConfig.CipherSuites = []uint16{suite}
+	}
+	if keyLog != "" {
+		f, _ := os.OpenFile(keyLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		defer f.Close()
+		clientConfig.KeyLogWriter = f
+	}
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+
+		// Underlying connection is closed directly, since close_notify alert would block on pipe
+		server := tls.Server(&recordedConn{serverConn, rec, false}, serverConfig)
+		defer serverConn.Close()
+
+		buf := make([]byte, 1024)
+		if _, err := server.Read(buf); err != nil {
+			t.Error("Server error:", err)
+			return
+		}
+		server.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	}()
+
+	client := tls.Client(&recordedConn{clientConn, rec, true}, clientConfig)
+	if _, err := client.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")); err != nil {
+		t.Fatal("Client error:", err)
+	}
+	buf := make([]byte, 1024)
+	client.Read(buf)
+	clientConn.Close()
+	<-done
+
+	return rec.writes
+}
+
+func TestRawListenerTLS(t *testing.T) {
+	// RSA key exchange is disabled by default
+	os.Setenv("GODEBUG", "tlsrsakex=1")
+	defer os.Unsetenv("GODEBUG")
+
+	cert, keyPEM := tlsTestCertificate(t)
+
+	keyPath := fmt.Sprintf("/tmp/%d", mrand.Int63())
+	ioutil.WriteFile(keyPath, keyPEM, 0600)
+	defer os.Remove(keyPath)
+
+	tests := []struct {
+		name     string
+		version  uint16
+		suite    uint16
+		useKey   bool
+		useLog   bool
+		expected bool
+	}{
+		{"TLS 1.3", tls.VersionTLS13, 0, false, true, true},
+		{"TLS 1.2 GCM", tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, false, true, true},
+		{"TLS 1.2 CBC", tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA, false, true, true},
+		{"RSA key exchange", tls.VersionTLS12, tls.TLS_RSA_WITH_AES_128_GCM_SHA256, true, false, true},
+		{"RSA key exchange CBC", tls.VersionTLS12, tls.TLS_RSA_WITH_AES_128_CBC_SHA, true, false, true},
+		{"ECDHE without key log", tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, true, false, false},
+	}
+
+	for _, tc := range tests {
+		logPath := fmt.Sprintf("/tmp/%d", mrand.Int63())
+		ioutil.WriteFile(logPath, nil, 0600)
+
+		var path string
+		if tc.useLog {
+			path = logPath
+		}
+		writes := recordTLSSession(t, cert, tc.version, tc.suite, path)
+
+		var keys *TLSKeys
+		var err error
+		if tc.useKey {
+			keys, err = NewTLSKeys(keyPath, "")
+		} else {
+			keys, err = NewTLSKeys("", logPath)
+		}
+		os.Remove(logPath)
+		if err != nil {
+			t.Fatal(tc.name, err)
+		}
+
+		listener := NewListenerWithConfig("", "0", EnginePcap, true, 10*time.Millisecond, ListenerConfig{TLSKeys: keys})
+
+		clientSeq, serverSeq := uint32(100), uint32(1000)
+		for _, w := range writes {
+			var p *TCPPacket
+			if w.isIncoming {
+				p = buildPacket(true, serverSeq, clientSeq, w.data, time.Now())
+				clientSeq += uint32(len(w.data))
+			} else {
+				p = buildPacket(false, clientSeq, serverSeq, w.data, time.Now())
+				serverSeq += uint32(len(w.data))
+			}
+			listener.packetsChan <- p.dump()
+		}
+
+		var messages []string
+		timeout := time.After(100 * time.Millisecond)
+	loop:
+		for len(messages) < 2 {
+			select {
+			case m := <-listener.Receiver():
+				messages = append(messages, string(m.Bytes()))
+			case <-timeout:
+				break loop
+			}
+		}
+		listener.Close()
+
+		if !tc.expected {
+			if len(messages) != 0 {
+				t.Error(tc.name, "Should not decrypt connection without keys", messages)
+			}
+			continue
+		}
+
+		if len(messages) != 2 {
+			t.Error(tc.name, "Should decrypt request and response", messages)
+			continue
+		}
+
+		if messages[0] != "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n" {
+			t.Error(tc.name, "Wrong request", messages[0])
+		}
+		if messages[1] != "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok" {
+			t.Error(tc.name, "Wrong response", messages[1])
+		}
+	}
+}
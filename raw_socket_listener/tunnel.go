@@ -0,0 +1,169 @@
+package rawSocket
+
+import (
+	"encoding/binary"
+)
+
+// Tunnel protocols used for traffic mirroring and overlay networks
+const (
+	ipProtocolUDP = 17
+	ipProtocolGRE = 47
+
+	// IANA port, and Linux default used by flannel
+	vxlanPort      = 4789
+	vxlanLinuxPort = 8472
+	genevePort     = 6081
+
+	etherTypeIPv4         = 0x0800
+	etherTypeIPv6         = 0x86DD
+	etherTypeTransparent  = 0x6558
+	etherTypeERSPAN       = 0x88BE
+	ethernetHeaderSize    = 14
+	tunnelMaxDepth        = 3
+	tunnelHeaderSize      = 8
+	greMinHeaderSize      = 4
+	greFlagChecksum       = 0x80
+	greFlagKey            = 0x20
+	greFlagSequenceNumber = 0x10
+)
+
+// tunnelBPF matches encapsulated packets, which are filtered by port after decapsulation
+const tunnelBPF = "udp dst port 4789 or udp dst port 8472 or udp dst port 6081 or ip proto 47 or ip6 proto 47"
+
+// parseNetworkPacket returns addresses and TCP segment (or UDP datagram, if listener captures UDP) of IP packet.
+// If decapsulation is enabled, packets inside VXLAN, Geneve and GRE tunnels are extracted, and tunneled is true.
+func (t *Listener) parseNetworkPacket(data []byte) (srcIP, dstIP, transport []byte, tunneled, ok bool) {
+	for depth := 0; depth <= tunnelMaxDepth; depth++ {
+		srcIP, dstIP, payload, protocol, ok := parseIPHeader(data)
+		if !ok {
+			return nil, nil, nil, false, false
+		}
+
+		switch {
+		case protocol == t.transportProtocol() && !(t.decapsulate && isTunnelDatagram(protocol, payload)):
+			return srcIP, dstIP, payload, depth > 0, true
+		case protocol == ipProtocolUDP && t.decapsulate:
+			data, ok = decapsulateUDP(payload)
+		case protocol == ipProtocolGRE && t.decapsulate:
+			data, ok = decapsulateGRE(payload)
+		default:
+			ok = false
+		}
+
+		if !ok {
+			return nil, nil, nil, false, false
+		}
+	}
+
+	return
+}
+
+// isTunnelDatagram checks if UDP datagram is sent to one of tunnel ports
+func isTunnelDatagram(protocol byte, udp []byte) bool {
+	if protocol != ipProtocolUDP || len(udp) < 4 {
+		return false
+	}
+
+	switch binary.BigEndian.Uint16(udp[2:4]) {
+	case vxlanPort, vxlanLinuxPort, genevePort:
+		return true
+	}
+
+	return false
+}
+
+// decapsulateUDP returns IP packet carried by VXLAN or Geneve
+func decapsulateUDP(udp []byte) ([]byte, bool) {
+	if len(udp) < 8+tunnelHeaderSize {
+		return nil, false
+	}
+
+	body := udp[8:]
+
+	switch binary.BigEndian.Uint16(udp[2:4]) {
+	case vxlanPort, vxlanLinuxPort:
+		// VNI flag should be set
+		if body[0]&0x08 == 0 {
+			return nil, false
+		}
+
+		return ethernetPayload(body[tunnelHeaderSize:])
+	case genevePort:
+		optionsLen := int(body[0]&0x3F) * 4
+		if len(body) < tunnelHeaderSize+optionsLen {
+			return nil, false
+		}
+
+		return tunnelPayload(binary.BigEndian.Uint16(body[2:4]), body[tunnelHeaderSize+optionsLen:])
+	}
+
+	return nil, false
+}
+
+// decapsulateGRE returns IP packet carried by GRE, including ERSPAN type II used for port mirroring
+func decapsulateGRE(gre []byte) ([]byte, bool) {
+	if len(gre) < greMinHeaderSize {
+		return nil, false
+	}
+
+	// Only version 0, version 1 is used by PPTP
+	if gre[1]&0x07 != 0 {
+		return nil, false
+	}
+
+	size := greMinHeaderSize
+	for _, flag := range []byte{greFlagChecksum, greFlagKey, greFlagSequenceNumber} {
+		if gre[0]&flag != 0 {
+			size += 4
+		}
+	}
+
+	if len(gre) < size {
+		return nil, false
+	}
+
+	protocol := binary.BigEndian.Uint16(gre[2:4])
+	body := gre[size:]
+
+	if protocol == etherTypeERSPAN {
+		if len(body) < tunnelHeaderSize {
+			return nil, false
+		}
+
+		return ethernetPayload(body[tunnelHeaderSize:])
+	}
+
+	return tunnelPayload(protocol, body)
+}
+
+// tunnelPayload returns IP packet of tunnel body, which is IP packet or Ethernet frame depending on EtherType
+func tunnelPayload(etherType uint16, body []byte) ([]byte, bool) {
+	switch etherType {
+	case etherTypeIPv4, etherTypeIPv6:
+		return body, true
+	case etherTypeTransparent:
+		return ethernetPayload(body)
+	}
+
+	return nil, false
+}
+
+// ethernetPayload returns IP packet of Ethernet frame, skipping VLAN tags
+func ethernetPayload(frame []byte) ([]byte, bool) {
+	of := ethernetHeaderSize
+
+	for {
+		if len(frame) < of {
+			return nil, false
+		}
+
+		switch binary.BigEndian.Uint16(frame[of-2 : of]) {
+		case etherTypeVLAN, etherTypeQinQ, etherTypeQinQOld:
+			of += vlanTagSize
+		case etherTypeIPv4, etherTypeIPv6:
+			return frame[of:], true
+		default:
+			return nil, false
+		}
+	}
+}
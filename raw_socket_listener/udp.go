@@ -0,0 +1,111 @@
+package rawSocket
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"time"
+)
+
+const udpHeaderSize = 8
+
+// UDPDatagram is UDP packet sent to or from listened port. Unlike TCP, each datagram is separate message.
+type UDPDatagram struct {
+	SrcPort  uint16
+	DestPort uint16
+	Data     []byte
+	Addr     []byte
+
+	Timestamp  time.Time
+	IsIncoming bool
+
+	// For response, last request datagram of the same flow
+	AssocDatagram *UDPDatagram
+}
+
+// udpFlowID identifies client and server pair by ports, since response packets carry only server address
+type udpFlowID struct {
+	clientPort uint16
+	serverPort uint16
+}
+
+// udpFlow holds last request of flow, which is answered by following responses
+type udpFlow struct {
+	request  *UDPDatagram
+	lastSeen time.Time
+}
+
+// ParseUDPDatagram takes address and UDP packet, and returns datagram with copied payload
+func ParseUDPDatagram(addr []byte, data []byte, timestamp time.Time) (d *UDPDatagram, ok bool) {
+	if len(data) < udpHeaderSize {
+		return nil, false
+	}
+
+	// Length includes header, and packet may have Ethernet padding
+	length := int(binary.BigEndian.Uint16(data[4:6]))
+	if length < udpHeaderSize || length > len(data) {
+		return nil, false
+	}
+
+	d = &UDPDatagram{
+		SrcPort:   binary.BigEndian.Uint16(data[0:2]),
+		DestPort:  binary.BigEndian.Uint16(data[2:4]),
+		Data:      append([]byte(nil), data[udpHeaderSize:length]...),
+		Addr:      append([]byte(nil), addr...),
+		Timestamp: timestamp,
+	}
+
+	return d, true
+}
+
+// UUID of request datagram, responses share UUID of their request
+func (d *UDPDatagram) UUID() []byte {
+	req := d
+	if !d.IsIncoming && d.AssocDatagram != nil {
+		req = d.AssocDatagram
+	}
+
+	var key []byte
+	key = append(key, req.Addr...)
+	key = strconv.AppendInt(key, req.Timestamp.UnixNano(), 10)
+	key = strconv.AppendUint(key, uint64(req.SrcPort), 10)
+
+	uuid := make([]byte, 40)
+	sha := sha1.Sum(key)
+	hex.Encode(uuid, sha[:20])
+
+	return uuid
+}
+
+func (d *UDPDatagram) IP() net.IP {
+	return net.IP(d.Addr)
+}
+
+// processUDPPacket emits requests, and responses which follow request of the same flow
+func (t *Listener) processUDPPacket(packet *packet) {
+	d, ok := ParseUDPDatagram(packet.srcIP, packet.data, packet.timestamp)
+	if !ok {
+		return
+	}
+
+	d.IsIncoming = t.isListenPort(d.DestPort)
+
+	if d.IsIncoming {
+		if t.trackResponse {
+			t.udpFlows[udpFlowID{d.SrcPort, d.DestPort}] = &udpFlow{d, time.Now()}
+		}
+	} else {
+		flow, ok := t.udpFlows[udpFlowID{d.DestPort, d.SrcPort}]
+		// Do not track responses which have no associated requests
+		if !ok {
+			return
+		}
+
+		flow.lastSeen = time.Now()
+		d.AssocDatagram = flow.request
+	}
+
+	t.datagramsChan <- d
+}
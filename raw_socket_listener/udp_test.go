@@ -0,0 +1,68 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func buildDatagram(srcPort, destPort uint16, data []byte) *packet {
+	buf := make([]byte, udpHeaderSize, udpHeaderSize+len(data))
+	binary.BigEndian.PutUint16(buf[0:2], srcPort)
+	binary.BigEndian.PutUint16(buf[2:4], destPort)
+	binary.BigEndian.PutUint16(buf[4:6], uint16(udpHeaderSize+len(data)))
+	buf = append(buf, data...)
+
+	return &packet{srcIP: []byte{127, 0, 0, 1}, data: buf, timestamp: time.Now()}
+}
+
+func TestRawListenerUDP(t *testing.T) {
+	listener := NewListenerWithConfig("", "0", EnginePcap, true, 10*time.Millisecond, ListenerConfig{UDP: true})
+	defer listener.Close()
+
+	// Response without request is skipped
+	listener.packetsChan <- buildDatagram(0, 5000, []byte("unknown"))
+	listener.packetsChan <- buildDatagram(5001, 0, []byte("query"))
+	listener.packetsChan <- buildDatagram(0, 5001, []byte("answer"))
+
+	var req, resp *UDPDatagram
+
+	select {
+	case req = <-listener.DatagramReceiver():
+	case <-time.After(10 * time.Millisecond):
+		t.Fatal("Should return request immediately")
+	}
+
+	if !req.IsIncoming || string(req.Data) != "query" {
+		t.Error("Should be request", req)
+	}
+
+	select {
+	case resp = <-listener.DatagramReceiver():
+	case <-time.After(10 * time.Millisecond):
+		t.Fatal("Should return response immediately")
+	}
+
+	if resp.IsIncoming || string(resp.Data) != "answer" {
+		t.Error("Should be response", resp)
+	}
+
+	if resp.AssocDatagram != req || !bytes.Equal(resp.UUID(), req.UUID()) {
+		t.Error("Response should be matched to request")
+	}
+}
+
+func TestParseUDPDatagram(t *testing.T) {
+	// Ethernet padding after datagram
+	p := buildDatagram(1, 2, []byte("data"))
+	p.data = append(p.data, 0, 0, 0)
+
+	if d, ok := ParseUDPDatagram(p.srcIP, p.data, p.timestamp); !ok || string(d.Data) != "data" {
+		t.Error("Should strip padding", d)
+	}
+
+	if _, ok := ParseUDPDatagram(p.srcIP, p.data[:10], p.timestamp); ok {
+		t.Error("Should reject truncated datagram")
+	}
+}
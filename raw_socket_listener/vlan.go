@@ -0,0 +1,76 @@
+package rawSocket
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// EtherTypes of 802.1Q and 802.1ad (QinQ) tags
+const (
+	etherTypeVLAN     = 0x8100
+	etherTypeQinQ     = 0x88a8
+	etherTypeQinQOld  = 0x9100
+	vlanTagSize       = 4
+	vlanMaxTagsParsed = 2
+)
+
+// skipVLANTags returns offset of network layer after VLAN tags, given offset right after EtherType.
+// Returns false if packet is truncated, or does not match VLAN filter.
+func (t *Listener) skipVLANTags(data []byte, of int) (int, bool) {
+	matched := len(t.vlans) == 0
+
+	for i := 0; i < vlanMaxTagsParsed && len(data) >= of; i++ {
+		switch binary.BigEndian.Uint16(data[of-2 : of]) {
+		case etherTypeVLAN, etherTypeQinQ, etherTypeQinQOld:
+		default:
+			return of, matched
+		}
+
+		if len(data) < of+vlanTagSize {
+			return of, false
+		}
+
+		if !matched {
+			id := binary.BigEndian.Uint16(data[of:of+2]) & 0x0FFF
+			for _, v := range t.vlans {
+				if v == id {
+					matched = true
+				}
+			}
+		}
+
+		of += vlanTagSize
+	}
+
+	return of, matched && len(data) >= of
+}
+
+// vlanBPF extends filter to match packets with single and double VLAN tags.
+// First 'vlan' keyword shifts offsets for the rest of expression, so repeated clause matches double tagged packets.
+func (t *Listener) vlanBPF(bpf string) string {
+	tagged := "(vlan and (" + bpf + ")) or (vlan and (" + bpf + "))"
+
+	// Not tagged packets are not matched by VLAN filter
+	if len(t.vlans) > 0 {
+		return tagged
+	}
+
+	return "(" + bpf + ") or " + tagged
+}
+
+// matchVLANLayers checks if decoded packet has VLAN tag with one of filtered IDs
+func (t *Listener) matchVLANLayers(packet gopacket.Packet) bool {
+	for _, layer := range packet.Layers() {
+		if tag, ok := layer.(*layers.Dot1Q); ok {
+			for _, v := range t.vlans {
+				if v == tag.VLANIdentifier {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,251 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/buger/gor/proto"
+)
+
+const (
+	// Bigger frames are treated as broken stream
+	wsMaxFrameSize = 16 * 1024 * 1024
+)
+
+var (
+	bWebSocket       = []byte("websocket")
+	bSwitchProtocols = []byte("101")
+)
+
+// WebSocketFrame is frame of upgraded connection, sent by client or server
+type WebSocketFrame struct {
+	// Frame in wire format, without masking
+	Data       []byte
+	IsIncoming bool
+	Timestamp  time.Time
+
+	// Id of handshake request, which frames of the same connection share
+	handshakeID []byte
+}
+
+// UUID returns id of handshake request, which started connection
+func (f *WebSocketFrame) UUID() []byte {
+	return f.handshakeID
+}
+
+// wsDirection parses frames sent by one side of connection
+type wsDirection struct {
+	stream *tcpStream
+	buf    []byte
+	// Set if stream can't be parsed anymore, for example after lost packet
+	broken bool
+}
+
+// wsConn is connection with WebSocket handshake request. Its frames are parsed after server accepts upgrade.
+type wsConn struct {
+	client      *wsDirection
+	server      *wsDirection
+	handshakeID []byte
+	upgraded    bool
+	lastSeen    time.Time
+}
+
+// newWSDirection returns direction, which stream starts at given sequence number
+func newWSDirection(seq uint32, maxPending int) *wsDirection {
+	stream := newTCPStream(maxPending)
+	stream.started = true
+	stream.next = seq
+
+	return &wsDirection{stream: stream}
+}
+
+// isWebSocketHandshake checks if data is HTTP request with 'Upgrade: websocket' header
+func isWebSocketHandshake(data []byte) bool {
+	if !bytes.HasPrefix(data, []byte("GET ")) {
+		return false
+	}
+
+	return bytes.EqualFold(proto.Header(data, []byte("Upgrade")), bWebSocket)
+}
+
+// setWebSocketHandshakeID links connection to its handshake request, so frames get id of request message
+func (t *Listener) setWebSocketHandshakeID(packet *TCPPacket, message *TCPMessage) {
+	if len(t.wsConns) == 0 || !message.IsIncoming {
+		return
+	}
+
+	id, _ := t.connID(packet)
+	if conn, ok := t.wsConns[id]; ok && conn.handshakeID == nil {
+		conn.handshakeID = message.UUID()
+	}
+}
+
+// processWebSocketPacket passes packet to WebSocket connection it belongs to. Returns false if packet
+// should be processed as HTTP, which includes handshake request and response.
+func (t *Listener) processWebSocketPacket(packet *TCPPacket) bool {
+	id, isIncoming := t.connID(packet)
+
+	conn, ok := t.wsConns[id]
+	if !ok {
+		if !isIncoming || !isWebSocketHandshake(packet.Data) {
+			return false
+		}
+
+		// Handshake request has no body, and its headers should fit single packet
+		end := bytes.Index(packet.Data, proto.EmptyLine)
+		if end == -1 {
+			return false
+		}
+
+		// Handshake id is set when request message is created
+		t.wsConns[id] = &wsConn{
+			client:   newWSDirection(packet.Seq+uint32(end+len(proto.EmptyLine)), t.reassemblyLimit),
+			lastSeen: time.Now(),
+		}
+
+		return false
+	}
+
+	conn.lastSeen = time.Now()
+
+	if packet.IsFIN {
+		delete(t.wsConns, id)
+		return conn.upgraded
+	}
+
+	if !conn.upgraded {
+		if isIncoming {
+			// Retransmitted handshake
+			if int32(packet.Seq-conn.client.stream.next) < 0 {
+				return false
+			}
+
+			// Client can send frames before it receives response
+			t.processWebSocketData(conn, conn.client, packet, true)
+			return true
+		}
+
+		if !bytes.HasPrefix(packet.Data, []byte("HTTP/1.1 ")) {
+			return false
+		}
+
+		end := bytes.Index(packet.Data, proto.EmptyLine)
+		if !bytes.Equal(proto.Status(packet.Data), bSwitchProtocols) || end == -1 {
+			delete(t.wsConns, id)
+			return false
+		}
+
+		conn.upgraded = true
+		conn.server = newWSDirection(packet.Seq+uint32(end+len(proto.EmptyLine)), t.reassemblyLimit)
+
+		// Frames can follow response in the same packet, which still should be emitted as HTTP response
+		t.processWebSocketData(conn, conn.server, packet, false)
+		return false
+	}
+
+	dir := conn.server
+	if isIncoming {
+		dir = conn.client
+	}
+
+	t.processWebSocketData(conn, dir, packet, isIncoming)
+
+	return true
+}
+
+// processWebSocketData adds packet data to direction stream, and emits completed frames
+func (t *Listener) processWebSocketData(conn *wsConn, dir *wsDirection, packet *TCPPacket, isIncoming bool) {
+	if dir.broken {
+		return
+	}
+
+	dir.buf = append(dir.buf, dir.stream.add(packet.Seq, packet.Data)...)
+
+	for len(dir.buf) > 0 {
+		frame, size, ok := parseWebSocketFrame(dir.buf)
+		if !ok {
+			dir.broken = true
+			dir.buf = nil
+			return
+		}
+
+		if size == 0 {
+			break
+		}
+
+		t.framesChan <- &WebSocketFrame{
+			Data:        frame,
+			IsIncoming:  isIncoming,
+			Timestamp:   packet.timestamp,
+			handshakeID: conn.handshakeID,
+		}
+
+		dir.buf = dir.buf[size:]
+	}
+
+	// Release memory of processed frames
+	if len(dir.buf) == 0 {
+		dir.buf = nil
+	}
+}
+
+// parseWebSocketFrame returns copy of the first frame in buffer with masking removed, and its size in buffer.
+// Size is 0 if frame is not complete yet, and ok is false if frame is malformed.
+// See https://tools.ietf.org/html/rfc6455#section-5.2
+func parseWebSocketFrame(buf []byte) (frame []byte, size int, ok bool) {
+	if len(buf) < 2 {
+		return nil, 0, true
+	}
+
+	masked := buf[1]&0x80 != 0
+	length := uint64(buf[1] & 0x7F)
+	header := 2
+
+	switch length {
+	case 126:
+		header += 2
+		if len(buf) < header {
+			return nil, 0, true
+		}
+		length = uint64(binary.BigEndian.Uint16(buf[2:4]))
+	case 127:
+		header += 8
+		if len(buf) < header {
+			return nil, 0, true
+		}
+		length = binary.BigEndian.Uint64(buf[2:10])
+	}
+
+	if length > wsMaxFrameSize {
+		return nil, 0, false
+	}
+
+	var key []byte
+	if masked {
+		if len(buf) < header+4 {
+			return nil, 0, true
+		}
+		key = buf[header : header+4]
+		size = header + 4 + int(length)
+	} else {
+		size = header + int(length)
+	}
+
+	if len(buf) < size {
+		return nil, 0, true
+	}
+
+	frame = make([]byte, header+int(length))
+	copy(frame, buf[:header])
+	frame[1] &= 0x7F
+	copy(frame[header:], buf[size-int(length):size])
+
+	for i := range key {
+		for j := header + i; j < len(frame); j += 4 {
+			frame[j] ^= key[i]
+		}
+	}
+
+	return frame, size, true
+}
@@ -0,0 +1,83 @@
+package rawSocket
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRawListenerWebSocket(t *testing.T) {
+	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond)
+	defer listener.Close()
+
+	handshake := []byte("GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	response := []byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+
+	// Masked text frame 'hello', split between packets, and unmasked server frame right after response
+	clientFrame := []byte{0x81, 0x85, 1, 2, 3, 4, 'h' ^ 1, 'e' ^ 2, 'l' ^ 3, 'l' ^ 4, 'o' ^ 1}
+	serverFrame := []byte{0x81, 0x02, 'h', 'i'}
+
+	seq := uint32(100)
+	clientSeq := seq + uint32(len(handshake))
+	packets := []*TCPPacket{
+		buildPacket(true, 1, seq, handshake, time.Now()),
+		buildPacket(false, clientSeq, 1, append(append([]byte(nil), response...), serverFrame...), time.Now()),
+		buildPacket(true, 1, clientSeq+4, clientFrame[4:], time.Now()),
+		buildPacket(true, 1, clientSeq, clientFrame[:4], time.Now()),
+	}
+	for _, p := range packets {
+		listener.packetsChan <- p.dump()
+	}
+
+	var messages []*TCPMessage
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-listener.Receiver():
+			messages = append(messages, m)
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("Should emit handshake request and response")
+		}
+	}
+
+	expected := []struct {
+		data       []byte
+		isIncoming bool
+	}{
+		{serverFrame, false},
+		{[]byte{0x81, 0x05, 'h', 'e', 'l', 'l', 'o'}, true},
+	}
+
+	for _, e := range expected {
+		select {
+		case f := <-listener.WebSocketReceiver():
+			if !bytes.Equal(f.Data, e.data) || f.IsIncoming != e.isIncoming {
+				t.Errorf("Expected frame %q, got %q", e.data, f.Data)
+			}
+
+			if !bytes.Equal(f.UUID(), messages[0].UUID()) {
+				t.Error("Frame should have id of handshake request")
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("Should emit frame", e.data)
+		}
+	}
+}
+
+func TestParseWebSocketFrame(t *testing.T) {
+	// Frame with 16 bit length
+	data := bytes.Repeat([]byte("a"), 200)
+	buf := append([]byte{0x82, 126, 0, 200}, data...)
+
+	if _, size, ok := parseWebSocketFrame(buf[:100]); size != 0 || !ok {
+		t.Error("Should wait for the rest of frame")
+	}
+
+	if frame, size, ok := parseWebSocketFrame(append(buf, 0x88)); !ok || size != len(buf) || !bytes.Equal(frame, buf) {
+		t.Error("Should parse first frame", size)
+	}
+
+	// Frame with 64 bit length is too big
+	if _, _, ok := parseWebSocketFrame([]byte{0x82, 127, 0, 0, 0, 1, 0, 0, 0, 0}); ok {
+		t.Error("Should reject too big frame")
+	}
+}
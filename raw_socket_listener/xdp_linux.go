@@ -0,0 +1,688 @@
+//go:build amd64 || arm64
+// +build amd64 arm64
+
+package rawSocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// bpf(2) commands, types and flags used by XDP engine
+const (
+	bpfMapCreate     = 0
+	bpfMapUpdateElem = 2
+	bpfProgLoad      = 5
+	bpfLinkCreate    = 28
+
+	bpfMapTypeArray          = 2
+	bpfMapTypePerfEventArray = 4
+	bpfProgTypeXDP           = 6
+	bpfAttachTypeXDP         = 37
+	bpfPseudoMapFD           = 1
+
+	bpfFuncMapLookupElem   = 1
+	bpfFuncPerfEventOutput = 25
+
+	xdpPass = 2
+)
+
+// perf_event_open(2) constants used to read samples sent by XDP program
+const (
+	perfTypeSoftware      = 1
+	perfCountSWBPFOutput  = 10
+	perfSampleRaw         = 1 << 10
+	perfFlagFDCloexec     = 8
+	perfEventIOCEnable    = 0x2400
+	perfRecordLost        = 2
+	perfRecordSample      = 9
+	perfRingPages         = 256
+	perfMetaDataHead      = 1024
+	perfMetaDataTail      = 1032
+	xdpMaxSampleSize      = 65000
+	xdpSampleMetaSize     = 8
+	xdpPollTimeoutMs      = 100
+	xdpVerifierLogBufSize = 1 << 20
+)
+
+type bpfMapCreateAttr struct {
+	mapType, keySize, valueSize, maxEntries, mapFlags uint32
+}
+
+type bpfMapUpdateAttr struct {
+	mapFD uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+type bpfProgLoadAttr struct {
+	progType, insnCnt           uint32
+	insns, license              uint64
+	logLevel, logSize           uint32
+	logBuf                      uint64
+	kernVersion, progFlags      uint32
+	progName                    [16]byte
+	progIfindex, expectedAttach uint32
+}
+
+type bpfLinkCreateAttr struct {
+	progFD, targetIfindex, attachType, flags uint32
+}
+
+type perfEventAttr struct {
+	typ, size        uint32
+	config           uint64
+	samplePeriod     uint64
+	sampleType       uint64
+	readFormat       uint64
+	flags            uint64
+	wakeupEvents     uint32
+	bpType           uint32
+	ext1, ext2       uint64
+	branchSampleType uint64
+	sampleRegsUser   uint64
+	sampleStackUser  uint32
+	clockID          int32
+	sampleRegsIntr   uint64
+	auxWatermark     uint32
+	sampleMaxStack   uint16
+	_                uint16
+}
+
+func bpfCall(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := syscall.Syscall(sysBPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+
+	return int(fd), nil
+}
+
+// bpfInsn is single eBPF instruction, see https://www.kernel.org/doc/html/latest/bpf/instruction-set.html
+type bpfInsn struct {
+	code uint8
+	regs uint8
+	off  int16
+	imm  int32
+}
+
+// bpfAsm assembles eBPF program, jumps refer to labels which are resolved at the end
+type bpfAsm struct {
+	insns  []bpfInsn
+	labels map[string]int
+	jumps  map[int]string
+}
+
+// Instruction classes, sizes and operations
+const (
+	bpfLD    = 0x00
+	bpfLDX   = 0x01
+	bpfSTX   = 0x03
+	bpfALU   = 0x04
+	bpfJMP   = 0x05
+	bpfALU64 = 0x07
+
+	bpfW  = 0x00
+	bpfB  = 0x10
+	bpfDW = 0x18
+
+	bpfIMM = 0x00
+	bpfMEM = 0x60
+
+	bpfK = 0x00
+	bpfX = 0x08
+
+	bpfADD  = 0x00
+	bpfSUB  = 0x10
+	bpfOR   = 0x40
+	bpfAND  = 0x50
+	bpfLSH  = 0x60
+	bpfMOV  = 0xb0
+	bpfJA   = 0x00
+	bpfJEQ  = 0x10
+	bpfJGT  = 0x20
+	bpfJNE  = 0x50
+	bpfCALL = 0x80
+	bpfEXIT = 0x90
+)
+
+func newBPFAsm() *bpfAsm {
+	return &bpfAsm{labels: make(map[string]int), jumps: make(map[int]string)}
+}
+
+func (a *bpfAsm) emit(code uint8, dst, src uint8, off int16, imm int32) {
+	a.insns = append(a.insns, bpfInsn{code, dst | src<<4, off, imm})
+}
+
+func (a *bpfAsm) label(name string) {
+	a.labels[name] = len(a.insns)
+}
+
+func (a *bpfAsm) jump(op uint8, dst uint8, imm int32, label string) {
+	a.jumps[len(a.insns)] = label
+	a.emit(bpfJMP|op|bpfK, dst, 0, 0, imm)
+}
+
+func (a *bpfAsm) jumpReg(op uint8, dst, src uint8, label string) {
+	a.jumps[len(a.insns)] = label
+	a.emit(bpfJMP|op|bpfX, dst, src, 0, 0)
+}
+
+func (a *bpfAsm) alu(op uint8, dst uint8, imm int32) {
+	a.emit(bpfALU64|op|bpfK, dst, 0, 0, imm)
+}
+
+func (a *bpfAsm) aluReg(op uint8, dst, src uint8) {
+	a.emit(bpfALU64|op|bpfX, dst, src, 0, 0)
+}
+
+func (a *bpfAsm) load(size uint8, dst, src uint8, off int16) {
+	a.emit(bpfLDX|size|bpfMEM, dst, src, off, 0)
+}
+
+func (a *bpfAsm) store(size uint8, dst, src uint8, off int16) {
+	a.emit(bpfSTX|size|bpfMEM, dst, src, off, 0)
+}
+
+func (a *bpfAsm) loadMap(dst uint8, fd int) {
+	a.emit(bpfLD|bpfDW|bpfIMM, dst, bpfPseudoMapFD, 0, int32(fd))
+	a.emit(0, 0, 0, 0, 0)
+}
+
+func (a *bpfAsm) call(fn int32) {
+	a.emit(bpfJMP|bpfCALL, 0, 0, 0, fn)
+}
+
+// loadPort loads big endian 16 bit value at offset of packet pointer
+func (a *bpfAsm) loadPort(dst, ptr uint8, off int16) {
+	a.load(bpfB, dst, ptr, off)
+	a.alu(bpfLSH, dst, 8)
+	a.load(bpfB, 3, ptr, off+1)
+	a.aluReg(bpfOR, dst, 3)
+}
+
+func (a *bpfAsm) bytes() []byte {
+	for i, label := range a.jumps {
+		a.insns[i].off = int16(a.labels[label] - i - 1)
+	}
+
+	buf := make([]byte, len(a.insns)*8)
+	for i, insn := range a.insns {
+		buf[i*8] = insn.code
+		buf[i*8+1] = insn.regs
+		binary.LittleEndian.PutUint16(buf[i*8+2:], uint16(insn.off))
+		binary.LittleEndian.PutUint32(buf[i*8+4:], uint32(insn.imm))
+	}
+
+	return buf
+}
+
+// xdpProgram copies TCP packets of listened ports to perf buffer, and passes all packets further to network stack.
+// Registers: r6 - context, r7 - packet start, r8 - packet end, r9 - current header.
+func xdpProgram(portsFD, perfFD int, trackResponse bool) []byte {
+	a := newBPFAsm()
+
+	a.aluReg(bpfMOV, 6, 1)
+	a.load(bpfW, 7, 6, 0)
+	a.load(bpfW, 8, 6, 4)
+
+	// Ethernet header, with optional VLAN tag
+	a.aluReg(bpfMOV, 9, 7)
+	a.alu(bpfADD, 9, 14)
+	a.jumpReg(bpfJGT, 9, 8, "pass")
+	a.loadPort(2, 7, 12)
+	a.jump(bpfJNE, 2, etherTypeVLAN, "network")
+	a.alu(bpfADD, 9, vlanTagSize)
+	a.jumpReg(bpfJGT, 9, 8, "pass")
+	a.loadPort(2, 7, 16)
+
+	a.label("network")
+	a.jump(bpfJEQ, 2, etherTypeIPv4, "ipv4")
+	a.jump(bpfJEQ, 2, etherTypeIPv6, "ipv6")
+	a.jump(bpfJA, 0, 0, "pass")
+
+	a.label("ipv4")
+	a.aluReg(bpfMOV, 1, 9)
+	a.alu(bpfADD, 1, 20)
+	a.jumpReg(bpfJGT, 1, 8, "pass")
+	a.load(bpfB, 2, 9, 9)
+	a.jump(bpfJNE, 2, ipProtocolTCP, "pass")
+	a.load(bpfB, 2, 9, 0)
+	a.alu(bpfAND, 2, 0x0F)
+	a.alu(bpfLSH, 2, 2)
+	a.aluReg(bpfADD, 9, 2)
+	a.jump(bpfJA, 0, 0, "tcp")
+
+	a.label("ipv6")
+	a.aluReg(bpfMOV, 1, 9)
+	a.alu(bpfADD, 1, ipv6HeaderSize)
+	a.jumpReg(bpfJGT, 1, 8, "pass")
+	a.load(bpfB, 2, 9, 6)
+	a.jump(bpfJNE, 2, ipProtocolTCP, "pass")
+	a.alu(bpfADD, 9, ipv6HeaderSize)
+
+	a.label("tcp")
+	a.aluReg(bpfMOV, 1, 9)
+	a.alu(bpfADD, 1, 4)
+	a.jumpReg(bpfJGT, 1, 8, "pass")
+
+	// Ports map has non zero value for listened ports
+	ports := []int16{2}
+	if trackResponse {
+		ports = append(ports, 0)
+	}
+	for _, off := range ports {
+		a.loadPort(2, 9, off)
+		a.store(bpfW, 10, 2, -4)
+		a.loadMap(1, portsFD)
+		a.aluReg(bpfMOV, 2, 10)
+		a.alu(bpfADD, 2, -4)
+		a.call(bpfFuncMapLookupElem)
+		a.jump(bpfJEQ, 0, 0, "pass")
+		a.load(bpfB, 1, 0, 0)
+		a.jump(bpfJNE, 1, 0, "output")
+	}
+	a.jump(bpfJA, 0, 0, "pass")
+
+	// Packet length is passed in sample metadata, and packet itself is appended by helper
+	a.label("output")
+	a.aluReg(bpfMOV, 3, 8)
+	a.aluReg(bpfSUB, 3, 7)
+	a.alu(bpfAND, 3, 0xFFFF)
+	a.jump(bpfJGT, 3, xdpMaxSampleSize, "pass")
+	a.store(bpfDW, 10, 3, -8)
+	a.alu(bpfLSH, 3, 32)
+	a.emit(bpfALU|bpfMOV|bpfK, 1, 0, 0, -1)
+	a.aluReg(bpfOR, 3, 1)
+	a.aluReg(bpfMOV, 1, 6)
+	a.loadMap(2, perfFD)
+	a.aluReg(bpfMOV, 4, 10)
+	a.alu(bpfADD, 4, -8)
+	a.emit(bpfALU64|bpfMOV|bpfK, 5, 0, 0, xdpSampleMetaSize)
+	a.call(bpfFuncPerfEventOutput)
+
+	a.label("pass")
+	a.emit(bpfALU64|bpfMOV|bpfK, 0, 0, 0, xdpPass)
+	a.emit(bpfJMP|bpfEXIT, 0, 0, 0, 0)
+
+	return a.bytes()
+}
+
+// perfRing is memory mapped ring buffer of perf event, one per CPU
+type perfRing struct {
+	fd   int
+	mem  []byte
+	data []byte
+}
+
+func newPerfRing(cpu int) (*perfRing, error) {
+	attr := perfEventAttr{
+		typ:          perfTypeSoftware,
+		config:       perfCountSWBPFOutput,
+		samplePeriod: 1,
+		sampleType:   perfSampleRaw,
+		wakeupEvents: 1,
+	}
+	attr.size = uint32(unsafe.Sizeof(attr))
+
+	fd, _, errno := syscall.Syscall6(syscall.SYS_PERF_EVENT_OPEN, uintptr(unsafe.Pointer(&attr)), ^uintptr(0), uintptr(cpu), ^uintptr(0), perfFlagFDCloexec, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+
+	pageSize := os.Getpagesize()
+	mem, err := syscall.Mmap(int(fd), 0, (perfRingPages+1)*pageSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		syscall.Close(int(fd))
+		return nil, err
+	}
+
+	if _, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, perfEventIOCEnable, 0); errno != 0 {
+		syscall.Munmap(mem)
+		syscall.Close(int(fd))
+		return nil, errno
+	}
+
+	return &perfRing{fd: int(fd), mem: mem, data: mem[pageSize:]}, nil
+}
+
+// read calls handler for each sample in ring, and returns number of lost samples
+func (r *perfRing) read(handler func([]byte)) (lost uint64) {
+	head := atomic.LoadUint64((*uint64)(unsafe.Pointer(&r.mem[perfMetaDataHead])))
+	tail := atomic.LoadUint64((*uint64)(unsafe.Pointer(&r.mem[perfMetaDataTail])))
+	size := uint64(len(r.data))
+
+	for tail < head {
+		header := r.copy(tail, 8)
+		typ := binary.LittleEndian.Uint32(header)
+		recordSize := uint64(binary.LittleEndian.Uint16(header[6:]))
+		if recordSize < 8 || recordSize > size {
+			break
+		}
+
+		record := r.copy(tail, recordSize)
+
+		switch typ {
+		case perfRecordSample:
+			rawSize := int(binary.LittleEndian.Uint32(record[8:]))
+			if 12+rawSize <= len(record) && rawSize >= xdpSampleMetaSize {
+				raw := record[12 : 12+rawSize]
+				length := int(binary.LittleEndian.Uint64(raw))
+				if xdpSampleMetaSize+length <= len(raw) {
+					handler(raw[xdpSampleMetaSize : xdpSampleMetaSize+length])
+				}
+			}
+		case perfRecordLost:
+			if len(record) >= 24 {
+				lost += binary.LittleEndian.Uint64(record[16:])
+			}
+		}
+
+		tail += recordSize
+	}
+
+	atomic.StoreUint64((*uint64)(unsafe.Pointer(&r.mem[perfMetaDataTail])), tail)
+
+	return
+}
+
+// copy returns record data, which can wrap around end of ring
+func (r *perfRing) copy(pos, length uint64) []byte {
+	size := uint64(len(r.data))
+	buf := make([]byte, length)
+
+	start := pos % size
+	n := copy(buf, r.data[start:])
+	if uint64(n) < length {
+		copy(buf[n:], r.data)
+	}
+
+	return buf
+}
+
+func (r *perfRing) close() {
+	syscall.Munmap(r.mem)
+	syscall.Close(r.fd)
+}
+
+// xdpCapture holds XDP program attached to interfaces, and perf buffers receiving captured packets
+type xdpCapture struct {
+	fds    []int
+	rings  []*perfRing
+	epoll  int
+	closed int32
+	done   chan bool
+	// Samples received, and lost since perf buffer was full
+	received uint64
+	lost     uint64
+}
+
+// Close detaches program. Resources are freed by reading goroutine, since it still can access ring buffers.
+func (c *xdpCapture) Close() {
+	atomic.StoreInt32(&c.closed, 1)
+	<-c.done
+}
+
+func (c *xdpCapture) captureStats() Stats {
+	return Stats{
+		PacketsReceived: atomic.LoadUint64(&c.received),
+		PacketsDropped:  atomic.LoadUint64(&c.lost),
+	}
+}
+
+func (c *xdpCapture) release() {
+	for _, r := range c.rings {
+		r.close()
+	}
+
+	// Closing link detaches program from interface
+	for _, fd := range c.fds {
+		syscall.Close(fd)
+	}
+
+	if c.epoll > 0 {
+		syscall.Close(c.epoll)
+	}
+}
+
+// possibleCPUs returns number of CPUs which can run XDP program, it can be larger than number of online CPUs
+func possibleCPUs() int {
+	data, err := ioutil.ReadFile("/sys/devices/system/cpu/possible")
+	if err != nil {
+		return runtime.NumCPU()
+	}
+
+	ranges := strings.Split(strings.TrimSpace(string(data)), ",")
+	last := ranges[len(ranges)-1]
+	if i := strings.Index(last, "-"); i != -1 {
+		last = last[i+1:]
+	}
+
+	n, err := strconv.Atoi(last)
+	if err != nil {
+		return runtime.NumCPU()
+	}
+
+	return n + 1
+}
+
+func (t *Listener) newXDPCapture(interfaces []net.Interface) (_ *xdpCapture, err error) {
+	c := &xdpCapture{done: make(chan bool)}
+	defer func() {
+		if err != nil {
+			c.release()
+		}
+	}()
+
+	mapAttr := bpfMapCreateAttr{mapType: bpfMapTypeArray, keySize: 4, valueSize: 1, maxEntries: 65536}
+	portsFD, err := bpfCall(bpfMapCreate, unsafe.Pointer(&mapAttr), unsafe.Sizeof(mapAttr))
+	if err != nil {
+		return nil, errors.New("can't create ports map: " + err.Error())
+	}
+	c.fds = append(c.fds, portsFD)
+
+	value := byte(1)
+	for _, r := range t.ports {
+		for port := uint32(r.min); port <= uint32(r.max); port++ {
+			attr := bpfMapUpdateAttr{mapFD: uint32(portsFD), key: uint64(uintptr(unsafe.Pointer(&port))), value: uint64(uintptr(unsafe.Pointer(&value)))}
+			_, err = bpfCall(bpfMapUpdateElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+			runtime.KeepAlive(&port)
+			if err != nil {
+				return nil, errors.New("can't update ports map: " + err.Error())
+			}
+		}
+	}
+
+	cpus := possibleCPUs()
+	mapAttr = bpfMapCreateAttr{mapType: bpfMapTypePerfEventArray, keySize: 4, valueSize: 4, maxEntries: uint32(cpus)}
+	perfFD, err := bpfCall(bpfMapCreate, unsafe.Pointer(&mapAttr), unsafe.Sizeof(mapAttr))
+	if err != nil {
+		return nil, errors.New("can't create perf map: " + err.Error())
+	}
+	c.fds = append(c.fds, perfFD)
+
+	if c.epoll, err = syscall.EpollCreate1(syscall.EPOLL_CLOEXEC); err != nil {
+		return nil, err
+	}
+
+	for cpu := 0; cpu < cpus; cpu++ {
+		ring, err := newPerfRing(cpu)
+		if err != nil {
+			// Offline CPU
+			continue
+		}
+		c.rings = append(c.rings, ring)
+
+		key, fd := uint32(cpu), uint32(ring.fd)
+		attr := bpfMapUpdateAttr{mapFD: uint32(perfFD), key: uint64(uintptr(unsafe.Pointer(&key))), value: uint64(uintptr(unsafe.Pointer(&fd)))}
+		_, err = bpfCall(bpfMapUpdateElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		runtime.KeepAlive(&key)
+		runtime.KeepAlive(&fd)
+		if err != nil {
+			return nil, errors.New("can't update perf map: " + err.Error())
+		}
+
+		event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(len(c.rings) - 1)}
+		if err = syscall.EpollCtl(c.epoll, syscall.EPOLL_CTL_ADD, ring.fd, &event); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(c.rings) == 0 {
+		return nil, errors.New("can't open perf events")
+	}
+
+	insns := xdpProgram(portsFD, perfFD, t.trackResponse)
+	license := []byte("GPL\x00")
+	logBuf := make([]byte, xdpVerifierLogBufSize)
+	progAttr := bpfProgLoadAttr{
+		progType:       bpfProgTypeXDP,
+		insnCnt:        uint32(len(insns) / 8),
+		insns:          uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:        uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel:       1,
+		logSize:        uint32(len(logBuf)),
+		logBuf:         uint64(uintptr(unsafe.Pointer(&logBuf[0]))),
+		expectedAttach: bpfAttachTypeXDP,
+	}
+	copy(progAttr.progName[:], "gor_capture")
+
+	progFD, err := bpfCall(bpfProgLoad, unsafe.Pointer(&progAttr), unsafe.Sizeof(progAttr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	runtime.KeepAlive(logBuf)
+	if err != nil {
+		return nil, errors.New("can't load XDP program: " + err.Error() + "\n" + strings.TrimRight(string(logBuf), "\x00"))
+	}
+	c.fds = append(c.fds, progFD)
+
+	for _, iface := range interfaces {
+		attr := bpfLinkCreateAttr{progFD: uint32(progFD), targetIfindex: uint32(iface.Index), attachType: bpfAttachTypeXDP}
+		linkFD, err := bpfCall(bpfLinkCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		if err != nil {
+			return nil, errors.New("can't attach XDP program to " + iface.Name + ": " + err.Error())
+		}
+		c.fds = append(c.fds, linkFD)
+	}
+
+	return c, nil
+}
+
+// findXDPInterfaces returns interfaces with given address or name, and loopback interface
+func findXDPInterfaces(addr string) (result []net.Interface, err error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+
+		addrs, _ := iface.Addrs()
+
+		if listenAllInterfaces(addr) && len(addrs) > 0 || iface.Flags&net.FlagLoopback != 0 || iface.Name == addr {
+			result = append(result, iface)
+			continue
+		}
+
+		for _, a := range addrs {
+			if ip, _, err := net.ParseCIDR(a.String()); err == nil && ip.String() == addr {
+				result = append(result, iface)
+				break
+			}
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, &DeviceNotFoundError{addr}
+	}
+
+	return
+}
+
+// readXDP captures traffic by XDP program, which filters packets in kernel before they reach network stack, and
+// copies only packets of listened ports to userspace. XDP sees only packets received by interface, so responses
+// are captured only on loopback, or if both directions are mirrored to interface.
+func (t *Listener) readXDP() {
+	if t.bpfFilter != "" {
+		log.Fatal("BPF filter is not supported by xdp engine")
+	}
+
+	if t.udp {
+		log.Fatal("UDP capture is not supported by xdp engine")
+	}
+
+	interfaces, err := findXDPInterfaces(t.addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var allowed []net.Interface
+	for _, iface := range interfaces {
+		if t.interfaceAllowed(iface.Name) {
+			allowed = append(allowed, iface)
+		}
+	}
+
+	if len(allowed) == 0 {
+		log.Fatal(errNoInterfacesMatched)
+	}
+	interfaces = allowed
+
+	c, err := t.newXDPCapture(interfaces)
+	if err != nil {
+		log.Fatal("XDP error: ", err)
+	}
+
+	t.mu.Lock()
+	t.captureHandles = append(t.captureHandles, c)
+	t.mu.Unlock()
+
+	t.readyCh <- true
+
+	defer func() {
+		c.release()
+		close(c.done)
+	}()
+
+	events := make([]syscall.EpollEvent, len(c.rings))
+	handler := func(data []byte) {
+		atomic.AddUint64(&c.received, 1)
+
+		of, ok := t.skipVLANTags(data, 14)
+		if !ok {
+			return
+		}
+
+		t.processIPPacket(data[of:], pcap.Interface{}, nil, true, time.Now())
+	}
+
+	for atomic.LoadInt32(&c.closed) == 0 {
+		n, err := syscall.EpollWait(c.epoll, events, xdpPollTimeoutMs)
+		if err != nil && err != syscall.EINTR {
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			lost := c.rings[events[i].Fd].read(handler)
+			atomic.AddUint64(&c.lost, lost)
+		}
+	}
+}
@@ -0,0 +1,4 @@
+package rawSocket
+
+// bpf(2) syscall number, it is missing in syscall package
+const sysBPF = 280
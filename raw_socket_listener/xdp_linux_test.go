@@ -0,0 +1,69 @@
+//go:build amd64 || arm64
+// +build amd64 arm64
+
+package rawSocket
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestXDPProgram(t *testing.T) {
+	program := xdpProgram(10, 11, true)
+
+	if len(program)%8 != 0 {
+		t.Fatal("Program should consist of 8 byte instructions")
+	}
+
+	// Last instruction is exit
+	if program[len(program)-8] != bpfJMP|bpfEXIT {
+		t.Error("Program should end with exit", program[len(program)-8:])
+	}
+}
+
+func TestRawListenerXDP(t *testing.T) {
+	lo, err := findXDPInterfaces("127.0.0.1")
+	if err != nil {
+		t.Skip("Can't find loopback interface", err)
+	}
+
+	// Check if kernel supports XDP, and we have permissions
+	l := &Listener{}
+	l.ports, _ = parsePorts("1")
+	if c, err := l.newXDPCapture(lo); err != nil {
+		t.Skip("XDP is not supported:", err)
+	} else {
+		c.release()
+	}
+
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	listener := NewListenerWithConfig("127.0.0.1", port, EngineXDP, true, 10*time.Millisecond, ListenerConfig{})
+	defer listener.Close()
+	listener.IsReady()
+
+	http.Get("http://127.0.0.1:" + port + "/xdp")
+
+	var messages []string
+	for len(messages) < 2 {
+		select {
+		case m := <-listener.Receiver():
+			messages = append(messages, string(m.Bytes()))
+		case <-time.After(time.Second):
+			t.Fatal("Should capture request and response", messages)
+		}
+	}
+
+	if !strings.HasPrefix(messages[0], "GET /xdp HTTP/1.1") || !strings.HasPrefix(messages[1], "HTTP/1.1 200 OK") {
+		t.Error("Wrong messages", messages)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux || (linux && !amd64 && !arm64)
+// +build !linux linux,!amd64,!arm64
+
+package rawSocket
+
+import (
+	"log"
+)
+
+// readXDP is not available, since XDP is Linux specific
+func (t *Listener) readXDP() {
+	log.Fatal("xdp engine is supported only on Linux amd64 and arm64")
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var emptyPayloadHash = sha256Hex(nil)
+
+// AWSCredentials used for signing requests, read from standard AWS environment variables
+type AWSCredentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+func awsCredentialsFromEnv() AWSCredentials {
+	return AWSCredentials{
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+func awsRegionFromEnv() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+
+	if region := os.Getenv("AWS_DEFAULT_REGION"); region != "" {
+		return region
+	}
+
+	return "us-east-1"
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsURIEscape escapes string according to RFC 3986, as required by Signature Version 4
+func awsURIEscape(s string, encodeSlash bool) string {
+	var buf []byte
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			buf = append(buf, c)
+		} else {
+			buf = append(buf, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+
+	return string(buf)
+}
+
+func awsCanonicalQuery(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		vals := values[k]
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, awsURIEscape(k, true)+"="+awsURIEscape(v, true))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// signAWSRequestV4 signs request using AWS Signature Version 4
+// See: http://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func signAWSRequestV4(req *http.Request, payloadHash string, creds AWSCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "authorization" || name == "user-agent" {
+			continue
+		}
+		headers[name] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	uri := req.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	// All services except S3 expect path to be encoded twice
+	if service != "s3" {
+		uri = awsURIEscape(uri, false)
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uri,
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// S3Client is minimal S3 REST API client, supporting only operations needed by Gor
+//
+// Credentials and region are read from the standard AWS_* environment variables.
+// Set AWS_ENDPOINT_URL to use S3 compatible storage (it switches to path-style addressing).
+type S3Client struct {
+	region   string
+	endpoint string
+	creds    AWSCredentials
+	client   *http.Client
+}
+
+// NewS3Client constructor for S3Client
+func NewS3Client() *S3Client {
+	return &S3Client{
+		region:   awsRegionFromEnv(),
+		endpoint: strings.TrimSuffix(os.Getenv("AWS_ENDPOINT_URL"), "/"),
+		creds:    awsCredentialsFromEnv(),
+		client:   &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// parseS3Path splits `s3://bucket/key` to bucket and key
+func parseS3Path(s3path string) (bucket, key string) {
+	s3path = strings.TrimPrefix(s3path, "s3://")
+
+	if idx := strings.IndexByte(s3path, '/'); idx != -1 {
+		return s3path[:idx], s3path[idx+1:]
+	}
+
+	return s3path, ""
+}
+
+func (c *S3Client) objectURL(bucket, key string) *url.URL {
+	var u *url.URL
+
+	if c.endpoint != "" {
+		u, _ = url.Parse(c.endpoint + "/" + bucket + "/")
+	} else {
+		u, _ = url.Parse("https://" + bucket + ".s3." + c.region + ".amazonaws.com/")
+	}
+
+	u.Path += key
+	u.RawPath = awsURIEscape(u.Path, false)
+
+	return u
+}
+
+func (c *S3Client) do(method string, u *url.URL, headers http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+
+	payloadHash := emptyPayloadHash
+	if body != nil {
+		payloadHash = sha256Hex(body)
+	}
+
+	signAWSRequestV4(req, payloadHash, c.creds, c.region, "s3", time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3 %s %s: %s %s", method, u.Path, resp.Status, msg)
+	}
+
+	return resp, nil
+}
+
+type s3Object struct {
+	Key  string `xml:"Key"`
+	Size int64  `xml:"Size"`
+}
+
+type s3ListBucketResult struct {
+	Contents              []s3Object `xml:"Contents"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+// List returns all objects with given prefix
+func (c *S3Client) List(bucket, prefix string) (objects []s3Object, err error) {
+	token := ""
+
+	for {
+		u := c.objectURL(bucket, "")
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		u.RawQuery = awsCanonicalQuery(q)
+
+		resp, err := c.do("GET", u, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result s3ListBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, result.Contents...)
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+
+		token = result.NextContinuationToken
+	}
+}
+
+// Glob returns objects matching `s3://bucket/pattern` path, where pattern uses path.Match syntax
+func (c *S3Client) Glob(s3path string) (objects []s3Object, err error) {
+	bucket, pattern := parseS3Path(s3path)
+
+	all, err := c.List(bucket, globPrefix(pattern))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, obj := range all {
+		if matched, _ := path.Match(pattern, obj.Key); matched {
+			objects = append(objects, obj)
+		}
+	}
+
+	return objects, nil
+}
+
+// OpenRange returns body of object bytes in [start, end] range
+func (c *S3Client) OpenRange(bucket, key string, start, end int64) (io.ReadCloser, error) {
+	headers := http.Header{}
+	headers.Set("Range", "bytes="+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(end, 10))
+
+	resp, err := c.do("GET", c.objectURL(bucket, key), headers, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// Size of parts in multipart upload. Smaller files are uploaded by a single request.
+var s3UploadPartSize int64 = 16 * 1024 * 1024
+
+type s3InitiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+// Upload writes object of given size, read from r. Big objects are uploaded by parts.
+func (c *S3Client) Upload(bucket, key string, r io.Reader, size int64) error {
+	if size <= s3UploadPartSize {
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		resp, err := c.do("PUT", c.objectURL(bucket, key), nil, body)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		return nil
+	}
+
+	u := c.objectURL(bucket, key)
+	u.RawQuery = "uploads="
+
+	resp, err := c.do("POST", u, nil, []byte{})
+	if err != nil {
+		return err
+	}
+
+	var upload s3InitiateMultipartUploadResult
+	err = xml.NewDecoder(resp.Body).Decode(&upload)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	if err = c.uploadParts(bucket, key, upload.UploadID, r); err != nil {
+		// Abort upload, so uploaded parts are not stored
+		u.RawQuery = awsCanonicalQuery(url.Values{"uploadId": {upload.UploadID}})
+		if resp, err := c.do("DELETE", u, nil, nil); err == nil {
+			resp.Body.Close()
+		}
+	}
+
+	return err
+}
+
+func (c *S3Client) uploadParts(bucket, key, uploadID string, r io.Reader) error {
+	var complete s3CompleteMultipartUpload
+	buf := make([]byte, s3UploadPartSize)
+
+	for number := 1; ; number++ {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		u := c.objectURL(bucket, key)
+		u.RawQuery = awsCanonicalQuery(url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}})
+
+		resp, err := c.do("PUT", u, nil, buf[:n])
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		complete.Parts = append(complete.Parts, s3CompletedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	}
+
+	body, _ := xml.Marshal(complete)
+
+	u := c.objectURL(bucket, key)
+	u.RawQuery = awsCanonicalQuery(url.Values{"uploadId": {uploadID}})
+
+	resp, err := c.do("POST", u, nil, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// s3Storage implements fileStorage for `s3://bucket/key` paths
+type s3Storage struct {
+	client *S3Client
+	sizes  map[string]int64
+}
+
+func newS3Storage() *s3Storage {
+	return &s3Storage{client: NewS3Client(), sizes: make(map[string]int64)}
+}
+
+func (s *s3Storage) Glob(pattern string) (matches []string, err error) {
+	objects, err := s.client.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket, _ := parseS3Path(pattern)
+
+	for _, obj := range objects {
+		name := "s3://" + bucket + "/" + obj.Key
+		s.sizes[name] = obj.Size
+		matches = append(matches, name)
+	}
+
+	return matches, nil
+}
+
+func (s *s3Storage) Open(name string) (io.ReadCloser, error) {
+	bucket, key := parseS3Path(name)
+
+	return newRangeReader(name, s.sizes[name], func(start, end int64) (io.ReadCloser, error) {
+		return s.client.OpenRange(bucket, key, start, end)
+	}), nil
+}
+
+func (s *s3Storage) Size(name string) int64 {
+	return s.sizes[name]
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Size of a single ranged request when streaming remote objects
+const storageRangeSize = 8 * 1024 * 1024
+
+// Number of attempts to re-open a range after a transient read error
+const storageMaxRetries = 3
+
+// fileStorage abstracts location of recorded files, so local files and objects
+// in cloud storages share same reading and merging logic of FileInput
+type fileStorage interface {
+	// Glob returns names of all files matching pattern
+	Glob(pattern string) ([]string, error)
+	// Open returns content of file returned by Glob
+	Open(name string) (io.ReadCloser, error)
+	// Size returns current size of file returned by Glob, or 0 if unknown
+	Size(name string) int64
+}
+
+// Path used to read recording from standard input
+const stdinPath = "-"
+
+// newFileStorage picks storage based on path scheme
+func newFileStorage(path string) fileStorage {
+	switch {
+	case path == stdinPath:
+		return stdinStorage{}
+	case strings.HasPrefix(path, "s3://"):
+		return newS3Storage()
+	case strings.HasPrefix(path, "gs://"):
+		return newGCSStorage()
+	case strings.HasPrefix(path, "azblob://"):
+		return newAzureBlobStorage()
+	case strings.HasPrefix(path, "http://"), strings.HasPrefix(path, "https://"):
+		return newHTTPStorage()
+	default:
+		return localStorage{}
+	}
+}
+
+// globPrefix returns static part of pattern, used for listing remote objects before matching
+func globPrefix(pattern string) string {
+	if idx := strings.IndexAny(pattern, "*?[\\"); idx != -1 {
+		return pattern[:idx]
+	}
+
+	return pattern
+}
+
+type localStorage struct{}
+
+func (localStorage) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
+
+func (localStorage) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (localStorage) Size(name string) int64 {
+	if stat, err := os.Stat(name); err == nil {
+		return stat.Size()
+	}
+
+	return 0
+}
+
+// stdinStorage reads single file from standard input, so recordings can be piped from other tools
+type stdinStorage struct{}
+
+func (stdinStorage) Glob(pattern string) ([]string, error) {
+	return []string{stdinPath}, nil
+}
+
+func (stdinStorage) Open(name string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(os.Stdin), nil
+}
+
+func (stdinStorage) Size(name string) int64 {
+	return 0
+}
+
+// rangeReader streams remote object using ranged requests,
+// so transient network errors only require to re-read a single range
+type rangeReader struct {
+	name      string
+	size      int64
+	offset    int64
+	body      io.ReadCloser
+	openRange func(start, end int64) (io.ReadCloser, error)
+}
+
+func newRangeReader(name string, size int64, openRange func(start, end int64) (io.ReadCloser, error)) *rangeReader {
+	return &rangeReader{name: name, size: size, openRange: openRange}
+}
+
+func (r *rangeReader) Read(data []byte) (n int, err error) {
+	for retries := 0; ; retries++ {
+		if r.offset >= r.size {
+			return 0, io.EOF
+		}
+
+		if retries > storageMaxRetries {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+
+		if r.body == nil {
+			end := r.offset + storageRangeSize - 1
+			if end >= r.size {
+				end = r.size - 1
+			}
+
+			if r.body, err = r.openRange(r.offset, end); err != nil {
+				log.Println("Error while reading", r.name, err)
+				time.Sleep(time.Duration(retries+1) * time.Second)
+				continue
+			}
+		}
+
+		n, err = r.body.Read(data)
+		r.offset += int64(n)
+
+		if err != nil {
+			// On io.EOF current range is finished, and next Read will open the following one.
+			// On other errors range will be re-opened starting from the current offset.
+			r.body.Close()
+			r.body = nil
+
+			if err != io.EOF {
+				log.Println("Error while reading", r.name, err)
+			}
+		}
+
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Close releases underlying connection
+func (r *rangeReader) Close() error {
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+
+	// Mark as finished
+	r.offset = r.size
+
+	return nil
+}